@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrAccountExists      = errors.New("account already exists")
+	ErrAccountNotFound    = errors.New("account not found, add it with `accounts add`")
+	ErrAccountBrokerMatch = errors.New("account belongs to another broker")
+	ErrMissingAccount     = errors.New("missing account")
+)
+
+const (
+	NORDNET_BROKER = "nordnet"
+	ETRADE_BROKER  = "etrade"
+)
+
+// brokerBaseCurrencies are the account currencies used when an account is added without one
+var brokerBaseCurrencies = map[string]CurrencyUnit{
+	NORDNET_BROKER: SEK,
+	ETRADE_BROKER:  USD,
+}
+
+// ImportSourceBroker maps an import --source to the broker whose accounts it fills
+func ImportSourceBroker(source string) string {
+	switch source {
+	case "nordnet":
+		return NORDNET_BROKER
+	case "etrade", "etrade-benefits":
+		return ETRADE_BROKER
+	}
+	return ""
+}
+
+// AddAccount registers an account, defaulting the type to depå and the base
+// currency to the broker's currency.
+func AddAccount(account Account) error {
+	if strings.TrimSpace(account.ID) == "" {
+		return ErrMissingAccount
+	}
+	account.Broker = strings.ToLower(strings.TrimSpace(account.Broker))
+	if account.AccountType == "" {
+		account.AccountType = DEPA_ACCOUNT
+	}
+	if account.BaseCurrency == "" {
+		account.BaseCurrency = brokerBaseCurrencies[account.Broker]
+	}
+	return InsertAccount(account)
+}
+
+// ValidateImportAccount checks that broker records are imported into a registered
+// account of the same broker. Accounts registered without a broker accept any source.
+func ValidateImportAccount(accountID string, broker string) error {
+	if strings.TrimSpace(accountID) == "" {
+		return ErrMissingAccount
+	}
+	account, err := GetAccount(accountID)
+	if err != nil {
+		return err
+	}
+	if account.Broker != "" && broker != "" && account.Broker != broker {
+		return fmt.Errorf("%w: %s is registered with %s", ErrAccountBrokerMatch, account.ID, account.Broker)
+	}
+	return nil
+}
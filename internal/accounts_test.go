@@ -0,0 +1,33 @@
+package internal_test
+
+import (
+	"accounting/internal"
+	"errors"
+	"testing"
+)
+
+func TestValidateImportAccount(t *testing.T) {
+	internal.InitializeDB()
+	if err := internal.ValidateImportAccount("accounts-test", "nordnet"); !errors.Is(err, internal.ErrAccountNotFound) {
+		t.Errorf("expected unregistered account to be refused, got %v", err)
+	}
+	if err := internal.AddAccount(internal.Account{ID: "accounts-test", Broker: "Nordnet"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := internal.AddAccount(internal.Account{ID: "accounts-test"}); !errors.Is(err, internal.ErrAccountExists) {
+		t.Errorf("expected duplicate account to be refused, got %v", err)
+	}
+	account, err := internal.GetAccount("accounts-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.AccountType != internal.DEPA_ACCOUNT || account.BaseCurrency != internal.SEK {
+		t.Errorf("expected depå account in SEK, got %s in %s", account.AccountType, account.BaseCurrency)
+	}
+	if err := internal.ValidateImportAccount("accounts-test", "nordnet"); err != nil {
+		t.Error(err)
+	}
+	if err := internal.ValidateImportAccount("accounts-test", "etrade"); !errors.Is(err, internal.ErrAccountBrokerMatch) {
+		t.Errorf("expected broker mismatch, got %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/ericlagergren/decimal"
+)
+
+// maxAmountExponent bounds the exponent of amounts in scientific notation, anything larger
+// wouldn't fit a stored column anyway
+const maxAmountExponent = 18
+
+/*
+parseAmount parses an amount written in locale with all of its places:
+
+  - SE writes 1 234,56 or 1.234,56 and US writes 1,234.56. Digits grouped by the group
+    separator or by spaces, no-break spaces and thin spaces come in groups of three.
+  - A leading - or + sign, or parentheses, as in (1 234,56), for negative amounts.
+  - A currency code or symbol before or after the amount, as in 1 234,56 kr, SEK 100 or $5.
+  - Scientific notation, as in 1,5e3 or 2.5E-4.
+
+An empty amount is 0. Errors wrap ErrInvalidPrecisionValue and quote the amount.
+*/
+func parseAmount(amount string, locale LocaleUnit) (*decimal.Big, error) {
+	var decimalSeparator, groupSeparator rune
+	switch locale {
+	case SE:
+		decimalSeparator, groupSeparator = ',', '.'
+	case US:
+		decimalSeparator, groupSeparator = '.', ','
+	default:
+		return ERROR_VALUE, ErrInvalidLocale
+	}
+	invalid := func(reason string) (*decimal.Big, error) {
+		return ERROR_VALUE, fmt.Errorf("%w %q: %s", ErrInvalidPrecisionValue, amount, reason)
+	}
+
+	s := trimCurrency(amount)
+	if s == "" {
+		if strings.TrimSpace(amount) != "" {
+			return invalid("no digits")
+		}
+		return decimal.New(0, STORAGE_SCALE), nil
+	}
+	negative := false
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		negative = true
+		s = trimCurrency(s[1 : len(s)-1])
+	}
+	if sign, size := firstRune(s); sign == '-' || sign == '+' || sign == '−' {
+		if sign != '+' {
+			if negative {
+				return invalid("negative sign inside parentheses")
+			}
+			negative = true
+		}
+		s = trimCurrency(s[size:])
+	}
+
+	// Spaces group thousands like the group separator does.
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return groupSeparator
+		}
+		return r
+	}, s)
+
+	mantissa, exponent, scientific := strings.Cut(strings.ToLower(s), "e")
+	if scientific {
+		e, err := strconv.Atoi(exponent)
+		if err != nil {
+			return invalid(fmt.Sprintf("exponent %q isn't a whole number", exponent))
+		}
+		if e > maxAmountExponent || e < -maxAmountExponent {
+			return invalid(fmt.Sprintf("exponent %d is out of range", e))
+		}
+	}
+	integer, fraction, _ := strings.Cut(mantissa, string(decimalSeparator))
+	if strings.ContainsRune(fraction, decimalSeparator) {
+		return invalid(fmt.Sprintf("more than one decimal separator %q", decimalSeparator))
+	}
+	if strings.ContainsRune(fraction, groupSeparator) {
+		return invalid(fmt.Sprintf("group separator %q after the decimal separator", groupSeparator))
+	}
+	groups := strings.Split(integer, string(groupSeparator))
+	for i, group := range groups {
+		if i > 0 && len(group) != 3 || i == 0 && len(groups) > 1 && (len(group) == 0 || len(group) > 3) {
+			return invalid(fmt.Sprintf("digits grouped by %q or spaces must come in groups of three", groupSeparator))
+		}
+	}
+	integer = strings.Join(groups, "")
+	for _, r := range integer + fraction {
+		if r < '0' || r > '9' {
+			return invalid(fmt.Sprintf("unexpected %q", r))
+		}
+	}
+	if integer == "" && fraction == "" {
+		return invalid("no digits")
+	}
+
+	value := integer
+	if value == "" {
+		value = "0"
+	}
+	if fraction != "" {
+		value += "." + fraction
+	}
+	if scientific {
+		value += "e" + exponent
+	}
+	if negative {
+		value = "-" + value
+	}
+	parsed, ok := decimal.WithContext(decimal.Context128).SetString(value)
+	if !ok {
+		return invalid("not a number")
+	}
+	return parsed, nil
+}
+
+// trimCurrency removes spaces and a currency code or symbol written before or after an amount
+func trimCurrency(s string) string {
+	s = strings.TrimSpace(s)
+	if end := strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.Is(unicode.Sc, r)
+	}); end > 0 && isCurrencyAffix(s[:end]) {
+		s = strings.TrimSpace(s[end:])
+	}
+	if start := strings.LastIndexFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.Is(unicode.Sc, r) && r != '.'
+	}); start < len(s)-1 && isCurrencyAffix(s[start+1:]) {
+		s = strings.TrimSpace(s[:start+1])
+	}
+	return s
+}
+
+// isCurrencyAffix reports whether s is a currency symbol like $ or US$, a three letter code
+// like SEK, or kr
+func isCurrencyAffix(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	letters, symbol := 0, false
+	for _, r := range s {
+		switch {
+		case unicode.Is(unicode.Sc, r):
+			symbol = true
+		case r < unicode.MaxASCII && unicode.IsLetter(r):
+			letters++
+		default:
+			return false
+		}
+	}
+	return symbol || letters == 3 || strings.EqualFold(s, "kr")
+}
+
+func firstRune(s string) (rune, int) {
+	for _, r := range s {
+		return r, len(string(r))
+	}
+	return 0, 0
+}
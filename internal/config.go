@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+Config is the config file, $XDG_CONFIG_HOME/accounting/config.json or
+~/.config/accounting/config.json:
+
+	{
+		"default_profile": "household",
+		"profiles": {
+			"household": {"ledger": "~/ledgers/household.db"},
+			"sandbox-2025": {"ledger": "sandbox-2025.db"}
+		}
+	}
+
+Ledger paths start with ~ for the home directory and relative ones are relative to the
+directory of the config file. Ledger is used when there's no default profile.
+*/
+type Config struct {
+	Ledger         string             `json:"ledger,omitempty"`
+	DefaultProfile string             `json:"default_profile,omitempty"`
+	Profiles       map[string]Profile `json:"profiles,omitempty"`
+}
+
+// Profile is a named ledger, like the ledger of a household member or a sandbox for a tax year
+type Profile struct {
+	Ledger string `json:"ledger"`
+}
+
+// DEFAULT_LEDGER is opened in the working directory without --ledger, --profile or a config file
+const DEFAULT_LEDGER = "ledger.db"
+
+var (
+	ErrUnknownProfile = errors.New("unknown profile")
+	ErrInvalidConfig  = errors.New("invalid config file")
+)
+
+// ConfigPath returns where the config file is read from, whether or not it exists
+func ConfigPath() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "accounting", "config.json"), nil
+}
+
+// LoadConfig reads the config file, a missing one is an empty Config
+func LoadConfig() (Config, error) {
+	var config Config
+	path, err := ConfigPath()
+	if err != nil {
+		return config, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	if err = json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("%w %s: %w", ErrInvalidConfig, path, err)
+	}
+	return config, nil
+}
+
+// SaveConfig writes the config file, creating its directory
+func SaveConfig(config Config) error {
+	path, err := ConfigPath()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// SaveProfile points a profile at a ledger in the config file, and makes it the default profile
+// when makeDefault is set. Relative ledger paths are stored relative to the working directory.
+func SaveProfile(name string, ledger string, makeDefault bool) error {
+	if name == "" || ledger == "" {
+		return fmt.Errorf("%w: a profile needs a name and a ledger", ErrInvalidConfig)
+	}
+	config, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	if ledger, err = expandHome(ledger); err != nil {
+		return err
+	}
+	if ledger, err = filepath.Abs(ledger); err != nil {
+		return err
+	}
+	if config.Profiles == nil {
+		config.Profiles = make(map[string]Profile)
+	}
+	config.Profiles[name] = Profile{Ledger: ledger}
+	if makeDefault {
+		config.DefaultProfile = name
+	}
+	return SaveConfig(config)
+}
+
+// ProfileNames returns the names of the profiles in order
+func (c Config) ProfileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+ResolveLedger returns the ledger to open: the --ledger path, else the ledger of the --profile,
+the default profile or the config file, else DEFAULT_LEDGER in the working directory.
+*/
+func ResolveLedger(ledger string, profile string) (string, error) {
+	if ledger != "" {
+		return expandHome(ledger)
+	}
+	config, err := LoadConfig()
+	if err != nil {
+		return "", err
+	}
+	if profile == "" {
+		profile = config.DefaultProfile
+	}
+	path := config.Ledger
+	if profile != "" {
+		p, ok := config.Profiles[profile]
+		if !ok || p.Ledger == "" {
+			return "", fmt.Errorf("%w %q, add it with `init --profile %s --ledger PATH`, known profiles: [ %s ]",
+				ErrUnknownProfile, profile, profile, strings.Join(config.ProfileNames(), " | "))
+		}
+		path = p.Ledger
+	}
+	if path == "" {
+		return DEFAULT_LEDGER, nil
+	}
+	if path, err = expandHome(path); err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) {
+		configPath, err := ConfigPath()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(filepath.Dir(configPath), path)
+	}
+	return path, nil
+}
+
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~")), nil
+}
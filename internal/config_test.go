@@ -0,0 +1,76 @@
+package internal_test
+
+import (
+	"accounting/internal"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveLedger(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ledger, err := internal.ResolveLedger("", "")
+	if err != nil || ledger != internal.DEFAULT_LEDGER {
+		t.Errorf("expected %s without a config file, got %s %v", internal.DEFAULT_LEDGER, ledger, err)
+	}
+	if _, err = internal.ResolveLedger("", "household"); !errors.Is(err, internal.ErrUnknownProfile) {
+		t.Errorf("expected an unknown profile, got %v", err)
+	}
+
+	err = internal.SaveConfig(internal.Config{
+		Ledger:         "main.db",
+		DefaultProfile: "household",
+		Profiles: map[string]internal.Profile{
+			"household":    {Ledger: "~/ledgers/household.db"},
+			"sandbox-2025": {Ledger: "sandbox-2025.db"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = internal.SaveProfile("sandbox-2024", "sandbox-2024.db", false); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDir := filepath.Join(dir, "accounting")
+	for _, test := range []struct {
+		ledger, profile, want string
+	}{
+		{"other.db", "sandbox-2025", "other.db"},
+		{"~/other.db", "", filepath.Join(home, "other.db")},
+		{"", "", filepath.Join(home, "ledgers", "household.db")},
+		{"", "sandbox-2025", filepath.Join(configDir, "sandbox-2025.db")},
+		{"", "sandbox-2024", filepath.Join(wd, "sandbox-2024.db")},
+	} {
+		ledger, err := internal.ResolveLedger(test.ledger, test.profile)
+		if err != nil {
+			t.Errorf("--ledger %q --profile %q: %v", test.ledger, test.profile, err)
+		} else if ledger != test.want {
+			t.Errorf("--ledger %q --profile %q: expected %s, got %s", test.ledger, test.profile, test.want, ledger)
+		}
+	}
+
+	config, err := internal.LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.DefaultProfile != "household" || len(config.ProfileNames()) != 3 {
+		t.Errorf("expected the default profile and 3 profiles to be kept, got %+v", config)
+	}
+	if err = internal.SaveProfile("sandbox-2024", "sandbox-2024.db", true); err != nil {
+		t.Fatal(err)
+	}
+	if config, err = internal.LoadConfig(); err != nil || config.DefaultProfile != "sandbox-2024" {
+		t.Errorf("expected sandbox-2024 to be the default profile, got %+v %v", config, err)
+	}
+}
@@ -3,6 +3,7 @@ package internal
 import (
 	"encoding/csv"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"sort"
@@ -16,11 +17,16 @@ import (
 var (
 	ErrUnhandledTransactionType = errors.New("unhandled transaction type")
 	ErrValueConversionFailed    = errors.New("value conversion failed")
+	ErrESPPGrantDateMissing     = errors.New("ESPP purchase without grant date")
 )
 
 type ImportRecord struct {
-	lot         AssetLot
-	transaction Transaction
+	lot          AssetLot
+	transaction  Transaction
+	stockPlanLot *StockPlanLot
+	rate         *CurrencyRate   // exchange rate the broker booked the row at, if any
+	losses       []PrecisionLoss // amounts rounded to the places of their field
+	reference    string          // reference the broker shares between the rows of one event, like both legs of a split
 }
 
 /*
@@ -89,6 +95,37 @@ type NordnetTransaction struct {
 	InitialLåneränta    string
 }
 
+// nordnetCurrencies returns the currency of Belopp, which the row is booked in, and the currency
+// its Kurs is quoted in. Rows of foreign instruments have a Växlingskurs other than 1, the
+// instrument currency is then the one of the fee or cost columns that isn't booked.
+func nordnetCurrencies(transaction NordnetTransaction) (CurrencyUnit, CurrencyUnit) {
+	booked := SEK
+	if v := strings.TrimSpace(transaction.BeloppValuta); v != "" {
+		booked = CurrencyUnit(strings.ToUpper(v))
+	}
+	for _, v := range []string{transaction.CourtageValuta, transaction.TotalAvgiftValuta, transaction.InköpsvärdeValuta, transaction.ResultatValuta} {
+		if c := CurrencyUnit(strings.ToUpper(strings.TrimSpace(v))); c != "" && c != booked {
+			return booked, c
+		}
+	}
+	return booked, booked
+}
+
+// nordnetToBooked converts an amount in currency to the booked currency at the Växlingskurs
+func nordnetToBooked(amount *decimal.Big, currency string, booked CurrencyUnit, rate *decimal.Big) *decimal.Big {
+	c := CurrencyUnit(strings.ToUpper(strings.TrimSpace(currency)))
+	if c == "" || c == booked || rate == nil {
+		return amount
+	}
+	return AMOUNT_FIELD.Round(decimal.New(0, 4).Mul(amount, rate))
+}
+
+/*
+TransformNordnetTransaction maps a row of a Nordnet export. Amounts are booked in the currency
+of Belopp, SEK unless the account holds another currency. Rows of foreign instruments quote
+Kurs, and possibly fees and Inköpsvärde, in the instrument currency; they are converted at the
+row's Växlingskurs and the rate is kept on the record.
+*/
 func TransformNordnetTransaction(transaction NordnetTransaction) (ImportRecord, error) {
 	var result = ImportRecord{}
 	var transactionType TransactionType
@@ -107,50 +144,78 @@ func TransformNordnetTransaction(transaction NordnetTransaction) (ImportRecord,
 		transactionType = SPLITOUT_TRANSACTION
 	case "UTDELNING":
 		transactionType = DIVIDEND
+	case "ÅTERBETALNING":
+		transactionType = RETURN_OF_CAPITAL
+	case "UTL KUPSKATT", "KUPONGSKATT":
+		transactionType = WITHHOLDING_TAX
+	case "INSÄTTNING":
+		transactionType = DEPOSIT_TRANSACTION
+	case "UTTAG":
+		transactionType = WITHDRAWAL_TRANSACTION
 	default:
 		return result, ErrUnhandledTransactionType
 	}
-	shares, err := ProcessStringAmount(transaction.Antal, SE)
+	booked, quoted := nordnetCurrencies(transaction)
+	parser := rowParser{locale: SE}
+	// Växlingskurs is the rate the row was executed at, rows without one may carry the
+	// reference rate Nordnet valued them at.
+	var exchangeRate *decimal.Big
+	for _, column := range [][2]string{{"Växlingskurs", transaction.Växlingskurs}, {"Referensvalutakurs", transaction.Referensvalutakurs}} {
+		if strings.TrimSpace(column[1]) == "" {
+			continue
+		}
+		rate, err := parser.exact(column[0], column[1])
+		if err != nil {
+			return result, fmt.Errorf("%w: %w", ErrValueConversionFailed, err)
+		}
+		if rate.Sign() > 0 && rate.Cmp(decimal.New(1, 0)) != 0 {
+			exchangeRate = rate
+		}
+		break
+	}
+	shares, err := parser.parse("Antal", transaction.Antal, QUANTITY_FIELD)
 	if err != nil {
 		if transaction.Antal == "" {
 			shares, _ = ProcessStringAmount("0", SE)
 		} else {
-			ErrLogger.Printf("failed to process shares with value: %s %s\n", transaction.Transaktionstyp, transaction.Antal)
-			return result, ErrValueConversionFailed
+			return result, fmt.Errorf("%w: %w", ErrValueConversionFailed, err)
 		}
 	}
-	var pricePerShare *decimal.Big
+	var pricePerShare, instrumentAmount *decimal.Big
 	if transactionType == SPLITIN_TRANSACTION || transactionType == TRANSFERIN_TRANSACTION {
-		pricePerShare, err = ProcessStringAmount(transaction.Inköpsvärde, SE)
+		pricePerShare, err = parser.parse("Inköpsvärde", transaction.Inköpsvärde, AMOUNT_FIELD)
 		if err != nil {
 			if transaction.Kurs == "" {
 				pricePerShare, _ = ProcessStringAmount("0", SE)
 			} else {
-				ErrLogger.Println("failed to process pricePerShare")
-				return result, ErrValueConversionFailed
+				return result, fmt.Errorf("%w: %w", ErrValueConversionFailed, err)
 			}
 		}
-		pricePerShare = pricePerShare.Quo(pricePerShare, shares).Quantize(4)
+		pricePerShare = nordnetToBooked(pricePerShare, transaction.InköpsvärdeValuta, booked, exchangeRate)
+		pricePerShare = PRICE_FIELD.Round(pricePerShare.Quo(pricePerShare, shares))
 	} else {
-		pricePerShare, err = ProcessStringAmount(transaction.Kurs, SE)
+		pricePerShare, err = parser.parse("Kurs", transaction.Kurs, PRICE_FIELD)
 		if err != nil {
 			if transaction.Kurs == "" {
 				pricePerShare, _ = ProcessStringAmount("0", SE)
 			} else {
-				ErrLogger.Println("failed to process pricePerShare")
-				return result, ErrValueConversionFailed
+				return result, fmt.Errorf("%w: %w", ErrValueConversionFailed, err)
 			}
 		}
+		if exchangeRate != nil {
+			instrumentAmount = AMOUNT_FIELD.Round(decimal.New(0, 4).Mul(pricePerShare, shares))
+			pricePerShare = PRICE_FIELD.Round(decimal.New(0, 4).Mul(pricePerShare, exchangeRate))
+		}
 	}
-	feeAmount, err := ProcessStringAmount(transaction.TotalAvgift, SE)
+	feeAmount, err := parser.parse("Totalavgift", transaction.TotalAvgift, AMOUNT_FIELD)
 	if err != nil {
 		if transaction.TotalAvgift == "" {
 			feeAmount, _ = ProcessStringAmount("0", SE)
 		} else {
-			ErrLogger.Printf("failed to process feeAmount %s \n", transaction.TotalAvgift)
-			return result, ErrValueConversionFailed
+			return result, fmt.Errorf("%w: %w", ErrValueConversionFailed, err)
 		}
 	}
+	feeAmount = nordnetToBooked(feeAmount, transaction.TotalAvgiftValuta, booked, exchangeRate)
 
 	settlementDate, err := time.Parse(time.DateOnly, transaction.Likviddag)
 	if err != nil {
@@ -158,7 +223,7 @@ func TransformNordnetTransaction(transaction NordnetTransaction) (ImportRecord,
 		return result, ErrValueConversionFailed
 	}
 	var shareValue = decimal.New(0, 4)
-	shareValue.Mul(pricePerShare, shares).Quantize(4)
+	AMOUNT_FIELD.Round(shareValue.Mul(pricePerShare, shares))
 
 	var mappedAssetLot = AssetLot{
 		ID:                "",
@@ -167,7 +232,7 @@ func TransformNordnetTransaction(transaction NordnetTransaction) (ImportRecord,
 		ISIN:              transaction.ISIN,
 		Shares:            shares,
 		CostBasisPerShare: pricePerShare,
-		CostBasisCurrency: SEK,
+		CostBasisCurrency: booked,
 		CreatedDate:       settlementDate,
 	}
 	var mappedTransaction = Transaction{
@@ -185,13 +250,34 @@ func TransformNordnetTransaction(transaction NordnetTransaction) (ImportRecord,
 		FeesAmount: feeAmount,
 
 		TotalAmount: shareValue.Sub(shareValue, feeAmount),
-		Currency:    SEK,
+		Currency:    booked,
 	}
 	if transactionType == TRANSFERIN_TRANSACTION || transactionType == SPLITIN_TRANSACTION || transactionType == TRANSFEROUT_TRANSACTION || transactionType == SPLITOUT_TRANSACTION {
 		mappedTransaction.TotalAmount = decimal.New(0, 4)
 		mappedTransaction.ShareValue = decimal.New(0, 4)
 	}
-	return ImportRecord{lot: mappedAssetLot, transaction: mappedTransaction}, nil
+	if transactionType == DEPOSIT_TRANSACTION || transactionType == WITHDRAWAL_TRANSACTION ||
+		(transactionType == WITHHOLDING_TAX && mappedTransaction.TotalAmount.Sign() == 0) {
+		// Cash rows and some withholding rows carry no per share rate, Belopp is the cash booked.
+		amount, err := parser.parse("Belopp", transaction.Belopp, AMOUNT_FIELD)
+		if err != nil {
+			return result, fmt.Errorf("%w: %w", ErrValueConversionFailed, err)
+		}
+		mappedTransaction.TotalAmount = amount.Abs(amount)
+	}
+	if exchangeRate != nil && quoted != booked {
+		mappedTransaction.InstrumentCurrency = quoted
+		mappedTransaction.InstrumentAmount = instrumentAmount
+		mappedTransaction.ExecutedFXRate = exchangeRate
+	}
+	result = ImportRecord{lot: mappedAssetLot, transaction: mappedTransaction, losses: parser.losses,
+		reference: strings.TrimSpace(transaction.Verifikationsnummer)}
+	if exchangeRate != nil && quoted != booked {
+		// Stored as the booked currency per unit of the instrument currency, which the
+		// rates of other base currencies than USD are.
+		result.rate = &CurrencyRate{Currency: booked, Base: quoted, Date: settlementDate, Rate: exchangeRate, Source: NORDNET_RATE_SOURCE}
+	}
+	return result, nil
 }
 
 func ReadNordnetExport(filepath string, accountNumber string) ([]ImportRecord, error) {
@@ -224,7 +310,8 @@ func ReadNordnetExport(filepath string, accountNumber string) ([]ImportRecord, e
 			continue
 		}
 		if err != nil {
-			return nil, err
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("line %d: %w", line, err)
 		}
 		transformedRecord.lot.AccountID = accountNumber
 		transformedRecord.transaction.AccountID = accountNumber
@@ -268,16 +355,22 @@ func TransformETradeTransaction(transaction ETradeTransaction) (ImportRecord, er
 		transactionType = DIVIDEND
 	case "Qualified Dividend":
 		transactionType = QUALIFIED_DIVIDEND
+	case "Return of Capital":
+		transactionType = RETURN_OF_CAPITAL
+	case "LT Cap Gain Distribution", "ST Cap Gain Distribution", "Capital Gain Distribution":
+		transactionType = CAPITAL_GAIN_DISTRIBUTION
+	case "Foreign Tax Paid", "Foreign Tax Withholding", "Tax Withholding":
+		transactionType = WITHHOLDING_TAX
 	default:
 		return result, ErrUnhandledTransactionType
 	}
-	shares, err := ProcessStringAmount(transaction.Quantity, US)
+	parser := rowParser{locale: US}
+	shares, err := parser.parse("Quantity", transaction.Quantity, QUANTITY_FIELD)
 	if err != nil {
 		if transaction.Quantity == "" {
 			shares, _ = ProcessStringAmount("0", US)
 		} else {
-			ErrLogger.Printf("failed to process shares with value: %s %s\n", transaction.TransactionType, transaction.Quantity)
-			return result, ErrValueConversionFailed
+			return result, fmt.Errorf("%w: %w", ErrValueConversionFailed, err)
 		}
 	}
 	if transactionType == SPLITOUT_TRANSACTION || transactionType == TRANSFEROUT_TRANSACTION {
@@ -285,34 +378,31 @@ func TransformETradeTransaction(transaction ETradeTransaction) (ImportRecord, er
 	}
 	var pricePerShare *decimal.Big
 	if transactionType == SPLITIN_TRANSACTION || transactionType == TRANSFERIN_TRANSACTION {
-		pricePerShare, err = ProcessStringAmount(transaction.Amount, US)
+		pricePerShare, err = parser.parse("Amount", transaction.Amount, AMOUNT_FIELD)
 		if err != nil {
 			if transaction.Price == "" {
 				pricePerShare, _ = ProcessStringAmount("0", US)
 			} else {
-				ErrLogger.Println("failed to process pricePerShare")
-				return result, ErrValueConversionFailed
+				return result, fmt.Errorf("%w: %w", ErrValueConversionFailed, err)
 			}
 		}
-		pricePerShare = pricePerShare.Quo(pricePerShare, shares).Quantize(4)
+		pricePerShare = PRICE_FIELD.Round(pricePerShare.Quo(pricePerShare, shares))
 	} else {
-		pricePerShare, err = ProcessStringAmount(transaction.Price, US)
+		pricePerShare, err = parser.parse("Price", transaction.Price, PRICE_FIELD)
 		if err != nil {
 			if transaction.Price == "" {
 				pricePerShare, _ = ProcessStringAmount("0", US)
 			} else {
-				ErrLogger.Println("failed to process pricePerShare")
-				return result, ErrValueConversionFailed
+				return result, fmt.Errorf("%w: %w", ErrValueConversionFailed, err)
 			}
 		}
 	}
-	feeAmount, err := ProcessStringAmount(transaction.Commission, US)
+	feeAmount, err := parser.parse("Commission", transaction.Commission, AMOUNT_FIELD)
 	if err != nil {
 		if transaction.Commission == "" {
 			feeAmount, _ = ProcessStringAmount("0", SE)
 		} else {
-			ErrLogger.Printf("failed to process feeAmount %s \n", transaction.Commission)
-			return result, ErrValueConversionFailed
+			return result, fmt.Errorf("%w: %w", ErrValueConversionFailed, err)
 		}
 	}
 	settlementDate, err := time.Parse("01/02/06", transaction.TransactionDate)
@@ -321,7 +411,7 @@ func TransformETradeTransaction(transaction ETradeTransaction) (ImportRecord, er
 		return result, ErrValueConversionFailed
 	}
 	var shareValue = decimal.New(0, 4)
-	shareValue.Mul(pricePerShare, shares).Quantize(4)
+	AMOUNT_FIELD.Round(shareValue.Mul(pricePerShare, shares))
 
 	var mappedAssetLot = AssetLot{
 		ID:                "",
@@ -354,14 +444,21 @@ func TransformETradeTransaction(transaction ETradeTransaction) (ImportRecord, er
 		mappedTransaction.TotalAmount = decimal.New(0, 4)
 		mappedTransaction.ShareValue = decimal.New(0, 4)
 	}
-	if transactionType == DIVIDEND {
-		mappedTransaction.TotalAmount, err = ProcessStringAmount(transaction.Amount, US)
+	if transactionType == DIVIDEND || transactionType == QUALIFIED_DIVIDEND || transactionType == RETURN_OF_CAPITAL || transactionType == CAPITAL_GAIN_DISTRIBUTION {
+		mappedTransaction.TotalAmount, err = parser.parse("Amount", transaction.Amount, AMOUNT_FIELD)
 		if err != nil {
-			ErrLogger.Printf("failed to process divident amount: %s", transaction.Amount)
-			return result, ErrValueConversionFailed
+			return result, fmt.Errorf("%w: %w", ErrValueConversionFailed, err)
 		}
 	}
-	return ImportRecord{lot: mappedAssetLot, transaction: mappedTransaction}, nil
+	if transactionType == WITHHOLDING_TAX {
+		// Withholding is booked as a negative cash amount, store what was withheld.
+		withheld, err := parser.parse("Amount", transaction.Amount, AMOUNT_FIELD)
+		if err != nil {
+			return result, fmt.Errorf("%w: %w", ErrValueConversionFailed, err)
+		}
+		mappedTransaction.TotalAmount = withheld.Abs(withheld)
+	}
+	return ImportRecord{lot: mappedAssetLot, transaction: mappedTransaction, losses: parser.losses}, nil
 }
 
 func ReadETradeExport(filepath string, accountNumber string) ([]ImportRecord, error) {
@@ -395,7 +492,8 @@ func ReadETradeExport(filepath string, accountNumber string) ([]ImportRecord, er
 			continue
 		}
 		if err != nil {
-			return nil, err
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("line %d: %w", line, err)
 		}
 		transformedRecord.lot.AccountID = accountNumber
 		transformedRecord.transaction.AccountID = accountNumber
@@ -409,3 +507,261 @@ func ReadETradeExport(filepath string, accountNumber string) ([]ImportRecord, er
 	})
 	return result, nil
 }
+
+/*
+E*TRADE stock plan BenefitHistory export (saved as CSV). Columns are looked up
+by their exact header name since the export layout differs between RSU and ESPP
+plans, and both carry several date and FMV columns.
+
+Record Type
+Symbol
+Grant Date
+Vest Date
+Vested Qty.
+Withheld Qty.
+Vest Date FMV
+Purchase Date
+Purchase Price
+Purchased Qty.
+Purchase Date FMV
+Grant Date FMV
+*/
+type ETradeBenefitRecord struct {
+	RecordType      string
+	Symbol          string
+	GrantDate       string
+	VestDate        string
+	VestedQuantity  string
+	WithheldShares  string
+	VestDateFMV     string
+	PurchaseDate    string
+	PurchasePrice   string
+	PurchasedShares string
+	PurchaseDateFMV string
+	GrantDateFMV    string
+}
+
+var etradeBenefitColumns = map[string][]string{
+	"RecordType":      {"record type"},
+	"Symbol":          {"symbol"},
+	"GrantDate":       {"grant date"},
+	"VestDate":        {"vest date"},
+	"VestedQuantity":  {"vested qty.", "vested qty", "released qty."},
+	"WithheldShares":  {"withheld qty.", "withheld qty", "tax collection shares", "shares withheld"},
+	"VestDateFMV":     {"vest date fmv"},
+	"PurchaseDate":    {"purchase date"},
+	"PurchasePrice":   {"purchase price"},
+	"PurchasedShares": {"purchased qty.", "purchased qty"},
+	"PurchaseDateFMV": {"purchase date fmv"},
+	"GrantDateFMV":    {"grant date fmv"},
+}
+
+func parseETradeBenefitDate(s string) (time.Time, error) {
+	trimmed := strings.TrimSpace(s)
+	for _, layout := range []string{"01/02/2006", "02-Jan-2006", time.DateOnly} {
+		if t, err := time.Parse(layout, trimmed); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, ErrValueConversionFailed
+}
+
+func processOptionalETradeAmount(parser *rowParser, column string, amount string, field PrecisionField) (*decimal.Big, error) {
+	// Stock plan exports prefix prices with "$" and group thousands with ",".
+	cleaned := strings.NewReplacer("$", "", ",", "").Replace(strings.TrimSpace(amount))
+	if cleaned == "" {
+		return ProcessStringAmount("0", US)
+	}
+	return parser.parse(column, cleaned, field)
+}
+
+func TransformETradeBenefitRecord(record ETradeBenefitRecord) (ImportRecord, error) {
+	var result = ImportRecord{}
+	var planType StockPlanType
+	var transactionType TransactionType
+	switch strings.ToLower(strings.TrimSpace(record.RecordType)) {
+	case "vest", "release":
+		planType = RSU
+		transactionType = RSU_VEST_TRANSACTION
+	case "purchase":
+		planType = ESPP
+		transactionType = ESPP_PURCHASE_TRANSACTION
+	default:
+		return result, ErrUnhandledTransactionType
+	}
+
+	var stockPlanLot = StockPlanLot{PlanType: planType}
+	parser := rowParser{locale: US}
+	var err error
+	if record.GrantDate != "" {
+		stockPlanLot.GrantDate, err = parseETradeBenefitDate(record.GrantDate)
+		if err != nil {
+			ErrLogger.Printf("failed to process grant date: %s\n", record.GrantDate)
+			return result, err
+		}
+	}
+
+	var shares *decimal.Big
+	if planType == RSU {
+		stockPlanLot.EventDate, err = parseETradeBenefitDate(record.VestDate)
+		if err != nil {
+			ErrLogger.Printf("failed to process vest date: %s\n", record.VestDate)
+			return result, err
+		}
+		shares, err = processOptionalETradeAmount(&parser, "Vested Qty.", record.VestedQuantity, QUANTITY_FIELD)
+		if err != nil {
+			return result, fmt.Errorf("%w: %w", ErrValueConversionFailed, err)
+		}
+		stockPlanLot.FairMarketValue, err = processOptionalETradeAmount(&parser, "Vest Date FMV", record.VestDateFMV, PRICE_FIELD)
+		if err != nil {
+			return result, fmt.Errorf("%w: %w", ErrValueConversionFailed, err)
+		}
+	} else {
+		// The grant date starts the two year holding period of a qualifying disposition.
+		if stockPlanLot.GrantDate.IsZero() {
+			return result, fmt.Errorf("%w: %s purchased %s", ErrESPPGrantDateMissing, strings.TrimSpace(record.Symbol), record.PurchaseDate)
+		}
+		stockPlanLot.EventDate, err = parseETradeBenefitDate(record.PurchaseDate)
+		if err != nil {
+			ErrLogger.Printf("failed to process purchase date: %s\n", record.PurchaseDate)
+			return result, err
+		}
+		shares, err = processOptionalETradeAmount(&parser, "Purchased Qty.", record.PurchasedShares, QUANTITY_FIELD)
+		if err != nil {
+			return result, fmt.Errorf("%w: %w", ErrValueConversionFailed, err)
+		}
+		stockPlanLot.FairMarketValue, err = processOptionalETradeAmount(&parser, "Purchase Date FMV", record.PurchaseDateFMV, PRICE_FIELD)
+		if err != nil {
+			return result, fmt.Errorf("%w: %w", ErrValueConversionFailed, err)
+		}
+		stockPlanLot.PurchasePrice, err = processOptionalETradeAmount(&parser, "Purchase Price", record.PurchasePrice, PRICE_FIELD)
+		if err != nil {
+			return result, fmt.Errorf("%w: %w", ErrValueConversionFailed, err)
+		}
+		if record.GrantDateFMV != "" {
+			stockPlanLot.GrantDateFMV, err = processOptionalETradeAmount(&parser, "Grant Date FMV", record.GrantDateFMV, PRICE_FIELD)
+			if err != nil {
+				return result, fmt.Errorf("%w: %w", ErrValueConversionFailed, err)
+			}
+		}
+		stockPlanLot.DiscountIncome = decimal.New(0, 4).Sub(stockPlanLot.FairMarketValue, stockPlanLot.PurchasePrice)
+	}
+	stockPlanLot.SharesWithheld, err = processOptionalETradeAmount(&parser, "Withheld Qty.", record.WithheldShares, QUANTITY_FIELD)
+	if err != nil {
+		return result, fmt.Errorf("%w: %w", ErrValueConversionFailed, err)
+	}
+
+	// RSU basis is the FMV at vest; ESPP basis is the purchase price plus the
+	// discount taxed as income, which also lands on the purchase date FMV.
+	costBasisPerShare := decimal.New(0, 4).Copy(stockPlanLot.FairMarketValue)
+	if planType == ESPP {
+		costBasisPerShare = decimal.New(0, 4).Add(stockPlanLot.PurchasePrice, stockPlanLot.DiscountIncome)
+	}
+	depositedShares := decimal.New(0, 4).Sub(shares, stockPlanLot.SharesWithheld)
+	var shareValue = decimal.New(0, 4)
+	AMOUNT_FIELD.Round(shareValue.Mul(costBasisPerShare, shares))
+
+	var mappedAssetLot = AssetLot{
+		ID:                "",
+		Exchange:          "Nasdaq", // E*TRADE US equities default
+		Symbol:            strings.TrimSpace(record.Symbol),
+		ISIN:              "",
+		Shares:            depositedShares,
+		CostBasisPerShare: costBasisPerShare,
+		CostBasisCurrency: USD,
+		CreatedDate:       stockPlanLot.EventDate,
+	}
+	var mappedTransaction = Transaction{
+		ID:                   -1,
+		TransactionReference: "NOREF",
+		TransactionType:      transactionType,
+		SettlementDate:       stockPlanLot.EventDate,
+
+		Symbol:        mappedAssetLot.Symbol,
+		ShareLot:      "",
+		Shares:        shares,
+		PricePerShare: costBasisPerShare,
+		ShareValue:    shareValue,
+
+		FeesAmount: decimal.New(0, 4),
+
+		TotalAmount: decimal.New(0, 4).Copy(shareValue),
+		Currency:    USD,
+	}
+	return ImportRecord{lot: mappedAssetLot, transaction: mappedTransaction, stockPlanLot: &stockPlanLot, losses: parser.losses}, nil
+}
+
+func ReadETradeBenefitHistory(filepath string, accountNumber string) ([]ImportRecord, error) {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.Comma = ','
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columnIndex := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		for field, aliases := range etradeBenefitColumns {
+			for _, alias := range aliases {
+				if _, found := columnIndex[field]; !found && name == alias {
+					columnIndex[field] = i
+				}
+			}
+		}
+	}
+	if _, ok := columnIndex["RecordType"]; !ok {
+		return nil, errors.New("invalid benefit history export: missing Record Type column")
+	}
+	column := func(record []string, field string) string {
+		i, ok := columnIndex[field]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return record[i]
+	}
+
+	result := make([]ImportRecord, 0)
+	var record []string
+	for {
+		record, err = reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		transformedRecord, err := TransformETradeBenefitRecord(ETradeBenefitRecord{
+			RecordType:      column(record, "RecordType"),
+			Symbol:          column(record, "Symbol"),
+			GrantDate:       column(record, "GrantDate"),
+			VestDate:        column(record, "VestDate"),
+			VestedQuantity:  column(record, "VestedQuantity"),
+			WithheldShares:  column(record, "WithheldShares"),
+			VestDateFMV:     column(record, "VestDateFMV"),
+			PurchaseDate:    column(record, "PurchaseDate"),
+			PurchasePrice:   column(record, "PurchasePrice"),
+			PurchasedShares: column(record, "PurchasedShares"),
+			PurchaseDateFMV: column(record, "PurchaseDateFMV"),
+			GrantDateFMV:    column(record, "GrantDateFMV"),
+		})
+		if err == ErrUnhandledTransactionType {
+			continue
+		}
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		transformedRecord.lot.AccountID = accountNumber
+		transformedRecord.transaction.AccountID = accountNumber
+		result = append(result, transformedRecord)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].transaction.SettlementDate.Before(result[j].transaction.SettlementDate)
+	})
+	return result, nil
+}
@@ -2,8 +2,12 @@ package internal_test
 
 import (
 	"accounting/internal"
+	"errors"
 	"log"
 	"testing"
+	"time"
+
+	"github.com/ericlagergren/decimal"
 )
 
 func TestReadNordnetExport(t *testing.T) {
@@ -13,3 +17,177 @@ func TestReadNordnetExport(t *testing.T) {
 		log.Printf("%#v\n", v)
 	}
 }
+
+func TestNordnetForeignCurrencyRow(t *testing.T) {
+	internal.InitializeDB()
+	record, err := internal.TransformNordnetTransaction(internal.NordnetTransaction{
+		Id:                "nok-1",
+		Likviddag:         "2022-05-10",
+		Transaktionstyp:   "KÖPT",
+		Värdepapper:       "EQNR",
+		ISIN:              "NO0010096985",
+		Antal:             "10",
+		Kurs:              "300",
+		TotalAvgift:       "20",
+		TotalAvgiftValuta: "NOK",
+		Belopp:            "-2869",
+		BeloppValuta:      "SEK",
+		Växlingskurs:      "0,95",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC)
+	yearEnd := time.Date(2022, 12, 31, 0, 0, 0, 0, time.UTC)
+	err = internal.UpsertCurrencyRate(internal.CurrencyRate{Currency: internal.SEK, Date: yearEnd, Rate: decimal.New(100000, 4), Source: internal.TREASURY_RATE_SOURCE}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = internal.HandleImport([]internal.ImportRecord{record}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Kurs and the fee are quoted in NOK and booked in SEK at the Växlingskurs.
+	lots, err := internal.GetAssetLotsForSecurityHeldBefore("", "EQNR", date.AddDate(0, 0, 1))
+	if err != nil || len(lots) == 0 {
+		t.Fatalf("expected the imported lot, got %v (%v)", lots, err)
+	}
+	if lots[0].CostBasisCurrency != internal.SEK || lots[0].CostBasisPerShare.Cmp(decimal.New(2850, 1)) != 0 {
+		t.Errorf("expected a cost basis of 285 SEK per share, got %s %s", lots[0].CostBasisPerShare, lots[0].CostBasisCurrency)
+	}
+
+	// The trade keeps the NOK amount and the rate it was executed at.
+	transactions, err := internal.GetTransactionBetweenDate(date, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trade *internal.Transaction
+	for i := range transactions {
+		if transactions[i].TransactionReference == "nok-1" {
+			trade = &transactions[i]
+		}
+	}
+	if trade == nil || trade.InstrumentCurrency != "NOK" || trade.InstrumentAmount.Cmp(decimal.New(3000, 0)) != 0 || trade.ExecutedFXRate.Cmp(decimal.New(95, 2)) != 0 {
+		t.Errorf("expected 3000 NOK executed at 0.95, got %+v", trade)
+	}
+
+	// NOK has no USD rate, it crosses through SEK: 10 SEK per USD / 0.95 SEK per NOK.
+	rate, err := internal.RateToOneUSD("NOK", yearEnd, internal.TREASURY_YEAR_END_FX_POLICY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate.Rate.Cmp(decimal.New(1052631579, 8)) != 0 || rate.Source != "nordnet via SEK (treasury)" {
+		t.Errorf("expected 10.52631579 NOK per USD through SEK, got %s from %s", rate.Rate, rate.Source)
+	}
+}
+
+func TestReadETradeBenefitHistory(t *testing.T) {
+	internal.InitializeDB()
+	records, err := internal.ReadETradeBenefitHistory("../testing/etrade-benefit-history.csv", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The grant row is informational only; the vest and purchase rows become lots.
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if err = internal.HandleImport(records); err != nil {
+		t.Fatal(err)
+	}
+	vested := time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)
+	purchased := time.Date(2024, 6, 30, 0, 0, 0, 0, time.UTC)
+	lots, err := internal.GetAssetLotsForSecurityHeldBefore("", "ACME", purchased.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lots) != 2 {
+		t.Fatalf("expected the RSU and ESPP lots, got %d", len(lots))
+	}
+	rsu, espp := lots[0], lots[1]
+
+	// RSU: 10 vested at an FMV of 120.50, 3 withheld for taxes.
+	if !rsu.CreatedDate.Equal(vested) || rsu.Shares.Cmp(decimal.New(7, 0)) != 0 || rsu.CostBasisPerShare.Cmp(decimal.New(12050, 2)) != 0 {
+		t.Errorf("expected 7 net shares at 120.50 on %s, got %s at %s on %s", vested.Format(time.DateOnly), rsu.Shares, rsu.CostBasisPerShare, rsu.CreatedDate.Format(time.DateOnly))
+	}
+	transactions, err := internal.GetTransactionBetweenDate(vested, vested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vests int
+	for _, transaction := range transactions {
+		if transaction.Symbol != "ACME" || transaction.TransactionType != internal.RSU_VEST_TRANSACTION {
+			continue
+		}
+		vests++
+		if transaction.Shares.Cmp(decimal.New(10, 0)) != 0 || transaction.TotalAmount.Cmp(decimal.New(1205, 0)) != 0 {
+			t.Errorf("expected the vest of 10 shares worth 1205.00, got %s worth %s", transaction.Shares, transaction.TotalAmount)
+		}
+	}
+	if vests != 1 {
+		t.Errorf("expected one vest transaction, got %d", vests)
+	}
+	plan, err := internal.GetStockPlanLot(rsu.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.PlanType != internal.RSU || plan.SharesWithheld.Cmp(decimal.New(3, 0)) != 0 || plan.FairMarketValue.Cmp(decimal.New(12050, 2)) != 0 {
+		t.Errorf("expected an RSU vest at 120.50 with 3 shares withheld, got %+v", plan)
+	}
+
+	// ESPP: 20 bought at 85.00 with an FMV of 110.00, the 25.00 discount is taxed
+	// as income and added to the basis.
+	if !espp.CreatedDate.Equal(purchased) || espp.Shares.Cmp(decimal.New(20, 0)) != 0 || espp.CostBasisPerShare.Cmp(decimal.New(110, 0)) != 0 {
+		t.Errorf("expected 20 shares at 110.00 on %s, got %s at %s on %s", purchased.Format(time.DateOnly), espp.Shares, espp.CostBasisPerShare, espp.CreatedDate.Format(time.DateOnly))
+	}
+	if plan, err = internal.GetStockPlanLot(espp.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+	if plan.PlanType != internal.ESPP || plan.PurchasePrice.Cmp(decimal.New(85, 0)) != 0 || plan.DiscountIncome.Cmp(decimal.New(25, 0)) != 0 ||
+		!plan.GrantDate.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected an ESPP purchase at 85.00 with a 25.00 discount offered on 2024-01-01, got %+v", plan)
+	}
+
+	// Selling 12 takes the 7 RSU shares and 5 ESPP shares within a year of the purchase,
+	// the rest is sold after both holding periods.
+	for _, sale := range []internal.ETradeTransaction{
+		{TransactionDate: "01/10/25", TransactionType: "Sold", Symbol: "ACME", Quantity: "12", Price: "130.00", Amount: "1560.00"},
+		{TransactionDate: "07/01/26", TransactionType: "Sold", Symbol: "ACME", Quantity: "15", Price: "140.00", Amount: "2100.00"},
+	} {
+		record, err := internal.TransformETradeTransaction(sale)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = internal.HandleImport([]internal.ImportRecord{record}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dispositions, err := internal.GetESPPDispositions(espp.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dispositions) != 2 {
+		t.Fatalf("expected 2 ESPP dispositions, got %d", len(dispositions))
+	}
+	if d := dispositions[0]; d.Qualifying || d.Shares.Cmp(decimal.New(5, 0)) != 0 || d.OrdinaryIncome == nil || d.OrdinaryIncome.Cmp(decimal.New(125, 0)) != 0 {
+		t.Errorf("expected 5 shares disqualified with 125.00 of ordinary income, got %+v", d)
+	}
+	if d := dispositions[1]; !d.Qualifying || d.Shares.Cmp(decimal.New(15, 0)) != 0 || d.OrdinaryIncome != nil {
+		t.Errorf("expected 15 shares to qualify, got %+v", d)
+	}
+	if dispositions, err = internal.GetESPPDispositions(rsu.ID); err != nil || len(dispositions) != 0 {
+		t.Errorf("expected no ESPP dispositions of the RSU lot, got %+v (%v)", dispositions, err)
+	}
+
+	// Without a grant date a later sale would look qualifying.
+	_, err = internal.TransformETradeBenefitRecord(internal.ETradeBenefitRecord{
+		RecordType:      "Purchase",
+		Symbol:          "ACME",
+		PurchaseDate:    "06/30/2024",
+		PurchasePrice:   "$85.00",
+		PurchasedShares: "20",
+		PurchaseDateFMV: "$110.00",
+	})
+	if !errors.Is(err, internal.ErrESPPGrantDateMissing) {
+		t.Errorf("expected an ESPP purchase without grant date to be refused, got %v", err)
+	}
+}
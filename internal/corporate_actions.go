@@ -0,0 +1,491 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ericlagergren/decimal"
+)
+
+var (
+	ErrCorporateActionApplied  = errors.New("corporate action already applied")
+	ErrCorporateActionNotFound = errors.New("corporate action not found")
+	ErrInvalidCorporateAction  = errors.New("invalid corporate action")
+	ErrUnpairedSplit           = errors.New("split-out without a matching split-in")
+	ErrSplitSharesMismatch     = errors.New("split-out shares don't match the open lots")
+)
+
+// ParseCorporateActionRatio parses a "new:old" ratio such as "4:1" for a
+// four-for-one split or "1:10" for a one-for-ten reverse split.
+func ParseCorporateActionRatio(ratio string) (ratioTo *decimal.Big, ratioFrom *decimal.Big, err error) {
+	parts := strings.Split(strings.TrimSpace(ratio), ":")
+	if len(parts) != 2 {
+		return nil, nil, fmt.Errorf("%w: ratio must look like 4:1, got %q", ErrInvalidCorporateAction, ratio)
+	}
+	ratioTo, err = ProcessStringAmount(strings.TrimSpace(parts[0]), US)
+	if err != nil {
+		return nil, nil, err
+	}
+	ratioFrom, err = ProcessStringAmount(strings.TrimSpace(parts[1]), US)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ratioTo, ratioFrom, nil
+}
+
+func validateCorporateAction(action CorporateAction) error {
+	if action.Symbol == "" && action.ISIN == "" {
+		return fmt.Errorf("%w: a symbol or ISIN is required", ErrInvalidCorporateAction)
+	}
+	if action.RatioFrom == nil || action.RatioTo == nil ||
+		action.RatioFrom.Cmp(ZeroPrecisionValue) <= 0 || action.RatioTo.Cmp(ZeroPrecisionValue) < 0 {
+		return fmt.Errorf("%w: ratio must be positive", ErrInvalidCorporateAction)
+	}
+	// Only an all-cash merger leaves no new shares.
+	allCash := action.ActionType == MERGER_ACTION && action.CashPerShare != nil && action.CashPerShare.Cmp(ZeroPrecisionValue) > 0
+	if action.RatioTo.Cmp(ZeroPrecisionValue) == 0 && !allCash {
+		return fmt.Errorf("%w: ratio must be positive", ErrInvalidCorporateAction)
+	}
+	switch action.ActionType {
+	case SPLIT_ACTION:
+		if action.RatioTo.Cmp(action.RatioFrom) <= 0 {
+			return fmt.Errorf("%w: a split must increase the share count", ErrInvalidCorporateAction)
+		}
+	case REVERSE_SPLIT_ACTION:
+		if action.RatioTo.Cmp(action.RatioFrom) >= 0 {
+			return fmt.Errorf("%w: a reverse split must decrease the share count", ErrInvalidCorporateAction)
+		}
+	case MERGER_ACTION:
+		if action.NewSymbol == "" && action.NewISIN == "" && action.RatioTo.Cmp(ZeroPrecisionValue) > 0 {
+			return fmt.Errorf("%w: a merger needs the acquiring security", ErrInvalidCorporateAction)
+		}
+		if action.RatioTo.Cmp(ZeroPrecisionValue) == 0 || action.CashPerShare == nil || action.CashPerShare.Cmp(ZeroPrecisionValue) <= 0 {
+			break
+		}
+		if action.BasisAllocation == nil || action.BasisAllocation.Cmp(ZeroPrecisionValue) < 0 ||
+			action.BasisAllocation.Cmp(decimal.New(100, 0)) > 0 {
+			return fmt.Errorf("%w: a merger paying shares and cash needs the percent of the basis allocated to the cash", ErrInvalidCorporateAction)
+		}
+	case SPINOFF_ACTION:
+		if action.NewSymbol == "" && action.NewISIN == "" {
+			return fmt.Errorf("%w: a spin-off needs the spun-off security", ErrInvalidCorporateAction)
+		}
+		if action.BasisAllocation == nil || action.BasisAllocation.Cmp(ZeroPrecisionValue) < 0 ||
+			action.BasisAllocation.Cmp(decimal.New(100, 0)) > 0 {
+			return fmt.Errorf("%w: spin-off basis allocation must be between 0 and 100 percent", ErrInvalidCorporateAction)
+		}
+	case RENAME_ACTION:
+		if action.NewSymbol == "" && action.NewISIN == "" {
+			return fmt.Errorf("%w: a rename needs a new symbol or ISIN", ErrInvalidCorporateAction)
+		}
+		if action.RatioTo.Cmp(action.RatioFrom) != 0 {
+			return fmt.Errorf("%w: a rename keeps the share count", ErrInvalidCorporateAction)
+		}
+	default:
+		return fmt.Errorf("%w: unknown type %s", ErrInvalidCorporateAction, action.ActionType)
+	}
+	return nil
+}
+
+// AddCorporateAction stores a corporate action and, when apply is set,
+// immediately transforms the affected lots.
+func AddCorporateAction(action CorporateAction, apply bool) (int, error) {
+	if action.Source == "" {
+		action.Source = "manual"
+	}
+	if err := validateCorporateAction(action); err != nil {
+		return -1, err
+	}
+	tx, err := GlobalDB.Begin()
+	if err != nil {
+		return -1, err
+	}
+	action.ID, err = InsertCorporateAction(action, tx)
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+	if apply {
+		if err = applyCorporateAction(action, tx); err != nil {
+			tx.Rollback()
+			return -1, err
+		}
+	}
+	return action.ID, tx.Commit()
+}
+
+// ApplyCorporateActionById applies a previously stored corporate action
+func ApplyCorporateActionById(id int) error {
+	actions, err := GetCorporateActions(id)
+	if err != nil {
+		return err
+	}
+	if len(actions) == 0 {
+		return ErrCorporateActionNotFound
+	}
+	tx, err := GlobalDB.Begin()
+	if err != nil {
+		return err
+	}
+	if err = applyCorporateAction(actions[0], tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// applyCorporateAction rewrites each open lot of the security in place so
+// lot ids, acquisition dates and total cost basis survive the action. Merger
+// cash takes its allocated share of the basis, all of it in an all-cash merger
+// which closes the lots, and books the difference as a gain.
+func applyCorporateAction(action CorporateAction, tx *sql.Tx) error {
+	if action.AppliedDate != nil {
+		return ErrCorporateActionApplied
+	}
+	lots, err := GetOpenAssetLotsForSecurity(action.AccountID, action.Symbol, action.ISIN, action.EffectiveDate, tx)
+	if err != nil {
+		return err
+	}
+	if len(lots) == 0 {
+		InfoLogger.Printf("corporate action %d: no open lots for %s %s\n", action.ID, action.Symbol, action.ISIN)
+	}
+	if action.ActionType == SPINOFF_ACTION {
+		if err = applySpinOff(action, lots, tx); err != nil {
+			return err
+		}
+		return MarkCorporateActionApplied(action.ID, time.Now(), tx)
+	}
+
+	for i := range lots {
+		lot := &lots[i]
+		oldShares := decimal.New(0, 4).Copy(lot.Shares)
+		totalCostBasis := decimal.New(0, 4).Mul(lot.CostBasisPerShare, oldShares)
+
+		newShares := decimal.New(0, 4).Mul(oldShares, action.RatioTo)
+		QUANTITY_FIELD.Round(newShares.Quo(newShares, action.RatioFrom))
+		if action.NewSymbol != "" {
+			lot.Symbol = action.NewSymbol
+		}
+		if action.NewISIN != "" {
+			lot.ISIN = action.NewISIN
+		}
+
+		if action.CashPerShare != nil && action.CashPerShare.Cmp(ZeroPrecisionValue) > 0 {
+			cash := AMOUNT_FIELD.Round(decimal.New(0, 4).Mul(oldShares, action.CashPerShare))
+			cashBasis := decimal.New(0, 4).Copy(totalCostBasis)
+			if newShares.Sign() > 0 {
+				cashBasis.Mul(cashBasis, action.BasisAllocation)
+				cashBasis.Quo(cashBasis, decimal.New(100, 0))
+			}
+			AMOUNT_FIELD.Round(cashBasis)
+			totalCostBasis.Sub(totalCostBasis, cashBasis)
+			_, err = InsertTransaction(corporateActionTransaction(action, *lot, MERGER_CASH_TRANSACTION, oldShares, action.CashPerShare, cash), tx)
+			if err != nil {
+				return err
+			}
+			if err = insertCorporateActionGain(action, *lot, oldShares, cash, cashBasis, tx); err != nil {
+				return err
+			}
+		}
+		lot.Shares = newShares
+		if newShares.Sign() > 0 {
+			lot.CostBasisPerShare = PRICE_FIELD.Round(decimal.New(0, 4).Quo(totalCostBasis, newShares))
+		}
+	}
+	if err = payCashInLieu(action, lots, tx); err != nil {
+		return err
+	}
+
+	for _, lot := range lots {
+		if err = UpdateAssetLotDetails(lot, tx); err != nil {
+			return err
+		}
+		if err = InsertCorporateActionLotHistory(lot, action.EffectiveDate, action.ID, tx); err != nil {
+			return err
+		}
+	}
+	return MarkCorporateActionApplied(action.ID, time.Now(), tx)
+}
+
+// applySpinOff creates a child lot for every parent lot. The child inherits
+// the parent's acquisition date and takes the allocated share of its basis,
+// which is removed from the parent lot.
+func applySpinOff(action CorporateAction, parentLots []AssetLot, tx *sql.Tx) error {
+	allocation := decimal.New(0, 4).Quo(action.BasisAllocation, decimal.New(100, 0))
+	childLots := make([]AssetLot, 0, len(parentLots))
+	for _, parent := range parentLots {
+		parentBasis := decimal.New(0, 4).Mul(parent.CostBasisPerShare, parent.Shares)
+		childBasis := decimal.New(0, 4).Mul(parentBasis, allocation)
+
+		childShares := decimal.New(0, 4).Mul(parent.Shares, action.RatioTo)
+		QUANTITY_FIELD.Round(childShares.Quo(childShares, action.RatioFrom))
+		if childShares.Cmp(ZeroPrecisionValue) <= 0 {
+			continue
+		}
+		child := AssetLot{
+			AccountID:         parent.AccountID,
+			Exchange:          parent.Exchange,
+			Symbol:            action.NewSymbol,
+			ISIN:              action.NewISIN,
+			Shares:            childShares,
+			CostBasisPerShare: PRICE_FIELD.Round(decimal.New(0, 4).Quo(childBasis, childShares)),
+			CostBasisCurrency: parent.CostBasisCurrency,
+			CreatedDate:       parent.CreatedDate,
+		}
+		if child.Symbol == "" {
+			child.Symbol = parent.Symbol
+		}
+		childLots = append(childLots, child)
+
+		parent.CostBasisPerShare = decimal.New(0, 4).Sub(parentBasis, childBasis)
+		PRICE_FIELD.Round(parent.CostBasisPerShare.Quo(parent.CostBasisPerShare, parent.Shares))
+		if err := UpdateAssetLotDetails(parent, tx); err != nil {
+			return err
+		}
+		if err := InsertCorporateActionLotHistory(parent, action.EffectiveDate, action.ID, tx); err != nil {
+			return err
+		}
+	}
+
+	// Fractional spun-off shares are settled before the child lots are created
+	// so the lots start out with whole shares. The payouts have no lot and are
+	// stored with a NULL share_lot.
+	if err := payCashInLieu(action, childLots, tx); err != nil {
+		return err
+	}
+	for _, child := range childLots {
+		if child.Shares.Cmp(ZeroPrecisionValue) <= 0 {
+			continue
+		}
+		if _, err := InsertCorporateActionAssetLot(child, action.EffectiveDate, action.ID, tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// payCashInLieu pays out each account's fractional shares at the action's
+// cash-in-lieu price, taking them from the account's most recent lots. The
+// shares leave with their basis, the lots keep their basis per share, and the
+// payout less that basis is booked as a gain.
+func payCashInLieu(action CorporateAction, lots []AssetLot, tx *sql.Tx) error {
+	if action.CashInLieuPrice == nil {
+		return nil
+	}
+	accountShares := make(map[string]*decimal.Big)
+	accountLots := make(map[string][]int)
+	accounts := make([]string, 0)
+	for i, lot := range lots {
+		if _, ok := accountShares[lot.AccountID]; !ok {
+			accountShares[lot.AccountID] = decimal.New(0, 4)
+			accounts = append(accounts, lot.AccountID)
+		}
+		accountShares[lot.AccountID].Add(accountShares[lot.AccountID], lot.Shares)
+		accountLots[lot.AccountID] = append(accountLots[lot.AccountID], i)
+	}
+	for _, account := range accounts {
+		total := accountShares[account]
+		fraction := decimal.New(0, 4).Sub(total, decimal.New(0, 4).QuoInt(total, decimal.New(1, 0)))
+		indexes := accountLots[account]
+		for i := len(indexes) - 1; i >= 0 && fraction.Sign() > 0; i-- {
+			lot := &lots[indexes[i]]
+			shares := decimal.New(0, 4).Copy(decimal.Min(lot.Shares, fraction))
+			if shares.Sign() <= 0 {
+				continue
+			}
+			fraction.Sub(fraction, shares)
+			lot.Shares = decimal.New(0, 4).Sub(lot.Shares, shares)
+			cash := AMOUNT_FIELD.Round(decimal.New(0, 4).Mul(shares, action.CashInLieuPrice))
+			basis := AMOUNT_FIELD.Round(decimal.New(0, 4).Mul(shares, lot.CostBasisPerShare))
+			_, err := InsertTransaction(corporateActionTransaction(action, *lot, CASH_IN_LIEU_TRANSACTION, shares, action.CashInLieuPrice, cash), tx)
+			if err != nil {
+				return err
+			}
+			if err = insertCorporateActionGain(action, *lot, shares, cash, basis, tx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// insertCorporateActionGain books the cash a lot received for shares less the basis that left with
+// them, the price per share is the basis per share of those shares
+func insertCorporateActionGain(action CorporateAction, lot AssetLot, shares *decimal.Big, cash *decimal.Big, basis *decimal.Big, tx *sql.Tx) error {
+	gain := decimal.New(0, 4).Sub(cash, basis)
+	pricePerShare := PRICE_FIELD.Round(decimal.New(0, 4).Quo(basis, shares))
+	_, err := InsertTransaction(corporateActionTransaction(action, lot, CORPORATE_ACTION_GAIN, shares, pricePerShare, gain), tx)
+	return err
+}
+
+func corporateActionTransaction(action CorporateAction, lot AssetLot, transactionType TransactionType, shares *decimal.Big, pricePerShare *decimal.Big, amount *decimal.Big) Transaction {
+	currency := action.Currency
+	if currency == "" {
+		currency = lot.CostBasisCurrency
+	}
+	return Transaction{
+		ID:                   -1,
+		AccountID:            lot.AccountID,
+		TransactionReference: fmt.Sprintf("CA-%d", action.ID),
+		TransactionType:      transactionType,
+		SettlementDate:       action.EffectiveDate,
+
+		Symbol:        lot.Symbol,
+		ShareLot:      lot.ID,
+		Shares:        decimal.New(0, 4).Copy(shares),
+		PricePerShare: decimal.New(0, 4).Copy(pricePerShare),
+		ShareValue:    decimal.New(0, 4).Copy(amount),
+
+		FeesAmount: decimal.New(0, 4),
+
+		TotalAmount: decimal.New(0, 4).Copy(amount),
+		Currency:    currency,
+	}
+}
+
+/*
+handleBrokerSplitImport turns a broker's split rows into a corporate action. The ratio is the
+shares booked in versus the shares the matching split-out row removed, which have to be the open
+shares of the old security; without a split-out row it is the open shares. A split-in of the same
+security and share count changes nothing and is only recorded.
+*/
+func handleBrokerSplitImport(splitIn ImportRecord, splitOut *ImportRecord) error {
+	tx, err := GlobalDB.Begin()
+	if err != nil {
+		return err
+	}
+	oldSymbol, oldISIN := splitIn.lot.Symbol, splitIn.lot.ISIN
+	if splitOut != nil {
+		oldSymbol, oldISIN = splitOut.lot.Symbol, splitOut.lot.ISIN
+	}
+	lots, err := GetOpenAssetLotsForSecurity(splitIn.lot.AccountID, oldSymbol, oldISIN, splitIn.transaction.SettlementDate, tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	openShares := decimal.New(0, 4)
+	for _, lot := range lots {
+		openShares.Add(openShares, lot.Shares)
+	}
+	newShares := decimal.New(0, 4).Abs(splitIn.transaction.Shares)
+
+	if openShares.Cmp(ZeroPrecisionValue) == 0 {
+		// Nothing to transform, e.g. the original purchase predates the import.
+		// Keep the broker's booked-in lot as is.
+		InfoLogger.Printf("split of %s on %s has no open lots, booking the split-in shares as a new lot\n",
+			splitIn.lot.Symbol, splitIn.transaction.SettlementDate.Format(time.DateOnly))
+		lotId, err := InsertAssetLot(splitIn.lot, tx)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		splitIn.transaction.ShareLot = lotId
+		if _, err = InsertTransaction(splitIn.transaction, tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	oldShares := openShares
+	if splitOut != nil {
+		oldShares = decimal.New(0, 4).Abs(splitOut.transaction.Shares)
+		if oldShares.Cmp(openShares) != 0 {
+			tx.Rollback()
+			return fmt.Errorf("%w: %s removed %s shares of %s on %s, the account has %s open", ErrSplitSharesMismatch,
+				splitOut.transaction.TransactionReference, oldShares, oldSymbol,
+				splitIn.transaction.SettlementDate.Format(time.DateOnly), openShares)
+		}
+	}
+	action := CorporateAction{
+		ActionType:    SPLIT_ACTION,
+		AccountID:     splitIn.lot.AccountID,
+		Symbol:        oldSymbol,
+		ISIN:          oldISIN,
+		EffectiveDate: splitIn.transaction.SettlementDate,
+		RatioFrom:     oldShares,
+		RatioTo:       newShares,
+		Currency:      splitIn.lot.CostBasisCurrency,
+		Source:        "broker",
+		Note:          splitIn.transaction.TransactionReference,
+	}
+	if newShares.Cmp(oldShares) < 0 {
+		action.ActionType = REVERSE_SPLIT_ACTION
+	} else if newShares.Cmp(oldShares) == 0 {
+		action.ActionType = RENAME_ACTION
+	}
+	if splitIn.lot.Symbol != oldSymbol {
+		action.NewSymbol = splitIn.lot.Symbol
+	}
+	if splitIn.lot.ISIN != oldISIN {
+		action.NewISIN = splitIn.lot.ISIN
+	}
+	if action.ActionType == RENAME_ACTION && action.NewSymbol == "" && action.NewISIN == "" {
+		InfoLogger.Printf("split of %s on %s keeps the security and its %s shares, the lots are left as they are\n",
+			oldSymbol, splitIn.transaction.SettlementDate.Format(time.DateOnly), oldShares)
+	} else {
+		action.ID, err = InsertCorporateAction(action, tx)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = applyCorporateAction(action, tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, record := range []*ImportRecord{&splitIn, splitOut} {
+		if record == nil {
+			continue
+		}
+		if _, err = InsertTransaction(record.transaction, tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+/*
+pairBrokerSplits matches each split-in record with the split-out record the broker gave the same
+reference. Without one it falls back to the split-out of the same account and settlement date,
+but only when that date has a single split-out, as two reorganisations on the same day could
+otherwise pair one security's lots with the other's shares.
+*/
+func pairBrokerSplits(records []ImportRecord) map[int]int {
+	pairs := make(map[int]int)
+	byReference := make(map[string]int)
+	byDate := make(map[string][]int)
+	paired := make(map[int]bool)
+	dateKey := func(record ImportRecord) string {
+		return record.transaction.AccountID + "|" + record.transaction.SettlementDate.Format(time.DateOnly)
+	}
+	referenceKey := func(record ImportRecord) string {
+		return record.transaction.AccountID + "|" + record.reference
+	}
+	for i, record := range records {
+		if record.transaction.TransactionType != SPLITOUT_TRANSACTION {
+			continue
+		}
+		if record.reference != "" {
+			byReference[referenceKey(record)] = i
+		}
+		byDate[dateKey(record)] = append(byDate[dateKey(record)], i)
+	}
+	for i, record := range records {
+		if record.transaction.TransactionType != SPLITIN_TRANSACTION {
+			continue
+		}
+		if out, ok := byReference[referenceKey(record)]; ok && record.reference != "" && !paired[out] {
+			pairs[i] = out
+			paired[out] = true
+		} else if outs := byDate[dateKey(record)]; len(outs) == 1 && !paired[outs[0]] {
+			pairs[i] = outs[0]
+			paired[outs[0]] = true
+		}
+	}
+	return pairs
+}
@@ -0,0 +1,417 @@
+package internal_test
+
+import (
+	"accounting/internal"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ericlagergren/decimal"
+)
+
+func TestParseCorporateActionRatio(t *testing.T) {
+	var cases = []struct {
+		ratio     string
+		ratioTo   *decimal.Big
+		ratioFrom *decimal.Big
+		fails     bool
+	}{
+		{"4:1", decimal.New(40000, 4), decimal.New(10000, 4), false},
+		{" 1 : 10 ", decimal.New(10000, 4), decimal.New(100000, 4), false},
+		{"3.5:1", decimal.New(35000, 4), decimal.New(10000, 4), false},
+		{"4", nil, nil, true},
+		{"a:1", nil, nil, true},
+	}
+	for i, c := range cases {
+		ratioTo, ratioFrom, err := internal.ParseCorporateActionRatio(c.ratio)
+		if c.fails {
+			if err == nil {
+				t.Errorf("Failed test %d: expected an error", i)
+			}
+			continue
+		}
+		if err != nil || ratioTo.Cmp(c.ratioTo) != 0 || ratioFrom.Cmp(c.ratioFrom) != 0 {
+			t.Errorf("Failed test %d", i)
+		}
+	}
+}
+
+// insertCorporateActionTestLot inserts a USD lot of shares bought at basis per share
+func insertCorporateActionTestLot(t *testing.T, account string, symbol string, shares *decimal.Big, basis *decimal.Big, created time.Time) {
+	tx, err := internal.GlobalDB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = internal.InsertAssetLot(internal.AssetLot{
+		AccountID:         account,
+		Exchange:          "Nasdaq",
+		Symbol:            symbol,
+		Shares:            shares,
+		CostBasisPerShare: basis,
+		CostBasisCurrency: internal.USD,
+		CreatedDate:       created,
+	}, tx)
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// corporateActionCash returns the transactions of a type a corporate action booked
+func corporateActionCash(t *testing.T, id int, transactionType internal.TransactionType, date time.Time) []internal.Transaction {
+	transactions, err := internal.GetTransactionBetweenDate(date, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []internal.Transaction
+	for _, transaction := range transactions {
+		if transaction.TransactionReference == fmt.Sprintf("CA-%d", id) && transaction.TransactionType == transactionType {
+			results = append(results, transaction)
+		}
+	}
+	return results
+}
+
+func TestApplyCorporateAction(t *testing.T) {
+	internal.InitializeDB()
+	bought := time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC)
+	effective := time.Date(2024, 6, 10, 0, 0, 0, 0, time.UTC)
+	var cases = []struct {
+		name     string
+		action   internal.CorporateAction
+		lots     [][2]*decimal.Big // shares and basis per share
+		symbol   string            // of the lots after the action
+		shares   []*decimal.Big
+		basis    []*decimal.Big
+		cashType internal.TransactionType
+		cash     []*decimal.Big
+		gains    []*decimal.Big // cash less the basis it takes
+	}{
+		{
+			name:   "split",
+			action: internal.CorporateAction{ActionType: internal.SPLIT_ACTION, Symbol: "CASPLIT", RatioTo: decimal.New(4, 0), RatioFrom: decimal.New(1, 0)},
+			lots:   [][2]*decimal.Big{{decimal.New(10, 0), decimal.New(100, 0)}, {decimal.New(5, 0), decimal.New(80, 0)}},
+			symbol: "CASPLIT",
+			shares: []*decimal.Big{decimal.New(40, 0), decimal.New(20, 0)},
+			basis:  []*decimal.Big{decimal.New(25, 0), decimal.New(20, 0)},
+		},
+		{
+			// 10 and 4 shares become 3.3333 and 1.3333, the 0.6666 fraction is paid from the last lot
+			// at its basis per share.
+			name: "reverse split with cash in lieu",
+			action: internal.CorporateAction{ActionType: internal.REVERSE_SPLIT_ACTION, Symbol: "CAREV", RatioTo: decimal.New(1, 0), RatioFrom: decimal.New(3, 0),
+				CashInLieuPrice: decimal.New(1250, 2)},
+			lots:     [][2]*decimal.Big{{decimal.New(10, 0), decimal.New(30, 0)}, {decimal.New(4, 0), decimal.New(60, 0)}},
+			symbol:   "CAREV",
+			shares:   []*decimal.Big{decimal.New(33333, 4), decimal.New(6667, 4)},
+			basis:    []*decimal.Big{decimal.New(900009, 4), decimal.New(1800045, 4)},
+			cashType: internal.CASH_IN_LIEU_TRANSACTION,
+			cash:     []*decimal.Big{decimal.New(83325, 4)},
+			gains:    []*decimal.Big{decimal.New(-1116585, 4)},
+		},
+		{
+			// 10 and 1 shares become 3.3333 and 0.3333, the last lot only has half of the 0.6666
+			// fraction and the first lot pays the rest.
+			name: "cash in lieu across lots",
+			action: internal.CorporateAction{ActionType: internal.REVERSE_SPLIT_ACTION, Symbol: "CAFRAC", RatioTo: decimal.New(1, 0), RatioFrom: decimal.New(3, 0),
+				CashInLieuPrice: decimal.New(1250, 2)},
+			lots:     [][2]*decimal.Big{{decimal.New(10, 0), decimal.New(30, 0)}, {decimal.New(1, 0), decimal.New(60, 0)}},
+			symbol:   "CAFRAC",
+			shares:   []*decimal.Big{decimal.New(3, 0), decimal.New(0, 0)},
+			basis:    []*decimal.Big{decimal.New(900009, 4), decimal.New(1800180, 4)},
+			cashType: internal.CASH_IN_LIEU_TRANSACTION,
+			cash:     []*decimal.Big{decimal.New(41662, 4), decimal.New(41662, 4)},
+			gains:    []*decimal.Big{decimal.New(-558338, 4), decimal.New(-258311, 4)},
+		},
+		{
+			// 5% of the 500 basis goes to the 30 cash, the new shares keep 475.
+			name: "merger with shares and cash",
+			action: internal.CorporateAction{ActionType: internal.MERGER_ACTION, Symbol: "CAOLD", NewSymbol: "CANEW", RatioTo: decimal.New(1, 0), RatioFrom: decimal.New(2, 0),
+				CashPerShare: decimal.New(3, 0), BasisAllocation: decimal.New(5, 0)},
+			lots:     [][2]*decimal.Big{{decimal.New(10, 0), decimal.New(50, 0)}},
+			symbol:   "CANEW",
+			shares:   []*decimal.Big{decimal.New(5, 0)},
+			basis:    []*decimal.Big{decimal.New(95, 0)},
+			cashType: internal.MERGER_CASH_TRANSACTION,
+			cash:     []*decimal.Big{decimal.New(30, 0)},
+			gains:    []*decimal.Big{decimal.New(5, 0)},
+		},
+		{
+			// The lot is closed, the cash takes all of its 300 basis.
+			name: "all-cash merger",
+			action: internal.CorporateAction{ActionType: internal.MERGER_ACTION, Symbol: "CACASH", RatioTo: decimal.New(0, 0), RatioFrom: decimal.New(1, 0),
+				CashPerShare: decimal.New(4250, 2)},
+			lots:     [][2]*decimal.Big{{decimal.New(10, 0), decimal.New(30, 0)}},
+			symbol:   "CACASH",
+			shares:   []*decimal.Big{decimal.New(0, 0)},
+			basis:    []*decimal.Big{decimal.New(30, 0)},
+			cashType: internal.MERGER_CASH_TRANSACTION,
+			cash:     []*decimal.Big{decimal.New(425, 0)},
+			gains:    []*decimal.Big{decimal.New(125, 0)},
+		},
+		{
+			name:   "rename",
+			action: internal.CorporateAction{ActionType: internal.RENAME_ACTION, Symbol: "CAREN", NewSymbol: "CARENAMED", RatioTo: decimal.New(1, 0), RatioFrom: decimal.New(1, 0)},
+			lots:   [][2]*decimal.Big{{decimal.New(7, 0), decimal.New(12, 0)}},
+			symbol: "CARENAMED",
+			shares: []*decimal.Big{decimal.New(7, 0)},
+			basis:  []*decimal.Big{decimal.New(12, 0)},
+		},
+	}
+	for _, c := range cases {
+		account := "ca-test-" + c.action.Symbol
+		for i, lot := range c.lots {
+			insertCorporateActionTestLot(t, account, c.action.Symbol, lot[0], lot[1], bought.AddDate(0, i, 0))
+		}
+		c.action.AccountID = account
+		c.action.EffectiveDate = effective
+		id, err := internal.AddCorporateAction(c.action, true)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		lots, err := internal.GetAssetLotsForSecurityHeldBefore(account, c.symbol, effective)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lots) != len(c.shares) {
+			t.Errorf("%s: expected %d lots of %s, got %d", c.name, len(c.shares), c.symbol, len(lots))
+			continue
+		}
+		for i, lot := range lots {
+			if lot.Shares.Cmp(c.shares[i]) != 0 || lot.CostBasisPerShare.Cmp(c.basis[i]) != 0 {
+				t.Errorf("%s: expected lot %d to hold %s at %s, got %s at %s", c.name, i, c.shares[i], c.basis[i], lot.Shares, lot.CostBasisPerShare)
+			}
+			if !lot.CreatedDate.Equal(bought.AddDate(0, i, 0)) {
+				t.Errorf("%s: expected lot %d to keep its acquisition date, got %s", c.name, i, lot.CreatedDate)
+			}
+			history, err := internal.GetAssetLotShareHistory(lot.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != 2 || !history[1].AsOfDate.Equal(effective) || history[1].Shares.Cmp(c.shares[i]) != 0 {
+				t.Errorf("%s: expected a history row of %s shares on the effective date, got %+v", c.name, c.shares[i], history)
+			}
+		}
+
+		var cash, gains []internal.Transaction
+		if len(c.cash) > 0 {
+			cash = corporateActionCash(t, id, c.cashType, effective)
+			gains = corporateActionCash(t, id, internal.CORPORATE_ACTION_GAIN, effective)
+		}
+		for _, booked := range []struct {
+			kind         string
+			transactions []internal.Transaction
+			want         []*decimal.Big
+		}{{"cash", cash, c.cash}, {"gain", gains, c.gains}} {
+			if len(booked.transactions) != len(booked.want) {
+				t.Errorf("%s: expected %d %s transactions, got %d", c.name, len(booked.want), booked.kind, len(booked.transactions))
+				continue
+			}
+			for i, transaction := range booked.transactions {
+				if transaction.TotalAmount.Cmp(booked.want[i]) != 0 {
+					t.Errorf("%s: expected %s %s, got %s", c.name, booked.want[i], booked.kind, transaction.TotalAmount)
+				}
+			}
+		}
+	}
+
+	// Only a merger paying cash can leave no shares.
+	_, err := internal.AddCorporateAction(internal.CorporateAction{
+		ActionType: internal.MERGER_ACTION, Symbol: "CANONE", EffectiveDate: effective, RatioTo: decimal.New(0, 0), RatioFrom: decimal.New(1, 0),
+	}, false)
+	if !errors.Is(err, internal.ErrInvalidCorporateAction) {
+		t.Errorf("expected a merger without shares or cash to be invalid, got %v", err)
+	}
+	// A merger paying shares and cash has to say how the basis is split.
+	_, err = internal.AddCorporateAction(internal.CorporateAction{
+		ActionType: internal.MERGER_ACTION, Symbol: "CANONE", NewSymbol: "CANEWER", EffectiveDate: effective, RatioTo: decimal.New(1, 0), RatioFrom: decimal.New(1, 0),
+		CashPerShare: decimal.New(1, 0),
+	}, false)
+	if !errors.Is(err, internal.ErrInvalidCorporateAction) {
+		t.Errorf("expected a merger paying shares and cash without basis allocation to be invalid, got %v", err)
+	}
+}
+
+func TestBrokerSplitPairing(t *testing.T) {
+	internal.InitializeDB()
+	row := func(id string, transactionType string, name string, isin string, shares string, cost string, reference string) internal.ImportRecord {
+		record, err := internal.TransformNordnetTransaction(internal.NordnetTransaction{
+			Id:                  id,
+			Likviddag:           "2024-05-10",
+			Transaktionstyp:     transactionType,
+			Värdepapper:         name,
+			ISIN:                isin,
+			Antal:               shares,
+			Kurs:                "0",
+			Inköpsvärde:         cost,
+			InköpsvärdeValuta:   "SEK",
+			BeloppValuta:        "SEK",
+			Verifikationsnummer: reference,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return record
+	}
+	purchase := func(id string, name string, isin string, shares string, price string) internal.ImportRecord {
+		record, err := internal.TransformNordnetTransaction(internal.NordnetTransaction{
+			Id:              id,
+			Likviddag:       "2024-01-10",
+			Transaktionstyp: "KÖPT",
+			Värdepapper:     name,
+			ISIN:            isin,
+			Antal:           shares,
+			Kurs:            price,
+			BeloppValuta:    "SEK",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return record
+	}
+
+	// An ISIN change and a split on the same day, the split-ins listed in the other order.
+	records := []internal.ImportRecord{
+		purchase("pair-1", "Pair A", "SE00000PAIR1", "10", "100"),
+		purchase("pair-2", "Pair B", "SE00000PAIR3", "20", "50"),
+		row("pair-3", "SPLIT UTTAG VP", "Pair A", "SE00000PAIR1", "10", "", "R1"),
+		row("pair-4", "SPLIT UTTAG VP", "Pair B", "SE00000PAIR3", "20", "", "R2"),
+		row("pair-5", "SPLIT INLÄGG VP", "Pair B", "SE00000PAIR4", "80", "1000", "R2"),
+		row("pair-6", "SPLIT INLÄGG VP", "Pair A", "SE00000PAIR2", "10", "1000", "R1"),
+	}
+	if err := internal.HandleImport(records); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct {
+		name          string
+		isin          string
+		shares, basis *decimal.Big
+	}{
+		{"Pair A", "SE00000PAIR2", decimal.New(10, 0), decimal.New(100, 0)},
+		{"Pair B", "SE00000PAIR4", decimal.New(80, 0), decimal.New(125, 1)},
+	} {
+		lots, err := internal.GetAssetLotsForSecurityHeldBefore("", want.name, time.Date(2024, 5, 10, 0, 0, 0, 0, time.UTC))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lots) != 1 || lots[0].ISIN != want.isin || lots[0].Shares.Cmp(want.shares) != 0 || lots[0].CostBasisPerShare.Cmp(want.basis) != 0 {
+			t.Errorf("expected %s to be %s shares of %s at %s, got %+v", want.name, want.shares, want.isin, want.basis, lots)
+		}
+	}
+
+	// Without references two split-outs on the same day can't be told apart.
+	err := internal.HandleImport([]internal.ImportRecord{
+		row("pair-7", "SPLIT UTTAG VP", "Pair A", "SE00000PAIR2", "10", "", ""),
+		row("pair-8", "SPLIT UTTAG VP", "Pair B", "SE00000PAIR4", "80", "", ""),
+		row("pair-9", "SPLIT INLÄGG VP", "Pair A", "SE00000PAIR5", "20", "1000", ""),
+	})
+	if !errors.Is(err, internal.ErrUnpairedSplit) {
+		t.Errorf("expected the split-outs to be unpaired, got %v", err)
+	}
+
+	// The split-out has to remove the open shares.
+	err = internal.HandleImport([]internal.ImportRecord{
+		row("pair-10", "SPLIT UTTAG VP", "Pair A", "SE00000PAIR2", "5", "", "R3"),
+		row("pair-11", "SPLIT INLÄGG VP", "Pair A", "SE00000PAIR5", "20", "1000", "R3"),
+	})
+	if !errors.Is(err, internal.ErrSplitSharesMismatch) {
+		t.Errorf("expected the split-out to miss open shares, got %v", err)
+	}
+
+	// The same security and share count is no corporate action.
+	err = internal.HandleImport([]internal.ImportRecord{
+		row("pair-12", "SPLIT UTTAG VP", "Pair A", "SE00000PAIR2", "10", "", "R4"),
+		row("pair-13", "SPLIT INLÄGG VP", "Pair A", "SE00000PAIR2", "10", "1000", "R4"),
+	})
+	if err != nil {
+		t.Errorf("expected an unchanged split to be recorded, got %v", err)
+	}
+}
+
+func TestApplySpinOff(t *testing.T) {
+	internal.InitializeDB()
+	account := "ca-test-spinoff"
+	bought := []time.Time{time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, 8, 15, 0, 0, 0, 0, time.UTC)}
+	effective := time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC)
+	insertCorporateActionTestLot(t, account, "CAPARENT", decimal.New(10, 0), decimal.New(100, 0), bought[0])
+	insertCorporateActionTestLot(t, account, "CAPARENT", decimal.New(7, 0), decimal.New(90, 0), bought[1])
+	originalBasis := decimal.New(1630, 0)
+
+	// One new share per three, 12.5% of the basis, and the 0.6666 of 3.3333 + 2.3333 shares paid at 6.
+	id, err := internal.AddCorporateAction(internal.CorporateAction{
+		ActionType:      internal.SPINOFF_ACTION,
+		AccountID:       account,
+		Symbol:          "CAPARENT",
+		NewSymbol:       "CACHILD",
+		EffectiveDate:   effective,
+		RatioTo:         decimal.New(1, 0),
+		RatioFrom:       decimal.New(3, 0),
+		BasisAllocation: decimal.New(125, 1),
+		CashInLieuPrice: decimal.New(6, 0),
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parents, err := internal.GetAssetLotsForSecurityHeldBefore(account, "CAPARENT", effective)
+	if err != nil {
+		t.Fatal(err)
+	}
+	children, err := internal.GetAssetLotsForSecurityHeldBefore(account, "CACHILD", effective)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parents) != 2 || len(children) != 2 {
+		t.Fatalf("expected 2 parent and 2 child lots, got %d and %d", len(parents), len(children))
+	}
+	cash := corporateActionCash(t, id, internal.CASH_IN_LIEU_TRANSACTION, effective)
+	if len(cash) != 1 || cash[0].Shares.Cmp(decimal.New(6666, 4)) != 0 || cash[0].TotalAmount.Cmp(decimal.New(39996, 4)) != 0 {
+		t.Fatalf("expected 0.6666 shares paid as 3.9996 cash in lieu, got %+v", cash)
+	}
+	// The child lots don't exist yet when the fraction is paid, the payout and its gain have no lot.
+	var withoutLot int
+	err = internal.GlobalDB.QueryRow(`SELECT COUNT(*) FROM transactions WHERE transaction_reference = ? AND share_lot IS NULL`,
+		fmt.Sprintf("CA-%d", id)).Scan(&withoutLot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if withoutLot != 2 {
+		t.Errorf("expected the cash in lieu and its gain to be stored without a lot, got %d", withoutLot)
+	}
+
+	wantParentBasis := []*decimal.Big{decimal.New(875, 1), decimal.New(7875, 2)}
+	wantChildShares := []*decimal.Big{decimal.New(33333, 4), decimal.New(16667, 4)}
+	basis := decimal.New(0, 4)
+	for i := range parents {
+		if parents[i].CostBasisPerShare.Cmp(wantParentBasis[i]) != 0 {
+			t.Errorf("expected parent lot %d at %s per share, got %s", i, wantParentBasis[i], parents[i].CostBasisPerShare)
+		}
+		if children[i].Shares.Cmp(wantChildShares[i]) != 0 {
+			t.Errorf("expected child lot %d to hold %s shares, got %s", i, wantChildShares[i], children[i].Shares)
+		}
+		if !parents[i].CreatedDate.Equal(bought[i]) || !children[i].CreatedDate.Equal(bought[i]) {
+			t.Errorf("expected parent and child lot %d to be acquired on %s, got %s and %s", i, bought[i].Format(time.DateOnly),
+				parents[i].CreatedDate.Format(time.DateOnly), children[i].CreatedDate.Format(time.DateOnly))
+		}
+		history, err := internal.GetAssetLotShareHistory(children[i].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 1 || !history[0].AsOfDate.Equal(effective) {
+			t.Errorf("expected child lot %d to start its history on the effective date, got %+v", i, history)
+		}
+		basis.Add(basis, decimal.New(0, 4).Mul(parents[i].CostBasisPerShare, parents[i].Shares))
+		basis.Add(basis, decimal.New(0, 4).Mul(children[i].CostBasisPerShare, children[i].Shares))
+	}
+	// The fractional shares paid in cash take their basis with them.
+	basis.Add(basis, decimal.New(0, 4).Mul(children[1].CostBasisPerShare, cash[0].Shares))
+	if difference := decimal.New(0, 4).Sub(basis, originalBasis); decimal.New(0, 4).Abs(difference).Cmp(decimal.New(1, 2)) > 0 {
+		t.Errorf("expected the parent and child lots to keep the basis of %s, got %s", originalBasis, basis)
+	}
+}
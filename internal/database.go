@@ -2,8 +2,13 @@ package internal
 
 import (
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/ericlagergren/decimal"
@@ -12,13 +17,13 @@ import (
 
 var GlobalDB *sql.DB
 
-func getDbDecimalValue(val *decimal.Big) int64 {
-	uintVal, _ := val.Mantissa()
-	intVal := int64(uintVal)
-	if val.Cmp(ZeroPrecisionValue) == -1 {
-		return -1 * intVal
+// nullString stores "" as NULL, so an optional reference that is missing doesn't refer to a
+// row that can't exist
+func nullString(s string) any {
+	if s == "" {
+		return nil
 	}
-	return intVal
+	return s
 }
 
 /**
@@ -43,7 +48,6 @@ func GetAssetLotBySymbol(symbol string, openOnly bool) ([]AssetLot, error) {
 	}
 	var results = make([]AssetLot, 0)
 	for rows.Next() {
-		var shares, cost_basis_per_share int64
 		var assetLot AssetLot
 		err = rows.Scan(
 			&assetLot.ID,
@@ -51,13 +55,11 @@ func GetAssetLotBySymbol(symbol string, openOnly bool) ([]AssetLot, error) {
 			&assetLot.Exchange,
 			&assetLot.Symbol,
 			&assetLot.ISIN,
-			&shares,
-			&cost_basis_per_share,
+			scanField(&assetLot.Shares, QUANTITY_FIELD),
+			scanField(&assetLot.CostBasisPerShare, PRICE_FIELD),
 			&assetLot.CostBasisCurrency,
 			&assetLot.CreatedDate,
 		)
-		assetLot.Shares = decimal.New(shares, 4)
-		assetLot.CostBasisPerShare = decimal.New(cost_basis_per_share, 4)
 		if err != nil {
 			return nil, err
 		}
@@ -81,7 +83,6 @@ func GetOpenAssetLotsBySymbolBeforeDate(symbol string, date time.Time) ([]AssetL
 	}
 	var results = make([]AssetLot, 0)
 	for rows.Next() {
-		var shares, cost_basis_per_share int64
 		var assetLot AssetLot
 		err = rows.Scan(
 			&assetLot.ID,
@@ -89,13 +90,11 @@ func GetOpenAssetLotsBySymbolBeforeDate(symbol string, date time.Time) ([]AssetL
 			&assetLot.Exchange,
 			&assetLot.Symbol,
 			&assetLot.ISIN,
-			&shares,
-			&cost_basis_per_share,
+			scanField(&assetLot.Shares, QUANTITY_FIELD),
+			scanField(&assetLot.CostBasisPerShare, PRICE_FIELD),
 			&assetLot.CostBasisCurrency,
 			&assetLot.CreatedDate,
 		)
-		assetLot.Shares = decimal.New(shares, 4)
-		assetLot.CostBasisPerShare = decimal.New(cost_basis_per_share, 4)
 		if err != nil {
 			return nil, err
 		}
@@ -114,20 +113,17 @@ func GetAssetLotById(id int) (AssetLot, error) {
 	`
 	row := GlobalDB.QueryRow(sql, id)
 	var assetLot AssetLot
-	var shares, costBasisPerShare int64
 	err := row.Scan(
 		&assetLot.ID,
 		&assetLot.AccountID,
 		&assetLot.Exchange,
 		&assetLot.Symbol,
 		&assetLot.ISIN,
-		&shares,
-		&costBasisPerShare,
+		scanField(&assetLot.Shares, QUANTITY_FIELD),
+		scanField(&assetLot.CostBasisPerShare, PRICE_FIELD),
 		&assetLot.CostBasisCurrency,
 		&assetLot.CreatedDate,
 	)
-	assetLot.Shares = decimal.New(shares, 4)
-	assetLot.CostBasisPerShare = decimal.New(costBasisPerShare, 4)
 	if err != nil {
 		assetLot.ID = ""
 		return assetLot, err
@@ -135,44 +131,110 @@ func GetAssetLotById(id int) (AssetLot, error) {
 	return assetLot, err
 }
 
-func getUnMarkedSymbols(beforeDate time.Time) ([]AssetLot, error) {
+// getLotsToMark returns the lots held on a date with the shares they held then. Lots already
+// marked on that date are left out unless they are to be re-marked.
+func getLotsToMark(date time.Time, remark bool) ([]AssetLot, error) {
 	sql := `
-		SELECT id, account, exchange, symbol, isin, shares, cost_basis_per_share, cost_basis_currency, created_date
-		FROM asset_lots
-		WHERE id NOT IN (select distinct asset_lot_id from market_marks)
-			AND created_date < ? AND shares > 0
+		SELECT l.id, l.account, l.exchange, l.symbol, l.isin, l.shares, l.cost_basis_per_share, l.cost_basis_currency, l.created_date
+		FROM asset_lots l
+		WHERE l.created_date <= ?
+			AND (? OR NOT EXISTS (
+				SELECT 1 FROM market_marks m
+				WHERE m.asset_lot_id = l.id AND m.market_mark_date = ? AND m.superseded_date IS NULL
+			))
+		ORDER BY l.account, l.created_date, l.id
 	`
 	var err error
 	var assetLots []AssetLot = []AssetLot{}
-	rows, err := GlobalDB.Query(sql, beforeDate)
+	rows, err := GlobalDB.Query(sql, date, remark, date)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
 		var assetLot AssetLot
-		var shares, costBasisPerShare int64
 		err = rows.Scan(
 			&assetLot.ID,
 			&assetLot.AccountID,
 			&assetLot.Exchange,
 			&assetLot.Symbol,
 			&assetLot.ISIN,
-			&shares,
-			&costBasisPerShare,
+			scanField(&assetLot.Shares, QUANTITY_FIELD),
+			scanField(&assetLot.CostBasisPerShare, PRICE_FIELD),
 			&assetLot.CostBasisCurrency,
 			&assetLot.CreatedDate,
 		)
 		if err != nil {
+			rows.Close()
 			return nil, err
 		}
-		assetLot.Shares = decimal.New(shares, 4)
-		assetLot.CostBasisPerShare = decimal.New(costBasisPerShare, 4)
 		assetLots = append(assetLots, assetLot)
 	}
-	return assetLots, err
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Lots sold, split or renamed since the date are marked as they were on it.
+	heldLots := make([]AssetLot, 0, len(assetLots))
+	for _, assetLot := range assetLots {
+		assetLot, err = getAssetLotAsOf(assetLot, date)
+		if err != nil {
+			return nil, err
+		}
+		if assetLot.Shares.Sign() > 0 {
+			heldLots = append(heldLots, assetLot)
+		}
+	}
+	return heldLots, nil
+}
+
+// getAssetLotAsOf returns a lot with the symbol, ISIN, shares and basis per share of the history row
+// in effect on a date. Lots without history are returned as they are, lots whose history starts after
+// the date hold no shares.
+func getAssetLotAsOf(assetLot AssetLot, date time.Time) (AssetLot, error) {
+	sql := `
+	SELECT symbol, isin, shares, cost_basis_per_share, as_of_date
+	FROM asset_lots_history
+	WHERE id = ?
+	ORDER BY as_of_date ASC, int_id ASC;
+	`
+	rows, err := GlobalDB.Query(sql, assetLot.ID)
+	if err != nil {
+		return assetLot, err
+	}
+	defer rows.Close()
+	asOf := assetLot
+	asOf.Shares = decimal.New(0, 4)
+	hasHistory := false
+	for rows.Next() {
+		hasHistory = true
+		var row AssetLot
+		var asOfDate time.Time
+		err = rows.Scan(&row.Symbol, &row.ISIN, scanField(&row.Shares, QUANTITY_FIELD),
+			scanField(&row.CostBasisPerShare, PRICE_FIELD), &asOfDate)
+		if err != nil {
+			return assetLot, err
+		}
+		if dateOnly(asOfDate).After(date) {
+			break
+		}
+		asOf.Symbol, asOf.ISIN, asOf.Shares = row.Symbol, row.ISIN, row.Shares
+		if row.CostBasisPerShare != nil {
+			asOf.CostBasisPerShare = row.CostBasisPerShare
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return assetLot, err
+	}
+	if !hasHistory {
+		return assetLot, nil
+	}
+	return asOf, nil
 }
 
-func MarkAssetLot(markDate time.Time, assetLot AssetLot, markedValue *decimal.Big, tx *sql.Tx) error {
+// MarkAssetLot records the value of a lot on a date, superseding an earlier mark of the lot on that date.
+// priceDate is the date of the price used, which is earlier when the mark date wasn't a trading day.
+func MarkAssetLot(markDate time.Time, assetLot AssetLot, markedValue *decimal.Big, priceDate time.Time, tx *sql.Tx) error {
 	/*
 		 asset_lot_id 				TEXT
 		,account
@@ -181,20 +243,35 @@ func MarkAssetLot(markDate time.Time, assetLot AssetLot, markedValue *decimal.Bi
 		,marked_value_per_share 	BIGINT
 		,marked_value_currency		CHAR(3)
 		,gain_loss					BIGINT
+		,superseded_date			TIMESTAMP
+		,price_date					TIMESTAMP
 	*/
 	sql := `
-		INSERT INTO market_marks (asset_lot_id, account, market_mark_date, marked_shares, marked_value_per_share, marked_value_currency, gain_loss)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO market_marks (asset_lot_id, account, market_mark_date, marked_shares, marked_value_per_share, marked_value_currency, gain_loss, price_date)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 	`
-	var shares = getDbDecimalValue(assetLot.Shares)
-	var dbMarkedValue = getDbDecimalValue(markedValue)
-	var gain_loss = getDbDecimalValue(decimal.New(0, 4).Mul(assetLot.Shares, decimal.New(0, 4).Sub(markedValue, assetLot.CostBasisPerShare)).Quantize(4))
-	_, err := tx.Exec(sql, assetLot.ID, assetLot.AccountID, markDate, shares, dbMarkedValue, assetLot.CostBasisCurrency, gain_loss)
+	var shares = fieldFixed(assetLot.Shares, QUANTITY_FIELD)
+	var dbMarkedValue = fieldFixed(PRICE_FIELD.Round(decimal.New(0, 4).Copy(markedValue)), PRICE_FIELD)
+	var gain_loss = fieldFixed(AMOUNT_FIELD.Round(decimal.New(0, 4).Mul(assetLot.Shares, decimal.New(0, 4).Sub(markedValue, assetLot.CostBasisPerShare))), AMOUNT_FIELD)
+	_, err := tx.Exec(`
+		UPDATE market_marks SET superseded_date = ?
+		WHERE asset_lot_id = ? AND market_mark_date = ? AND superseded_date IS NULL;
+	`, time.Now().UTC(), assetLot.ID, markDate)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(sql, assetLot.ID, assetLot.AccountID, markDate, shares, dbMarkedValue, assetLot.CostBasisCurrency, gain_loss, dateOnly(priceDate))
 	return err
 }
 
 // InsertAssetLot inserts a asset lot record and then returns the resulting id
 func InsertAssetLot(assetLot AssetLot, tx *sql.Tx) (string, error) {
+	return InsertCorporateActionAssetLot(assetLot, assetLot.CreatedDate, 0, tx)
+}
+
+// InsertCorporateActionAssetLot inserts a asset lot record created by a corporate
+// action, recording its first history row as of asOfDate, and then returns the resulting id
+func InsertCorporateActionAssetLot(assetLot AssetLot, asOfDate time.Time, corporateActionId int, tx *sql.Tx) (string, error) {
 	sql := `
 	INSERT INTO asset_lots (
 		id, account, exchange, symbol, isin, shares, cost_basis_per_share, cost_basis_currency, created_date
@@ -225,8 +302,8 @@ func InsertAssetLot(assetLot AssetLot, tx *sql.Tx) (string, error) {
 			return "", err
 		}
 	}
-	var shares = getDbDecimalValue(assetLot.Shares)
-	var costBasisPerShare = getDbDecimalValue(assetLot.CostBasisPerShare)
+	var shares = fieldFixed(assetLot.Shares, QUANTITY_FIELD)
+	var costBasisPerShare = fieldFixed(assetLot.CostBasisPerShare, PRICE_FIELD)
 	assetLot.ID = derivedId
 	_, err = tx.Exec(sql,
 		derivedId, assetLot.AccountID, assetLot.Exchange, assetLot.Symbol, assetLot.ISIN, shares,
@@ -234,9 +311,18 @@ func InsertAssetLot(assetLot AssetLot, tx *sql.Tx) (string, error) {
 	)
 	if err != nil {
 		ErrLogger.Println(derivedId)
+		if immediateCommit {
+			tx.Rollback()
+		}
+		return "", err
+	}
+	if _, err = EnsureSecurity(assetLot, tx); err != nil {
+		if immediateCommit {
+			tx.Rollback()
+		}
 		return "", err
 	}
-	InsertAssetLotHistory(assetLot, assetLot.CreatedDate, tx)
+	InsertCorporateActionLotHistory(assetLot, asOfDate, corporateActionId, tx)
 	if immediateCommit {
 		err = tx.Commit()
 		if err != nil {
@@ -248,10 +334,16 @@ func InsertAssetLot(assetLot AssetLot, tx *sql.Tx) (string, error) {
 
 // InsertAssetLotHistory inserts a asset lot record and then returns
 func InsertAssetLotHistory(assetLot AssetLot, asOfDate time.Time, tx *sql.Tx) error {
+	return InsertCorporateActionLotHistory(assetLot, asOfDate, 0, tx)
+}
+
+// InsertCorporateActionLotHistory inserts a asset lot record tied to the corporate
+// action that produced it. A corporateActionId of 0 records no action.
+func InsertCorporateActionLotHistory(assetLot AssetLot, asOfDate time.Time, corporateActionId int, tx *sql.Tx) error {
 	sql := `
 	INSERT INTO asset_lots_history (
-		id, account, symbol, isin, shares, cost_basis_per_share, cost_basis_currency, as_of_date
-	) VALUES (?, ?, ?, ?, ?, ?, ?, ?);
+		id, account, symbol, isin, shares, cost_basis_per_share, cost_basis_currency, as_of_date, corporate_action_id
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
 	`
 
 	immediateCommit := false
@@ -263,14 +355,21 @@ func InsertAssetLotHistory(assetLot AssetLot, asOfDate time.Time, tx *sql.Tx) er
 			return err
 		}
 	}
-	var shares = getDbDecimalValue(assetLot.Shares)
-	var costBasisPerShare = getDbDecimalValue(assetLot.CostBasisPerShare)
+	var shares = fieldFixed(assetLot.Shares, QUANTITY_FIELD)
+	var costBasisPerShare = fieldFixed(assetLot.CostBasisPerShare, PRICE_FIELD)
+	var actionId any
+	if corporateActionId > 0 {
+		actionId = corporateActionId
+	}
 	_, err = tx.Exec(sql,
 		assetLot.ID, assetLot.AccountID, assetLot.Symbol, assetLot.ISIN, shares,
-		costBasisPerShare, assetLot.CostBasisCurrency, asOfDate,
+		costBasisPerShare, assetLot.CostBasisCurrency, asOfDate, actionId,
 	)
 	if err != nil {
 		ErrLogger.Println(assetLot.ID)
+		if immediateCommit {
+			tx.Rollback()
+		}
 		return err
 	}
 	if immediateCommit {
@@ -296,12 +395,14 @@ func UpdateAssetLot(assetLot AssetLot, tx *sql.Tx) error {
 			return err
 		}
 	}
-	var shares, _ = assetLot.Shares.Mantissa()
 	_, err = tx.Exec(sql,
-		shares,
+		fieldFixed(assetLot.Shares, QUANTITY_FIELD),
 		assetLot.ID,
 	)
 	if err != nil {
+		if immediateCommit {
+			tx.Rollback()
+		}
 		return err
 	}
 	if immediateCommit {
@@ -313,298 +414,1324 @@ func UpdateAssetLot(assetLot AssetLot, tx *sql.Tx) error {
 	return err
 }
 
-/**
-TRANSACTION DATA ACCESS
-*/
+// UpdateAssetLotDetails updates the security, shares and cost basis of a asset lot record
+func UpdateAssetLotDetails(assetLot AssetLot, tx *sql.Tx) error {
+	sql := `
+	UPDATE asset_lots SET symbol=?, isin=?, shares=?, cost_basis_per_share=? WHERE id=?;
+	`
+	_, err := tx.Exec(sql,
+		assetLot.Symbol,
+		assetLot.ISIN,
+		fieldFixed(assetLot.Shares, QUANTITY_FIELD),
+		fieldFixed(assetLot.CostBasisPerShare, PRICE_FIELD),
+		assetLot.ID,
+	)
+	if err != nil {
+		return err
+	}
+	// Renames can move the lot to another security.
+	_, err = EnsureSecurity(assetLot, tx)
+	return err
+}
 
-// GetTransactionBetweenDate returns a transaction when given a date range
-func GetTransactionBetweenDate(startDate time.Time, endDate time.Time) ([]Transaction, error) {
+// GetOpenAssetLotsForSecurity returns the open lots of a security acquired before a date.
+// The security is matched by ISIN when one is given and by symbol otherwise;
+// an empty account matches every account.
+func GetOpenAssetLotsForSecurity(account string, symbol string, isin string, beforeDate time.Time, tx *sql.Tx) ([]AssetLot, error) {
 	sql := `
 	SELECT
-		id, account, transaction_reference, transaction_type, settlement_date,
-		share_lot, shares, price_per_share, share_value, fees_amount,
-		total_amount, currency
-	FROM transactions
-	WHERE settlement_date BETWEEN ? AND ?;
+		id, account, exchange, symbol, isin, shares, cost_basis_per_share, cost_basis_currency, created_date
+	FROM asset_lots
+	WHERE shares > 0 AND created_date < ?
+		AND ((? != '' AND isin = ?) OR (? = '' AND symbol = ?))
+		AND (? = '' OR account = ?)
+	ORDER BY account ASC, created_date ASC, id ASC;
 	`
-	rows, err := GlobalDB.Query(sql, startDate, endDate)
+	rows, err := tx.Query(sql, beforeDate, isin, isin, isin, symbol, account, account)
 	if err != nil {
 		return nil, err
 	}
-	var transactions []Transaction
+	defer rows.Close()
+	var results = make([]AssetLot, 0)
 	for rows.Next() {
-		var transaction Transaction
-		var shares, pricePerShare, shareValue, feesAmount, totalAmount int64
-		err := rows.Scan(
-			&transaction.ID,
-			&transaction.AccountID,
-			&transaction.TransactionReference,
-			&transaction.TransactionType,
-			&transaction.SettlementDate,
-			&transaction.Symbol,
-			&transaction.ShareLot,
-			&shares,
-			&pricePerShare,
-			&shareValue,
-			&feesAmount,
-			&totalAmount,
-			&transaction.Currency,
+		var assetLot AssetLot
+		err = rows.Scan(
+			&assetLot.ID,
+			&assetLot.AccountID,
+			&assetLot.Exchange,
+			&assetLot.Symbol,
+			&assetLot.ISIN,
+			scanField(&assetLot.Shares, QUANTITY_FIELD),
+			scanField(&assetLot.CostBasisPerShare, PRICE_FIELD),
+			&assetLot.CostBasisCurrency,
+			&assetLot.CreatedDate,
 		)
-		transaction.Shares = decimal.New(shares, 4)
-		transaction.PricePerShare = decimal.New(pricePerShare, 4)
-		transaction.ShareValue = decimal.New(shareValue, 4)
-		transaction.FeesAmount = decimal.New(feesAmount, 4)
-		transaction.TotalAmount = decimal.New(totalAmount, 4)
 		if err != nil {
 			return nil, err
 		}
-		transactions = append(transactions, transaction)
+		results = append(results, assetLot)
 	}
-	return transactions, err
+	return results, rows.Err()
 }
 
-// GetTransactionById returns a transaction when given a transaction id
-func GetTransactionById(id int) (Transaction, error) {
+// GetAssetLotsForSecurityHeldBefore returns every lot of a security in an account
+// acquired on or before a date, including lots that have since been closed.
+func GetAssetLotsForSecurityHeldBefore(account string, symbol string, date time.Time) ([]AssetLot, error) {
 	sql := `
 	SELECT
-		id, account, transaction_reference, transaction_type, settlement_date, symbol,
-		share_lot, shares, price_per_share, share_value, fees_amount,
-		total_amount, currency
-	FROM transactions
-	WHERE id = ?;
+		id, account, exchange, symbol, isin, shares, cost_basis_per_share, cost_basis_currency, created_date
+	FROM asset_lots
+	WHERE account = ? AND symbol = ? AND created_date <= ?
+	ORDER BY created_date ASC, id ASC;
 	`
-	row := GlobalDB.QueryRow(sql, id)
-	var transaction Transaction
-	var shares, pricePerShare, shareValue, feesAmount, totalAmount int64
-	err := row.Scan(
-		&transaction.ID,
-		&transaction.AccountID,
-		&transaction.TransactionReference,
-		&transaction.TransactionType,
-		&transaction.SettlementDate,
-		&transaction.Symbol,
-		&transaction.ShareLot,
-		&shares,
-		&pricePerShare,
-		&shareValue,
-		&feesAmount,
-		&totalAmount,
-		&transaction.Currency,
-	)
-	transaction.Shares = decimal.New(shares, 4)
-	transaction.PricePerShare = decimal.New(pricePerShare, 4)
-	transaction.ShareValue = decimal.New(shareValue, 4)
-	transaction.FeesAmount = decimal.New(feesAmount, 4)
-	transaction.TotalAmount = decimal.New(totalAmount, 4)
+	rows, err := GlobalDB.Query(sql, account, symbol, date)
 	if err != nil {
-		transaction.ID = -1
-		return transaction, err
+		return nil, err
 	}
-	return transaction, err
+	defer rows.Close()
+	var results = make([]AssetLot, 0)
+	for rows.Next() {
+		var assetLot AssetLot
+		err = rows.Scan(
+			&assetLot.ID,
+			&assetLot.AccountID,
+			&assetLot.Exchange,
+			&assetLot.Symbol,
+			&assetLot.ISIN,
+			scanField(&assetLot.Shares, QUANTITY_FIELD),
+			scanField(&assetLot.CostBasisPerShare, PRICE_FIELD),
+			&assetLot.CostBasisCurrency,
+			&assetLot.CreatedDate,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, assetLot)
+	}
+	return results, rows.Err()
 }
 
-// InsertTransaction inserts a transaction record and then returns the resulting id
-func InsertTransaction(transaction Transaction, tx *sql.Tx) (int, error) {
+// GetAssetLotShareHistory returns the share count of a lot after each recorded change, oldest first
+func GetAssetLotShareHistory(assetLotID string) ([]AssetLotShares, error) {
 	sql := `
-	INSERT INTO transactions (
-		account, transaction_reference, transaction_type, settlement_date, symbol,
-		share_lot, shares, price_per_share, share_value, fees_amount,
-		total_amount, currency
-	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	SELECT shares, as_of_date
+	FROM asset_lots_history
+	WHERE id = ?
+	ORDER BY as_of_date ASC, int_id ASC;
 	`
-	immediateCommit := false
-	var err error
-	if tx == nil {
-		immediateCommit = true
-		tx, err = GlobalDB.Begin()
+	rows, err := GlobalDB.Query(sql, assetLotID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results = make([]AssetLotShares, 0)
+	for rows.Next() {
+		var change AssetLotShares
+		if err = rows.Scan(scanField(&change.Shares, QUANTITY_FIELD), &change.AsOfDate); err != nil {
+			return nil, err
+		}
+		results = append(results, change)
+	}
+	return results, rows.Err()
+}
+
+/**
+SECURITY DATA ACCESS
+*/
+
+type queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// InsertSecurityIfMissing stores a security and its ticker, keeping what is already recorded
+func InsertSecurityIfMissing(security Security, tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	INSERT OR IGNORE INTO securities (id, isin, name, currency, asset_class, pfic)
+	VALUES (?, ?, ?, ?, ?, ?);
+	`, security.ID, security.ISIN, security.Name, security.Currency, security.AssetClass, security.PFIC)
+	if err != nil {
+		return err
+	}
+	for _, ticker := range security.Tickers {
+		_, err = tx.Exec(`
+		INSERT OR IGNORE INTO security_tickers (security_id, exchange, ticker) VALUES (?, ?, ?);
+		`, security.ID, ticker.Exchange, ticker.Ticker)
 		if err != nil {
-			return -1, err
+			return err
 		}
 	}
-	shares := getDbDecimalValue(transaction.Shares)
-	pricePerShare := getDbDecimalValue(transaction.PricePerShare)
-	shareValue := getDbDecimalValue(transaction.ShareValue)
-	feesAmount := getDbDecimalValue(transaction.FeesAmount)
-	totalAmount := getDbDecimalValue(transaction.TotalAmount)
-	result, err := tx.Exec(sql, transaction.AccountID, transaction.TransactionReference, transaction.TransactionType, transaction.SettlementDate,
-		transaction.Symbol, transaction.ShareLot, shares, pricePerShare, shareValue, feesAmount,
-		totalAmount, transaction.Currency)
+	return nil
+}
+
+// UpdateSecurity overwrites the attributes and tickers of a security
+func UpdateSecurity(security Security) error {
+	tx, err := GlobalDB.Begin()
 	if err != nil {
-		return -1, err
+		return err
 	}
-	lastId, err := result.LastInsertId()
-	if immediateCommit {
-		err = tx.Commit()
+	result, err := tx.Exec(`
+	UPDATE securities SET name = ?, yahoo_symbol = ?, currency = ?, asset_class = ?, pfic = ? WHERE id = ?;
+	`, security.Name, security.YahooSymbol, security.Currency, security.AssetClass, security.PFIC, security.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		tx.Rollback()
+		return fmt.Errorf("%w: %s", ErrSecurityNotFound, security.ID)
+	}
+	for _, ticker := range security.Tickers {
+		_, err = tx.Exec(`
+		INSERT INTO security_tickers (security_id, exchange, ticker) VALUES (?, ?, ?)
+		ON CONFLICT (security_id, exchange) DO UPDATE SET ticker = excluded.ticker;
+		`, security.ID, ticker.Exchange, ticker.Ticker)
 		if err != nil {
-			return -1, err
+			tx.Rollback()
+			return err
 		}
 	}
-	return int(lastId), err
+	return tx.Commit()
 }
 
-func UpdateRates() {
-	supportedCurrenciesInsert := `
-	INSERT INTO "supported_currencies" (id, name)
-		SELECT "USD", "US Dollar"
-		UNION ALL
-		SELECT "SEK", "Svensk krona"
-	`
-	insertCurrencyRatesTable := `
-	INSERT INTO "currency_rates" (currency_code, rate, as_of_date)
-		SELECT 'USD', 10000, '2022-12-31'
-		UNION ALL
-		SELECT 'USD', 10000, '2023-12-31'
-		UNION ALL
-		SELECT 'USD', 10000, '2024-12-31'
-		UNION ALL
-		SELECT 'USD', 10000, '2025-12-31'
-		UNION ALL
-		SELECT 'SEK', 101220, '2022-12-31'
-		UNION ALL
-		SELECT 'SEK', 106130, '2023-12-31'
-		UNION ALL
-		SELECT 'SEK', 105770, '2024-12-31'
-		UNION ALL
-		SELECT 'SEK', 98130, '2025-12-31'
-	`
-	tx, _ := GlobalDB.Begin()
-	tx.Exec(supportedCurrenciesInsert)
-	tx.Exec(insertCurrencyRatesTable)
-	tx.Commit()
+// SetSecurityYahooSymbol caches the Yahoo symbol a security resolved to
+func SetSecurityYahooSymbol(securityID string, yahooSymbol string, tx *sql.Tx) error {
+	_, err := tx.Exec(`UPDATE securities SET yahoo_symbol = ? WHERE id = ?;`, yahooSymbol, securityID)
+	return err
 }
 
-/*
-*
+func getSecurityTickers(db queryer, securityID string) ([]SecurityTicker, error) {
+	rows, err := db.Query(`SELECT exchange, ticker FROM security_tickers WHERE security_id = ? ORDER BY exchange;`, securityID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tickers = make([]SecurityTicker, 0)
+	for rows.Next() {
+		var ticker SecurityTicker
+		if err = rows.Scan(&ticker.Exchange, &ticker.Ticker); err != nil {
+			return nil, err
+		}
+		tickers = append(tickers, ticker)
+	}
+	return tickers, rows.Err()
+}
 
-	INITIALIZATION
-*/
-func createTables() {
-	supportedCurrenciesTable := `
-	CREATE TABLE IF NOT EXISTS "supported_currencies" (
-		 id                   	CHAR(3) PRIMARY KEY
-		,name      				TEXT NOT NULL
-	)
-	`
-	lotsTable := `
-	CREATE TABLE IF NOT EXISTS "asset_lots" (
-		 id                   	TEXT PRIMARY KEY
-		,account				TEXT NOT NULL
-		,exchange				TEXT NOT NULL DEFAULT ''
-		,symbol				 	TEXT NOT NULL
-		,isin      				TEXT NOT NULL
-		,shares       			BIGINT NOT NULL
-
-		,cost_basis_per_share   TEXT
-		,cost_basis_currency   	BIGINT
-		,created_date   		TIMESTAMP NOT NULL
-		,FOREIGN KEY (cost_basis_currency) REFERENCES supported_currencies(id)
-	)
-	`
-	lotsHistoryTable := `
-	CREATE TABLE IF NOT EXISTS "asset_lots_history" (
-		 int_id                 INTEGER PRIMARY KEY AUTOINCREMENT
-		,id                   	TEXT
-		,account               	TEXT
-		,symbol				 	TEXT NOT NULL
-		,isin      				TEXT NOT NULL
-		,shares       			BIGINT NOT NULL
-
-		,cost_basis_per_share   TEXT
-		,cost_basis_currency   	BIGINT
-		,as_of_date   			TIMESTAMP NOT NULL
-		,FOREIGN KEY (cost_basis_currency) REFERENCES supported_currencies(id)
-	)
-	`
-	transactionsTable := `
-	CREATE TABLE IF NOT EXISTS "transactions" (
-		 id                   	INTEGER PRIMARY KEY AUTOINCREMENT
-		,account			 	TEXT
-		,transaction_reference 	TEXT
-		,transaction_type      	SMALLINT NOT NULL
-		,settlement_date       	TIMESTAMP NOT NULL
-
-		,symbol					TEXT
-		,share_lot      		TEXT
-		,shares        			BIGINT
-		,price_per_share 		BIGINT
-		,share_value    		BIGINT
-
-		,fees_amount 			BIGINT NOT NULL DEFAULT 0
-
-		,total_amount 			BIGINT NOT NULL
-		,currency    			CHAR(3) NOT NULL
-		,FOREIGN KEY (share_lot) REFERENCES asset_lots(id)
-		,FOREIGN KEY (currency) REFERENCES supported_currencies(id)
-		)
-	`
-	currencyRatesTable := `
-		CREATE TABLE IF NOT EXISTS "currency_rates" (
-			id                   	INTEGER PRIMARY KEY AUTOINCREMENT
-			,currency_code 			CHAR(3)
-			,rate 		     		BIGINT -- how much to one USD
-			,as_of_date    			TIMESTAMP
-			,FOREIGN KEY (currency_code) REFERENCES supported_currencies(id)
-		)
-	`
+const securityColumns = `s.id, s.isin, s.name, s.yahoo_symbol, s.currency, s.asset_class, s.pfic`
 
-	marketMarksTable := `
-		CREATE TABLE IF NOT EXISTS "market_marks" (
-			id                   		INTEGER PRIMARY KEY AUTOINCREMENT
-			,account	 				TEXT
-			,asset_lot_id 				TEXT
-			,market_mark_date			TIMESTAMP
-			,marked_shares				BIGINT
-			,marked_value_per_share 	BIGINT
-			,marked_value_currency		CHAR(3)
-			,gain_loss				 	BIGINT
-			,FOREIGN KEY (asset_lot_id) REFERENCES asset_lots(id)
-			,FOREIGN KEY (marked_value_currency) REFERENCES supported_currencies(id)
-		)
-	`
+func scanSecurity(row interface{ Scan(...any) error }) (Security, error) {
+	var security Security
+	err := row.Scan(&security.ID, &security.ISIN, &security.Name, &security.YahooSymbol,
+		&security.Currency, &security.AssetClass, &security.PFIC)
+	return security, err
+}
 
-	tx, _ := GlobalDB.Begin()
-	_, err := tx.Exec(supportedCurrenciesTable)
-	if err != nil {
-		ErrLogger.Fatal(err)
+// GetSecurity returns a security with its tickers
+func GetSecurity(id string) (Security, error) {
+	security, err := scanSecurity(GlobalDB.QueryRow(`SELECT `+securityColumns+` FROM securities s WHERE s.id = ?;`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return security, fmt.Errorf("%w: %s", ErrSecurityNotFound, id)
 	}
-	_, err = tx.Exec(lotsTable)
 	if err != nil {
-		ErrLogger.Fatal(err)
+		return security, err
 	}
-	// Backfill existing DBs (older `asset_lots` tables) with the new column.
-	// SQLite returns an error if the column already exists; ignore it.
-	_, _ = tx.Exec(`ALTER TABLE asset_lots ADD COLUMN exchange TEXT NOT NULL DEFAULT '';`)
-	_, err = tx.Exec(lotsHistoryTable)
-	if err != nil {
-		ErrLogger.Fatal(err)
+	security.Tickers, err = getSecurityTickers(GlobalDB, id)
+	return security, err
+}
+
+// GetSecurityByAssetLot returns the security a lot references. A nil tx reads outside any transaction.
+func GetSecurityByAssetLot(assetLotID string, tx *sql.Tx) (Security, error) {
+	var db queryer = GlobalDB
+	if tx != nil {
+		db = tx
 	}
-	_, err = tx.Exec(transactionsTable)
-	if err != nil {
-		ErrLogger.Fatal(err)
+	security, err := scanSecurity(db.QueryRow(`
+	SELECT `+securityColumns+`
+	FROM securities s JOIN asset_lots l ON l.security_id = s.id
+	WHERE l.id = ?;
+	`, assetLotID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return security, fmt.Errorf("%w: lot %s", ErrSecurityNotFound, assetLotID)
 	}
-	_, err = tx.Exec(currencyRatesTable)
 	if err != nil {
-		ErrLogger.Fatal(err)
+		return security, err
 	}
-	_, err = tx.Exec(marketMarksTable)
+	security.Tickers, err = getSecurityTickers(db, security.ID)
+	return security, err
+}
+
+// GetSecurities returns every security with its tickers
+func GetSecurities() ([]Security, error) {
+	rows, err := GlobalDB.Query(`SELECT ` + securityColumns + ` FROM securities s ORDER BY s.name, s.id;`)
 	if err != nil {
-		ErrLogger.Fatal(err)
+		return nil, err
 	}
-	err = tx.Commit()
-	if err != nil {
-		ErrLogger.Fatal(err)
+	var securities = make([]Security, 0)
+	for rows.Next() {
+		security, err := scanSecurity(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		securities = append(securities, security)
 	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range securities {
+		if securities[i].Tickers, err = getSecurityTickers(GlobalDB, securities[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return securities, nil
 }
 
-func InitializeDB() {
-	var err error
-	var dbPath = "ledger.db"
-	if flag.Lookup("test.v") != nil {
-		dbPath = "test_" + dbPath
+// SetAssetLotSecurity points a lot at its security
+func SetAssetLotSecurity(assetLotID string, securityID string, tx *sql.Tx) error {
+	_, err := tx.Exec(`UPDATE asset_lots SET security_id = ? WHERE id = ?;`, securityID, assetLotID)
+	return err
+}
+
+// GetAssetLotsWithoutSecurity returns the lots that don't reference a security yet
+func GetAssetLotsWithoutSecurity(tx *sql.Tx) ([]AssetLot, error) {
+	rows, err := tx.Query(`
+	SELECT id, account, exchange, symbol, isin, cost_basis_currency
+	FROM asset_lots
+	WHERE security_id IS NULL OR security_id = '';
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results = make([]AssetLot, 0)
+	for rows.Next() {
+		var assetLot AssetLot
+		err = rows.Scan(&assetLot.ID, &assetLot.AccountID, &assetLot.Exchange, &assetLot.Symbol, &assetLot.ISIN, &assetLot.CostBasisCurrency)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, assetLot)
 	}
-	GlobalDB, err = sql.Open("sqlite3", dbPath)
+	return results, rows.Err()
+}
+
+/**
+CORPORATE ACTION DATA ACCESS
+*/
+
+// InsertCorporateAction inserts a corporate action record and then returns the resulting id
+func InsertCorporateAction(action CorporateAction, tx *sql.Tx) (int, error) {
+	sql := `
+	INSERT INTO corporate_actions (
+		action_type, account, symbol, isin, effective_date, ratio_from, ratio_to,
+		new_symbol, new_isin, cash_per_share, cash_in_lieu_price, basis_allocation, currency, source, note
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`
+	result, err := tx.Exec(sql,
+		string(action.ActionType), action.AccountID, action.Symbol, action.ISIN, action.EffectiveDate,
+		fixed(action.RatioFrom), fixed(action.RatioTo),
+		action.NewSymbol, action.NewISIN, fieldFixed(action.CashPerShare, PRICE_FIELD), fieldFixed(action.CashInLieuPrice, PRICE_FIELD),
+		fixed(action.BasisAllocation), nullString(string(action.Currency)), action.Source, action.Note,
+	)
 	if err != nil {
-		ErrLogger.Fatal(err)
+		return -1, err
+	}
+	lastId, err := result.LastInsertId()
+	return int(lastId), err
+}
+
+// MarkCorporateActionApplied stamps a corporate action as applied
+func MarkCorporateActionApplied(id int, appliedDate time.Time, tx *sql.Tx) error {
+	sql := `
+	UPDATE corporate_actions SET applied_date=? WHERE id=?;
+	`
+	_, err := tx.Exec(sql, appliedDate, id)
+	return err
+}
+
+// GetCorporateActions returns corporate actions, optionally only a single id
+func GetCorporateActions(id int) ([]CorporateAction, error) {
+	query := `
+	SELECT
+		id, action_type, account, symbol, isin, effective_date, ratio_from, ratio_to,
+		new_symbol, new_isin, cash_per_share, cash_in_lieu_price, basis_allocation, COALESCE(currency, ''), source, note, applied_date
+	FROM corporate_actions
+	WHERE (? = 0 OR id = ?)
+	ORDER BY effective_date ASC, id ASC;
+	`
+	rows, err := GlobalDB.Query(query, id, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results = make([]CorporateAction, 0)
+	for rows.Next() {
+		var action CorporateAction
+		var actionType, currency string
+		var basisAllocation sql.NullInt64
+		var appliedDate sql.NullTime
+		err = rows.Scan(
+			&action.ID,
+			&actionType,
+			&action.AccountID,
+			&action.Symbol,
+			&action.ISIN,
+			&action.EffectiveDate,
+			scanFixed(&action.RatioFrom),
+			scanFixed(&action.RatioTo),
+			&action.NewSymbol,
+			&action.NewISIN,
+			scanField(&action.CashPerShare, PRICE_FIELD),
+			scanField(&action.CashInLieuPrice, PRICE_FIELD),
+			&basisAllocation,
+			&currency,
+			&action.Source,
+			&action.Note,
+			&appliedDate,
+		)
+		if err != nil {
+			return nil, err
+		}
+		action.ActionType = CorporateActionType(actionType)
+		action.Currency = CurrencyUnit(currency)
+		if basisAllocation.Valid {
+			action.BasisAllocation = decimal.New(basisAllocation.Int64, 4)
+		}
+		if appliedDate.Valid {
+			action.AppliedDate = &appliedDate.Time
+		}
+		results = append(results, action)
+	}
+	return results, rows.Err()
+}
+
+/**
+STOCK PLAN DATA ACCESS
+*/
+
+// InsertStockPlanLot records the stock plan details behind an asset lot
+func InsertStockPlanLot(stockPlanLot StockPlanLot, tx *sql.Tx) error {
+	sql := `
+	INSERT INTO stock_plan_lots (
+		asset_lot_id, plan_type, grant_date, event_date, fair_market_value,
+		purchase_price, grant_date_fmv, discount_income, shares_withheld
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`
+	immediateCommit := false
+	var err error
+	if tx == nil {
+		immediateCommit = true
+		tx, err = GlobalDB.Begin()
+		if err != nil {
+			return err
+		}
+	}
+	var purchasePrice, grantDateFMV, discountIncome any
+	if stockPlanLot.PurchasePrice != nil {
+		purchasePrice = fieldFixed(stockPlanLot.PurchasePrice, PRICE_FIELD)
+	}
+	if stockPlanLot.GrantDateFMV != nil {
+		grantDateFMV = fieldFixed(stockPlanLot.GrantDateFMV, PRICE_FIELD)
+	}
+	if stockPlanLot.DiscountIncome != nil {
+		discountIncome = fieldFixed(stockPlanLot.DiscountIncome, PRICE_FIELD)
+	}
+	_, err = tx.Exec(sql,
+		stockPlanLot.AssetLotID, string(stockPlanLot.PlanType), stockPlanLot.GrantDate, stockPlanLot.EventDate,
+		fieldFixed(stockPlanLot.FairMarketValue, PRICE_FIELD), purchasePrice, grantDateFMV, discountIncome,
+		fieldFixed(stockPlanLot.SharesWithheld, QUANTITY_FIELD),
+	)
+	if err != nil {
+		if immediateCommit {
+			tx.Rollback()
+		}
+		return err
+	}
+	if immediateCommit {
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// GetStockPlanLot returns the stock plan details for an asset lot, or
+// sql.ErrNoRows when the lot did not come from a stock plan
+func GetStockPlanLot(assetLotID string, tx *sql.Tx) (StockPlanLot, error) {
+	query := `
+	SELECT
+		asset_lot_id, plan_type, grant_date, event_date, fair_market_value,
+		purchase_price, grant_date_fmv, discount_income, shares_withheld
+	FROM stock_plan_lots
+	WHERE asset_lot_id = ?;
+	`
+	var row *sql.Row
+	if tx != nil {
+		row = tx.QueryRow(query, assetLotID)
+	} else {
+		row = GlobalDB.QueryRow(query, assetLotID)
+	}
+	var stockPlanLot StockPlanLot
+	var planType string
+	var grantDate sql.NullTime
+	err := row.Scan(
+		&stockPlanLot.AssetLotID,
+		&planType,
+		&grantDate,
+		&stockPlanLot.EventDate,
+		scanField(&stockPlanLot.FairMarketValue, PRICE_FIELD),
+		scanField(&stockPlanLot.PurchasePrice, PRICE_FIELD),
+		scanField(&stockPlanLot.GrantDateFMV, PRICE_FIELD),
+		scanField(&stockPlanLot.DiscountIncome, PRICE_FIELD),
+		scanField(&stockPlanLot.SharesWithheld, QUANTITY_FIELD),
+	)
+	if err != nil {
+		return stockPlanLot, err
+	}
+	stockPlanLot.PlanType = StockPlanType(planType)
+	stockPlanLot.GrantDate = grantDate.Time
+	return stockPlanLot, nil
+}
+
+// InsertESPPDisposition flags the sale of ESPP shares as qualifying or disqualifying
+func InsertESPPDisposition(transactionID int, stockPlanLot StockPlanLot, dispositionDate time.Time, shares *decimal.Big, tx *sql.Tx) error {
+	sql := `
+	INSERT INTO espp_dispositions (
+		transaction_id, asset_lot_id, disposition_date, shares, qualifying, ordinary_income
+	) VALUES (?, ?, ?, ?, ?, ?);
+	`
+	qualifying := IsQualifyingESPPDisposition(stockPlanLot, dispositionDate)
+	// Disqualifying dispositions recognize the full purchase discount as
+	// ordinary income. Qualifying ones depend on the sale price and plan terms,
+	// so that figure is left for the user to work out.
+	var ordinaryIncome any
+	if !qualifying && stockPlanLot.DiscountIncome != nil {
+		ordinaryIncome = fieldFixed(AMOUNT_FIELD.Round(decimal.New(0, 4).Mul(stockPlanLot.DiscountIncome, shares)), AMOUNT_FIELD)
+	}
+	_, err := tx.Exec(sql,
+		transactionID, stockPlanLot.AssetLotID, dispositionDate, fieldFixed(shares, QUANTITY_FIELD), qualifying, ordinaryIncome,
+	)
+	return err
+}
+
+// GetESPPDispositions returns the dispositions of an ESPP lot in the order they were sold
+func GetESPPDispositions(assetLotID string) ([]ESPPDisposition, error) {
+	rows, err := GlobalDB.Query(`
+	SELECT transaction_id, asset_lot_id, disposition_date, shares, qualifying, ordinary_income
+	FROM espp_dispositions
+	WHERE asset_lot_id = ?
+	ORDER BY disposition_date ASC, id ASC;
+	`, assetLotID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results = make([]ESPPDisposition, 0)
+	for rows.Next() {
+		var disposition ESPPDisposition
+		err = rows.Scan(
+			&disposition.TransactionID,
+			&disposition.AssetLotID,
+			&disposition.DispositionDate,
+			scanField(&disposition.Shares, QUANTITY_FIELD),
+			&disposition.Qualifying,
+			scanField(&disposition.OrdinaryIncome, AMOUNT_FIELD),
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, disposition)
+	}
+	return results, rows.Err()
+}
+
+/**
+DIVIDEND DATA ACCESS
+*/
+
+// InsertDividendClassification records the qualified/ordinary outcome of a dividend, replacing an earlier one
+func InsertDividendClassification(classification DividendClassification, tx *sql.Tx) error {
+	sql := `
+	INSERT OR REPLACE INTO dividend_classifications (
+		transaction_id, qualified, qualified_amount, payer_country, reason, classified_date
+	) VALUES (?, ?, ?, ?, ?, ?);
+	`
+	immediateCommit := false
+	var err error
+	if tx == nil {
+		immediateCommit = true
+		tx, err = GlobalDB.Begin()
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(sql,
+		classification.TransactionID, classification.Qualified, fieldFixed(classification.QualifiedAmount, AMOUNT_FIELD),
+		classification.PayerCountry, classification.Reason, time.Now().UTC(),
+	)
+	if err != nil {
+		if immediateCommit {
+			tx.Rollback()
+		}
+		return err
+	}
+	if immediateCommit {
+		err = tx.Commit()
+	}
+	return err
+}
+
+// UpsertExDividendDate records the ex-dividend date of a payment, replacing an earlier one
+func UpsertExDividendDate(exDividend ExDividendDate) error {
+	sql := `
+	INSERT INTO ex_dividend_dates (symbol, payment_date, ex_date, source)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT (symbol, payment_date) DO UPDATE SET ex_date = excluded.ex_date, source = excluded.source;
+	`
+	if exDividend.Symbol == "" || dateOnly(exDividend.ExDate).After(dateOnly(exDividend.PaymentDate)) {
+		return fmt.Errorf("%w: %s paid %s can't go ex-dividend on %s", ErrInvalidExDividendDate, exDividend.Symbol,
+			exDividend.PaymentDate.Format(time.DateOnly), exDividend.ExDate.Format(time.DateOnly))
+	}
+	if exDividend.Source == "" {
+		exDividend.Source = "manual"
+	}
+	_, err := GlobalDB.Exec(sql, exDividend.Symbol, dateOnly(exDividend.PaymentDate), dateOnly(exDividend.ExDate), exDividend.Source)
+	return err
+}
+
+// GetExDividendDate returns the ex-dividend date of a payment, ErrExDividendDateMissing without one
+func GetExDividendDate(symbol string, paymentDate time.Time) (time.Time, error) {
+	query := `
+	SELECT ex_date FROM ex_dividend_dates WHERE symbol = ? AND payment_date = ?;
+	`
+	var exDate time.Time
+	err := GlobalDB.QueryRow(query, symbol, dateOnly(paymentDate)).Scan(&exDate)
+	if errors.Is(err, sql.ErrNoRows) {
+		return exDate, fmt.Errorf("%w: %s paid %s", ErrExDividendDateMissing, symbol, paymentDate.Format(time.DateOnly))
+	}
+	return exDate, err
+}
+
+// GetExDividendDates returns the ex-dividend dates of the payments of a year
+func GetExDividendDates(year int) ([]ExDividendDate, error) {
+	sql := `
+	SELECT symbol, payment_date, ex_date, source
+	FROM ex_dividend_dates
+	WHERE payment_date >= ? AND payment_date < ?
+	ORDER BY payment_date ASC, symbol ASC;
+	`
+	from := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+	rows, err := GlobalDB.Query(sql, from, from.AddDate(1, 0, 0))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results = make([]ExDividendDate, 0)
+	for rows.Next() {
+		var exDividend ExDividendDate
+		if err = rows.Scan(&exDividend.Symbol, &exDividend.PaymentDate, &exDividend.ExDate, &exDividend.Source); err != nil {
+			return nil, err
+		}
+		results = append(results, exDividend)
+	}
+	return results, rows.Err()
+}
+
+/**
+ACCOUNT DATA ACCESS
+*/
+
+// InsertAccount registers a new account
+func InsertAccount(account Account) error {
+	sql := `
+	INSERT INTO accounts (
+		id, broker, account_type, base_currency, opened_date, owners, institution, institution_address
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?);
+	`
+	var openedDate any
+	if account.OpenedDate != nil {
+		openedDate = *account.OpenedDate
+	}
+	_, err := GlobalDB.Exec(sql,
+		account.ID, account.Broker, account.AccountType, account.BaseCurrency, openedDate,
+		account.Owners, account.Institution, account.InstitutionAddress,
+	)
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return fmt.Errorf("%w: %s", ErrAccountExists, account.ID)
+	}
+	return err
+}
+
+// UpdateAccount overwrites every attribute of a registered account
+func UpdateAccount(account Account) error {
+	sql := `
+	UPDATE accounts SET
+		broker = ?, account_type = ?, base_currency = ?, opened_date = ?, owners = ?, institution = ?, institution_address = ?
+	WHERE id = ?;
+	`
+	var openedDate any
+	if account.OpenedDate != nil {
+		openedDate = *account.OpenedDate
+	}
+	result, err := GlobalDB.Exec(sql,
+		account.Broker, account.AccountType, account.BaseCurrency, openedDate,
+		account.Owners, account.Institution, account.InstitutionAddress, account.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return fmt.Errorf("%w: %s", ErrAccountNotFound, account.ID)
+	}
+	return nil
+}
+
+func scanAccount(row interface{ Scan(...any) error }) (Account, error) {
+	var account Account
+	var baseCurrency string
+	var openedDate sql.NullTime
+	err := row.Scan(
+		&account.ID, &account.Broker, &account.AccountType, &baseCurrency, &openedDate,
+		&account.Owners, &account.Institution, &account.InstitutionAddress,
+	)
+	if err != nil {
+		return account, err
+	}
+	account.BaseCurrency = CurrencyUnit(baseCurrency)
+	if openedDate.Valid {
+		account.OpenedDate = &openedDate.Time
+	}
+	return account, nil
+}
+
+const accountColumns = `id, broker, account_type, base_currency, opened_date, owners, institution, institution_address`
+
+// GetAccount returns a registered account
+func GetAccount(id string) (Account, error) {
+	account, err := scanAccount(GlobalDB.QueryRow(`SELECT `+accountColumns+` FROM accounts WHERE id = ?;`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return account, fmt.Errorf("%w: %s", ErrAccountNotFound, id)
+	}
+	return account, err
+}
+
+// GetAccounts returns every registered account
+func GetAccounts() ([]Account, error) {
+	rows, err := GlobalDB.Query(`SELECT ` + accountColumns + ` FROM accounts ORDER BY id;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var accounts = make([]Account, 0)
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+// GetAccountsByType returns the ids of the accounts of the given types
+func GetAccountsByType(accountTypes ...AccountType) ([]string, error) {
+	sql := `SELECT id FROM accounts WHERE account_type IN (` + strings.TrimSuffix(strings.Repeat("?,", len(accountTypes)), ",") + `) ORDER BY id;`
+	args := make([]any, 0, len(accountTypes))
+	for _, accountType := range accountTypes {
+		args = append(args, accountType)
+	}
+	rows, err := GlobalDB.Query(sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var accounts = make([]string, 0)
+	for rows.Next() {
+		var account string
+		if err = rows.Scan(&account); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+// GetAccountType returns the type of an account, accounts never given a type are depå accounts
+func GetAccountType(account string) (AccountType, error) {
+	var accountType AccountType
+	err := GlobalDB.QueryRow(`SELECT account_type FROM accounts WHERE id = ?;`, account).Scan(&accountType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DEPA_ACCOUNT, nil
+	}
+	return accountType, err
+}
+
+// GetAccountCashFlows returns the transactions of a type booked on an account in [from, to), with
+// their settlement date, amount and currency
+func GetAccountCashFlows(account string, transactionType TransactionType, from time.Time, to time.Time) ([]Transaction, error) {
+	rows, err := GlobalDB.Query(`
+	SELECT settlement_date, total_amount, currency
+	FROM transactions
+	WHERE account = ? AND transaction_type = ? AND settlement_date >= ? AND settlement_date < ?
+	ORDER BY settlement_date ASC, id ASC;
+	`, account, transactionType, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results = make([]Transaction, 0)
+	for rows.Next() {
+		transaction := Transaction{AccountID: account, TransactionType: transactionType}
+		if err = rows.Scan(&transaction.SettlementDate, scanField(&transaction.TotalAmount, AMOUNT_FIELD), &transaction.Currency); err != nil {
+			return nil, err
+		}
+		results = append(results, transaction)
+	}
+	return results, rows.Err()
+}
+
+// GetAccountMarkedValue returns the value of an account's latest marks in the week up to date,
+// per currency, and the date of those marks. Without marks the date is nil.
+func GetAccountMarkedValue(account string, date time.Time) (map[CurrencyUnit]*decimal.Big, *time.Time, error) {
+	var markDate time.Time
+	err := GlobalDB.QueryRow(`
+	SELECT market_mark_date
+	FROM market_marks
+	WHERE account = ? AND market_mark_date <= ? AND market_mark_date > ? AND superseded_date IS NULL
+	ORDER BY market_mark_date DESC
+	LIMIT 1;
+	`, account, date, date.AddDate(0, 0, -7)).Scan(&markDate)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := GlobalDB.Query(`
+	SELECT marked_shares, marked_value_per_share, marked_value_currency
+	FROM market_marks
+	WHERE account = ? AND market_mark_date = ? AND superseded_date IS NULL;
+	`, account, markDate)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	values := make(map[CurrencyUnit]*decimal.Big)
+	for rows.Next() {
+		var shares, valuePerShare *decimal.Big
+		var currency CurrencyUnit
+		if err = rows.Scan(scanField(&shares, QUANTITY_FIELD), scanField(&valuePerShare, PRICE_FIELD), &currency); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := values[currency]; !ok {
+			values[currency] = decimal.New(0, 4)
+		}
+		value := AMOUNT_FIELD.Round(decimal.New(0, 4).Mul(shares, valuePerShare))
+		values[currency].Add(values[currency], value)
+	}
+	return values, &markDate, rows.Err()
+}
+
+/**
+ISK DATA ACCESS
+*/
+
+// GetISKRate returns the ISK/KF rate inputs of a year
+func GetISKRate(year int) (ISKRate, error) {
+	rate := ISKRate{Year: year}
+	err := GlobalDB.QueryRow(`
+	SELECT government_bond_rate, tax_free_amount FROM isk_rates WHERE year = ?;
+	`, year).Scan(scanFixed(&rate.GovernmentBondRate), scanFixed(&rate.TaxFreeAmount))
+	if err != nil {
+		return rate, err
+	}
+	return rate, nil
+}
+
+// GetISKRates returns every stored ISK/KF rate year
+func GetISKRates() ([]ISKRate, error) {
+	rows, err := GlobalDB.Query(`SELECT year, government_bond_rate, tax_free_amount FROM isk_rates ORDER BY year;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rates = make([]ISKRate, 0)
+	for rows.Next() {
+		var rate ISKRate
+		if err = rows.Scan(&rate.Year, scanFixed(&rate.GovernmentBondRate), scanFixed(&rate.TaxFreeAmount)); err != nil {
+			return nil, err
+		}
+		rates = append(rates, rate)
+	}
+	return rates, rows.Err()
+}
+
+// SetISKRate stores the ISK/KF rate inputs of a year, replacing earlier values
+func SetISKRate(rate ISKRate) error {
+	_, err := GlobalDB.Exec(`
+	INSERT INTO isk_rates (year, government_bond_rate, tax_free_amount) VALUES (?, ?, ?)
+	ON CONFLICT (year) DO UPDATE SET
+		government_bond_rate = excluded.government_bond_rate,
+		tax_free_amount = excluded.tax_free_amount;
+	`, rate.Year, fixed(rate.GovernmentBondRate), fixed(rate.TaxFreeAmount))
+	return err
+}
+
+/**
+PRICE DATA ACCESS
+*/
+
+// UpsertPrice stores a price, replacing the one from the same source on that date
+func UpsertPrice(price Price, tx *sql.Tx) error {
+	query := `
+	INSERT INTO prices (security_id, price_date, price, currency, source, created_date) VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT (security_id, price_date, source) DO UPDATE SET
+		price = excluded.price,
+		currency = excluded.currency,
+		created_date = excluded.created_date;
+	`
+	value := fieldFixed(PRICE_FIELD.Round(decimal.New(0, 4).Copy(price.Price)), PRICE_FIELD)
+	args := []any{price.SecurityID, dateOnly(price.Date), value, price.Currency, price.Source, time.Now().UTC()}
+	var err error
+	if tx == nil {
+		_, err = GlobalDB.Exec(query, args...)
+	} else {
+		_, err = tx.Exec(query, args...)
+	}
+	return err
+}
+
+// GetStoredPrice returns the price of a security on a date. Manual prices win over
+// imported ones, and both win over fetched ones. A nil tx reads outside any transaction.
+func GetStoredPrice(securityID string, date time.Time, tx *sql.Tx) (Price, error) {
+	var db queryer = GlobalDB
+	if tx != nil {
+		db = tx
+	}
+	price := Price{SecurityID: securityID}
+	err := db.QueryRow(`
+	SELECT price_date, price, currency, source
+	FROM prices
+	WHERE security_id = ? AND price_date = ?
+	ORDER BY CASE source WHEN 'manual' THEN 0 WHEN 'import' THEN 1 ELSE 2 END
+	LIMIT 1;
+	`, securityID, dateOnly(date)).Scan(&price.Date, scanField(&price.Price, PRICE_FIELD), &price.Currency, &price.Source)
+	if err != nil {
+		return price, err
+	}
+	return price, nil
+}
+
+// GetLatestStoredPrice returns the latest price of a security between two dates, inclusive,
+// preferring manual and imported prices on the same date. A nil tx reads outside any transaction.
+func GetLatestStoredPrice(securityID string, from time.Time, to time.Time, tx *sql.Tx) (Price, error) {
+	var db queryer = GlobalDB
+	if tx != nil {
+		db = tx
+	}
+	price := Price{SecurityID: securityID}
+	err := db.QueryRow(`
+	SELECT price_date, price, currency, source
+	FROM prices
+	WHERE security_id = ? AND price_date BETWEEN ? AND ?
+	ORDER BY price_date DESC, CASE source WHEN 'manual' THEN 0 WHEN 'import' THEN 1 ELSE 2 END
+	LIMIT 1;
+	`, securityID, dateOnly(from), dateOnly(to)).Scan(&price.Date, scanField(&price.Price, PRICE_FIELD), &price.Currency, &price.Source)
+	if err != nil {
+		return price, err
+	}
+	return price, nil
+}
+
+// GetLastKnownPrice returns the latest price of a security before a date. Stored prices are
+// used first, then the latest mark of any lot of the security.
+func GetLastKnownPrice(securityID string, date time.Time, tx *sql.Tx) (Price, error) {
+	price := Price{SecurityID: securityID}
+	err := tx.QueryRow(`
+	SELECT price_date, price, currency, source
+	FROM prices
+	WHERE security_id = ? AND price_date < ?
+	ORDER BY price_date DESC, CASE source WHEN 'manual' THEN 0 WHEN 'import' THEN 1 ELSE 2 END
+	LIMIT 1;
+	`, securityID, dateOnly(date)).Scan(&price.Date, scanField(&price.Price, PRICE_FIELD), &price.Currency, &price.Source)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = tx.QueryRow(`
+		SELECT m.market_mark_date, m.marked_value_per_share, m.marked_value_currency
+		FROM market_marks m JOIN asset_lots l ON l.id = m.asset_lot_id
+		WHERE l.security_id = ? AND m.market_mark_date < ? AND m.superseded_date IS NULL
+		ORDER BY m.market_mark_date DESC
+		LIMIT 1;
+		`, securityID, dateOnly(date)).Scan(&price.Date, scanField(&price.Price, PRICE_FIELD), &price.Currency)
+	}
+	if err != nil {
+		return price, err
+	}
+	return price, nil
+}
+
+/**
+TRANSACTION DATA ACCESS
+*/
+
+// executedColumns returns the instrument currency, amount and executed rate to store, NULL
+// for trades booked in their own currency
+func (t Transaction) executedColumns() (any, any, any) {
+	if t.ExecutedFX() == nil {
+		return nil, nil, nil
+	}
+	var amount any
+	if t.InstrumentAmount != nil {
+		amount = fieldFixed(AMOUNT_FIELD.Round(decimal.New(0, 4).Copy(t.InstrumentAmount)), AMOUNT_FIELD)
+	}
+	return t.InstrumentCurrency, amount, fieldFixed(RATE_FIELD.Round(decimal.New(0, 4).Copy(t.ExecutedFXRate)), RATE_FIELD)
+}
+
+func (t *Transaction) setExecutedColumns(currency sql.NullString, amount sql.NullInt64, rate sql.NullInt64) {
+	if currency.Valid {
+		t.InstrumentCurrency = CurrencyUnit(currency.String)
+	}
+	if amount.Valid {
+		t.InstrumentAmount = decimal.New(amount.Int64, AMOUNT_FIELD.Places())
+	}
+	if rate.Valid {
+		t.ExecutedFXRate = decimal.New(rate.Int64, RATE_FIELD.Places())
+	}
+}
+
+// GetTransactionBetweenDate returns a transaction when given a date range
+func GetTransactionBetweenDate(startDate time.Time, endDate time.Time) ([]Transaction, error) {
+	query := `
+	SELECT
+		id, account, transaction_reference, transaction_type, settlement_date, symbol,
+		COALESCE(share_lot, ''), shares, price_per_share, share_value, fees_amount,
+		total_amount, currency, instrument_currency, instrument_amount, executed_fx_rate
+	FROM transactions
+	WHERE settlement_date BETWEEN ? AND ?;
+	`
+	rows, err := GlobalDB.Query(query, startDate, endDate)
+	if err != nil {
+		return nil, err
+	}
+	var transactions []Transaction
+	for rows.Next() {
+		var transaction Transaction
+		var instrumentCurrency sql.NullString
+		var instrumentAmount, executedFXRate sql.NullInt64
+		err := rows.Scan(
+			&transaction.ID,
+			&transaction.AccountID,
+			&transaction.TransactionReference,
+			&transaction.TransactionType,
+			&transaction.SettlementDate,
+			&transaction.Symbol,
+			&transaction.ShareLot,
+			scanField(&transaction.Shares, QUANTITY_FIELD),
+			scanField(&transaction.PricePerShare, PRICE_FIELD),
+			scanField(&transaction.ShareValue, AMOUNT_FIELD),
+			scanField(&transaction.FeesAmount, AMOUNT_FIELD),
+			scanField(&transaction.TotalAmount, AMOUNT_FIELD),
+			&transaction.Currency,
+			&instrumentCurrency,
+			&instrumentAmount,
+			&executedFXRate,
+		)
+		transaction.setExecutedColumns(instrumentCurrency, instrumentAmount, executedFXRate)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, transaction)
+	}
+	return transactions, err
+}
+
+// GetTransactionById returns a transaction when given a transaction id
+func GetTransactionById(id int) (Transaction, error) {
+	query := `
+	SELECT
+		id, account, transaction_reference, transaction_type, settlement_date, symbol,
+		COALESCE(share_lot, ''), shares, price_per_share, share_value, fees_amount,
+		total_amount, currency, instrument_currency, instrument_amount, executed_fx_rate
+	FROM transactions
+	WHERE id = ?;
+	`
+	row := GlobalDB.QueryRow(query, id)
+	var transaction Transaction
+	var instrumentCurrency sql.NullString
+	var instrumentAmount, executedFXRate sql.NullInt64
+	err := row.Scan(
+		&transaction.ID,
+		&transaction.AccountID,
+		&transaction.TransactionReference,
+		&transaction.TransactionType,
+		&transaction.SettlementDate,
+		&transaction.Symbol,
+		&transaction.ShareLot,
+		scanField(&transaction.Shares, QUANTITY_FIELD),
+		scanField(&transaction.PricePerShare, PRICE_FIELD),
+		scanField(&transaction.ShareValue, AMOUNT_FIELD),
+		scanField(&transaction.FeesAmount, AMOUNT_FIELD),
+		scanField(&transaction.TotalAmount, AMOUNT_FIELD),
+		&transaction.Currency,
+		&instrumentCurrency,
+		&instrumentAmount,
+		&executedFXRate,
+	)
+	transaction.setExecutedColumns(instrumentCurrency, instrumentAmount, executedFXRate)
+	if err != nil {
+		transaction.ID = -1
+		return transaction, err
+	}
+	return transaction, err
+}
+
+// InsertTransaction inserts a transaction record and then returns the resulting id
+func InsertTransaction(transaction Transaction, tx *sql.Tx) (int, error) {
+	sql := `
+	INSERT INTO transactions (
+		account, transaction_reference, transaction_type, settlement_date, symbol,
+		share_lot, shares, price_per_share, share_value, fees_amount,
+		total_amount, currency, instrument_currency, instrument_amount, executed_fx_rate
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`
+	immediateCommit := false
+	var err error
+	if tx == nil {
+		immediateCommit = true
+		tx, err = GlobalDB.Begin()
+		if err != nil {
+			return -1, err
+		}
+	}
+	shares := fieldFixed(transaction.Shares, QUANTITY_FIELD)
+	pricePerShare := fieldFixed(transaction.PricePerShare, PRICE_FIELD)
+	shareValue := fieldFixed(transaction.ShareValue, AMOUNT_FIELD)
+	feesAmount := fieldFixed(transaction.FeesAmount, AMOUNT_FIELD)
+	totalAmount := fieldFixed(transaction.TotalAmount, AMOUNT_FIELD)
+	instrumentCurrency, instrumentAmount, executedFXRate := transaction.executedColumns()
+	result, err := tx.Exec(sql, transaction.AccountID, transaction.TransactionReference, transaction.TransactionType, transaction.SettlementDate,
+		transaction.Symbol, nullString(transaction.ShareLot), shares, pricePerShare, shareValue, feesAmount,
+		totalAmount, transaction.Currency, instrumentCurrency, instrumentAmount, executedFXRate)
+	if err != nil {
+		if immediateCommit {
+			tx.Rollback()
+		}
+		return -1, err
+	}
+	lastId, err := result.LastInsertId()
+	if immediateCommit {
+		err = tx.Commit()
+		if err != nil {
+			return -1, err
+		}
+	}
+	return int(lastId), err
+}
+
+// UpdateRates seeds the supported currencies and their yearly rates. Seeding again
+// leaves the stored rates as they are.
+func UpdateRates() error {
+	return ensureCurrencyRates()
+}
+
+/**
+CURRENCY RATE DATA ACCESS
+*/
+
+// UpsertCurrencyRate stores a rate, replacing the one of the same currency, base, date and source.
+// A nil tx writes outside any transaction.
+func UpsertCurrencyRate(rate CurrencyRate, tx *sql.Tx) error {
+	query := `
+	INSERT INTO currency_rates (currency_code, rate, as_of_date, source, base_currency) VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT (currency_code, base_currency, as_of_date, source) DO UPDATE SET rate = excluded.rate;
+	`
+	base := rate.Base
+	if base == "" {
+		base = USD
+	}
+	value := fieldFixed(RATE_FIELD.Round(decimal.New(0, 4).Copy(rate.Rate)), RATE_FIELD)
+	args := []any{rate.Currency, value, dateOnly(rate.Date), rate.Source, base}
+	var err error
+	if tx == nil {
+		_, err = GlobalDB.Exec(query, args...)
+	} else {
+		_, err = tx.Exec(query, args...)
+	}
+	return err
+}
+
+// GetCurrencyRates returns the stored rates of a currency by date
+func GetCurrencyRates(currency CurrencyUnit) ([]CurrencyRate, error) {
+	rows, err := GlobalDB.Query(`
+	SELECT as_of_date, rate, source, base_currency FROM currency_rates WHERE currency_code = ? ORDER BY as_of_date, source;
+	`, currency)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rates := make([]CurrencyRate, 0)
+	for rows.Next() {
+		rate := CurrencyRate{Currency: currency}
+		if err = rows.Scan(&rate.Date, scanField(&rate.Rate, RATE_FIELD), &rate.Source, &rate.Base); err != nil {
+			return nil, err
+		}
+		rates = append(rates, rate)
+	}
+	return rates, rows.Err()
+}
+
+// GetSupportedCurrencies returns the codes in supported_currencies
+func GetSupportedCurrencies() ([]CurrencyUnit, error) {
+	rows, err := GlobalDB.Query(`SELECT id FROM supported_currencies ORDER BY id;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	currencies := make([]CurrencyUnit, 0)
+	for rows.Next() {
+		var currency string
+		if err = rows.Scan(&currency); err != nil {
+			return nil, err
+		}
+		currencies = append(currencies, CurrencyUnit(currency))
+	}
+	return currencies, rows.Err()
+}
+
+// GetCurrencies returns the supported currencies with their names and number formats.
+// A nil tx reads outside any transaction.
+func GetCurrencies(tx *sql.Tx) ([]Currency, error) {
+	var db queryer = GlobalDB
+	if tx != nil {
+		db = tx
+	}
+	rows, err := db.Query(`SELECT id, name, locale FROM supported_currencies ORDER BY id;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	currencies := make([]Currency, 0)
+	for rows.Next() {
+		var currency Currency
+		if err = rows.Scan(&currency.Code, &currency.Name, &currency.Locale); err != nil {
+			return nil, err
+		}
+		currencies = append(currencies, currency)
+	}
+	return currencies, rows.Err()
+}
+
+// UpsertCurrency adds a supported currency or changes its name and number format
+func UpsertCurrency(currency Currency) error {
+	_, err := GlobalDB.Exec(`
+	INSERT INTO supported_currencies (id, name, locale) VALUES (?, ?, ?)
+	ON CONFLICT (id) DO UPDATE SET name = excluded.name, locale = excluded.locale;
+	`, currency.Code, currency.Name, currency.Locale)
+	return err
+}
+
+/*
+*
+
+	INITIALIZATION
+*/
+// retypeCostBasisColumns rebuilds a lot table with create when its cost_basis_per_share column
+// isn't BIGINT.
+func retypeCostBasisColumns(tx *sql.Tx, table string, create string) error {
+	columns, err := tableColumns(tx, table)
+	if err != nil {
+		return err
+	}
+	retype := false
+	for _, column := range columns {
+		if column.Name == "cost_basis_per_share" && !strings.EqualFold(column.Type, "BIGINT") {
+			retype = true
+		}
+	}
+	if !retype {
+		return nil
+	}
+
+	var invalid int
+	err = tx.QueryRow(fmt.Sprintf(`
+		SELECT COUNT(*) FROM %q
+		WHERE cost_basis_per_share IS NOT NULL AND CAST(CAST(cost_basis_per_share AS INTEGER) AS TEXT) != TRIM(cost_basis_per_share);
+	`, table)).Scan(&invalid)
+	if err != nil {
+		return err
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%w: %d rows of %s have a cost basis per share that isn't an integer", ErrFixedScan, invalid, table)
+	}
+	return rebuildTable(tx, table, create, map[string]string{
+		"cost_basis_per_share": "CAST(TRIM(cost_basis_per_share) AS INTEGER)",
+		"cost_basis_currency":  "UPPER(TRIM(CAST(cost_basis_currency AS TEXT)))",
+	})
+}
+
+// LedgerPath is the ledger OpenDB opens, main resolves it with ResolveLedger
+var LedgerPath = DEFAULT_LEDGER
+
+// openedLedgerPath is the file GlobalDB was opened from
+var openedLedgerPath string
+
+var ErrLedgerNotFound = errors.New("ledger not found, create it with `init` or choose another with --ledger or --profile")
+
+// OpenDB opens LedgerPath without migrating it, see InitializeDB
+func OpenDB() error {
+	return openDB(false)
+}
+
+// openDB opens LedgerPath, which only create makes when it doesn't exist. Tests open a
+// test_ledger.db of their own unless they point LedgerPath elsewhere.
+func openDB(create bool) error {
+	openedLedgerPath = LedgerPath
+	if flag.Lookup("test.v") != nil && LedgerPath == DEFAULT_LEDGER {
+		openedLedgerPath = "test_" + DEFAULT_LEDGER
+	} else if _, err := os.Stat(openedLedgerPath); errors.Is(err, fs.ErrNotExist) {
+		if !create {
+			return fmt.Errorf("%w: %s", ErrLedgerNotFound, openedLedgerPath)
+		}
+		if err = os.MkdirAll(filepath.Dir(openedLedgerPath), 0o755); err != nil {
+			return err
+		}
+	}
+	var err error
+	// Every connection enforces the foreign keys, migrations turn them off on theirs.
+	GlobalDB, err = sql.Open("sqlite3", openedLedgerPath+"?_foreign_keys=on")
+	return err
+}
+
+// InitializeDB opens the ledger and applies the migrations it is missing
+func InitializeDB() {
+	if err := OpenDB(); err != nil {
+		ErrLogger.Fatal(err)
+	}
+	if err := migrateOpenedDB(); err != nil {
+		ErrLogger.Fatal(err)
+	}
+}
+
+// CreateDB creates the ledger at LedgerPath with its directory, or opens it when it exists,
+// and migrates it
+func CreateDB() error {
+	if err := openDB(true); err != nil {
+		return err
+	}
+	return migrateOpenedDB()
+}
+
+func migrateOpenedDB() error {
+	applied, backup, err := MigrateDB()
+	if backup != "" {
+		InfoLogger.Printf("backed up %s to %s before migrating\n", openedLedgerPath, backup)
+	}
+	for _, migration := range applied {
+		InfoLogger.Printf("applied migration %d %s\n", migration.Version, migration.Name)
+	}
+	if err != nil {
+		return err
 	}
-	createTables()
+	return loadFieldPlaces(GlobalDB)
 }
@@ -0,0 +1,756 @@
+package internal
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ericlagergren/decimal"
+)
+
+var (
+	ErrUnsupportedReportFormat = errors.New("unsupported report format")
+	ErrExDividendDateMissing   = errors.New("no ex-dividend date recorded")
+	ErrInvalidExDividendDate   = errors.New("invalid ex-dividend date")
+)
+
+const (
+	ORDINARY_DIVIDEND_CLASS     = "ORDINARY"
+	QUALIFIED_DIVIDEND_CLASS    = "QUALIFIED"
+	CAPITAL_GAIN_DIVIDEND_CLASS = "CAPITAL_GAIN_DISTRIBUTION"
+)
+
+// Dividends must be held more than 60 days of the 121 day period that begins
+// 60 days before the ex-dividend date to be qualified.
+const (
+	dividendHoldingWindowDays  = 60
+	dividendHoldingMinimumDays = 61
+)
+
+/*
+qualifiedForeignCorporationCountries are the ISIN country prefixes of countries
+with a comprehensive US income tax treaty that has an exchange of information
+program (IRS Notice 2011-64), plus US possessions. Dividends from corporations
+organized elsewhere are ordinary unless the shares trade on a US exchange.
+Hungary's treaty ended in 2024 and Russia's is suspended, so both are left out.
+*/
+var qualifiedForeignCorporationCountries = map[string]bool{
+	"US": true, "PR": true, "GU": true, "VI": true, "AS": true, "MP": true,
+	"AU": true, "AT": true, "BD": true, "BB": true, "BE": true, "BG": true,
+	"CA": true, "CN": true, "CY": true, "CZ": true, "DK": true, "EG": true,
+	"EE": true, "FI": true, "FR": true, "DE": true, "GR": true, "IS": true,
+	"IN": true, "ID": true, "IE": true, "IL": true, "IT": true, "JM": true,
+	"JP": true, "KZ": true, "KR": true, "LV": true, "LT": true, "LU": true,
+	"MT": true, "MX": true, "MA": true, "NL": true, "NZ": true, "NO": true,
+	"PK": true, "PH": true, "PL": true, "PT": true, "RO": true, "SK": true,
+	"SI": true, "ZA": true, "ES": true, "LK": true, "SE": true, "CH": true,
+	"TH": true, "TT": true, "TN": true, "TR": true, "UA": true, "GB": true,
+	"VE": true,
+}
+
+/*
+DividendPayment is a single income transaction with the withholding booked
+against the same account, security and settlement date. A partially qualified
+dividend is split into a qualified and an ordinary payment.
+*/
+type DividendPayment struct {
+	TransactionID   int             `json:"transaction_id"`
+	TransactionType TransactionType `json:"-"`
+	AccountID       string          `json:"account"`
+	Symbol          string          `json:"symbol"`
+	PaymentDate     time.Time       `json:"payment_date"`
+	PayerCountry    string          `json:"payer_country"`
+	Classification  string          `json:"classification"`
+	Reason          string          `json:"reason"`
+	Currency        CurrencyUnit    `json:"currency"`
+	Gross           *decimal.Big    `json:"gross"`
+	Withholding     *decimal.Big    `json:"withholding"`
+}
+
+type DividendReportRow struct {
+	Account        string       `json:"account"`
+	Symbol         string       `json:"symbol"`
+	PayerCountry   string       `json:"payer_country"`
+	Classification string       `json:"classification"`
+	Currency       CurrencyUnit `json:"currency"`
+	Payments       int          `json:"payments"`
+	Gross          *decimal.Big `json:"gross"`
+	Withholding    *decimal.Big `json:"withholding"`
+	Net            *decimal.Big `json:"net"`
+
+	// USD converted per payment at the rate of the payment date, with the policy of the USD column.
+	GrossUSD       *decimal.Big `json:"gross_usd"`
+	WithholdingUSD *decimal.Big `json:"withholding_usd"`
+	NetUSD         *decimal.Big `json:"net_usd"`
+
+	// USD converted at one rate for the year, with the policy of the USD Yearly Average column.
+	YearlyAverageRate     *decimal.Big `json:"yearly_average_rate"`
+	GrossUSDAverage       *decimal.Big `json:"gross_usd_average"`
+	WithholdingUSDAverage *decimal.Big `json:"withholding_usd_average"`
+	NetUSDAverage         *decimal.Big `json:"net_usd_average"`
+}
+
+// Form1099DivTotals are the USD totals of the Form 1099-DIV boxes the ledger can fill in.
+// Withholding on US payers is federal tax withheld, anything else is foreign tax paid.
+type Form1099DivTotals struct {
+	TotalOrdinaryDividends   *decimal.Big `json:"box_1a_total_ordinary_dividends"`
+	QualifiedDividends       *decimal.Big `json:"box_1b_qualified_dividends"`
+	CapitalGainDistributions *decimal.Big `json:"box_2a_total_capital_gain_distributions"`
+	FederalTaxWithheld       *decimal.Big `json:"box_4_federal_income_tax_withheld"`
+	ForeignTaxPaid           *decimal.Big `json:"box_7_foreign_tax_paid"`
+}
+
+type DividendReport struct {
+	Year                int                 `json:"year"`
+	Rows                []DividendReportRow `json:"rows"`
+	Totals              Form1099DivTotals   `json:"totals_usd"`
+	TotalsYearlyAverage Form1099DivTotals   `json:"totals_usd_yearly_average"`
+	Payments            []DividendPayment   `json:"payments"`
+	FX                  []FXColumn          `json:"fx"`
+}
+
+func dividendClassification(t TransactionType) (string, bool) {
+	switch t {
+	case DIVIDEND:
+		return ORDINARY_DIVIDEND_CLASS, true
+	case QUALIFIED_DIVIDEND:
+		return QUALIFIED_DIVIDEND_CLASS, true
+	case CAPITAL_GAIN_DISTRIBUTION:
+		return CAPITAL_GAIN_DIVIDEND_CLASS, true
+	}
+	return "", false
+}
+
+/*
+GetDividendPayments loads the income transactions settled in year and attaches
+withholding tax rows by account, symbol and settlement date. Withholding without
+a matching payment is reported as an ordinary dividend with no gross amount so it
+isn't lost.
+*/
+func GetDividendPayments(year int, accountNumber string) ([]DividendPayment, error) {
+	from := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(1, 0, 0)
+	query := `
+	SELECT id, account, symbol, settlement_date, transaction_type, total_amount, currency
+	FROM transactions
+	WHERE transaction_type IN (?, ?, ?, ?)
+		AND settlement_date >= ? AND settlement_date < ?
+	`
+	args := []any{DIVIDEND, QUALIFIED_DIVIDEND, CAPITAL_GAIN_DISTRIBUTION, WITHHOLDING_TAX, from, to}
+	if accountNumber != "" {
+		query += " AND account = ?"
+		args = append(args, accountNumber)
+	}
+	query += " ORDER BY settlement_date ASC, id ASC;"
+
+	rows, err := GlobalDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []DividendPayment
+	var withholdings []DividendPayment
+	for rows.Next() {
+		var payment DividendPayment
+		var transactionType int64
+		var totalAmount *decimal.Big
+		var currency string
+		if err := rows.Scan(&payment.TransactionID, &payment.AccountID, &payment.Symbol, &payment.PaymentDate, &transactionType, scanField(&totalAmount, AMOUNT_FIELD), &currency); err != nil {
+			return nil, err
+		}
+		payment.TransactionType = TransactionType(transactionType)
+		payment.Currency = CurrencyUnit(strings.ToUpper(strings.TrimSpace(currency)))
+		if payment.TransactionType == WITHHOLDING_TAX {
+			payment.Classification = ORDINARY_DIVIDEND_CLASS
+			payment.Reason = "withholding without a matching dividend"
+			payment.Gross = decimal.New(0, 4)
+			payment.Withholding = totalAmount
+			withholdings = append(withholdings, payment)
+			continue
+		}
+		payment.Classification, _ = dividendClassification(payment.TransactionType)
+		payment.Gross = totalAmount
+		payment.Withholding = decimal.New(0, 4)
+		payments = append(payments, payment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	paymentKey := func(p DividendPayment) string {
+		return p.AccountID + "|" + p.Symbol + "|" + p.PaymentDate.Format(time.DateOnly)
+	}
+	byKey := make(map[string]int)
+	for i, p := range payments {
+		if _, ok := byKey[paymentKey(p)]; !ok {
+			byKey[paymentKey(p)] = i
+		}
+	}
+	for _, w := range withholdings {
+		if i, ok := byKey[paymentKey(w)]; ok {
+			payments[i].Withholding.Add(payments[i].Withholding, w.Withholding)
+			continue
+		}
+		InfoLogger.Printf("withholding on %s for %s has no matching dividend\n", w.PaymentDate.Format(time.DateOnly), w.Symbol)
+		payments = append(payments, w)
+	}
+	return payments, nil
+}
+
+func dateOnly(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func lotSharesAsOf(history []AssetLotShares, date time.Time) *decimal.Big {
+	shares := decimal.New(0, 4)
+	for _, change := range history {
+		if dateOnly(change.AsOfDate).After(date) {
+			break
+		}
+		shares = change.Shares
+	}
+	return shares
+}
+
+/*
+QualifyingDividendShares runs the holding period test for one lot. eligible is
+the number of shares the lot held going into exDate, qualifying is how many of
+them were held more than 60 days of the 121 day period that begins 60 days
+before exDate. The acquisition day doesn't count towards the holding period,
+the disposal day does.
+*/
+func QualifyingDividendShares(acquired time.Time, history []AssetLotShares, exDate time.Time) (eligible *decimal.Big, qualifying *decimal.Big) {
+	acquired = dateOnly(acquired)
+	exDate = dateOnly(exDate)
+	eligible = lotSharesAsOf(history, exDate.AddDate(0, 0, -1))
+	qualifying = decimal.New(0, 4)
+	if eligible.Sign() <= 0 {
+		return eligible, qualifying
+	}
+
+	// Shares held on each day of the window, as of the end of the previous day.
+	levels := make([]*decimal.Big, 0, 2*dividendHoldingWindowDays+1)
+	for d := exDate.AddDate(0, 0, -dividendHoldingWindowDays); !d.After(exDate.AddDate(0, 0, dividendHoldingWindowDays)); d = d.AddDate(0, 0, 1) {
+		if !d.After(acquired) {
+			levels = append(levels, decimal.New(0, 4))
+			continue
+		}
+		levels = append(levels, lotSharesAsOf(history, d.AddDate(0, 0, -1)))
+	}
+
+	// The largest share count held on enough days, capped at the eligible shares.
+	candidates := append([]*decimal.Big{eligible}, levels...)
+	for _, candidate := range candidates {
+		if candidate.Sign() <= 0 || candidate.Cmp(eligible) > 0 || candidate.Cmp(qualifying) <= 0 {
+			continue
+		}
+		days := 0
+		for _, level := range levels {
+			if level.Cmp(candidate) >= 0 {
+				days++
+			}
+		}
+		if days >= dividendHoldingMinimumDays {
+			qualifying = candidate
+		}
+	}
+	return eligible, qualifying
+}
+
+func payerCountry(isin string, currency CurrencyUnit) string {
+	isin = strings.ToUpper(strings.TrimSpace(isin))
+	if len(isin) >= 2 {
+		return isin[:2]
+	}
+	// E*TRADE rows carry no ISIN and only hold US listed securities.
+	if currency == USD {
+		return "US"
+	}
+	return ""
+}
+
+/*
+ClassifyDividend decides how much of a dividend is qualified. Dividends the broker
+already reports as qualified are kept as such. Otherwise the payer must be a US
+or treaty country corporation, and the shares must pass the holding period test
+against the lot history, counted from the ex-dividend date recorded for the payment.
+Exports carry no ex-dividend dates, a payment without one is ordinary until it is
+recorded.
+*/
+func ClassifyDividend(payment DividendPayment) (DividendClassification, error) {
+	classification := DividendClassification{
+		TransactionID:   payment.TransactionID,
+		QualifiedAmount: decimal.New(0, 4),
+	}
+	lots, err := GetAssetLotsForSecurityHeldBefore(payment.AccountID, payment.Symbol, payment.PaymentDate)
+	if err != nil {
+		return classification, err
+	}
+	isin := ""
+	for _, lot := range lots {
+		if lot.ISIN != "" {
+			isin = lot.ISIN
+			break
+		}
+	}
+	classification.PayerCountry = payerCountry(isin, payment.Currency)
+
+	if len(lots) > 0 {
+		security, err := GetSecurityByAssetLot(lots[0].ID, nil)
+		if err != nil && !errors.Is(err, ErrSecurityNotFound) {
+			return classification, err
+		}
+		if security.PFIC {
+			classification.Reason = fmt.Sprintf("%s is flagged as a PFIC", security.ID)
+			return classification, nil
+		}
+	}
+
+	if payment.TransactionType == QUALIFIED_DIVIDEND {
+		classification.Qualified = true
+		classification.QualifiedAmount = decimal.New(0, 4).Copy(payment.Gross)
+		classification.Reason = "reported as qualified by the broker"
+		return classification, nil
+	}
+	if classification.PayerCountry == "" {
+		classification.Reason = "payer country unknown, no ISIN on the lots"
+		return classification, nil
+	}
+	if !qualifiedForeignCorporationCountries[classification.PayerCountry] {
+		classification.Reason = fmt.Sprintf("payer country %s has no qualifying US income tax treaty", classification.PayerCountry)
+		return classification, nil
+	}
+
+	exDate, err := GetExDividendDate(payment.Symbol, payment.PaymentDate)
+	if errors.Is(err, ErrExDividendDateMissing) {
+		InfoLogger.Printf("%s paid on %s has no ex-dividend date, reporting it as ordinary\n",
+			payment.Symbol, payment.PaymentDate.Format(time.DateOnly))
+		classification.Reason = fmt.Sprintf("no ex-dividend date recorded, add it with `dividends ex-date set --symbol %s --paid %s --ex-date DATE`",
+			payment.Symbol, payment.PaymentDate.Format(time.DateOnly))
+		return classification, nil
+	}
+	if err != nil {
+		return classification, err
+	}
+
+	eligible := decimal.New(0, 4)
+	qualifying := decimal.New(0, 4)
+	for _, lot := range lots {
+		history, err := GetAssetLotShareHistory(lot.ID)
+		if err != nil {
+			return classification, err
+		}
+		lotEligible, lotQualifying := QualifyingDividendShares(lot.CreatedDate, history, exDate)
+		eligible.Add(eligible, lotEligible)
+		qualifying.Add(qualifying, lotQualifying)
+	}
+	if eligible.Sign() <= 0 {
+		classification.Reason = fmt.Sprintf("no shares held going into the ex-dividend date %s", exDate.Format(time.DateOnly))
+		return classification, nil
+	}
+	classification.Reason = fmt.Sprintf("%s of %s shares held more than 60 days of the 121 days around the ex-dividend date %s",
+		qualifying, eligible, exDate.Format(time.DateOnly))
+	if qualifying.Sign() <= 0 {
+		return classification, nil
+	}
+	classification.Qualified = true
+	if qualifying.Cmp(eligible) >= 0 {
+		classification.QualifiedAmount.Copy(payment.Gross)
+		return classification, nil
+	}
+	classification.QualifiedAmount.Mul(payment.Gross, qualifying)
+	AMOUNT_FIELD.Round(classification.QualifiedAmount.Quo(classification.QualifiedAmount, eligible))
+	return classification, nil
+}
+
+/*
+classifyDividendPayments classifies every dividend without recording it. Partially
+qualified dividends are split in two, with the withholding spread pro rata.
+*/
+func classifyDividendPayments(payments []DividendPayment) ([]DividendPayment, []DividendClassification, error) {
+	results := make([]DividendPayment, 0, len(payments))
+	classifications := make([]DividendClassification, 0, len(payments))
+	for _, payment := range payments {
+		if payment.TransactionType != DIVIDEND && payment.TransactionType != QUALIFIED_DIVIDEND {
+			lots, err := GetAssetLotsForSecurityHeldBefore(payment.AccountID, payment.Symbol, payment.PaymentDate)
+			if err != nil {
+				return nil, nil, err
+			}
+			isin := ""
+			if len(lots) > 0 {
+				isin = lots[0].ISIN
+			}
+			payment.PayerCountry = payerCountry(isin, payment.Currency)
+			results = append(results, payment)
+			continue
+		}
+		classification, err := ClassifyDividend(payment)
+		if err != nil {
+			return nil, nil, err
+		}
+		classifications = append(classifications, classification)
+		payment.PayerCountry = classification.PayerCountry
+		payment.Reason = classification.Reason
+		qualifiedAmount := classification.QualifiedAmount
+		switch {
+		case qualifiedAmount.Sign() <= 0:
+			payment.Classification = ORDINARY_DIVIDEND_CLASS
+			results = append(results, payment)
+		case qualifiedAmount.Cmp(payment.Gross) >= 0:
+			payment.Classification = QUALIFIED_DIVIDEND_CLASS
+			results = append(results, payment)
+		default:
+			qualified := payment
+			qualified.Classification = QUALIFIED_DIVIDEND_CLASS
+			qualified.Gross = decimal.New(0, 4).Copy(qualifiedAmount)
+			qualified.Withholding = decimal.New(0, 4).Mul(payment.Withholding, qualifiedAmount)
+			AMOUNT_FIELD.Round(qualified.Withholding.Quo(qualified.Withholding, payment.Gross))
+
+			ordinary := payment
+			ordinary.Classification = ORDINARY_DIVIDEND_CLASS
+			ordinary.Gross = decimal.New(0, 4).Sub(payment.Gross, qualified.Gross)
+			ordinary.Withholding = decimal.New(0, 4).Sub(payment.Withholding, qualified.Withholding)
+			results = append(results, qualified, ordinary)
+		}
+	}
+	return results, classifications, nil
+}
+
+// SaveDividendClassifications classifies the dividends of a year and records the outcomes in
+// dividend_classifications, replacing earlier ones. Returns the number of dividends recorded.
+func SaveDividendClassifications(year int, accountNumber string) (int, error) {
+	payments, err := GetDividendPayments(year, accountNumber)
+	if err != nil {
+		return 0, err
+	}
+	_, classifications, err := classifyDividendPayments(payments)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := GlobalDB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	for _, classification := range classifications {
+		if err := InsertDividendClassification(classification, tx); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(classifications), nil
+}
+
+func addOptional(total *decimal.Big, val *decimal.Big) *decimal.Big {
+	if total == nil || val == nil {
+		return nil
+	}
+	return total.Add(total, val)
+}
+
+func newForm1099DivTotals() Form1099DivTotals {
+	return Form1099DivTotals{
+		TotalOrdinaryDividends:   decimal.New(0, 4),
+		QualifiedDividends:       decimal.New(0, 4),
+		CapitalGainDistributions: decimal.New(0, 4),
+		FederalTaxWithheld:       decimal.New(0, 4),
+		ForeignTaxPaid:           decimal.New(0, 4),
+	}
+}
+
+func (totals *Form1099DivTotals) add(classification string, payerCountry string, gross *decimal.Big, withholding *decimal.Big) {
+	switch classification {
+	case CAPITAL_GAIN_DIVIDEND_CLASS:
+		totals.CapitalGainDistributions = addOptional(totals.CapitalGainDistributions, gross)
+	case QUALIFIED_DIVIDEND_CLASS:
+		totals.QualifiedDividends = addOptional(totals.QualifiedDividends, gross)
+		totals.TotalOrdinaryDividends = addOptional(totals.TotalOrdinaryDividends, gross)
+	default:
+		totals.TotalOrdinaryDividends = addOptional(totals.TotalOrdinaryDividends, gross)
+	}
+	if payerCountry == "US" {
+		totals.FederalTaxWithheld = addOptional(totals.FederalTaxWithheld, withholding)
+	} else {
+		totals.ForeignTaxPaid = addOptional(totals.ForeignTaxPaid, withholding)
+	}
+}
+
+// Columns converted to USD by the dividend report, and the policies they default to.
+const (
+	DIVIDEND_USD_COLUMN                = "USD"
+	DIVIDEND_USD_YEARLY_AVERAGE_COLUMN = "USD Yearly Average"
+)
+
+var dividendFXColumns = map[string]FXPolicy{
+	DIVIDEND_USD_COLUMN:                SPOT_FX_POLICY,
+	DIVIDEND_USD_YEARLY_AVERAGE_COLUMN: YEARLY_AVERAGE_FX_POLICY,
+}
+
+/*
+BuildDividendReport groups the payments of a year per account, security, currency
+and classification. USD amounts are converted per payment at the rate of the payment
+date (spot by default) and, as an alternative, at one rate for the whole year per
+payment currency (the yearly average by default). USD columns are left empty when
+no rate is available. The classifications are not recorded, see SaveDividendClassifications.
+*/
+func BuildDividendReport(year int, accountNumber string, policies FXPolicies) (DividendReport, error) {
+	report := DividendReport{
+		Year:                year,
+		Rows:                []DividendReportRow{},
+		Totals:              newForm1099DivTotals(),
+		TotalsYearlyAverage: newForm1099DivTotals(),
+	}
+	converter, err := newFXConverter(policies, dividendFXColumns)
+	if err != nil {
+		return report, err
+	}
+	if err := ensureCurrencyRates(); err != nil {
+		return report, err
+	}
+	payments, err := GetDividendPayments(year, accountNumber)
+	if err != nil {
+		return report, err
+	}
+	payments, _, err = classifyDividendPayments(payments)
+	if err != nil {
+		return report, err
+	}
+	report.Payments = payments
+
+	yearEnd := time.Date(year, 12, 31, 0, 0, 0, 0, time.UTC)
+	index := make(map[string]int)
+	for _, p := range payments {
+		key := strings.Join([]string{p.AccountID, p.Symbol, string(p.Currency), p.Classification}, "|")
+		i, ok := index[key]
+		if !ok {
+			// Missing rates are logged by the converter.
+			averageRate, _ := converter.rate(DIVIDEND_USD_YEARLY_AVERAGE_COLUMN, p.Currency, yearEnd)
+			report.Rows = append(report.Rows, DividendReportRow{
+				Account:           p.AccountID,
+				Symbol:            p.Symbol,
+				PayerCountry:      p.PayerCountry,
+				Classification:    p.Classification,
+				Currency:          p.Currency,
+				Gross:             decimal.New(0, 4),
+				Withholding:       decimal.New(0, 4),
+				GrossUSD:          decimal.New(0, 4),
+				WithholdingUSD:    decimal.New(0, 4),
+				YearlyAverageRate: averageRate,
+			})
+			i = len(report.Rows) - 1
+			index[key] = i
+		}
+		row := &report.Rows[i]
+		row.Payments++
+		row.Gross.Add(row.Gross, p.Gross)
+		row.Withholding.Add(row.Withholding, p.Withholding)
+
+		grossUSD, _ := converter.toUSD(DIVIDEND_USD_COLUMN, p.Gross, p.Currency, p.PaymentDate)
+		withholdingUSD, _ := converter.toUSD(DIVIDEND_USD_COLUMN, p.Withholding, p.Currency, p.PaymentDate)
+		row.GrossUSD = addOptional(row.GrossUSD, grossUSD)
+		row.WithholdingUSD = addOptional(row.WithholdingUSD, withholdingUSD)
+	}
+
+	for i := range report.Rows {
+		row := &report.Rows[i]
+		row.Net = decimal.New(0, 4).Sub(row.Gross, row.Withholding)
+		if row.GrossUSD != nil && row.WithholdingUSD != nil {
+			row.NetUSD = decimal.New(0, 4).Sub(row.GrossUSD, row.WithholdingUSD)
+		} else {
+			row.GrossUSD, row.WithholdingUSD = nil, nil
+		}
+		row.GrossUSDAverage, _ = converter.toUSD(DIVIDEND_USD_YEARLY_AVERAGE_COLUMN, row.Gross, row.Currency, yearEnd)
+		row.WithholdingUSDAverage, _ = converter.toUSD(DIVIDEND_USD_YEARLY_AVERAGE_COLUMN, row.Withholding, row.Currency, yearEnd)
+		if row.GrossUSDAverage != nil && row.WithholdingUSDAverage != nil {
+			row.NetUSDAverage = decimal.New(0, 4).Sub(row.GrossUSDAverage, row.WithholdingUSDAverage)
+		}
+		report.Totals.add(row.Classification, row.PayerCountry, row.GrossUSD, row.WithholdingUSD)
+		report.TotalsYearlyAverage.add(row.Classification, row.PayerCountry, row.GrossUSDAverage, row.WithholdingUSDAverage)
+	}
+	sort.SliceStable(report.Rows, func(a, b int) bool {
+		ra, rb := report.Rows[a], report.Rows[b]
+		if ra.Account != rb.Account {
+			return ra.Account < rb.Account
+		}
+		if ra.Symbol != rb.Symbol {
+			return ra.Symbol < rb.Symbol
+		}
+		return ra.Classification < rb.Classification
+	})
+	report.FX = converter.Columns()
+	return report, nil
+}
+
+/*
+ExportDividendReport writes the report for a year into outDir. JSON is a single
+dividends-<year>.json file; CSV is split into the grouped rows, the per payment
+classifications and the 1099-DIV totals, each with a <file>.meta.json listing the
+policy and rate sources of its USD columns. CSV amounts are written in the given
+locale, or in the one of their currency when it's empty.
+*/
+func ExportDividendReport(outDir string, year int, accountNumber string, fileFormat string, policies FXPolicies, locale LocaleUnit) ([]string, error) {
+	if fileFormat != "csv" && fileFormat != "json" {
+		return nil, ErrUnsupportedReportFormat
+	}
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		return nil, err
+	}
+	report, err := BuildDividendReport(year, accountNumber, policies)
+	if err != nil {
+		return nil, err
+	}
+
+	if fileFormat == "json" {
+		path := filepath.Join(outDir, fmt.Sprintf("dividends-%d.json", year))
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		return []string{path}, encoder.Encode(report)
+	}
+
+	format, err := newAmountFormat(locale, nil)
+	if err != nil {
+		return nil, err
+	}
+	files := []struct {
+		name  string
+		write func(w *csv.Writer, report DividendReport, format amountFormat) error
+		fx    []FXColumn
+	}{
+		{fmt.Sprintf("dividends-%d.csv", year), writeDividendRowsCSV, report.FX},
+		{fmt.Sprintf("dividends-%d-payments.csv", year), writeDividendPaymentsCSV, []FXColumn{}},
+		{fmt.Sprintf("dividends-%d-1099.csv", year), writeDividendTotalsCSV, report.FX},
+	}
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		path := filepath.Join(outDir, file.name)
+		if err := writeDividendCSV(path, report, format, file.write); err != nil {
+			return paths, err
+		}
+		if err := writeExportMetadata(path, file.fx); err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+func writeDividendCSV(path string, report DividendReport, format amountFormat, write func(w *csv.Writer, report DividendReport, format amountFormat) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	if err := write(w, report, format); err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func writeDividendRowsCSV(w *csv.Writer, report DividendReport, format amountFormat) error {
+	if err := w.Write([]string{
+		"Account",
+		"Symbol",
+		"Payer Country",
+		"Classification",
+		"Payments",
+		"Gross",
+		"Withholding",
+		"Net",
+		"Currency",
+		"Gross USD",
+		"Withholding USD",
+		"Net USD",
+		"Yearly Average Rate",
+		"Gross USD Yearly Average",
+		"Withholding USD Yearly Average",
+		"Net USD Yearly Average",
+	}); err != nil {
+		return err
+	}
+	for _, row := range report.Rows {
+		if err := w.Write([]string{
+			row.Account,
+			row.Symbol,
+			row.PayerCountry,
+			row.Classification,
+			fmt.Sprintf("%d", row.Payments),
+			format.format(row.Gross, row.Currency),
+			format.format(row.Withholding, row.Currency),
+			format.format(row.Net, row.Currency),
+			string(row.Currency),
+			format.format(row.GrossUSD, USD),
+			format.format(row.WithholdingUSD, USD),
+			format.format(row.NetUSD, USD),
+			format.format(row.YearlyAverageRate, USD),
+			format.format(row.GrossUSDAverage, USD),
+			format.format(row.WithholdingUSDAverage, USD),
+			format.format(row.NetUSDAverage, USD),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeDividendPaymentsCSV(w *csv.Writer, report DividendReport, format amountFormat) error {
+	if err := w.Write([]string{
+		"Account",
+		"Date Paid",
+		"Symbol",
+		"Payer Country",
+		"Classification",
+		"Gross",
+		"Withholding",
+		"Currency",
+		"Reason",
+	}); err != nil {
+		return err
+	}
+	for _, p := range report.Payments {
+		if err := w.Write([]string{
+			p.AccountID,
+			p.PaymentDate.Format(time.DateOnly),
+			p.Symbol,
+			p.PayerCountry,
+			p.Classification,
+			format.format(p.Gross, p.Currency),
+			format.format(p.Withholding, p.Currency),
+			string(p.Currency),
+			p.Reason,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeDividendTotalsCSV(w *csv.Writer, report DividendReport, format amountFormat) error {
+	if err := w.Write([]string{"Box", "Description", "USD", "USD Yearly Average"}); err != nil {
+		return err
+	}
+	totals, average := report.Totals, report.TotalsYearlyAverage
+	boxes := [][]string{
+		{"1a", "Total ordinary dividends", format.format(totals.TotalOrdinaryDividends, USD), format.format(average.TotalOrdinaryDividends, USD)},
+		{"1b", "Qualified dividends", format.format(totals.QualifiedDividends, USD), format.format(average.QualifiedDividends, USD)},
+		{"2a", "Total capital gain distributions", format.format(totals.CapitalGainDistributions, USD), format.format(average.CapitalGainDistributions, USD)},
+		{"4", "Federal income tax withheld", format.format(totals.FederalTaxWithheld, USD), format.format(average.FederalTaxWithheld, USD)},
+		{"7", "Foreign tax paid", format.format(totals.ForeignTaxPaid, USD), format.format(average.ForeignTaxPaid, USD)},
+	}
+	return w.WriteAll(boxes)
+}
@@ -0,0 +1,180 @@
+package internal_test
+
+import (
+	"accounting/internal"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ericlagergren/decimal"
+)
+
+func insertDividendTestTransaction(t *testing.T, transactionType internal.TransactionType, date time.Time, amount int64) {
+	zero := decimal.New(0, 4)
+	_, err := internal.InsertTransaction(internal.Transaction{
+		AccountID:       "dividend-test",
+		TransactionType: transactionType,
+		SettlementDate:  date,
+		Symbol:          "DIVCO",
+		Shares:          zero,
+		PricePerShare:   zero,
+		ShareValue:      zero,
+		FeesAmount:      zero,
+		TotalAmount:     decimal.New(amount, 4),
+		Currency:        internal.USD,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildDividendReport(t *testing.T) {
+	internal.InitializeDB()
+	paid := time.Date(2024, 6, 14, 0, 0, 0, 0, time.UTC)
+	insertDividendTestTransaction(t, internal.QUALIFIED_DIVIDEND, paid, 1000000)
+	insertDividendTestTransaction(t, internal.WITHHOLDING_TAX, paid, 150000)
+	insertDividendTestTransaction(t, internal.DIVIDEND, paid.AddDate(0, 3, 0), 200000)
+	// Next year's payment must not be included.
+	insertDividendTestTransaction(t, internal.DIVIDEND, paid.AddDate(1, 0, 0), 200000)
+
+	report, err := internal.BuildDividendReport(2024, "dividend-test", internal.FXPolicies{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Rows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(report.Rows))
+	}
+	ordinary, qualified := report.Rows[0], report.Rows[1]
+	if ordinary.Classification != internal.ORDINARY_DIVIDEND_CLASS || ordinary.Gross.Cmp(decimal.New(200000, 4)) != 0 {
+		t.Errorf("unexpected ordinary row %+v", ordinary)
+	}
+	if qualified.Withholding.Cmp(decimal.New(150000, 4)) != 0 || qualified.Net.Cmp(decimal.New(850000, 4)) != 0 {
+		t.Errorf("expected withholding 15 and net 85, got %s and %s", qualified.Withholding, qualified.Net)
+	}
+	if qualified.NetUSD == nil || qualified.NetUSD.Cmp(qualified.Net) != 0 {
+		t.Errorf("expected USD amounts to equal USD payments, got %v", qualified.NetUSD)
+	}
+
+	// The report leaves the classifications to an explicit save.
+	countClassifications := func() int {
+		var count int
+		err := internal.GlobalDB.QueryRow(`
+		SELECT COUNT(*) FROM dividend_classifications c JOIN transactions t ON t.id = c.transaction_id
+		WHERE t.account = 'dividend-test'`).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+	if count := countClassifications(); count != 0 {
+		t.Errorf("expected the report not to record classifications, got %d", count)
+	}
+	saved, err := internal.SaveDividendClassifications(2024, "dividend-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := countClassifications(); saved != 2 || count != 2 {
+		t.Errorf("expected 2 classifications saved, got %d and %d recorded", saved, count)
+	}
+}
+
+func TestQualifyingDividendShares(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse(time.DateOnly, s)
+		return d
+	}
+	exDate := day("2024-06-14")
+	// Bought 100 shares 30 days before the ex-date, sold 40 six days after it and the rest a month later.
+	history := []internal.AssetLotShares{
+		{AsOfDate: day("2024-05-15"), Shares: decimal.New(100, 0)},
+		{AsOfDate: day("2024-06-20"), Shares: decimal.New(60, 0)},
+		{AsOfDate: day("2024-07-20"), Shares: decimal.New(0, 0)},
+	}
+	eligible, qualifying := internal.QualifyingDividendShares(day("2024-05-15"), history, exDate)
+	if eligible.Cmp(decimal.New(100, 0)) != 0 || qualifying.Cmp(decimal.New(60, 0)) != 0 {
+		t.Errorf("expected 60 of 100 shares to qualify, got %s of %s", qualifying, eligible)
+	}
+
+	// Bought 30 days before the ex-date and sold 31 days after it: held 61 days.
+	history = []internal.AssetLotShares{
+		{AsOfDate: day("2024-05-15"), Shares: decimal.New(10, 0)},
+		{AsOfDate: day("2024-07-15"), Shares: decimal.New(0, 0)},
+	}
+	if _, qualifying = internal.QualifyingDividendShares(day("2024-05-15"), history, exDate); qualifying.Cmp(decimal.New(10, 0)) != 0 {
+		t.Errorf("expected 61 days held to qualify, got %s", qualifying)
+	}
+	history[1].AsOfDate = day("2024-07-14")
+	if _, qualifying = internal.QualifyingDividendShares(day("2024-05-15"), history, exDate); qualifying.Sign() != 0 {
+		t.Errorf("expected 60 days held not to qualify, got %s", qualifying)
+	}
+}
+
+func TestClassifyDividendExDate(t *testing.T) {
+	internal.InitializeDB()
+	day := func(s string) time.Time {
+		d, _ := time.Parse(time.DateOnly, s)
+		return d
+	}
+	// 100 shares bought in March and sold after the ex-date but before the payment.
+	tx, err := internal.GlobalDB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lot := internal.AssetLot{
+		AccountID:         "dividend-ex-date-test",
+		Symbol:            "EXDIV",
+		ISIN:              "US00000EXDIV",
+		Shares:            decimal.New(100, 0),
+		CostBasisPerShare: decimal.New(10, 0),
+		CostBasisCurrency: internal.USD,
+		CreatedDate:       day("2024-03-15"),
+	}
+	if lot.ID, err = internal.InsertAssetLot(lot, tx); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	lot.Shares = decimal.New(0, 0)
+	if err = internal.UpdateAssetLot(lot, tx); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err = internal.InsertAssetLotHistory(lot, day("2024-06-05"), tx); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	payment := internal.DividendPayment{
+		TransactionType: internal.DIVIDEND,
+		AccountID:       "dividend-ex-date-test",
+		Symbol:          "EXDIV",
+		PaymentDate:     day("2024-06-20"),
+		Currency:        internal.USD,
+		Gross:           decimal.New(50, 0),
+	}
+
+	classification, err := internal.ClassifyDividend(payment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if classification.Qualified {
+		t.Errorf("expected a dividend without an ex-dividend date to be ordinary, got %+v", classification)
+	}
+
+	err = internal.UpsertExDividendDate(internal.ExDividendDate{Symbol: "EXDIV", PaymentDate: payment.PaymentDate, ExDate: day("2024-06-21")})
+	if !errors.Is(err, internal.ErrInvalidExDividendDate) {
+		t.Errorf("expected an ex-dividend date after the payment to be invalid, got %v", err)
+	}
+	if err = internal.UpsertExDividendDate(internal.ExDividendDate{Symbol: "EXDIV", PaymentDate: payment.PaymentDate, ExDate: day("2024-05-31")}); err != nil {
+		t.Fatal(err)
+	}
+	// Held from April 1, 60 days before the ex-date, until June 5: 66 days of the window.
+	classification, err = internal.ClassifyDividend(payment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !classification.Qualified || classification.QualifiedAmount.Cmp(payment.Gross) != 0 {
+		t.Errorf("expected the shares held going into the ex-date to qualify, got %+v", classification)
+	}
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ericlagergren/decimal"
+)
+
+var (
+	ErrFixedPrecision = errors.New("decimal has more places than its column stores")
+	ErrFixedOverflow  = errors.New("decimal doesn't fit its column")
+	ErrFixedScan      = errors.New("column doesn't hold a fixed-point integer")
+)
+
+// STORAGE_SCALE is the number of decimal places amounts, quantities, prices, ratios and
+// percentages are stored with: 12.3456 is stored as 123456.
+const STORAGE_SCALE = 4
+
+/*
+Fixed is a decimal stored in a BIGINT column as its value times 10^Scale. It implements
+driver.Valuer and sql.Scanner:
+
+  - A nil Decimal is stored and scanned as NULL.
+  - Storing a value with non-zero places beyond Scale fails with ErrFixedPrecision instead of
+    truncating, round explicitly with Quantize first. Values outside int64 fail with
+    ErrFixedOverflow. The sign is kept.
+  - Scanning accepts integers and their text, which older tables with TEXT columns hold.
+*/
+type Fixed struct {
+	Decimal *decimal.Big
+	Scale   int
+}
+
+// fixed stores a decimal with STORAGE_SCALE places
+func fixed(d *decimal.Big) Fixed {
+	return Fixed{Decimal: d, Scale: STORAGE_SCALE}
+}
+
+// Value implements driver.Valuer
+func (f Fixed) Value() (driver.Value, error) {
+	if f.Decimal == nil {
+		return nil, nil
+	}
+	if !f.Decimal.IsFinite() {
+		return nil, fmt.Errorf("%w: %s", ErrFixedOverflow, f.Decimal)
+	}
+	// Shifting the scale keeps the coefficient, so the value is multiplied by 10^Scale exactly.
+	scaled := decimal.New(0, 0).Copy(f.Decimal)
+	scaled.SetScale(scaled.Scale() - f.Scale)
+	if !scaled.IsInt() {
+		return nil, fmt.Errorf("%w: %s has more than %d places", ErrFixedPrecision, f.Decimal, f.Scale)
+	}
+	value, ok := scaled.Int64()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrFixedOverflow, f.Decimal)
+	}
+	return value, nil
+}
+
+// Scan implements sql.Scanner
+func (f *Fixed) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		f.Decimal = nil
+		return nil
+	case int64:
+		f.Decimal = decimal.New(v, f.Scale)
+		return nil
+	case []byte:
+		return f.scanText(string(v))
+	case string:
+		return f.scanText(v)
+	}
+	return fmt.Errorf("%w: %T", ErrFixedScan, src)
+}
+
+func (f *Fixed) scanText(s string) error {
+	v, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %q", ErrFixedScan, s)
+	}
+	f.Decimal = decimal.New(v, f.Scale)
+	return nil
+}
+
+type scannerFunc func(src any) error
+
+func (f scannerFunc) Scan(src any) error {
+	return f(src)
+}
+
+// scanFixed scans a column stored with STORAGE_SCALE places into dest
+func scanFixed(dest **decimal.Big) sql.Scanner {
+	return scannerFunc(func(src any) error {
+		f := Fixed{Scale: STORAGE_SCALE}
+		if err := f.Scan(src); err != nil {
+			return err
+		}
+		*dest = f.Decimal
+		return nil
+	})
+}
@@ -0,0 +1,72 @@
+package internal_test
+
+import (
+	"accounting/internal"
+	"errors"
+	"testing"
+
+	"github.com/ericlagergren/decimal"
+)
+
+func TestFixedValue(t *testing.T) {
+	type TestCase struct {
+		value  *decimal.Big
+		scale  int
+		stored any
+		err    error
+	}
+	huge, _ := new(decimal.Big).SetString("1000000000000000")
+	var cases = []TestCase{
+		{decimal.New(1234500, 4), 4, int64(1234500), nil},
+		{decimal.New(-1234500, 4), 4, int64(-1234500), nil},
+		{decimal.New(5, 0), 4, int64(50000), nil},
+		{decimal.New(123, 2), 4, int64(12300), nil},
+		{decimal.New(1234560, 5), 4, int64(123456), nil},
+		{decimal.New(123456, 5), 4, nil, internal.ErrFixedPrecision},
+		{decimal.New(-123456, 5), 4, nil, internal.ErrFixedPrecision},
+		{decimal.New(123456, 5), 5, int64(123456), nil},
+		{huge, 4, nil, internal.ErrFixedOverflow},
+		{nil, 4, nil, nil},
+	}
+	for i, c := range cases {
+		stored, err := internal.Fixed{Decimal: c.value, Scale: c.scale}.Value()
+		if !errors.Is(err, c.err) {
+			t.Errorf("Case %d: expected error %v, got %v", i, c.err, err)
+			continue
+		}
+		if stored != c.stored {
+			t.Errorf("Case %d: expected %v, got %v", i, c.stored, stored)
+		}
+	}
+}
+
+func TestFixedScan(t *testing.T) {
+	type TestCase struct {
+		src   any
+		value *decimal.Big
+		err   error
+	}
+	var cases = []TestCase{
+		{int64(1234500), decimal.New(1234500, 4), nil},
+		{int64(-50000), decimal.New(-50000, 4), nil},
+		{"1234500", decimal.New(1234500, 4), nil},
+		{[]byte(" -1 "), decimal.New(-1, 4), nil},
+		{"123.45", nil, internal.ErrFixedScan},
+		{1.5, nil, internal.ErrFixedScan},
+		{nil, nil, nil},
+	}
+	for i, c := range cases {
+		f := internal.Fixed{Scale: 4}
+		err := f.Scan(c.src)
+		if !errors.Is(err, c.err) {
+			t.Errorf("Case %d: expected error %v, got %v", i, c.err, err)
+			continue
+		}
+		if c.err != nil {
+			continue
+		}
+		if (c.value == nil) != (f.Decimal == nil) || (c.value != nil && c.value.Cmp(f.Decimal) != 0) {
+			t.Errorf("Case %d: expected %v, got %v", i, c.value, f.Decimal)
+		}
+	}
+}
@@ -0,0 +1,470 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ericlagergren/decimal"
+)
+
+var (
+	ErrFXRateMissing   = errors.New("no currency rate for the fx policy")
+	ErrUnknownFXColumn = errors.New("unknown fx column")
+	ErrInvalidFXColumn = errors.New("invalid fx column policy, expected COLUMN=POLICY")
+)
+
+// dailyRateLookbackDays covers weekends and holidays without a published rate
+const dailyRateLookbackDays = 7
+
+// FXRate is how much of a currency one USD buys under a policy, and the rate it was taken from
+type FXRate struct {
+	Rate     *decimal.Big
+	Date     time.Time // date of the stored rate, December 31 for yearly rates
+	Source   string    // rate source, "<source> average" for averages of daily rates
+	Fallback bool      // spot without a daily rate, taken from calendar-year
+}
+
+/*
+RateToOneUSD returns the rate of a currency for an amount dated asOf:
+
+  - spot: the daily rate published closest before asOf, looking back a week to cover weekends
+    and holidays. Riksbank rates win over ECB cross rates. Without a daily rate it falls back
+    to calendar-year and marks the rate as a fallback.
+  - yearly-average: the imported IRS yearly average of the calendar year, else the average of
+    its daily rates, else its seeded yearly rate.
+  - treasury-year-end: the Treasury reporting rate of December 31 of the calendar year.
+  - riksbank-daily: the Riksbank rate published closest before asOf, within a week.
+  - calendar-year: the IRS or seeded rate of the calendar year, else the latest rate before asOf.
+  - executed: the rate a trade was executed at is applied by the report (see fxConverter.convertTrade),
+    the stored rates are looked up like spot.
+
+Currencies without a USD rate under the policy cross through SEK: the SEK rate of the policy
+divided by the latest SEK price of the currency, such as the Växlingskurs of a Nordnet trade. Daily policies take
+SEK rates within the lookback, the others the latest one of the calendar year up to asOf.
+
+Policies without a fallback return ErrFXRateMissing when the rate isn't stored.
+*/
+func RateToOneUSD(currency CurrencyUnit, asOf time.Time, policy FXPolicy) (FXRate, error) {
+	if currency == USD {
+		return FXRate{Rate: decimal.New(1, 0), Date: asOf}, nil
+	}
+	var rate FXRate
+	var err error
+	switch policy {
+	case SPOT_FX_POLICY, EXECUTED_FX_POLICY:
+		rate, err = getDailyRate(currency, asOf, RIKSBANK_RATE_SOURCE, ECB_RATE_SOURCE)
+		if errors.Is(err, sql.ErrNoRows) {
+			rate, err = getCalendarYearRate(currency, asOf)
+			rate.Fallback = err == nil
+		}
+	case YEARLY_AVERAGE_FX_POLICY:
+		rate, err = getYearlyAverageRate(currency, asOf.Year())
+	case TREASURY_YEAR_END_FX_POLICY:
+		rate, err = getTreasuryYearEndRate(currency, asOf.Year())
+	case RIKSBANK_DAILY_FX_POLICY:
+		rate, err = getDailyRate(currency, asOf, RIKSBANK_RATE_SOURCE)
+	case CALENDAR_YEAR_FX_POLICY:
+		rate, err = getCalendarYearRate(currency, asOf)
+	default:
+		return rate, fmt.Errorf("%w: %s", ErrInvalidFXPolicy, policy)
+	}
+	if errors.Is(err, sql.ErrNoRows) && currency != SEK {
+		rate, err = getRateThroughSEK(currency, asOf, policy)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return rate, fmt.Errorf("%w: %s %s on %s", ErrFXRateMissing, policy, currency, asOf.Format(time.DateOnly))
+	}
+	return rate, err
+}
+
+func scanFXRate(row *sql.Row) (FXRate, error) {
+	var rate FXRate
+	if err := row.Scan(scanField(&rate.Rate, RATE_FIELD), &rate.Date, &rate.Source); err != nil {
+		return FXRate{}, err
+	}
+	return rate, nil
+}
+
+func getCalendarYearRate(currency CurrencyUnit, asOf time.Time) (FXRate, error) {
+	// We treat currency_rates as "per year" rates. The table is seeded with
+	// e.g. 2024-12-31, but marks may happen earlier in 2024. Selecting by
+	// calendar year avoids falling back to the previous year. Imported IRS
+	// yearly averages win over the seeded ones.
+	rate, err := scanFXRate(GlobalDB.QueryRow(`
+		SELECT rate, as_of_date, source
+		FROM currency_rates
+		WHERE currency_code = ? AND base_currency = 'USD'
+			AND source IN ('seed', 'irs')
+			AND strftime('%Y', as_of_date) = strftime('%Y', ?)
+		ORDER BY CASE source WHEN 'irs' THEN 0 ELSE 1 END, as_of_date DESC
+		LIMIT 1;
+	`, string(currency), asOf))
+	if !errors.Is(err, sql.ErrNoRows) {
+		return rate, err
+	}
+	// If the exact calendar year rate doesn't exist (e.g. exports into 2025
+	// but `rates` hasn't been extended beyond 2024), fall back to the latest
+	// available rate up to the requested date so exported USD fields aren't blank.
+	return scanFXRate(GlobalDB.QueryRow(`
+		SELECT rate, as_of_date, source
+		FROM currency_rates
+		WHERE currency_code = ? AND base_currency = 'USD' AND as_of_date <= ?
+		ORDER BY as_of_date DESC
+		LIMIT 1;
+	`, string(currency), asOf))
+}
+
+// getDailyRate returns the rate of the latest day within the lookback, preferring the sources in order
+func getDailyRate(currency CurrencyUnit, asOf time.Time, sources ...RateSource) (FXRate, error) {
+	placeholders := make([]string, len(sources))
+	order := make([]string, len(sources))
+	args := []any{string(currency), asOf, asOf.AddDate(0, 0, -dailyRateLookbackDays)}
+	for i, source := range sources {
+		placeholders[i] = "?"
+		order[i] = fmt.Sprintf("WHEN '%s' THEN %d", source, i)
+		args = append(args, string(source))
+	}
+	return scanFXRate(GlobalDB.QueryRow(fmt.Sprintf(`
+		SELECT rate, as_of_date, source
+		FROM currency_rates
+		WHERE currency_code = ? AND base_currency = 'USD' AND as_of_date <= ? AND as_of_date > ? AND source IN (%s)
+		ORDER BY as_of_date DESC, CASE source %s END
+		LIMIT 1;
+	`, strings.Join(placeholders, ", "), strings.Join(order, " ")), args...))
+}
+
+func getYearlyAverageRate(currency CurrencyUnit, year int) (FXRate, error) {
+	yearArg := fmt.Sprintf("%04d", year)
+	yearEnd := time.Date(year, 12, 31, 0, 0, 0, 0, time.UTC)
+	rate, err := scanFXRate(GlobalDB.QueryRow(`
+		SELECT rate, as_of_date, source
+		FROM currency_rates
+		WHERE currency_code = ? AND base_currency = 'USD' AND strftime('%Y', as_of_date) = ? AND source = 'irs'
+		LIMIT 1;
+	`, string(currency), yearArg))
+	if !errors.Is(err, sql.ErrNoRows) {
+		return rate, err
+	}
+
+	// Averages are taken over one source so days quoted by both aren't counted twice.
+	// Rates are fixed-point BIGINTs, round the average back to an integer.
+	var rateAvg *decimal.Big
+	var source string
+	err = GlobalDB.QueryRow(`
+		SELECT CAST(ROUND(AVG(rate)) AS INTEGER), source
+		FROM currency_rates
+		WHERE currency_code = ? AND base_currency = 'USD' AND strftime('%Y', as_of_date) = ? AND source IN ('riksbank', 'ecb')
+		GROUP BY source
+		ORDER BY CASE source WHEN 'riksbank' THEN 0 ELSE 1 END
+		LIMIT 1;
+	`, string(currency), yearArg).Scan(scanField(&rateAvg, RATE_FIELD), &source)
+	if err == nil {
+		return FXRate{Rate: rateAvg, Date: yearEnd, Source: source + " average"}, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return FXRate{}, err
+	}
+
+	return scanFXRate(GlobalDB.QueryRow(`
+		SELECT rate, as_of_date, source
+		FROM currency_rates
+		WHERE currency_code = ? AND base_currency = 'USD' AND strftime('%Y', as_of_date) = ? AND source = 'seed'
+		LIMIT 1;
+	`, string(currency), yearArg))
+}
+
+func getTreasuryYearEndRate(currency CurrencyUnit, year int) (FXRate, error) {
+	return scanFXRate(GlobalDB.QueryRow(`
+		SELECT rate, as_of_date, source
+		FROM currency_rates
+		WHERE currency_code = ? AND base_currency = 'USD' AND strftime('%Y-%m', as_of_date) = ? AND source = 'treasury'
+		ORDER BY as_of_date DESC
+		LIMIT 1;
+	`, string(currency), fmt.Sprintf("%04d-12", year)))
+}
+
+// getRateThroughSEK divides the SEK rate of the policy by the latest SEK price of one unit of
+// the currency
+func getRateThroughSEK(currency CurrencyUnit, asOf time.Time, policy FXPolicy) (FXRate, error) {
+	from := time.Date(asOf.Year(), 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, -1)
+	if policy == SPOT_FX_POLICY || policy == EXECUTED_FX_POLICY || policy == RIKSBANK_DAILY_FX_POLICY {
+		from = asOf.AddDate(0, 0, -dailyRateLookbackDays)
+	}
+	sekPerUnit, err := scanFXRate(GlobalDB.QueryRow(`
+		SELECT rate, as_of_date, source
+		FROM currency_rates
+		WHERE currency_code = 'SEK' AND base_currency = ? AND as_of_date <= ? AND as_of_date > ?
+		ORDER BY as_of_date DESC
+		LIMIT 1;
+	`, string(currency), asOf, from))
+	if err != nil {
+		return sekPerUnit, err
+	}
+	if sekPerUnit.Rate.Sign() == 0 {
+		return FXRate{}, sql.ErrNoRows
+	}
+	sek, err := RateToOneUSD(SEK, asOf, policy)
+	if errors.Is(err, ErrFXRateMissing) {
+		return FXRate{}, sql.ErrNoRows
+	}
+	if err != nil {
+		return FXRate{}, err
+	}
+	rate := decimal.New(0, 4).Quo(sek.Rate, sekPerUnit.Rate)
+	return FXRate{Rate: RATE_FIELD.Round(rate), Date: sekPerUnit.Date, Source: fmt.Sprintf("%s via SEK (%s)", sekPerUnit.Source, sek.Source), Fallback: sek.Fallback}, nil
+}
+
+// FXPolicies are the policies a report converts with. Columns overrides the policy of single
+// columns, Default the policy of the others. Columns without either use the report's own default.
+type FXPolicies struct {
+	Default FXPolicy
+	Columns map[string]FXPolicy
+}
+
+// ParseFXPolicies parses a default policy, which may be empty, and COLUMN=POLICY overrides
+func ParseFXPolicies(defaultPolicy string, columns []string) (FXPolicies, error) {
+	var policies FXPolicies
+	var err error
+	if strings.TrimSpace(defaultPolicy) != "" {
+		if policies.Default, err = ParseFXPolicy(defaultPolicy); err != nil {
+			return policies, err
+		}
+	}
+	for _, column := range columns {
+		name, value, ok := strings.Cut(column, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return policies, fmt.Errorf("%w: %s", ErrInvalidFXColumn, column)
+		}
+		policy, err := ParseFXPolicy(value)
+		if err != nil {
+			return policies, err
+		}
+		if policies.Columns == nil {
+			policies.Columns = make(map[string]FXPolicy)
+		}
+		policies.Columns[strings.TrimSpace(name)] = policy
+	}
+	return policies, nil
+}
+
+// FXColumn is the metadata of a converted column: its policy and the rate sources used
+type FXColumn struct {
+	Column    string   `json:"column"`
+	Policy    FXPolicy `json:"policy"`
+	Sources   []string `json:"sources"`
+	Converted int      `json:"converted"`
+	Fallbacks int      `json:"fallbacks"` // spot amounts converted at the calendar-year rate for lack of a daily rate
+	Missing   int      `json:"missing"`   // amounts left empty for lack of a rate
+}
+
+// ExecutedFX is the rate a broker executed a trade at, units of the booked currency per unit
+// of the instrument currency
+type ExecutedFX struct {
+	Currency CurrencyUnit
+	Rate     *decimal.Big
+}
+
+// executedFXSource is the source recorded in the metadata for amounts at their executed rate
+const executedFXSource = "executed"
+
+type fxRateKey struct {
+	currency CurrencyUnit
+	date     string
+	policy   FXPolicy
+}
+
+type fxFallbackKey struct {
+	column string
+	key    fxRateKey
+}
+
+// fxConverter converts the columns of a report with their policies and records the rate sources used
+type fxConverter struct {
+	columns   map[string]*FXColumn
+	sources   map[string]map[string]bool
+	rates     map[fxRateKey]FXRate
+	missing   map[fxRateKey]error
+	fallbacks map[fxFallbackKey]bool // spot fallbacks already logged
+}
+
+// newFXConverter sets up the columns of a report with their default policies. Overrides of
+// columns the report doesn't have are refused.
+func newFXConverter(policies FXPolicies, defaults map[string]FXPolicy) (*fxConverter, error) {
+	c := &fxConverter{
+		columns:   make(map[string]*FXColumn),
+		sources:   make(map[string]map[string]bool),
+		rates:     make(map[fxRateKey]FXRate),
+		missing:   make(map[fxRateKey]error),
+		fallbacks: make(map[fxFallbackKey]bool),
+	}
+	for column := range policies.Columns {
+		if _, ok := defaults[column]; !ok {
+			names := make([]string, 0, len(defaults))
+			for name := range defaults {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("%w %q, expected one of: %s", ErrUnknownFXColumn, column, strings.Join(names, ", "))
+		}
+	}
+	for column, policy := range defaults {
+		if override, ok := policies.Columns[column]; ok {
+			policy = override
+		} else if policies.Default != "" {
+			policy = policies.Default
+		}
+		c.columns[column] = &FXColumn{Column: column, Policy: policy, Sources: []string{}}
+		c.sources[column] = make(map[string]bool)
+	}
+	return c, nil
+}
+
+// rate returns the rate of a currency for a column, logging missing rates once
+func (c *fxConverter) rate(column string, currency CurrencyUnit, asOf time.Time) (*decimal.Big, error) {
+	rate, err := c.fxRate(column, currency, asOf)
+	if err != nil {
+		return nil, err
+	}
+	return rate.Rate, nil
+}
+
+// fxRate looks up the rate of a currency for a column once per day, logging spot fallbacks
+// the first time a column runs into them
+func (c *fxConverter) fxRate(column string, currency CurrencyUnit, asOf time.Time) (FXRate, error) {
+	col, ok := c.columns[column]
+	if !ok {
+		return FXRate{}, fmt.Errorf("%w %q", ErrUnknownFXColumn, column)
+	}
+	key := fxRateKey{currency: currency, date: asOf.Format(time.DateOnly), policy: col.Policy}
+	if err, ok := c.missing[key]; ok {
+		return FXRate{}, err
+	}
+	rate, ok := c.rates[key]
+	if !ok {
+		var err error
+		rate, err = RateToOneUSD(currency, asOf, col.Policy)
+		if err != nil {
+			c.missing[key] = err
+			InfoLogger.Printf("%s: %v\n", column, err)
+			return FXRate{}, err
+		}
+		c.rates[key] = rate
+	}
+	fallbackKey := fxFallbackKey{column: column, key: key}
+	if rate.Fallback && !c.fallbacks[fallbackKey] {
+		c.fallbacks[fallbackKey] = true
+		InfoLogger.Printf("%s: no daily %s rate in the week up to %s, using the calendar-year rate (%s)\n",
+			column, currency, key.date, rate.Source)
+	}
+	c.used(column, rate.Source)
+	return rate, nil
+}
+
+// used records a rate source of a column
+func (c *fxConverter) used(column string, source string) {
+	col, ok := c.columns[column]
+	if !ok || source == "" || c.sources[column][source] {
+		return
+	}
+	c.sources[column][source] = true
+	col.Sources = append(col.Sources, source)
+	sort.Strings(col.Sources)
+}
+
+// toUSD converts an amount for a column, nil amounts stay nil
+func (c *fxConverter) toUSD(column string, amount *decimal.Big, currency CurrencyUnit, asOf time.Time) (*decimal.Big, error) {
+	return c.convert(column, amount, currency, USD, asOf)
+}
+
+// convert converts an amount between two currencies for a column, crossing through USD
+func (c *fxConverter) convert(column string, amount *decimal.Big, from CurrencyUnit, to CurrencyUnit, asOf time.Time) (*decimal.Big, error) {
+	if amount == nil || from == to {
+		return amount, nil
+	}
+	fromRate, err := c.fxRate(column, from, asOf)
+	if err != nil {
+		return nil, c.miss(column, err)
+	}
+	toRate, err := c.fxRate(column, to, asOf)
+	if err != nil {
+		return nil, c.miss(column, err)
+	}
+	c.columns[column].Converted++
+	if fromRate.Fallback || toRate.Fallback {
+		c.columns[column].Fallbacks++
+	}
+	converted := decimal.New(0, 4).Mul(amount, toRate.Rate)
+	return converted.Quo(converted, fromRate.Rate).Quantize(4), nil
+}
+
+// convertTrade converts an amount of a trade for a column. Columns with the executed policy
+// take the amount back into the instrument currency at the executed rate first, and convert
+// it from there like spot. Trades without an executed rate convert like spot.
+func (c *fxConverter) convertTrade(column string, amount *decimal.Big, from CurrencyUnit, to CurrencyUnit, asOf time.Time, executed *ExecutedFX) (*decimal.Big, error) {
+	col, ok := c.columns[column]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownFXColumn, column)
+	}
+	if amount == nil || from == to || executed == nil || col.Policy != EXECUTED_FX_POLICY || executed.Currency == from {
+		return c.convert(column, amount, from, to, asOf)
+	}
+	instrumentAmount := decimal.New(0, 4).Quo(amount, executed.Rate).Quantize(4)
+	c.used(column, executedFXSource)
+	if executed.Currency == to {
+		col.Converted++
+		return instrumentAmount, nil
+	}
+	return c.convert(column, instrumentAmount, executed.Currency, to, asOf)
+}
+
+// miss counts an amount of a column left unconverted
+func (c *fxConverter) miss(column string, err error) error {
+	if col, ok := c.columns[column]; ok {
+		col.Missing++
+	}
+	return err
+}
+
+// Columns returns the metadata of the given columns, or of all the report's columns sorted by name
+func (c *fxConverter) Columns(names ...string) []FXColumn {
+	if len(names) > 0 {
+		columns := make([]FXColumn, 0, len(names))
+		for _, name := range names {
+			if column, ok := c.columns[name]; ok {
+				columns = append(columns, *column)
+			}
+		}
+		return columns
+	}
+	columns := make([]FXColumn, 0, len(c.columns))
+	for _, column := range c.columns {
+		columns = append(columns, *column)
+	}
+	sort.Slice(columns, func(i, j int) bool { return columns[i].Column < columns[j].Column })
+	return columns
+}
+
+// ExportMetadata is written next to every exported CSV file as <file>.meta.json
+type ExportMetadata struct {
+	File      string     `json:"file"`
+	Generated time.Time  `json:"generated"`
+	FX        []FXColumn `json:"fx"`
+}
+
+func writeExportMetadata(path string, columns []FXColumn) error {
+	f, err := os.Create(path + ".meta.json")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(ExportMetadata{File: filepath.Base(path), Generated: time.Now().UTC().Truncate(time.Second), FX: columns})
+}
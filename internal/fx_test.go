@@ -0,0 +1,246 @@
+package internal_test
+
+import (
+	"accounting/internal"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ericlagergren/decimal"
+)
+
+func insertFXTestRate(t *testing.T, date string, rate int64, source internal.RateSource) {
+	d, _ := time.Parse(time.DateOnly, date)
+	err := internal.UpsertCurrencyRate(internal.CurrencyRate{Currency: "EUR", Date: d, Rate: decimal.New(rate, 4), Source: source}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRateToOneUSDPolicies(t *testing.T) {
+	internal.InitializeDB()
+	insertFXTestRate(t, "2021-12-31", 8500, internal.SEED_RATE_SOURCE)
+	insertFXTestRate(t, "2021-12-31", 8800, internal.IRS_RATE_SOURCE)
+	insertFXTestRate(t, "2021-09-30", 8600, internal.TREASURY_RATE_SOURCE)
+	insertFXTestRate(t, "2021-12-31", 8790, internal.TREASURY_RATE_SOURCE)
+	insertFXTestRate(t, "2021-03-01", 8200, internal.RIKSBANK_RATE_SOURCE)
+	insertFXTestRate(t, "2021-03-01", 8100, internal.ECB_RATE_SOURCE)
+	insertFXTestRate(t, "2021-03-02", 8150, internal.ECB_RATE_SOURCE)
+	insertFXTestRate(t, "2020-05-04", 9200, internal.ECB_RATE_SOURCE)
+	insertFXTestRate(t, "2020-05-05", 9300, internal.ECB_RATE_SOURCE)
+
+	date := time.Date(2021, 3, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		policy   internal.FXPolicy
+		date     time.Time
+		rate     int64
+		source   string
+		fallback bool
+	}{
+		// The latest day wins over the preferred source.
+		{internal.SPOT_FX_POLICY, date, 8150, "ecb", false},
+		{internal.RIKSBANK_DAILY_FX_POLICY, date, 8200, "riksbank", false},
+		{internal.YEARLY_AVERAGE_FX_POLICY, date, 8800, "irs", false},
+		{internal.TREASURY_YEAR_END_FX_POLICY, date, 8790, "treasury", false},
+		{internal.CALENDAR_YEAR_FX_POLICY, date, 8800, "irs", false},
+		// Without a daily rate in the week before spot falls back to the calendar year.
+		{internal.SPOT_FX_POLICY, date.AddDate(0, 3, 0), 8800, "irs", true},
+		{internal.YEARLY_AVERAGE_FX_POLICY, date.AddDate(-1, 0, 0), 9250, "ecb average", false},
+	}
+	for _, test := range tests {
+		rate, err := internal.RateToOneUSD("EUR", test.date, test.policy)
+		if err != nil {
+			t.Errorf("%s on %s: %v", test.policy, test.date.Format(time.DateOnly), err)
+			continue
+		}
+		if rate.Rate.Cmp(decimal.New(test.rate, 4)) != 0 || rate.Source != test.source || rate.Fallback != test.fallback {
+			t.Errorf("%s on %s: expected %d from %s (fallback %t), got %s from %s (fallback %t)", test.policy, test.date.Format(time.DateOnly),
+				test.rate, test.source, test.fallback, rate.Rate, rate.Source, rate.Fallback)
+		}
+	}
+
+	if _, err := internal.RateToOneUSD("EUR", date.AddDate(0, 3, 0), internal.RIKSBANK_DAILY_FX_POLICY); !errors.Is(err, internal.ErrFXRateMissing) {
+		t.Errorf("expected no Riksbank rate in June, got %v", err)
+	}
+	if _, err := internal.RateToOneUSD("EUR", date.AddDate(-1, 0, 0), internal.TREASURY_YEAR_END_FX_POLICY); !errors.Is(err, internal.ErrFXRateMissing) {
+		t.Errorf("expected no Treasury rate for 2020, got %v", err)
+	}
+	if rate, err := internal.RateToOneUSD(internal.USD, date, internal.TREASURY_YEAR_END_FX_POLICY); err != nil || rate.Rate.Cmp(decimal.New(1, 0)) != 0 {
+		t.Errorf("expected USD to convert at 1, got %+v (%v)", rate, err)
+	}
+}
+
+func TestRatePlaces(t *testing.T) {
+	internal.InitializeDB()
+	date := time.Date(2018, 4, 3, 0, 0, 0, 0, time.UTC)
+	err := internal.UpsertCurrencyRate(internal.CurrencyRate{Currency: "EUR", Date: date, Rate: decimal.New(87663067, 8), Source: internal.RIKSBANK_RATE_SOURCE}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate, err := internal.RateToOneUSD("EUR", date, internal.RIKSBANK_DAILY_FX_POLICY); err != nil || rate.Rate.Cmp(decimal.New(87663067, 8)) != 0 {
+		t.Errorf("expected the rate stored with 8 places, got %+v (%v)", rate, err)
+	}
+
+	zero := decimal.New(0, 4)
+	_, err = internal.InsertTransaction(internal.Transaction{
+		AccountID:          "fx-rate-places",
+		TransactionType:    internal.SALE_TRANSACTION,
+		SettlementDate:     date,
+		Symbol:             "AAPL",
+		Shares:             decimal.New(1, 0),
+		PricePerShare:      decimal.New(1000, 0),
+		ShareValue:         decimal.New(1000, 0),
+		FeesAmount:         zero,
+		TotalAmount:        decimal.New(1000, 0),
+		Currency:           internal.SEK,
+		InstrumentCurrency: internal.USD,
+		InstrumentAmount:   decimal.New(120, 0),
+		ExecutedFXRate:     decimal.New(833333333, 8),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transactions, err := internal.GetTransactionBetweenDate(date, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transactions) != 1 || transactions[0].ExecutedFXRate.Cmp(decimal.New(833333333, 8)) != 0 {
+		t.Errorf("expected the executed rate stored with 8 places, got %+v", transactions)
+	}
+}
+
+func TestParseFXPolicies(t *testing.T) {
+	policies, err := internal.ParseFXPolicies("spot", []string{"USD Yearly Average=treasury-year-end"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policies.Default != internal.SPOT_FX_POLICY || policies.Columns["USD Yearly Average"] != internal.TREASURY_YEAR_END_FX_POLICY {
+		t.Errorf("unexpected policies %+v", policies)
+	}
+	if _, err = internal.ParseFXPolicies("", []string{"USD"}); !errors.Is(err, internal.ErrInvalidFXColumn) {
+		t.Errorf("expected a column without policy to be refused, got %v", err)
+	}
+	if _, err = internal.ParseFXPolicies("monthly", nil); !errors.Is(err, internal.ErrInvalidFXPolicy) {
+		t.Errorf("expected an unknown policy to be refused, got %v", err)
+	}
+}
+
+func TestExportFXMetadata(t *testing.T) {
+	internal.InitializeDB()
+	insertFXTestRate(t, "2021-03-02", 8000, internal.RIKSBANK_RATE_SOURCE)
+	insertFXTestRate(t, "2021-12-31", 8800, internal.IRS_RATE_SOURCE)
+	zero := decimal.New(0, 4)
+	// The second deposit has no daily rate in the week before.
+	for _, date := range []time.Time{time.Date(2021, 3, 2, 0, 0, 0, 0, time.UTC), time.Date(2021, 8, 2, 0, 0, 0, 0, time.UTC)} {
+		_, err := internal.InsertTransaction(internal.Transaction{
+			AccountID:       "fx-test",
+			TransactionType: internal.DEPOSIT_TRANSACTION,
+			SettlementDate:  date,
+			Symbol:          "CASH",
+			Shares:          zero,
+			PricePerShare:   zero,
+			ShareValue:      zero,
+			FeesAmount:      zero,
+			TotalAmount:     decimal.New(1000000, 4),
+			Currency:        "EUR",
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := t.TempDir()
+	policies := internal.FXPolicies{Columns: map[string]internal.FXPolicy{internal.TOTAL_AMOUNT_USD_COLUMN: internal.RIKSBANK_DAILY_FX_POLICY}}
+	fxMetadata := func() internal.FXColumn {
+		t.Helper()
+		if err := internal.ExportReportingExports(dir, "fx-test", nil, policies, ""); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "transactions.csv.meta.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var metadata internal.ExportMetadata
+		if err = json.Unmarshal(data, &metadata); err != nil {
+			t.Fatal(err)
+		}
+		if metadata.File != "transactions.csv" || len(metadata.FX) != 1 {
+			t.Fatalf("expected the metadata of the USD column of transactions.csv, got %+v", metadata)
+		}
+		return metadata.FX[0]
+	}
+	fx := fxMetadata()
+	if fx.Policy != internal.RIKSBANK_DAILY_FX_POLICY || len(fx.Sources) != 1 || fx.Sources[0] != "riksbank" || fx.Converted != 1 || fx.Missing != 1 {
+		t.Errorf("expected one amount converted at the Riksbank rate and one left empty, got %+v", fx)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "assets.csv.meta.json")); err != nil {
+		t.Errorf("expected assets metadata, got %v", err)
+	}
+	// Spot converts both, the second at the calendar-year rate.
+	policies.Columns = map[string]internal.FXPolicy{internal.TOTAL_AMOUNT_USD_COLUMN: internal.SPOT_FX_POLICY}
+	if fx = fxMetadata(); fx.Converted != 2 || fx.Fallbacks != 1 || fx.Missing != 0 {
+		t.Errorf("expected two amounts converted, one of them at the calendar-year rate, got %+v", fx)
+	}
+
+	policies.Columns = map[string]internal.FXPolicy{"USD": internal.SPOT_FX_POLICY}
+	if err := internal.ExportReportingExports(dir, "fx-test", nil, policies, ""); !errors.Is(err, internal.ErrUnknownFXColumn) {
+		t.Errorf("expected a column of another report to be refused, got %v", err)
+	}
+}
+
+func TestExportExecutedFX(t *testing.T) {
+	internal.InitializeDB()
+	zero := decimal.New(0, 4)
+	_, err := internal.InsertTransaction(internal.Transaction{
+		AccountID:          "fx-executed",
+		TransactionType:    internal.SALE_TRANSACTION,
+		SettlementDate:     time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC),
+		Symbol:             "AAPL",
+		Shares:             decimal.New(100000, 4),
+		PricePerShare:      decimal.New(12500000, 4),
+		ShareValue:         decimal.New(125000000, 4),
+		FeesAmount:         zero,
+		TotalAmount:        decimal.New(125000000, 4),
+		Currency:           internal.SEK,
+		InstrumentCurrency: internal.USD,
+		InstrumentAmount:   decimal.New(15000000, 4),
+		ExecutedFXRate:     decimal.New(83333, 4),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	policies := internal.FXPolicies{Columns: map[string]internal.FXPolicy{internal.TOTAL_AMOUNT_USD_COLUMN: internal.EXECUTED_FX_POLICY}}
+	if err = internal.ExportReportingExports(dir, "fx-executed", nil, policies, internal.US); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filepath.Join(dir, "transactions.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 12500 SEK at the executed 8.3333 SEK per USD instead of a table rate.
+	if len(records) != 2 || records[1][7] != "1500.0060" {
+		t.Errorf("expected the proceeds at the executed rate, got %v", records)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "transactions.csv.meta.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata internal.ExportMetadata
+	if err = json.Unmarshal(data, &metadata); err != nil {
+		t.Fatal(err)
+	}
+	if fx := metadata.FX[0]; len(fx.Sources) != 1 || fx.Sources[0] != "executed" || fx.Converted != 1 {
+		t.Errorf("expected one amount at the executed rate, got %+v", fx)
+	}
+}
@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// IntegrityViolation is a row that breaks a foreign key or a rule of integrityRules
+type IntegrityViolation struct {
+	Table string
+	RowID int64
+	Rule  string
+	Value string // the offending value, quoted as SQL
+}
+
+func (v IntegrityViolation) String() string {
+	return fmt.Sprintf("%s row %d: %s, found %s", v.Table, v.RowID, v.Rule, v.Value)
+}
+
+var ErrIntegrityViolation = errors.New("ledger has rows that break its constraints, list them with `db check`")
+
+// integrityRule is a CHECK constraint on a column. NULL passes, as it does in SQLite.
+type integrityRule struct {
+	table  string
+	column string
+	check  string
+}
+
+func (r integrityRule) name() string {
+	return r.table + "_" + r.column
+}
+
+// integrityRules are the CHECK constraints enforce_integrity adds. Constraints added later need
+// a migration of their own, the ledgers that have enforce_integrity applied won't get them.
+var integrityRules = []integrityRule{
+	{"asset_lots", "shares", "shares >= 0"},
+	{"asset_lots", "cost_basis_per_share", "cost_basis_per_share >= 0"},
+	{"asset_lots_history", "shares", "shares >= 0"},
+	{"asset_lots_history", "cost_basis_per_share", "cost_basis_per_share >= 0"},
+	{"transactions", "price_per_share", "price_per_share >= 0"},
+	{"market_marks", "marked_shares", "marked_shares >= 0"},
+	{"market_marks", "marked_value_per_share", "marked_value_per_share >= 0"},
+	{"stock_plan_lots", "plan_type", "plan_type IN ('RSU', 'ESPP')"},
+	{"stock_plan_lots", "shares_withheld", "shares_withheld >= 0"},
+	{"espp_dispositions", "shares", "shares >= 0"},
+	{"corporate_actions", "ratio_from", "ratio_from > 0"},
+	{"corporate_actions", "ratio_to", "ratio_to >= 0"},
+	{"currency_rates", "rate", "rate > 0"},
+	{"prices", "price", "price >= 0"},
+	{"isk_rates", "tax_free_amount", "tax_free_amount >= 0"},
+	{"field_precisions", "places", fmt.Sprintf("places BETWEEN 0 AND %d", MAX_FIELD_PLACES)},
+}
+
+// integrityIndexes speed up the lookups of transactions by account and date, lots by symbol,
+// and the rows of a lot
+var integrityIndexes = []string{
+	`CREATE INDEX IF NOT EXISTS transactions_account_settlement_date ON transactions (account, settlement_date);`,
+	`CREATE INDEX IF NOT EXISTS transactions_share_lot ON transactions (share_lot);`,
+	`CREATE INDEX IF NOT EXISTS asset_lots_symbol ON asset_lots (symbol);`,
+	`CREATE INDEX IF NOT EXISTS asset_lots_history_id ON asset_lots_history (id);`,
+	`CREATE INDEX IF NOT EXISTS market_marks_asset_lot_id ON market_marks (asset_lot_id);`,
+}
+
+// CheckIntegrity returns the rows referring to rows that don't exist and the rows breaking a
+// CHECK constraint, whether or not the ledger enforces them yet
+func CheckIntegrity(db queryer) ([]IntegrityViolation, error) {
+	violations, err := foreignKeyViolations(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range integrityRules {
+		// Ledgers that aren't migrated yet can miss the table or the column.
+		columns, err := tableColumns(db, rule.table)
+		if err != nil {
+			return nil, err
+		}
+		if !hasColumn(columns, rule.column) {
+			continue
+		}
+		rows, err := db.Query(fmt.Sprintf(`SELECT rowid, quote(%q) FROM %q WHERE NOT (%s) ORDER BY rowid;`, rule.column, rule.table, rule.check))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			violation := IntegrityViolation{Table: rule.table, Rule: rule.check}
+			if err = rows.Scan(&violation.RowID, &violation.Value); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			violations = append(violations, violation)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return violations, nil
+}
+
+// foreignKeyViolations lists what PRAGMA foreign_key_check finds with the column and value
+// of each reference
+func foreignKeyViolations(db queryer) ([]IntegrityViolation, error) {
+	type foreignKey struct {
+		from, parent, to string
+	}
+	type orphan struct {
+		table string
+		rowID int64
+		key   int
+	}
+	var orphans []orphan
+	rows, err := db.Query(`PRAGMA foreign_key_check;`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var o orphan
+		var parent string
+		if err = rows.Scan(&o.table, &o.rowID, &parent, &o.key); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		orphans = append(orphans, o)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]map[int]foreignKey)
+	var violations []IntegrityViolation
+	for _, o := range orphans {
+		if _, ok := keys[o.table]; !ok {
+			keys[o.table] = make(map[int]foreignKey)
+			rows, err := db.Query(`SELECT id, "table", "from", COALESCE("to", '') FROM pragma_foreign_key_list(?);`, o.table)
+			if err != nil {
+				return nil, err
+			}
+			for rows.Next() {
+				var id int
+				var key foreignKey
+				if err = rows.Scan(&id, &key.parent, &key.from, &key.to); err != nil {
+					rows.Close()
+					return nil, err
+				}
+				keys[o.table][id] = key
+			}
+			rows.Close()
+			if err = rows.Err(); err != nil {
+				return nil, err
+			}
+		}
+		key := keys[o.table][o.key]
+		violation := IntegrityViolation{
+			Table: o.table,
+			RowID: o.rowID,
+			Rule:  fmt.Sprintf("%s references %s(%s)", key.from, key.parent, key.to),
+		}
+		err = db.QueryRow(fmt.Sprintf(`SELECT quote(%q) FROM %q WHERE rowid = ?;`, key.from, o.table), o.rowID).Scan(&violation.Value)
+		if err != nil {
+			return nil, err
+		}
+		violations = append(violations, violation)
+	}
+	return violations, nil
+}
+
+/*
+enforceIntegrity adds the CHECK constraints of integrityRules and the integrityIndexes. It
+fails with ErrIntegrityViolation, leaving the ledger as it was, when rows break them or a
+foreign key, which the connections of the ledger enforce from then on.
+*/
+func enforceIntegrity(tx *sql.Tx) error {
+	violations, err := CheckIntegrity(tx)
+	if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("%w: %d violations", ErrIntegrityViolation, len(violations))
+	}
+	var tables []string
+	checks := make(map[string][]string)
+	for _, rule := range integrityRules {
+		if _, ok := checks[rule.table]; !ok {
+			tables = append(tables, rule.table)
+		}
+		checks[rule.table] = append(checks[rule.table], fmt.Sprintf("CONSTRAINT %s CHECK (%s)", rule.name(), rule.check))
+	}
+	for _, table := range tables {
+		var create string
+		if err = tx.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?;`, table).Scan(&create); err != nil {
+			return err
+		}
+		// Tables written by hand or renamed may quote their name differently, rebuildTable
+		// needs it quoted.
+		start, end := strings.Index(create, "("), strings.LastIndex(create, ")")
+		create = fmt.Sprintf("CREATE TABLE %q %s\n\t,%s\n)",
+			table, strings.TrimRight(create[start:end], " \t\n"), strings.Join(checks[table], "\n\t,"))
+		if err = rebuildTable(tx, table, create, nil); err != nil {
+			return err
+		}
+	}
+	for _, index := range integrityIndexes {
+		if _, err = tx.Exec(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package internal_test
+
+import (
+	"accounting/internal"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ericlagergren/decimal"
+)
+
+func TestIntegrityEnforced(t *testing.T) {
+	internal.InitializeDB()
+	zero := decimal.New(0, 4)
+	_, err := internal.InsertTransaction(internal.Transaction{
+		AccountID:       "integrity-test",
+		TransactionType: internal.SALE_TRANSACTION,
+		SettlementDate:  time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		ShareLot:        "integrity-missing-lot",
+		Shares:          zero,
+		PricePerShare:   zero,
+		ShareValue:      zero,
+		FeesAmount:      zero,
+		TotalAmount:     zero,
+		Currency:        internal.SEK,
+	}, nil)
+	if err == nil {
+		t.Error("expected a transaction of a missing lot to break its foreign key")
+	}
+
+	tx, err := internal.GlobalDB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	_, err = internal.InsertAssetLot(internal.AssetLot{
+		AccountID:         "integrity-test",
+		Symbol:            "NEG",
+		Shares:            decimal.New(-1, 0),
+		CostBasisPerShare: decimal.New(1, 0),
+		CostBasisCurrency: internal.SEK,
+		CreatedDate:       time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+	}, tx)
+	if err == nil {
+		t.Error("expected a lot of negative shares to break asset_lots_shares")
+	}
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	internal.InitializeDB()
+	violations, err := internal.CheckIntegrity(internal.GlobalDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 0 {
+		t.Fatalf("expected no violations, got %v", violations)
+	}
+
+	// Rows written before foreign keys were enforced.
+	ctx := context.Background()
+	conn, err := internal.GlobalDB.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF;`); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.ExecContext(ctx, `PRAGMA foreign_keys = ON;`)
+	result, err := conn.ExecContext(ctx, `
+		INSERT INTO transactions (account, transaction_type, settlement_date, share_lot, total_amount, currency)
+		VALUES ('integrity-test', 1, '2024-03-01', 'integrity-orphan', 0, 'SEK');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+	defer conn.ExecContext(ctx, `DELETE FROM transactions WHERE id = ?;`, id)
+
+	violations, err = internal.CheckIntegrity(internal.GlobalDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 1 || violations[0].Table != "transactions" || violations[0].RowID != id || violations[0].Value != "'integrity-orphan'" {
+		t.Errorf("expected the orphan transaction %d, got %v", id, violations)
+	}
+}
@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ericlagergren/decimal"
+)
+
+var (
+	ErrISKRateMissing          = errors.New("no ISK rate stored for year")
+	ErrNotISKAccount           = errors.New("account is not an ISK or KF account")
+	ErrISKOverridesNeedAccount = errors.New("quarter values can only be given for a single account")
+	ErrISKQuarterValueMissing  = errors.New("no quarter start value")
+)
+
+var (
+	iskMinimumRate     = decimal.New(125, 2) // schablonränta floor, percent
+	iskRateAddition    = decimal.New(1, 0)   // percentage point added to the statslåneränta
+	iskTaxRate         = decimal.New(30, 2)  // capital income tax on the schablonintäkt
+	iskPercentDivisor  = decimal.New(100, 0)
+	iskQuartersPerYear = decimal.New(4, 0)
+)
+
+type ISKQuarterValue struct {
+	Date   time.Time
+	Value  *decimal.Big // SEK
+	Source string
+}
+
+// ISKAccountBase is the kapitalunderlag of one account: the quarter start values
+// plus the year's deposits, divided by four.
+type ISKAccountBase struct {
+	Account     string
+	AccountType AccountType
+	Quarters    [4]ISKQuarterValue
+	Deposits    *decimal.Big
+	CapitalBase *decimal.Big
+}
+
+type ISKReport struct {
+	Year           int
+	Rate           ISKRate
+	StandardRate   *decimal.Big // schablonränta, percent
+	Accounts       []ISKAccountBase
+	CapitalBase    *decimal.Big
+	TaxFreeAmount  *decimal.Big
+	TaxableBase    *decimal.Big
+	StandardIncome *decimal.Big // schablonintäkt
+	Tax            *decimal.Big
+	FX             []FXColumn // policy and rate sources of the SEK conversions
+}
+
+// ISKStandardRate is the statslåneränta plus one percentage point, at least 1.25 percent
+func ISKStandardRate(governmentBondRate *decimal.Big) *decimal.Big {
+	rate := decimal.New(0, 4).Add(governmentBondRate, iskRateAddition)
+	if rate.Cmp(iskMinimumRate) < 0 {
+		rate.Copy(iskMinimumRate)
+	}
+	return rate
+}
+
+// ISK_SEK_COLUMN is the column of the ISK report converted to SEK, calendar-year by default
+const ISK_SEK_COLUMN = "SEK"
+
+var iskFXColumns = map[string]FXPolicy{ISK_SEK_COLUMN: CALENDAR_YEAR_FX_POLICY}
+
+// iskQuarterValue returns the value of an account at the start of quarter i, 0 before the account
+// was opened. Without an override or marks it fails rather than understating the capital base.
+func iskQuarterValue(account Account, i int, date time.Time, override *decimal.Big, converter *fxConverter) (ISKQuarterValue, error) {
+	quarter := ISKQuarterValue{Date: date, Value: decimal.New(0, 4)}
+	if override != nil {
+		quarter.Value = override
+		quarter.Source = "manual"
+		return quarter, nil
+	}
+	if account.OpenedDate != nil && account.OpenedDate.After(date) {
+		quarter.Source = "opened " + account.OpenedDate.Format(time.DateOnly)
+		return quarter, nil
+	}
+	values, markDate, err := GetAccountMarkedValue(account.ID, date)
+	if err != nil {
+		return quarter, err
+	}
+	if markDate == nil {
+		return quarter, fmt.Errorf("%w: account %s has no marks in the week up to %s, mark it or give the value with --q%d",
+			ErrISKQuarterValueMissing, account.ID, date.Format(time.DateOnly), i+1)
+	}
+	for currency, value := range values {
+		sek, err := converter.convert(ISK_SEK_COLUMN, value, currency, SEK, *markDate)
+		if err != nil {
+			return quarter, err
+		}
+		quarter.Value.Add(quarter.Value, sek)
+	}
+	quarter.Source = "marks " + markDate.Format(time.DateOnly)
+	return quarter, nil
+}
+
+/*
+ComputeISKReport works out the schablonintäkt and tax of the ISK and KF accounts
+for a year, or of a single account when one is given. Quarter start values come
+from the latest marks in the week up to January 1, April 1, July 1 and October 1
+unless overridden, a quarter without either fails the report. Marks only cover
+securities, so cash held in the account has to be added through the overrides.
+The skattefri nivå is deducted once from the combined capital base since it
+applies per person. Marks and deposits in other currencies are converted to SEK
+with the policy of the SEK column, deposits at their settlement date.
+*/
+func ComputeISKReport(year int, account string, overrides [4]*decimal.Big, policies FXPolicies) (ISKReport, error) {
+	report := ISKReport{Year: year, CapitalBase: decimal.New(0, 4)}
+	converter, err := newFXConverter(policies, iskFXColumns)
+	if err != nil {
+		return report, err
+	}
+	rate, err := GetISKRate(year)
+	if errors.Is(err, sql.ErrNoRows) {
+		return report, fmt.Errorf("%w %d", ErrISKRateMissing, year)
+	}
+	if err != nil {
+		return report, err
+	}
+	report.Rate = rate
+	report.StandardRate = ISKStandardRate(rate.GovernmentBondRate)
+
+	var accounts []string
+	if account != "" {
+		accountType, err := GetAccountType(account)
+		if err != nil {
+			return report, err
+		}
+		if accountType != ISK_ACCOUNT && accountType != KF_ACCOUNT {
+			return report, fmt.Errorf("%w: %s", ErrNotISKAccount, account)
+		}
+		accounts = []string{account}
+	} else {
+		for _, override := range overrides {
+			if override != nil {
+				return report, ErrISKOverridesNeedAccount
+			}
+		}
+		accounts, err = GetAccountsByType(ISK_ACCOUNT, KF_ACCOUNT)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	yearStart := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, id := range accounts {
+		account, err := GetAccount(id)
+		if err != nil {
+			return report, err
+		}
+		base := ISKAccountBase{Account: id, AccountType: account.AccountType, Deposits: decimal.New(0, 4), CapitalBase: decimal.New(0, 4)}
+		for i := range base.Quarters {
+			base.Quarters[i], err = iskQuarterValue(account, i, yearStart.AddDate(0, 3*i, 0), overrides[i], converter)
+			if err != nil {
+				return report, err
+			}
+			base.CapitalBase.Add(base.CapitalBase, base.Quarters[i].Value)
+		}
+		deposits, err := GetAccountCashFlows(id, DEPOSIT_TRANSACTION, yearStart, yearStart.AddDate(1, 0, 0))
+		if err != nil {
+			return report, err
+		}
+		for _, deposit := range deposits {
+			sek, err := converter.convert(ISK_SEK_COLUMN, deposit.TotalAmount, deposit.Currency, SEK, deposit.SettlementDate)
+			if err != nil {
+				return report, err
+			}
+			base.Deposits.Add(base.Deposits, sek)
+		}
+		base.CapitalBase.Add(base.CapitalBase, base.Deposits)
+		base.CapitalBase.Quo(base.CapitalBase, iskQuartersPerYear).Quantize(4)
+		report.CapitalBase.Add(report.CapitalBase, base.CapitalBase)
+		report.Accounts = append(report.Accounts, base)
+	}
+
+	report.TaxFreeAmount = decimal.New(0, 4).Copy(rate.TaxFreeAmount)
+	if report.TaxFreeAmount.Cmp(report.CapitalBase) > 0 {
+		report.TaxFreeAmount.Copy(report.CapitalBase)
+	}
+	report.TaxableBase = decimal.New(0, 4).Sub(report.CapitalBase, report.TaxFreeAmount)
+	report.StandardIncome = decimal.New(0, 4).Mul(report.TaxableBase, report.StandardRate)
+	report.StandardIncome.Quo(report.StandardIncome, iskPercentDivisor).Quantize(4)
+	report.Tax = decimal.New(0, 4).Mul(report.StandardIncome, iskTaxRate).Quantize(4)
+	report.FX = converter.Columns()
+	return report, nil
+}
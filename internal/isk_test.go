@@ -0,0 +1,145 @@
+package internal_test
+
+import (
+	"accounting/internal"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ericlagergren/decimal"
+)
+
+func TestISKStandardRate(t *testing.T) {
+	// 2024: statslåneränta 2.62% + 1 percentage point.
+	if rate := internal.ISKStandardRate(decimal.New(262, 2)); rate.Cmp(decimal.New(362, 2)) != 0 {
+		t.Errorf("expected 3.62, got %s", rate)
+	}
+	// 2022: 0.23% + 1 is below the 1.25% floor.
+	if rate := internal.ISKStandardRate(decimal.New(23, 2)); rate.Cmp(decimal.New(125, 2)) != 0 {
+		t.Errorf("expected 1.25, got %s", rate)
+	}
+}
+
+func TestComputeISKReport(t *testing.T) {
+	internal.InitializeDB()
+	opened := time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)
+	older := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	for _, account := range []internal.Account{
+		{ID: "isk-test", Broker: "nordnet", AccountType: internal.ISK_ACCOUNT, BaseCurrency: internal.SEK, OpenedDate: &opened},
+		{ID: "isk-test-unmarked", Broker: "nordnet", AccountType: internal.ISK_ACCOUNT, BaseCurrency: internal.SEK, OpenedDate: &older},
+	} {
+		if err := internal.InsertAccount(account); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx, err := internal.GlobalDB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lot := internal.AssetLot{
+		AccountID:         "isk-test",
+		Exchange:          "Stockholm",
+		Symbol:            "ISKTEST",
+		ISIN:              "SE0000000ISK",
+		Shares:            decimal.New(100, 0),
+		CostBasisPerShare: decimal.New(100, 0),
+		CostBasisCurrency: internal.SEK,
+		CreatedDate:       opened,
+	}
+	if lot.ID, err = internal.InsertAssetLot(lot, tx); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	// Marks on the last day of a quarter count for the start of the next one.
+	for i, date := range []string{"2024-03-31", "2024-06-30", "2024-09-30"} {
+		markDate, _ := time.Parse(time.DateOnly, date)
+		if err = internal.MarkAssetLot(markDate, lot, decimal.New(int64(110+10*i), 0), markDate, tx); err != nil {
+			tx.Rollback()
+			t.Fatal(err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	zero := decimal.New(0, 4)
+	for _, deposit := range []struct {
+		date     time.Time
+		amount   *decimal.Big
+		currency internal.CurrencyUnit
+	}{
+		{opened, decimal.New(10000, 0), internal.SEK},
+		{time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC), decimal.New(100, 0), internal.USD},
+		// Outside the year.
+		{time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC), decimal.New(5000, 0), internal.SEK},
+	} {
+		_, err = internal.InsertTransaction(internal.Transaction{
+			AccountID:       "isk-test",
+			TransactionType: internal.DEPOSIT_TRANSACTION,
+			SettlementDate:  deposit.date,
+			Symbol:          "CASH",
+			Shares:          zero,
+			PricePerShare:   zero,
+			ShareValue:      zero,
+			FeesAmount:      zero,
+			TotalAmount:     deposit.amount,
+			Currency:        deposit.currency,
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := internal.ComputeISKReport(2024, "isk-test", [4]*decimal.Big{}, internal.FXPolicies{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Accounts) != 1 {
+		t.Fatalf("expected one account, got %d", len(report.Accounts))
+	}
+	base := report.Accounts[0]
+	quarters := []struct {
+		value  int64
+		source string
+	}{
+		{0, "opened 2024-03-15"},
+		{11000, "marks 2024-03-31"},
+		{12000, "marks 2024-06-30"},
+		{13000, "marks 2024-09-30"},
+	}
+	for i, quarter := range quarters {
+		if base.Quarters[i].Value.Cmp(decimal.New(quarter.value, 0)) != 0 || base.Quarters[i].Source != quarter.source {
+			t.Errorf("expected quarter %d at %d from %s, got %s from %s", i+1, quarter.value, quarter.source, base.Quarters[i].Value, base.Quarters[i].Source)
+		}
+	}
+	// 10000 SEK plus 100 USD at the 2024 rate.
+	rate, err := internal.RateToOneUSD(internal.SEK, time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC), internal.CALENDAR_YEAR_FX_POLICY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deposits := decimal.New(0, 4).Mul(decimal.New(100, 0), rate.Rate)
+	deposits.Add(deposits, decimal.New(10000, 0))
+	if base.Deposits.Cmp(deposits) != 0 {
+		t.Errorf("expected %s SEK of deposits, got %s", deposits, base.Deposits)
+	}
+	capitalBase := decimal.New(0, 4).Add(deposits, decimal.New(36000, 0))
+	capitalBase.Quo(capitalBase, decimal.New(4, 0)).Quantize(4)
+	if base.CapitalBase.Cmp(capitalBase) != 0 {
+		t.Errorf("expected a capital base of %s, got %s", capitalBase, base.CapitalBase)
+	}
+
+	if _, err = internal.ComputeISKReport(2024, "isk-test-unmarked", [4]*decimal.Big{}, internal.FXPolicies{}); !errors.Is(err, internal.ErrISKQuarterValueMissing) {
+		t.Errorf("expected quarters without marks to fail, got %v", err)
+	}
+	if _, err = internal.ComputeISKReport(2024, "", [4]*decimal.Big{}, internal.FXPolicies{}); !errors.Is(err, internal.ErrISKQuarterValueMissing) {
+		t.Errorf("expected the report of all accounts to fail on the unmarked one, got %v", err)
+	}
+	overrides := [4]*decimal.Big{decimal.New(1000, 0), decimal.New(2000, 0), decimal.New(3000, 0), decimal.New(4000, 0)}
+	report, err = internal.ComputeISKReport(2024, "isk-test-unmarked", overrides, internal.FXPolicies{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base = report.Accounts[0]; base.CapitalBase.Cmp(decimal.New(2500, 0)) != 0 || base.Quarters[0].Source != "manual" {
+		t.Errorf("expected the overrides to give a capital base of 2500, got %s from %s", base.CapitalBase, base.Quarters[0].Source)
+	}
+}
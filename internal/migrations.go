@@ -0,0 +1,410 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles are the SQL migrations, named VERSION_name.sql
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration is a versioned change of the schema, applied once and in the order of its version
+type Migration struct {
+	Version int
+	Name    string
+	apply   func(tx *sql.Tx) error
+}
+
+// MigrationStatus is a migration and when it was applied to the ledger, nil while pending
+type MigrationStatus struct {
+	Migration
+	AppliedDate *time.Time
+}
+
+// goMigrations are the migrations that need more than SQL, numbered along with the embedded files
+var goMigrations = []Migration{
+	{Version: 2, Name: "backfill_columns", apply: backfillColumns},
+	{Version: 5, Name: "enforce_integrity", apply: enforceIntegrity},
+}
+
+var (
+	ErrInvalidMigration = errors.New("invalid migration")
+	ErrUnknownMigration = errors.New("ledger has migrations this version doesn't know, it was migrated by a newer version")
+)
+
+const schemaMigrationsTable = `
+	CREATE TABLE IF NOT EXISTS "schema_migrations" (
+		version						INTEGER PRIMARY KEY
+		,name						TEXT NOT NULL
+		,applied_date				TIMESTAMP NOT NULL
+	)
+`
+
+// Migrations returns the embedded SQL and the Go migrations ordered by version. Versions
+// start at 1 and leave no gaps.
+func Migrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+	migrations := append([]Migration{}, goMigrations...)
+	for _, entry := range entries {
+		number, name, found := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		version, err := strconv.Atoi(number)
+		if !found || err != nil {
+			return nil, fmt.Errorf("%w: %s isn't named VERSION_name.sql", ErrInvalidMigration, entry.Name())
+		}
+		path := "migrations/" + entry.Name()
+		migrations = append(migrations, Migration{Version: version, Name: name, apply: func(tx *sql.Tx) error {
+			statements, err := migrationFiles.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(string(statements))
+			return err
+		}})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			return nil, fmt.Errorf("%w: expected version %d, found %d %s", ErrInvalidMigration, i+1, migration.Version, migration.Name)
+		}
+	}
+	return migrations, nil
+}
+
+// GetMigrationStatus returns every migration and whether the ledger has it applied
+func GetMigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	var exists int
+	err = GlobalDB.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations';`).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]time.Time)
+	if exists > 0 {
+		rows, err := GlobalDB.Query(`SELECT version, applied_date FROM schema_migrations;`)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var version int
+			var appliedDate time.Time
+			if err = rows.Scan(&version, &appliedDate); err != nil {
+				return nil, err
+			}
+			applied[version] = appliedDate
+		}
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]MigrationStatus, len(migrations))
+	for i, migration := range migrations {
+		result[i] = MigrationStatus{Migration: migration}
+		if appliedDate, ok := applied[migration.Version]; ok {
+			result[i].AppliedDate = &appliedDate
+			delete(applied, migration.Version)
+		}
+	}
+	if len(applied) > 0 {
+		unknown := make([]int, 0, len(applied))
+		for version := range applied {
+			unknown = append(unknown, version)
+		}
+		sort.Ints(unknown)
+		return result, fmt.Errorf("%w: %v", ErrUnknownMigration, unknown)
+	}
+	return result, nil
+}
+
+/*
+MigrateDB applies the pending migrations in order, each in a transaction of its own. A ledger
+that already has tables is first copied next to itself, backup is the path of the copy or ""
+when none was made. applied holds the migrations that were applied, also when one fails.
+*/
+func MigrateDB() (applied []Migration, backup string, err error) {
+	status, err := GetMigrationStatus()
+	if err != nil {
+		return nil, "", err
+	}
+	version := 0
+	var pending []Migration
+	for _, s := range status {
+		if s.AppliedDate == nil {
+			pending = append(pending, s.Migration)
+		} else {
+			version = s.Version
+		}
+	}
+	if len(pending) == 0 {
+		return nil, "", nil
+	}
+	if backup, err = backupDB(version); err != nil {
+		return nil, "", err
+	}
+	if _, err = GlobalDB.Exec(schemaMigrationsTable); err != nil {
+		return nil, backup, err
+	}
+	// Foreign keys can't be turned off inside a transaction, so the migrations run on a
+	// connection of their own that has them off.
+	ctx := context.Background()
+	conn, err := GlobalDB.Conn(ctx)
+	if err != nil {
+		return nil, backup, err
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF;`); err != nil {
+		return nil, backup, err
+	}
+	defer conn.ExecContext(ctx, `PRAGMA foreign_keys = ON;`)
+	for _, migration := range pending {
+		if err = applyMigration(ctx, conn, migration); err != nil {
+			return applied, backup, fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+		}
+		applied = append(applied, migration)
+	}
+	return applied, backup, nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err = migration.apply(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO schema_migrations (version, name, applied_date) VALUES (?, ?, ?);`,
+		migration.Version, migration.Name, time.Now())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// backupDB copies the opened ledger, when it has tables, to <ledger>.vVERSION-TIMESTAMP.bak
+func backupDB(version int) (string, error) {
+	var tables int
+	err := GlobalDB.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name != 'schema_migrations';`).Scan(&tables)
+	if err != nil || tables == 0 {
+		return "", err
+	}
+	backup := fmt.Sprintf("%s.v%d-%s.bak", openedLedgerPath, version, time.Now().Format("20060102T150405"))
+	if _, err = GlobalDB.Exec(`VACUUM INTO ?;`, backup); err != nil {
+		return "", fmt.Errorf("backing up %s: %w", openedLedgerPath, err)
+	}
+	return backup, nil
+}
+
+// createStatement returns the CREATE TABLE statement of table in the create_tables migration
+func createStatement(table string) (string, error) {
+	statements, err := migrationFiles.ReadFile("migrations/0001_create_tables.sql")
+	if err != nil {
+		return "", err
+	}
+	for _, statement := range strings.Split(string(statements), ";") {
+		if strings.Contains(statement, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%s" (`, table)) {
+			return statement, nil
+		}
+	}
+	return "", fmt.Errorf("%w: create_tables doesn't create %s", ErrInvalidMigration, table)
+}
+
+type tableColumn struct {
+	Name string
+	Type string
+}
+
+// tableColumns returns the columns of table in the order they are declared
+func tableColumns(db queryer, table string) ([]tableColumn, error) {
+	rows, err := db.Query(fmt.Sprintf(`PRAGMA table_info(%q);`, table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []tableColumn
+	for rows.Next() {
+		var cid, notNull, pk int
+		var column tableColumn
+		var defaultValue sql.NullString
+		if err = rows.Scan(&cid, &column.Name, &column.Type, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+/*
+rebuildTable replaces table with the one create makes, which has to declare every column table
+has. SQLite can't change the type or the constraints of a column, so the rows are copied to a
+new table which then replaces the old one and gets its indexes and AUTOINCREMENT counter.
+expressions replace the column names the rows are copied with. Migrations run with foreign
+keys off, dropping the old table would otherwise delete or fail on the rows referring to it.
+*/
+func rebuildTable(tx *sql.Tx, table string, create string, expressions map[string]string) error {
+	columns, err := tableColumns(tx, table)
+	if err != nil {
+		return err
+	}
+	var indexes []string
+	rows, err := tx.Query(`SELECT sql FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL;`, table)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var index string
+		if err = rows.Scan(&index); err != nil {
+			rows.Close()
+			return err
+		}
+		indexes = append(indexes, index)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	var sequence sql.NullInt64
+	err = tx.QueryRow(`
+		SELECT seq FROM sqlite_sequence WHERE name = ? AND EXISTS (SELECT 1 FROM sqlite_master WHERE name = 'sqlite_sequence');
+	`, table).Scan(&sequence)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	rebuilt := table + "_rebuilt"
+	if _, err = tx.Exec(strings.Replace(create, fmt.Sprintf(`"%s"`, table), fmt.Sprintf(`"%s"`, rebuilt), 1)); err != nil {
+		return err
+	}
+	quoted := make([]string, len(columns))
+	selected := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = fmt.Sprintf("%q", column.Name)
+		selected[i] = quoted[i]
+		if expression, ok := expressions[column.Name]; ok {
+			selected[i] = expression
+		}
+	}
+	_, err = tx.Exec(fmt.Sprintf(`INSERT INTO %q (%s) SELECT %s FROM %q;`,
+		rebuilt, strings.Join(quoted, ", "), strings.Join(selected, ", "), table))
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(fmt.Sprintf(`DROP TABLE %q;`, table)); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %q RENAME TO %q;`, rebuilt, table)); err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if _, err = tx.Exec(index); err != nil {
+			return err
+		}
+	}
+	if sequence.Valid {
+		_, err = tx.Exec(`UPDATE sqlite_sequence SET seq = MAX(seq, ?) WHERE name = ?;`, sequence.Int64, table)
+	}
+	return err
+}
+
+// legacyColumns are the columns added to tables after they were first created, in the order
+// they were added. Ledgers created before migrations can be missing any of them.
+var legacyColumns = []struct{ table, column, definition string }{
+	{"supported_currencies", "locale", "TEXT NOT NULL DEFAULT 'US'"},
+	{"asset_lots", "exchange", "TEXT NOT NULL DEFAULT ''"},
+	{"asset_lots", "security_id", "TEXT REFERENCES securities(id)"},
+	{"asset_lots_history", "corporate_action_id", "INTEGER REFERENCES corporate_actions(id)"},
+	{"transactions", "instrument_currency", "CHAR(3)"},
+	{"transactions", "instrument_amount", "BIGINT"},
+	{"transactions", "executed_fx_rate", "BIGINT"},
+	{"currency_rates", "source", "TEXT NOT NULL DEFAULT 'seed'"},
+	{"currency_rates", "base_currency", "CHAR(3) NOT NULL DEFAULT 'USD'"},
+	{"market_marks", "superseded_date", "TIMESTAMP"},
+	{"market_marks", "price_date", "TIMESTAMP"},
+	{"corporate_actions", "basis_allocation", "BIGINT"},
+	{"accounts", "broker", "TEXT NOT NULL DEFAULT ''"},
+	{"accounts", "base_currency", "CHAR(3) NOT NULL DEFAULT ''"},
+	{"accounts", "opened_date", "TIMESTAMP"},
+	{"accounts", "owners", "TEXT NOT NULL DEFAULT ''"},
+	{"accounts", "institution", "TEXT NOT NULL DEFAULT ''"},
+	{"accounts", "institution_address", "TEXT NOT NULL DEFAULT ''"},
+}
+
+func hasColumn(columns []tableColumn, name string) bool {
+	for _, column := range columns {
+		if column.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// backfillColumns brings tables created before migrations up to create_tables
+func backfillColumns(tx *sql.Tx) error {
+	for _, c := range legacyColumns {
+		columns, err := tableColumns(tx, c.table)
+		if err != nil {
+			return err
+		}
+		if hasColumn(columns, c.column) {
+			continue
+		}
+		if _, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %q ADD COLUMN %q %s;`, c.table, c.column, c.definition)); err != nil {
+			return err
+		}
+		// Amounts in SEK were always written with decimal commas.
+		if c.table == "supported_currencies" && c.column == "locale" {
+			if _, err = tx.Exec(`UPDATE supported_currencies SET locale = 'SE' WHERE id = 'SEK';`); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.Exec(supportedCurrenciesSeed); err != nil {
+		return err
+	}
+	// Lot tables used to declare the cost basis per share TEXT, which sorts "900000" after
+	// "1250000", and its currency BIGINT.
+	for _, table := range []string{"asset_lots", "asset_lots_history"} {
+		create, err := createStatement(table)
+		if err != nil {
+			return err
+		}
+		if err = retypeCostBasisColumns(tx, table, create); err != nil {
+			return err
+		}
+	}
+	// One current mark per lot and date. Re-marking a lot used to add another current mark,
+	// the latest one stays current and the others are superseded now.
+	_, err := tx.Exec(`
+		UPDATE market_marks SET superseded_date = ?
+		WHERE superseded_date IS NULL AND id NOT IN (
+			SELECT MAX(id) FROM market_marks WHERE superseded_date IS NULL GROUP BY asset_lot_id, market_mark_date
+		);
+	`, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		CREATE UNIQUE INDEX IF NOT EXISTS market_marks_current_lot_date
+		ON market_marks (asset_lot_id, market_mark_date) WHERE superseded_date IS NULL;
+	`)
+	return err
+}
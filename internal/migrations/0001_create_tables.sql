@@ -0,0 +1,191 @@
+-- Tables of the ledger as they were when migrations were introduced. Ledgers created before
+-- then already have them, backfill_columns adds the columns they are missing.
+
+CREATE TABLE IF NOT EXISTS "supported_currencies" (
+	 id                   	CHAR(3) PRIMARY KEY
+	,name      				TEXT NOT NULL
+	,locale					TEXT NOT NULL DEFAULT 'US' -- number format of its amounts in exports: SE or US
+);
+
+CREATE TABLE IF NOT EXISTS "asset_lots" (
+	 id                   	TEXT PRIMARY KEY
+	,account				TEXT NOT NULL
+	,exchange				TEXT NOT NULL DEFAULT ''
+	,symbol				 	TEXT NOT NULL
+	,isin      				TEXT NOT NULL
+	,shares       			BIGINT NOT NULL
+	,cost_basis_per_share   BIGINT
+	,cost_basis_currency   	CHAR(3)
+	,created_date   		TIMESTAMP NOT NULL
+	,security_id			TEXT
+	,FOREIGN KEY (cost_basis_currency) REFERENCES supported_currencies(id)
+	,FOREIGN KEY (security_id) REFERENCES securities(id)
+);
+
+CREATE TABLE IF NOT EXISTS "asset_lots_history" (
+	 int_id                 INTEGER PRIMARY KEY AUTOINCREMENT
+	,id                   	TEXT
+	,account               	TEXT
+	,symbol				 	TEXT NOT NULL
+	,isin      				TEXT NOT NULL
+	,shares       			BIGINT NOT NULL
+	,cost_basis_per_share   BIGINT
+	,cost_basis_currency   	CHAR(3)
+	,as_of_date   			TIMESTAMP NOT NULL
+	,corporate_action_id	INTEGER
+	,FOREIGN KEY (cost_basis_currency) REFERENCES supported_currencies(id)
+	,FOREIGN KEY (corporate_action_id) REFERENCES corporate_actions(id)
+);
+
+CREATE TABLE IF NOT EXISTS "transactions" (
+	 id                   	INTEGER PRIMARY KEY AUTOINCREMENT
+	,account			 	TEXT
+	,transaction_reference 	TEXT
+	,transaction_type      	SMALLINT NOT NULL
+	,settlement_date       	TIMESTAMP NOT NULL
+	,symbol					TEXT
+	,share_lot      		TEXT
+	,shares        			BIGINT
+	,price_per_share 		BIGINT
+	,share_value    		BIGINT
+	,fees_amount 			BIGINT NOT NULL DEFAULT 0
+	,total_amount 			BIGINT NOT NULL
+	,currency    			CHAR(3) NOT NULL
+	,instrument_currency	CHAR(3) -- currency the instrument trades in, when it isn't currency
+	,instrument_amount		BIGINT -- trade amount in instrument_currency
+	,executed_fx_rate		BIGINT -- currency per one instrument_currency the broker executed at
+	,FOREIGN KEY (share_lot) REFERENCES asset_lots(id)
+	,FOREIGN KEY (currency) REFERENCES supported_currencies(id)
+);
+
+CREATE TABLE IF NOT EXISTS "currency_rates" (
+	id                   	INTEGER PRIMARY KEY AUTOINCREMENT
+	,currency_code 			CHAR(3)
+	,rate 		     		BIGINT -- how much to one USD
+	,as_of_date    			TIMESTAMP
+	,source					TEXT NOT NULL DEFAULT 'seed' -- seed, riksbank, ecb, irs, treasury or nordnet
+	,base_currency			CHAR(3) NOT NULL DEFAULT 'USD' -- rate is how much to one of this currency
+	,FOREIGN KEY (currency_code) REFERENCES supported_currencies(id)
+);
+
+CREATE TABLE IF NOT EXISTS "market_marks" (
+	id                   		INTEGER PRIMARY KEY AUTOINCREMENT
+	,account	 				TEXT
+	,asset_lot_id 				TEXT
+	,market_mark_date			TIMESTAMP
+	,marked_shares				BIGINT
+	,marked_value_per_share 	BIGINT
+	,marked_value_currency		CHAR(3)
+	,gain_loss				 	BIGINT
+	,superseded_date			TIMESTAMP -- set when the lot is re-marked for the same date
+	,price_date					TIMESTAMP -- trading day of the price, on or before the mark date
+	,FOREIGN KEY (asset_lot_id) REFERENCES asset_lots(id)
+	,FOREIGN KEY (marked_value_currency) REFERENCES supported_currencies(id)
+);
+
+CREATE TABLE IF NOT EXISTS "stock_plan_lots" (
+	asset_lot_id 				TEXT PRIMARY KEY
+	,plan_type					TEXT NOT NULL -- RSU or ESPP
+	,grant_date					TIMESTAMP
+	,event_date					TIMESTAMP NOT NULL -- vest or purchase date
+	,fair_market_value			BIGINT NOT NULL
+	,purchase_price				BIGINT
+	,grant_date_fmv				BIGINT
+	,discount_income			BIGINT -- per share
+	,shares_withheld			BIGINT NOT NULL DEFAULT 0
+	,FOREIGN KEY (asset_lot_id) REFERENCES asset_lots(id)
+);
+
+CREATE TABLE IF NOT EXISTS "espp_dispositions" (
+	id                   		INTEGER PRIMARY KEY AUTOINCREMENT
+	,transaction_id				INTEGER
+	,asset_lot_id 				TEXT
+	,disposition_date			TIMESTAMP NOT NULL
+	,shares						BIGINT NOT NULL
+	,qualifying					BOOLEAN NOT NULL
+	,ordinary_income			BIGINT
+	,FOREIGN KEY (transaction_id) REFERENCES transactions(id)
+	,FOREIGN KEY (asset_lot_id) REFERENCES asset_lots(id)
+);
+
+CREATE TABLE IF NOT EXISTS "corporate_actions" (
+	id                   		INTEGER PRIMARY KEY AUTOINCREMENT
+	,action_type				TEXT NOT NULL
+	,account					TEXT NOT NULL DEFAULT '' -- '' applies to every account
+	,symbol						TEXT NOT NULL DEFAULT ''
+	,isin						TEXT NOT NULL DEFAULT ''
+	,effective_date				TIMESTAMP NOT NULL
+	,ratio_from					BIGINT NOT NULL
+	,ratio_to					BIGINT NOT NULL
+	,new_symbol					TEXT NOT NULL DEFAULT ''
+	,new_isin					TEXT NOT NULL DEFAULT ''
+	,cash_per_share				BIGINT
+	,cash_in_lieu_price			BIGINT
+	,basis_allocation			BIGINT -- percent of parent basis moved to spin-off shares
+	,currency					CHAR(3)
+	,source						TEXT NOT NULL DEFAULT 'manual'
+	,note						TEXT NOT NULL DEFAULT ''
+	,applied_date				TIMESTAMP
+	,FOREIGN KEY (currency) REFERENCES supported_currencies(id)
+);
+
+CREATE TABLE IF NOT EXISTS "dividend_classifications" (
+	transaction_id				INTEGER PRIMARY KEY
+	,qualified					BOOLEAN NOT NULL
+	,qualified_amount			BIGINT NOT NULL
+	,payer_country				CHAR(2) NOT NULL DEFAULT ''
+	,reason						TEXT NOT NULL
+	,classified_date			TIMESTAMP NOT NULL
+	,FOREIGN KEY (transaction_id) REFERENCES transactions(id)
+);
+
+CREATE TABLE IF NOT EXISTS "securities" (
+	id							TEXT PRIMARY KEY -- ISIN, or CURRENCY:SYMBOL without one
+	,isin						TEXT NOT NULL DEFAULT ''
+	,name						TEXT NOT NULL DEFAULT ''
+	,yahoo_symbol				TEXT NOT NULL DEFAULT ''
+	,currency					CHAR(3) NOT NULL DEFAULT ''
+	,asset_class				TEXT NOT NULL DEFAULT 'EQUITY' -- EQUITY, FUND, ETF, BOND or ETC
+	,pfic						BOOLEAN NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS "security_tickers" (
+	security_id					TEXT NOT NULL
+	,exchange					TEXT NOT NULL DEFAULT ''
+	,ticker						TEXT NOT NULL
+	,PRIMARY KEY (security_id, exchange)
+	,FOREIGN KEY (security_id) REFERENCES securities(id)
+);
+
+CREATE TABLE IF NOT EXISTS "accounts" (
+	id							TEXT PRIMARY KEY
+	,broker						TEXT NOT NULL DEFAULT ''
+	,account_type				TEXT NOT NULL DEFAULT 'DEPA' -- DEPA, ISK, KF, TAXABLE_US or IRA
+	,base_currency				CHAR(3) NOT NULL DEFAULT ''
+	,opened_date				TIMESTAMP
+	,owners						TEXT NOT NULL DEFAULT '' -- comma separated
+	,institution				TEXT NOT NULL DEFAULT ''
+	,institution_address		TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS "prices" (
+	security_id					TEXT NOT NULL
+	,price_date					TIMESTAMP NOT NULL
+	,price						BIGINT NOT NULL
+	,currency					CHAR(3) NOT NULL
+	,source						TEXT NOT NULL -- yahoo, stooq, manual or import
+	,created_date				TIMESTAMP NOT NULL
+	,UNIQUE (security_id, price_date, source)
+	,FOREIGN KEY (security_id) REFERENCES securities(id)
+);
+
+CREATE TABLE IF NOT EXISTS "isk_rates" (
+	year						INTEGER PRIMARY KEY
+	,government_bond_rate		BIGINT NOT NULL -- statslåneränta Nov 30 the year before, percent
+	,tax_free_amount			BIGINT NOT NULL DEFAULT 0 -- skattefri nivå, SEK
+);
+
+CREATE TABLE IF NOT EXISTS "field_precisions" (
+	field						TEXT PRIMARY KEY -- quantity, price or amount
+	,places						INTEGER NOT NULL -- decimal places the field's columns are stored with
+);
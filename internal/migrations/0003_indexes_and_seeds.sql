@@ -0,0 +1,24 @@
+-- Seeding used to insert the yearly rates again on every export.
+DELETE FROM currency_rates WHERE id NOT IN (
+	SELECT MIN(id) FROM currency_rates GROUP BY currency_code, base_currency, as_of_date, source
+);
+
+-- Rates of other base currencies, like Nordnet's SEK per EUR and SEK per NOK of a day,
+-- share the currency code, date and source.
+DROP INDEX IF EXISTS currency_rates_currency_date_source;
+CREATE UNIQUE INDEX IF NOT EXISTS currency_rates_currency_base_date_source
+ON currency_rates (currency_code, base_currency, as_of_date, source);
+
+-- Published statslåneränta (Nov 30 the year before) and skattefri nivå per year.
+-- Edit with `isk rates set` when a year is missing or a value needs correcting.
+INSERT OR IGNORE INTO isk_rates (year, government_bond_rate, tax_free_amount) VALUES
+	(2022, 2300, 0),
+	(2023, 19400, 0),
+	(2024, 26200, 0),
+	(2025, 19600, 1500000000);
+
+-- Every field was stored with 4 places, change them with `precision set`.
+INSERT OR IGNORE INTO field_precisions (field, places) VALUES
+	('quantity', 4),
+	('price', 4),
+	('amount', 4);
@@ -0,0 +1,6 @@
+-- Cash transactions, corporate actions without cash and unlinked lots stored '' for the lot,
+-- currency and security they don't have, which refers to a row that can't exist once foreign
+-- keys are enforced.
+UPDATE transactions SET share_lot = NULL WHERE share_lot = '';
+UPDATE corporate_actions SET currency = NULL WHERE currency = '';
+UPDATE asset_lots SET security_id = NULL WHERE security_id = '';
@@ -0,0 +1,10 @@
+-- Ex-dividend dates of payments, which the holding period of qualified dividends is counted
+-- from. Broker exports only carry the date a dividend was paid.
+CREATE TABLE IF NOT EXISTS "ex_dividend_dates" (
+	symbol						TEXT NOT NULL
+	,payment_date				DATE NOT NULL
+	,ex_date					DATE NOT NULL
+	,source						TEXT NOT NULL DEFAULT 'manual'
+	,UNIQUE (symbol, payment_date)
+	,CONSTRAINT ex_dividend_dates_ex_date CHECK (ex_date <= payment_date)
+);
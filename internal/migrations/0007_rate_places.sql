@@ -0,0 +1,4 @@
+-- Currency and executed FX rates were stored with 4 places, which lost the precision of
+-- crossed and inverted rates. They are stored with 8 places from here on.
+UPDATE currency_rates SET rate = rate * 10000 WHERE rate IS NOT NULL;
+UPDATE transactions SET executed_fx_rate = executed_fx_rate * 10000 WHERE executed_fx_rate IS NOT NULL;
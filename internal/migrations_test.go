@@ -0,0 +1,142 @@
+package internal_test
+
+import (
+	"accounting/internal"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ericlagergren/decimal"
+)
+
+func TestMigrateDB(t *testing.T) {
+	internal.InitializeDB()
+	migrations, err := internal.Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := internal.GetMigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != len(migrations) {
+		t.Fatalf("expected %d migrations, got %d", len(migrations), len(status))
+	}
+	for i, s := range status {
+		if s.Version != i+1 {
+			t.Errorf("expected version %d, got %d", i+1, s.Version)
+		}
+		if s.AppliedDate == nil {
+			t.Errorf("migration %d %s is pending after InitializeDB", s.Version, s.Name)
+		}
+	}
+
+	applied, backup, err := internal.MigrateDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 || backup != "" {
+		t.Errorf("migrated ledger applied %d migrations again, backup %q", len(applied), backup)
+	}
+
+	unknown := len(migrations) + 1
+	_, err = internal.GlobalDB.Exec(`INSERT INTO schema_migrations (version, name, applied_date) VALUES (?, 'newer', CURRENT_TIMESTAMP);`, unknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer internal.GlobalDB.Exec(`DELETE FROM schema_migrations WHERE version = ?;`, unknown)
+	if _, _, err = internal.MigrateDB(); !errors.Is(err, internal.ErrUnknownMigration) {
+		t.Errorf("expected ErrUnknownMigration, got %v", err)
+	}
+}
+
+func TestMigrateBaselineLedger(t *testing.T) {
+	fixture, err := os.ReadFile("../testing/baseline-ledger.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ledger.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(string(fixture)); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	db.Close()
+
+	testDB := internal.GlobalDB
+	internal.LedgerPath = path
+	t.Cleanup(func() {
+		internal.GlobalDB.Close()
+		internal.LedgerPath = internal.DEFAULT_LEDGER
+		internal.GlobalDB = testDB
+		internal.InitializeDB()
+	})
+	if err = internal.OpenDB(); err != nil {
+		t.Fatal(err)
+	}
+	migrations, err := internal.Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, backup, err := internal.MigrateDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("expected all %d migrations to be applied, got %d", len(migrations), len(applied))
+	}
+	if _, err = os.Stat(backup); backup == "" || err != nil {
+		t.Errorf("expected a backup of the baseline ledger, got %q (%v)", backup, err)
+	}
+
+	violations, err := internal.CheckIntegrity(internal.GlobalDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 0 {
+		t.Errorf("expected no integrity violations, got %v", violations)
+	}
+
+	// The TEXT cost basis keeps its value as a number.
+	lots, err := internal.GetAssetLotsForSecurityHeldBefore("1234", "ERIC B", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lots) != 1 || lots[0].CostBasisPerShare.Cmp(decimal.New(90, 0)) != 0 || lots[0].CostBasisCurrency != internal.SEK {
+		t.Errorf("expected the lot at 90 SEK per share, got %+v", lots)
+	}
+	// Rates stored with 4 places keep their value with 8.
+	rates, err := internal.GetCurrencyRates(internal.SEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rates) != 4 || rates[1].Rate.Cmp(decimal.New(10613, 3)) != 0 {
+		t.Errorf("expected the 2023 SEK rate at 10.6130, got %+v", rates)
+	}
+	// Only the latest of the two marks of December 29 stays current.
+	values, markDate, err := internal.GetAccountMarkedValue("1234", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if markDate == nil || values[internal.SEK] == nil || values[internal.SEK].Cmp(decimal.New(372, 0)) != 0 {
+		t.Errorf("expected 6 shares marked at 62 SEK, got %v on %v", values, markDate)
+	}
+	var current int
+	err = internal.GlobalDB.QueryRow(`SELECT COUNT(*) FROM market_marks WHERE superseded_date IS NULL;`).Scan(&current)
+	if err != nil || current != 2 {
+		t.Errorf("expected 2 current marks, got %d (%v)", current, err)
+	}
+	if _, err = internal.GlobalDB.Exec(`
+		INSERT INTO market_marks (asset_lot_id, account, market_mark_date, marked_shares, marked_value_per_share, marked_value_currency, gain_loss)
+		SELECT asset_lot_id, account, market_mark_date, marked_shares, marked_value_per_share, marked_value_currency, gain_loss
+		FROM market_marks WHERE superseded_date IS NULL LIMIT 1;
+	`); err == nil {
+		t.Error("expected a second current mark of a lot and date to be refused")
+	}
+}
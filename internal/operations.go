@@ -2,11 +2,10 @@ package internal
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"strings"
 	"time"
@@ -17,7 +16,48 @@ import (
 var ErrNoSymbolFound = errors.New("no symbol found")
 
 func HandleImport(records []ImportRecord) error {
-	for _, record := range records {
+	splitPairs := pairBrokerSplits(records)
+	pairedSplitOuts := make(map[int]bool)
+	for _, out := range splitPairs {
+		pairedSplitOuts[out] = true
+	}
+	// An unpaired split-out would leave the old lots open next to the shares booked in for them,
+	// so nothing is imported until the file is complete.
+	for i, record := range records {
+		if record.transaction.TransactionType == SPLITOUT_TRANSACTION && !pairedSplitOuts[i] {
+			err := fmt.Errorf("%w: %s of %s on %s", ErrUnpairedSplit, record.transaction.Shares, record.transaction.Symbol,
+				record.transaction.SettlementDate.Format(time.DateOnly))
+			ErrLogger.Println(err)
+			return err
+		}
+	}
+	currencies, err := GetSupportedCurrencies()
+	if err != nil {
+		return err
+	}
+	supported := make(map[CurrencyUnit]bool, len(currencies))
+	for _, currency := range currencies {
+		supported[currency] = true
+	}
+	for i, record := range records {
+		if !supported[record.transaction.Currency] {
+			err := fmt.Errorf("%w: %s of %s on %s", ErrUnsupportedCurrency, record.transaction.Currency,
+				record.transaction.Symbol, record.transaction.SettlementDate.Format(time.DateOnly))
+			ErrLogger.Println(err)
+			return err
+		}
+		for _, loss := range record.losses {
+			InfoLogger.Printf("%s %s on %s: rounded %s\n", record.transaction.TransactionType, record.transaction.Symbol,
+				record.transaction.SettlementDate.Format(time.DateOnly), loss)
+		}
+		if rate := record.rate; rate != nil {
+			if !supported[rate.Base] {
+				InfoLogger.Printf("skipping %s rate of unsupported %s on %s\n", rate.Source, rate.Base, rate.Date.Format(time.DateOnly))
+			} else if err := UpsertCurrencyRate(*rate, nil); err != nil {
+				ErrLogger.Println(err)
+				return err
+			}
+		}
 		switch record.transaction.TransactionType {
 		case PURCHASE_TRANSACTION:
 			err := handlePurchaseImport(record)
@@ -32,7 +72,11 @@ func HandleImport(records []ImportRecord) error {
 				return err
 			}
 		case SPLITIN_TRANSACTION:
-			err := handleSplitInImport(record)
+			var splitOut *ImportRecord
+			if out, ok := splitPairs[i]; ok {
+				splitOut = &records[out]
+			}
+			err := handleBrokerSplitImport(record, splitOut)
 			if err != nil {
 				ErrLogger.Println(err)
 				return err
@@ -50,13 +94,21 @@ func HandleImport(records []ImportRecord) error {
 				return err
 			}
 		case SPLITOUT_TRANSACTION:
-			err := handleSplitOutImport(record)
+			// Split-outs are applied together with their split-in row.
+		case DIVIDEND, QUALIFIED_DIVIDEND, CAPITAL_GAIN_DISTRIBUTION, WITHHOLDING_TAX, DEPOSIT_TRANSACTION, WITHDRAWAL_TRANSACTION:
+			_, err := InsertTransaction(record.transaction, nil)
 			if err != nil {
 				ErrLogger.Println(err)
 				return err
 			}
-		case DIVIDEND:
-			_, err := InsertTransaction(record.transaction, nil)
+		case RETURN_OF_CAPITAL:
+			err := handleReturnOfCapitalImport(record)
+			if err != nil {
+				ErrLogger.Println(err)
+				return err
+			}
+		case RSU_VEST_TRANSACTION, ESPP_PURCHASE_TRANSACTION:
+			err := handleStockPlanImport(record)
 			if err != nil {
 				ErrLogger.Println(err)
 				return err
@@ -66,46 +118,53 @@ func HandleImport(records []ImportRecord) error {
 	return nil
 }
 
-func handlePurchaseImport(record ImportRecord) error {
+func handleStockPlanImport(record ImportRecord) error {
 	tx, err := GlobalDB.Begin()
 	if err != nil {
-		ErrLogger.Fatal(err)
 		return err
 	}
 	lotId, err := InsertAssetLot(record.lot, tx)
 	if err != nil {
-		ErrLogger.Fatal(err, record)
+		tx.Rollback()
 		return err
 	}
 	record.lot.ID = lotId
 	record.transaction.ShareLot = lotId
-	InsertTransaction(record.transaction, tx)
-	err = tx.Commit()
+	_, err = InsertTransaction(record.transaction, tx)
 	if err != nil {
-		ErrLogger.Fatal(err)
+		tx.Rollback()
 		return err
 	}
-	return nil
+	record.stockPlanLot.AssetLotID = lotId
+	err = InsertStockPlanLot(*record.stockPlanLot, tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	// Shares withheld for tax never reach the account, but the withholding is
+	// still recorded at the vest/purchase FMV.
+	if record.stockPlanLot.SharesWithheld.Cmp(ZeroPrecisionValue) > 0 {
+		withheldTransaction := record.transaction.CopyFromShares(record.stockPlanLot.SharesWithheld)
+		withheldTransaction.TransactionType = SHARES_WITHHELD_TRANSACTION
+		withheldTransaction.ShareLot = lotId
+		_, err = InsertTransaction(withheldTransaction, tx)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-func handleSplitInImport(record ImportRecord) error {
+func handlePurchaseImport(record ImportRecord) error {
 	tx, err := GlobalDB.Begin()
 	if err != nil {
 		ErrLogger.Fatal(err)
 		return err
 	}
-	var newTotalCostBasis = decimal.New(0, 4)
-	beforeAssetLots, err := GetOpenAssetLotsBySymbolBeforeDate(record.transaction.Symbol, record.transaction.SettlementDate)
-	if err != nil {
-		return err
-	}
-	for _, lot := range beforeAssetLots {
-		newTotalCostBasis = newTotalCostBasis.Add(newTotalCostBasis, lot.CostBasisPerShare.Mul(lot.CostBasisPerShare, lot.Shares).Quantize(4))
-	}
-	record.lot.CostBasisPerShare = newTotalCostBasis.Quo(newTotalCostBasis, record.lot.Shares).Quantize(4)
 	lotId, err := InsertAssetLot(record.lot, tx)
 	if err != nil {
-		ErrLogger.Fatal(err)
+		ErrLogger.Fatal(err, record)
 		return err
 	}
 	record.lot.ID = lotId
@@ -119,6 +178,85 @@ func handleSplitInImport(record ImportRecord) error {
 	return nil
 }
 
+// handleReturnOfCapitalImport spreads a return of capital over the account's
+// open lots pro rata by shares and reduces their cost basis. Anything beyond a
+// lot's remaining basis is recognized as a RETURN_OF_CAPITAL_GAIN.
+func handleReturnOfCapitalImport(record ImportRecord) error {
+	tx, err := GlobalDB.Begin()
+	if err != nil {
+		return err
+	}
+	lots, err := GetOpenAssetLotsForSecurity(record.lot.AccountID, record.lot.Symbol, record.lot.ISIN, record.transaction.SettlementDate, tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	totalShares := decimal.New(0, 4)
+	for _, lot := range lots {
+		totalShares.Add(totalShares, lot.Shares)
+	}
+	if totalShares.Cmp(ZeroPrecisionValue) == 0 {
+		InfoLogger.Printf("return of capital for %s on %s has no open lots, basis left unchanged\n",
+			record.transaction.Symbol, record.transaction.SettlementDate.Format(time.DateOnly))
+		if _, err = InsertTransaction(record.transaction, tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	amountLeft := decimal.New(0, 4).Copy(record.transaction.TotalAmount)
+	for i, lot := range lots {
+		reduction := decimal.New(0, 4).Copy(amountLeft)
+		// The last lot takes the remainder so rounding never loses any of the amount.
+		if i < len(lots)-1 {
+			reduction = decimal.New(0, 4).Mul(record.transaction.TotalAmount, lot.Shares)
+			AMOUNT_FIELD.Round(reduction.Quo(reduction, totalShares))
+		}
+		amountLeft.Sub(amountLeft, reduction)
+
+		rocTransaction := record.transaction.CopyFromShares(lot.Shares)
+		rocTransaction.ShareLot = lot.ID
+		rocTransaction.PricePerShare = PRICE_FIELD.Round(decimal.New(0, 4).Quo(reduction, lot.Shares))
+		rocTransaction.ShareValue = decimal.New(0, 4).Copy(reduction)
+		rocTransaction.TotalAmount = decimal.New(0, 4).Copy(reduction)
+		if i == 0 {
+			rocTransaction.FeesAmount = record.transaction.FeesAmount
+		}
+		if _, err = InsertTransaction(rocTransaction, tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		lotBasis := AMOUNT_FIELD.Round(decimal.New(0, 4).Mul(lot.CostBasisPerShare, lot.Shares))
+		if reduction.Cmp(lotBasis) > 0 {
+			gain := decimal.New(0, 4).Sub(reduction, lotBasis)
+			gainTransaction := rocTransaction.CopyFromShares(lot.Shares)
+			gainTransaction.TransactionType = RETURN_OF_CAPITAL_GAIN
+			gainTransaction.PricePerShare = PRICE_FIELD.Round(decimal.New(0, 4).Quo(gain, lot.Shares))
+			gainTransaction.ShareValue = decimal.New(0, 4).Copy(gain)
+			gainTransaction.TotalAmount = decimal.New(0, 4).Copy(gain)
+			if _, err = InsertTransaction(gainTransaction, tx); err != nil {
+				tx.Rollback()
+				return err
+			}
+			lot.CostBasisPerShare = decimal.New(0, 4)
+		} else {
+			lot.CostBasisPerShare = decimal.New(0, 4).Sub(lotBasis, reduction)
+			PRICE_FIELD.Round(lot.CostBasisPerShare.Quo(lot.CostBasisPerShare, lot.Shares))
+		}
+		if err = UpdateAssetLotDetails(lot, tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = InsertAssetLotHistory(lot, record.transaction.SettlementDate, tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func handleTransferInImport(record ImportRecord) error {
 	tx, err := GlobalDB.Begin()
 	if err != nil {
@@ -170,7 +308,13 @@ func handleSaleImport(record ImportRecord) error {
 			newTransaction.FeesAmount = record.transaction.FeesAmount
 			newTransaction.TotalAmount = newTransaction.TotalAmount.Add(newTransaction.TotalAmount, record.transaction.FeesAmount)
 		}
-		_, err := InsertTransaction(newTransaction, tx)
+		transactionId, err := InsertTransaction(newTransaction, tx)
+		if err != nil {
+			ErrLogger.Println(err)
+			tx.Rollback()
+			return err
+		}
+		err = flagESPPDisposition(lot, transactionId, record.transaction.SettlementDate, sharesProcessed, tx)
 		if err != nil {
 			ErrLogger.Println(err)
 			tx.Rollback()
@@ -193,29 +337,25 @@ func handleSaleImport(record ImportRecord) error {
 	return nil
 }
 
-func handleSplitOutImport(record ImportRecord) error {
-	tx, err := GlobalDB.Begin()
-	if err != nil {
-		return err
+// flagESPPDisposition records whether selling shares from an ESPP lot is a
+// qualifying or disqualifying disposition. Lots from other sources are ignored.
+func flagESPPDisposition(lot AssetLot, transactionId int, saleDate time.Time, shares *decimal.Big, tx *sql.Tx) error {
+	stockPlanLot, err := GetStockPlanLot(lot.ID, tx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
 	}
-	lots, err := GetOpenAssetLotsBySymbolBeforeDate(record.lot.Symbol, record.transaction.SettlementDate)
 	if err != nil {
-		ErrLogger.Println(err)
 		return err
 	}
-	for _, lot := range lots {
-		lot.Shares = ZeroPrecisionValue
-		err = UpdateAssetLot(lot, tx)
-		if err != nil {
-			return err
-		}
-		err = InsertAssetLotHistory(lot, record.transaction.SettlementDate, tx)
-		if err != nil {
-			ErrLogger.Println(err)
-		}
+	if stockPlanLot.PlanType != ESPP {
+		return nil
 	}
-	err = tx.Commit()
-	return err
+	if IsQualifyingESPPDisposition(stockPlanLot, saleDate) {
+		InfoLogger.Printf("qualifying ESPP disposition: lot %s, %s shares\n", lot.ID, shares)
+	} else {
+		InfoLogger.Printf("disqualifying ESPP disposition: lot %s, %s shares\n", lot.ID, shares)
+	}
+	return InsertESPPDisposition(transactionId, stockPlanLot, saleDate, shares, tx)
 }
 
 func handleTransferOutImport(record ImportRecord) error {
@@ -263,279 +403,194 @@ func handleTransferOutImport(record ImportRecord) error {
 	return err
 }
 
-type StockPriceResponse struct {
-	Chart struct {
-		Result []struct {
-			Indicators struct {
-				Adjclose []struct {
-					AdjClose []float64
-				}
-			}
-		}
-	}
+var ErrMissingPrice = errors.New("no price for security")
+
+// MarkOptions are the price lookups of a mark run
+type MarkOptions struct {
+	Prices    PriceProviderConfig
+	PriceFile string // asked after the providers
+	OnMissing MissingPricePolicy
+	Replace   bool // re-mark lots already marked on the date, superseding their marks
 }
 
-type SymbolSearchResponse struct {
-	Quotes []struct {
-		Symbol string
-	}
+// MarkResult is the price a lot was marked at and where it came from. Price is nil for skipped lots.
+type MarkResult struct {
+	LotID      string
+	AccountID  string
+	Symbol     string
+	SecurityID string
+	Price      *decimal.Big
+	Currency   CurrencyUnit
+	PriceDate  time.Time // trading day of the price, on or before the mark date
+	Source     string
 }
 
-func getReq(url string) *http.Request {
-	req, _ := http.NewRequest("GET", url, nil)
-	req.AddCookie(&http.Cookie{Name: "_cb_svref", Value: "https%3A%2F%2Ffinance.yahoo.com%2Fquote%2FSSAB-B.ST%2F"})
-	req.Header.Add("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/133.0.0.0 Safari/537.36")
-	return req
+type markPrice struct {
+	price  *decimal.Big
+	date   time.Time
+	source string
 }
 
-func RetrieveStockPrice(assetLot AssetLot, valueDate time.Time) (*decimal.Big, error) {
-	yahooSymbol, err := ResolveYahooSymbol(assetLot)
+/*
+MarkStocks marks every lot held on the date at the price of its security, with the
+shares it held then. Lots already marked on the date are skipped unless Replace is set.
+Prices are looked up once per security, concurrently, through the configured providers
+and the price file before anything is written. A price is the last close on or before
+the date within the lookback, and the mark keeps the date of that close. When none has
+one, the OnMissing policy decides: prompt for a manual price, skip the security, fail
+the run or use the last known price. Fetched and manual prices are stored so later runs for the same date don't
+look them up again. Nothing is marked when the run fails.
+*/
+func MarkStocks(ctx context.Context, date time.Time, opts MarkOptions) ([]MarkResult, error) {
+	lots, err := getLotsToMark(date, opts.Replace)
 	if err != nil {
 		return nil, err
 	}
-	return RetrieveStockPriceByYahooSymbol(yahooSymbol, valueDate)
-}
-
-func ResolveYahooSymbol(assetLot AssetLot) (string, error) {
-	SearchUrlBase := "https://query2.finance.yahoo.com/v1/finance/search?q=%s&lang=en-US&region=US"
-	symbol := assetLot.Symbol
-	if assetLot.CostBasisCurrency != USD {
-		// If not US, do a search using ISIN.
-		searchData := SymbolSearchResponse{}
-		resp, err := http.DefaultClient.Do(getReq(fmt.Sprintf(SearchUrlBase, assetLot.ISIN)))
-		if err != nil {
-			ErrLogger.Println(err)
-			return "", err
-		}
-		searchBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			ErrLogger.Println(err)
-			return "", err
-		}
-		if err := json.Unmarshal(searchBytes, &searchData); err != nil {
-			ErrLogger.Println(err)
-			return "", err
+	if _, err := SyncSecurities(nil); err != nil {
+		return nil, err
+	}
+	lotSecurities := make([]Security, len(lots))
+	securities := make([]Security, 0)
+	seen := make(map[string]bool)
+	for i, lot := range lots {
+		if lotSecurities[i], err = GetSecurityByAssetLot(lot.ID, nil); err != nil {
+			return nil, err
 		}
-		if len(searchData.Quotes) > 0 && strings.TrimSpace(searchData.Quotes[0].Symbol) != "" {
-			symbol = searchData.Quotes[0].Symbol
-		} else {
-			return "", ErrNoSymbolFound
+		if !seen[lotSecurities[i].ID] {
+			seen[lotSecurities[i].ID] = true
+			securities = append(securities, lotSecurities[i])
 		}
 	}
-	return symbol, nil
-}
 
-func RetrieveStockPriceByYahooSymbol(yahooSymbol string, valueDate time.Time) (*decimal.Big, error) {
-	PriceUrlBase := "https://query2.finance.yahoo.com/v8/finance/chart/%s?period1=%d&period2=%d&interval=1d&includePrePost=true&lang=en-US&region=SE"
-	unixTime := valueDate.Unix()
-	formattedUrl := fmt.Sprintf(PriceUrlBase, yahooSymbol, unixTime, unixTime+80000)
-	var stockPrice StockPriceResponse
-	response, err := http.DefaultClient.Do(getReq(formattedUrl))
+	providers, err := NewPriceProviders(opts.Prices, nil)
 	if err != nil {
-		ErrLogger.Println(err)
 		return nil, err
 	}
-	data, err := io.ReadAll(response.Body)
-	if err != nil {
-		ErrLogger.Println(err)
-		return nil, err
+	if opts.PriceFile != "" {
+		fileProvider, err := NewFilePriceProvider(opts.PriceFile, nil)
+		if err != nil {
+			return nil, err
+		}
+		fileProvider.Lookback = opts.Prices.Lookback()
+		providers = append(providers, fileProvider)
 	}
-	if err := json.Unmarshal(data, &stockPrice); err != nil {
-		ErrLogger.Println(err, string(data))
+	fetched := FetchPrices(ctx, providers, securities, date, opts.Prices.Workers)
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	// Yahoo may return empty chart results for non-equities / unknown symbols.
-	if len(stockPrice.Chart.Result) == 0 {
-		return nil, ErrNoSymbolFound
-	}
-	first := stockPrice.Chart.Result[0]
-	if len(first.Indicators.Adjclose) == 0 || len(first.Indicators.Adjclose[0].AdjClose) == 0 {
-		return nil, ErrNoSymbolFound
-	}
-
-	stringedClose := fmt.Sprintf("%.4f", first.Indicators.Adjclose[0].AdjClose[0])
-	InfoLogger.Println(stringedClose)
-	value, err := ProcessStringAmount(stringedClose, US)
+	// Writes and prompts stay on this goroutine, in lot order.
+	tx, err := GlobalDB.Begin()
 	if err != nil {
-		ErrLogger.Println(err)
 		return nil, err
 	}
-	return value, nil
-}
-
-func MarkStocks(date time.Time) {
-	// Cache by resolved Yahoo symbol so different lot symbols that map to the same Yahoo symbol
-	// don't trigger repeated HTTP requests.
-	prices := make(map[string]*decimal.Big)
-	nonEquitySymbols := make(map[string]bool)
 	reader := bufio.NewReader(os.Stdin)
-	lots, err := getUnMarkedSymbols(date)
-	if err != nil {
-		ErrLogger.Println(err)
-		return
-	}
-	// start tx
-	tx, err := GlobalDB.Begin()
-	if err != nil {
-		panic("can't do transaction")
-	}
-	for _, lot := range lots {
-		resolveKey := lot.Symbol
-		if lot.CostBasisCurrency != USD {
-			resolveKey = lot.ISIN
-		}
-		if nonEquitySymbols[resolveKey] {
-			continue
-		}
-
-		// If we already have a (manual or cached) price, don't resolve / fetch again.
-		if cached, ok := prices[resolveKey]; ok {
-			if err := MarkAssetLot(date, lot, cached, tx); err != nil {
-				ErrLogger.Println(err)
+	prices := make(map[string]markPrice)
+	results := make([]MarkResult, 0, len(lots))
+	for i, lot := range lots {
+		security := lotSecurities[i]
+		marked, ok := prices[security.ID]
+		if !ok {
+			marked, err = resolveMarkPrice(security, lot, date, fetched[security.ID], opts.OnMissing, reader, tx)
+			if err != nil {
 				tx.Rollback()
-				return
+				return nil, err
 			}
-			continue
+			prices[security.ID] = marked
 		}
-
-		// Hardcoded special case from earlier behavior.
-		if lot.Symbol == "TRACKER GULD NORDNET" {
-			marketPrice := decimal.New(2426500, 4)
-			if err := MarkAssetLot(date, lot, marketPrice, tx); err != nil {
-				ErrLogger.Println(err)
-				tx.Rollback()
-				return
-			}
+		results = append(results, MarkResult{
+			LotID:      lot.ID,
+			AccountID:  lot.AccountID,
+			Symbol:     lot.Symbol,
+			SecurityID: security.ID,
+			Price:      marked.price,
+			Currency:   lot.CostBasisCurrency,
+			PriceDate:  marked.date,
+			Source:     marked.source,
+		})
+		if marked.price == nil {
 			continue
 		}
-
-		yahooSymbol, err := ResolveYahooSymbol(lot)
-		if err != nil {
-			if err == ErrNoSymbolFound {
-				manualPrice, promptErr := promptManualPrice(lot, date, reader, "symbol not found from Yahoo")
-				if promptErr != nil {
-					ErrLogger.Println(promptErr)
-					tx.Rollback()
-					return
-				}
-				if manualPrice == nil {
-					nonEquitySymbols[resolveKey] = true
-					InfoLogger.Println("Skipping non-equity")
-					continue
-				}
-				// Cache manual answer.
-				prices[resolveKey] = manualPrice
-				// If we can't resolve a Yahoo symbol, we can't populate yahooSymbol-based caches.
-				if err := MarkAssetLot(date, lot, manualPrice, tx); err != nil {
-					ErrLogger.Println(err)
-					tx.Rollback()
-					return
-				}
-				continue
-			}
-			// For other errors (network/JSON/etc) we still offer a manual override.
-			manualPrice, promptErr := promptManualPrice(lot, date, reader, err.Error())
-			if promptErr != nil {
-				ErrLogger.Println(promptErr)
-				tx.Rollback()
-				return
-			}
-			if manualPrice == nil {
-				nonEquitySymbols[resolveKey] = true
-				ErrLogger.Println("Skipping due to Yahoo resolution error (manual price blank)")
-				continue
-			}
-			prices[resolveKey] = manualPrice
-			if err := MarkAssetLot(date, lot, manualPrice, tx); err != nil {
-				ErrLogger.Println(err)
-				tx.Rollback()
-				return
-			}
-			continue
+		if err = MarkAssetLot(date, lot, marked.price, marked.date, tx); err != nil {
+			tx.Rollback()
+			return nil, err
 		}
+	}
+	return results, tx.Commit()
+}
 
-		if nonEquitySymbols[yahooSymbol] {
-			continue
+// resolveMarkPrice stores a fetched price, or handles a missing one with the policy.
+// The price is nil when the security is skipped.
+func resolveMarkPrice(security Security, lot AssetLot, date time.Time, fetched FetchedPrice, policy MissingPricePolicy, reader *bufio.Reader, tx *sql.Tx) (markPrice, error) {
+	price, provider := fetched.Price, fetched.Provider
+	var reason string
+	switch {
+	case fetched.Err != nil:
+		reason = fetched.Err.Error()
+	case price.Currency != lot.CostBasisCurrency:
+		reason = fmt.Sprintf("%s price is in %s", provider, price.Currency)
+	default:
+		if provider != STORE_PRICE_PROVIDER {
+			if err := UpsertPrice(price, tx); err != nil {
+				return markPrice{}, err
+			}
 		}
-
-		marketPrice, ok := prices[yahooSymbol]
-		if !ok {
-			InfoLogger.Printf("retrieving price for %s (%s)\n", lot.Symbol, yahooSymbol)
-			price, err := RetrieveStockPriceByYahooSymbol(yahooSymbol, date)
-			if err != nil {
-				if err == ErrNoSymbolFound {
-					manualPrice, promptErr := promptManualPrice(lot, date, reader, "price not found from Yahoo")
-					if promptErr != nil {
-						ErrLogger.Println(promptErr)
-						tx.Rollback()
-						return
-					}
-					if manualPrice == nil {
-						nonEquitySymbols[resolveKey] = true
-						nonEquitySymbols[yahooSymbol] = true
-						InfoLogger.Println("Skipping non-equity")
-						continue
-					}
-					prices[resolveKey] = manualPrice
-					prices[yahooSymbol] = manualPrice
-					marketPrice = manualPrice
-				} else {
-					// Other Yahoo errors: prompt for a manual override.
-					manualPrice, promptErr := promptManualPrice(lot, date, reader, err.Error())
-					if promptErr != nil {
-						ErrLogger.Println(promptErr)
-						tx.Rollback()
-						return
-					}
-					if manualPrice == nil {
-						nonEquitySymbols[resolveKey] = true
-						nonEquitySymbols[yahooSymbol] = true
-						ErrLogger.Println("Skipping due to Yahoo price error (manual price blank)")
-						continue
-					}
-					prices[resolveKey] = manualPrice
-					prices[yahooSymbol] = manualPrice
-					marketPrice = manualPrice
-				}
-			} else {
-				// sleep to avoid ban from
-				time.Sleep(1 * time.Second)
-				prices[yahooSymbol] = price
-				prices[resolveKey] = price
-				marketPrice = price
+		if price.Source == YAHOO_PRICE_SOURCE && security.YahooSymbol == "" && price.Symbol != "" {
+			if err := SetSecurityYahooSymbol(security.ID, price.Symbol, tx); err != nil {
+				return markPrice{}, err
 			}
-		} else {
-			// Cached by yahooSymbol, also store under resolveKey for consistent future hits.
-			prices[resolveKey] = marketPrice
 		}
+		return markPrice{price: price.Price, date: price.Date, source: provider}, nil
+	}
 
-		err = MarkAssetLot(date, lot, marketPrice, tx)
+	switch policy {
+	case SKIP_ON_MISSING:
+		return markPrice{source: "skipped: " + reason}, nil
+	case FAIL_ON_MISSING:
+		return markPrice{}, fmt.Errorf("%w %s (%s): %s", ErrMissingPrice, security.ID, lot.Symbol, reason)
+	case LAST_KNOWN_ON_MISSING:
+		lastKnown, err := GetLastKnownPrice(security.ID, date, tx)
+		if errors.Is(err, sql.ErrNoRows) {
+			return markPrice{source: "skipped: no last known price, " + reason}, nil
+		}
 		if err != nil {
-			ErrLogger.Println(err)
-			tx.Rollback()
-			return
+			return markPrice{}, err
+		}
+		if lastKnown.Currency != lot.CostBasisCurrency {
+			return markPrice{source: fmt.Sprintf("skipped: last known price is in %s", lastKnown.Currency)}, nil
 		}
+		return markPrice{price: lastKnown.Price, date: lastKnown.Date, source: "last known " + lastKnown.Date.Format(time.DateOnly)}, nil
 	}
-	err = tx.Commit()
+
+	manualPrice, err := promptManualPrice(lot, date, reader, reason, tx)
 	if err != nil {
-		tx.Rollback()
-		return
-	}
+		return markPrice{}, err
+	}
+	if manualPrice == nil {
+		return markPrice{source: "skipped"}, nil
+	}
+	return markPrice{price: manualPrice, date: date, source: string(MANUAL_PRICE_SOURCE)}, UpsertPrice(Price{
+		SecurityID: security.ID,
+		Date:       date,
+		Price:      manualPrice,
+		Currency:   lot.CostBasisCurrency,
+		Source:     MANUAL_PRICE_SOURCE,
+	}, tx)
 }
 
-func promptManualPrice(assetLot AssetLot, date time.Time, reader *bufio.Reader, reason string) (*decimal.Big, error) {
-	example := "0.00"
-	if assetLot.CostBasisCurrency == SEK {
-		example = "0,00"
+func promptManualPrice(assetLot AssetLot, date time.Time, reader *bufio.Reader, reason string, tx *sql.Tx) (*decimal.Big, error) {
+	format, err := newAmountFormat("", tx)
+	if err != nil {
+		return nil, err
 	}
+	example := format.format(decimal.New(0, 2), assetLot.CostBasisCurrency)
 
 	for {
 		if reason != "" {
-			fmt.Printf("Yahoo price unavailable for %s (ISIN=%s, %s). Enter manual price per share in %s (format like %s; blank to skip): ",
+			fmt.Printf("No price for %s (ISIN=%s, %s). Enter manual price per share in %s (format like %s; blank to skip): ",
 				assetLot.Symbol, assetLot.ISIN, reason, assetLot.CostBasisCurrency, example)
 		} else {
-			fmt.Printf("Yahoo price not found for %s (ISIN=%s). Enter manual price per share in %s (format like %s; blank to skip): ",
+			fmt.Printf("No price for %s (ISIN=%s). Enter manual price per share in %s (format like %s; blank to skip): ",
 				assetLot.Symbol, assetLot.ISIN, assetLot.CostBasisCurrency, example)
 		}
 		text, err := reader.ReadString('\n')
@@ -547,7 +602,7 @@ func promptManualPrice(assetLot AssetLot, date time.Time, reader *bufio.Reader,
 			return nil, nil
 		}
 
-		val, err := parseReportDecimal(text, assetLot.CostBasisCurrency)
+		val, err := format.parse("price", text, assetLot.CostBasisCurrency, PRICE_FIELD)
 		if err != nil {
 			fmt.Printf("Invalid number. %v\n", err)
 			continue
@@ -0,0 +1,108 @@
+package internal_test
+
+import (
+	"accounting/internal"
+	"testing"
+	"time"
+
+	"github.com/ericlagergren/decimal"
+)
+
+func TestReturnOfCapitalImport(t *testing.T) {
+	internal.InitializeDB()
+	bought := time.Date(2023, 1, 10, 0, 0, 0, 0, time.UTC)
+	paid := time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)
+	var cases = []struct {
+		name   string
+		symbol string
+		lots   [][2]*decimal.Big // shares and basis per share
+		amount string
+		// of each lot
+		reductions []*decimal.Big
+		basis      []*decimal.Big
+		gains      []*decimal.Big
+	}{
+		{
+			// 10/33 and 20/33 of 10.00 are rounded, the last lot takes the remaining 0.9091.
+			name:       "pro rata over lots",
+			symbol:     "ROCPRO",
+			lots:       [][2]*decimal.Big{{decimal.New(10, 0), decimal.New(10, 0)}, {decimal.New(20, 0), decimal.New(10, 0)}, {decimal.New(3, 0), decimal.New(10, 0)}},
+			amount:     "10.00",
+			reductions: []*decimal.Big{decimal.New(30303, 4), decimal.New(60606, 4), decimal.New(9091, 4)},
+			basis:      []*decimal.Big{decimal.New(96970, 4), decimal.New(96970, 4), decimal.New(96970, 4)},
+			gains:      []*decimal.Big{nil, nil, nil},
+		},
+		{
+			// 40.00 a lot: the first lot has 10.00 of basis left, the rest of its share is a gain.
+			name:       "basis exhausted",
+			symbol:     "ROCGAIN",
+			lots:       [][2]*decimal.Big{{decimal.New(10, 0), decimal.New(1, 0)}, {decimal.New(10, 0), decimal.New(5, 0)}},
+			amount:     "80.00",
+			reductions: []*decimal.Big{decimal.New(40, 0), decimal.New(40, 0)},
+			basis:      []*decimal.Big{decimal.New(0, 0), decimal.New(1, 0)},
+			gains:      []*decimal.Big{decimal.New(30, 0), nil},
+		},
+		{
+			name:       "basis used up exactly",
+			symbol:     "ROCZERO",
+			lots:       [][2]*decimal.Big{{decimal.New(10, 0), decimal.New(2, 0)}},
+			amount:     "20.00",
+			reductions: []*decimal.Big{decimal.New(20, 0)},
+			basis:      []*decimal.Big{decimal.New(0, 0)},
+			gains:      []*decimal.Big{nil},
+		},
+	}
+	for _, c := range cases {
+		for i, lot := range c.lots {
+			insertCorporateActionTestLot(t, "", c.symbol, lot[0], lot[1], bought.AddDate(0, i, 0))
+		}
+		record, err := internal.TransformETradeTransaction(internal.ETradeTransaction{
+			TransactionDate: paid.Format("01/02/06"),
+			TransactionType: "Return of Capital",
+			Symbol:          c.symbol,
+			Amount:          c.amount,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = internal.HandleImport([]internal.ImportRecord{record}); err != nil {
+			t.Fatal(err)
+		}
+
+		lots, err := internal.GetAssetLotsForSecurityHeldBefore("", c.symbol, paid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transactions, err := internal.GetTransactionBetweenDate(paid, paid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reductions := make(map[string]*decimal.Big)
+		gains := make(map[string]*decimal.Big)
+		for _, transaction := range transactions {
+			if transaction.Symbol != c.symbol {
+				continue
+			}
+			switch transaction.TransactionType {
+			case internal.RETURN_OF_CAPITAL:
+				reductions[transaction.ShareLot] = transaction.TotalAmount
+			case internal.RETURN_OF_CAPITAL_GAIN:
+				gains[transaction.ShareLot] = transaction.TotalAmount
+			}
+		}
+		if len(lots) != len(c.lots) {
+			t.Fatalf("%s: expected %d lots, got %d", c.name, len(c.lots), len(lots))
+		}
+		for i, lot := range lots {
+			if reduction := reductions[lot.ID]; reduction == nil || reduction.Cmp(c.reductions[i]) != 0 {
+				t.Errorf("%s: expected lot %d to get %s, got %v", c.name, i, c.reductions[i], reduction)
+			}
+			if lot.CostBasisPerShare.Cmp(c.basis[i]) != 0 {
+				t.Errorf("%s: expected lot %d at %s per share, got %s", c.name, i, c.basis[i], lot.CostBasisPerShare)
+			}
+			if gain := gains[lot.ID]; (gain == nil) != (c.gains[i] == nil) || (gain != nil && gain.Cmp(c.gains[i]) != 0) {
+				t.Errorf("%s: expected lot %d to have a gain of %v, got %v", c.name, i, c.gains[i], gain)
+			}
+		}
+	}
+}
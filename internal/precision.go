@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/ericlagergren/decimal"
+)
+
+// PrecisionField is a kind of stored value whose number of decimal places can be configured
+type PrecisionField string
+
+var (
+	QUANTITY_FIELD = PrecisionField("quantity") // share quantities
+	PRICE_FIELD    = PrecisionField("price")    // unit prices and cost basis per share
+	AMOUNT_FIELD   = PrecisionField("amount")   // trade, fee and cash amounts
+	RATE_FIELD     = PrecisionField("rate")     // currency and executed FX rates, not configurable
+)
+
+// RATE_PLACES keeps crossed and inverted currency rates exact enough to convert large amounts
+const RATE_PLACES = 8
+
+// PrecisionFields are the configurable fields in the order they are listed
+var PrecisionFields = []PrecisionField{QUANTITY_FIELD, PRICE_FIELD, AMOUNT_FIELD}
+
+// MAX_FIELD_PLACES keeps 92 billion units representable in a BIGINT column
+const MAX_FIELD_PLACES = 8
+
+var (
+	ErrInvalidPrecisionField = errors.New("invalid precision field, expected quantity, price or amount")
+	ErrInvalidFieldPlaces    = fmt.Errorf("places must be between 0 and %d", MAX_FIELD_PLACES)
+)
+
+func ParsePrecisionField(value string) (PrecisionField, error) {
+	for _, field := range PrecisionFields {
+		if PrecisionField(strings.ToLower(strings.TrimSpace(value))) == field {
+			return field, nil
+		}
+	}
+	return "", ErrInvalidPrecisionField
+}
+
+// precisionColumns are the table.column pairs each field is stored in. Ratios and percentages
+// aren't configurable and keep STORAGE_SCALE places, currency rates keep RATE_PLACES.
+var precisionColumns = map[PrecisionField][]string{
+	QUANTITY_FIELD: {
+		"asset_lots.shares",
+		"asset_lots_history.shares",
+		"transactions.shares",
+		"market_marks.marked_shares",
+		"stock_plan_lots.shares_withheld",
+		"espp_dispositions.shares",
+	},
+	PRICE_FIELD: {
+		"asset_lots.cost_basis_per_share",
+		"asset_lots_history.cost_basis_per_share",
+		"transactions.price_per_share",
+		"market_marks.marked_value_per_share",
+		"stock_plan_lots.fair_market_value",
+		"stock_plan_lots.purchase_price",
+		"stock_plan_lots.grant_date_fmv",
+		"stock_plan_lots.discount_income",
+		"corporate_actions.cash_per_share",
+		"corporate_actions.cash_in_lieu_price",
+		"prices.price",
+	},
+	AMOUNT_FIELD: {
+		"transactions.share_value",
+		"transactions.fees_amount",
+		"transactions.total_amount",
+		"transactions.instrument_amount",
+		"market_marks.gain_loss",
+		"espp_dispositions.ordinary_income",
+		"dividend_classifications.qualified_amount",
+	},
+}
+
+// fieldPlaces holds the places of field_precisions, loaded when the database is opened
+var fieldPlaces = map[PrecisionField]int{
+	QUANTITY_FIELD: STORAGE_SCALE,
+	PRICE_FIELD:    STORAGE_SCALE,
+	AMOUNT_FIELD:   STORAGE_SCALE,
+	RATE_FIELD:     RATE_PLACES,
+}
+
+// Places is the number of decimal places the field is stored with
+func (f PrecisionField) Places() int {
+	if places, ok := fieldPlaces[f]; ok {
+		return places
+	}
+	return STORAGE_SCALE
+}
+
+// Round rounds d half-even to the places of the field and returns it
+func (f PrecisionField) Round(d *decimal.Big) *decimal.Big {
+	return decimal.Context128.Quantize(d, f.Places())
+}
+
+// fieldFixed stores a decimal with the places of its field
+func fieldFixed(d *decimal.Big, field PrecisionField) Fixed {
+	return Fixed{Decimal: d, Scale: field.Places()}
+}
+
+// scanField scans a column stored with the places of field into dest
+func scanField(dest **decimal.Big, field PrecisionField) sql.Scanner {
+	return scannerFunc(func(src any) error {
+		f := Fixed{Scale: field.Places()}
+		if err := f.Scan(src); err != nil {
+			return err
+		}
+		*dest = f.Decimal
+		return nil
+	})
+}
+
+// PrecisionLoss is an imported value with more places than its field is stored with
+type PrecisionLoss struct {
+	Column string
+	Input  string
+	Field  PrecisionField
+	Stored *decimal.Big
+}
+
+func (l PrecisionLoss) String() string {
+	return fmt.Sprintf("%s %q stored as %s (%s, %d places)", l.Column, l.Input, l.Stored, l.Field, l.Field.Places())
+}
+
+// ParseFieldAmount parses an amount written in locale and rounds it half-even to the places of
+// field. Rounding isn't an error, loss describes it so imports can report it.
+func ParseFieldAmount(amount string, locale LocaleUnit, field PrecisionField) (*decimal.Big, *PrecisionLoss, error) {
+	exact, err := parseAmount(amount, locale)
+	if err != nil {
+		return ERROR_VALUE, nil, err
+	}
+	value := field.Round(decimal.New(0, 0).Copy(exact))
+	if value.Cmp(exact) != 0 {
+		return value, &PrecisionLoss{Input: amount, Field: field, Stored: value}, nil
+	}
+	return value, nil, nil
+}
+
+// rowParser parses the amounts of an import row and keeps what was rounded
+type rowParser struct {
+	locale LocaleUnit
+	losses []PrecisionLoss
+}
+
+func (p *rowParser) parse(column string, amount string, field PrecisionField) (*decimal.Big, error) {
+	value, loss, err := ParseFieldAmount(amount, p.locale, field)
+	if err != nil {
+		return value, fmt.Errorf("%s: %w", column, err)
+	}
+	if loss != nil {
+		loss.Column = column
+		p.losses = append(p.losses, *loss)
+	}
+	return value, nil
+}
+
+// exact parses an amount, like an exchange rate, that is only used to compute stored values
+func (p *rowParser) exact(column string, amount string) (*decimal.Big, error) {
+	value, err := parseAmount(amount, p.locale)
+	if err != nil {
+		return value, fmt.Errorf("%s: %w", column, err)
+	}
+	return value, nil
+}
+
+// loadFieldPlaces reads field_precisions into fieldPlaces
+func loadFieldPlaces(db queryer) error {
+	rows, err := db.Query(`SELECT field, places FROM field_precisions;`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var field PrecisionField
+		var places int
+		if err = rows.Scan(&field, &places); err != nil {
+			return err
+		}
+		fieldPlaces[field] = places
+	}
+	return rows.Err()
+}
+
+/*
+SetFieldPlaces changes the places a field is stored with and rescales its stored values.
+More places multiply the values, which fails with ErrFixedOverflow when one would no longer
+fit. Fewer places divide them, which fails with ErrFixedPrecision when a value has non-zero
+digits in the places dropped instead of rounding the ledger.
+*/
+func SetFieldPlaces(field PrecisionField, places int) error {
+	if places < 0 || places > MAX_FIELD_PLACES {
+		return ErrInvalidFieldPlaces
+	}
+	current := field.Places()
+	if places == current {
+		return nil
+	}
+	shift := places - current
+	if shift < 0 {
+		shift = -shift
+	}
+	factor := int64(math.Pow10(shift))
+	tx, err := GlobalDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, column := range precisionColumns[field] {
+		table, name, _ := strings.Cut(column, ".")
+		var affected int64
+		if places > current {
+			err = tx.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM %q WHERE ABS(%q) > ?;`, table, name), math.MaxInt64/factor).Scan(&affected)
+			if err == nil && affected > 0 {
+				err = fmt.Errorf("%w: %d values of %s with %d places", ErrFixedOverflow, affected, column, places)
+			}
+			if err == nil {
+				_, err = tx.Exec(fmt.Sprintf(`UPDATE %q SET %q = %q * ? WHERE %q IS NOT NULL;`, table, name, name, name), factor)
+			}
+		} else {
+			err = tx.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM %q WHERE %q %% ? != 0;`, table, name), factor).Scan(&affected)
+			if err == nil && affected > 0 {
+				err = fmt.Errorf("%w: %d values of %s have more than %d places", ErrFixedPrecision, affected, column, places)
+			}
+			if err == nil {
+				_, err = tx.Exec(fmt.Sprintf(`UPDATE %q SET %q = %q / ? WHERE %q IS NOT NULL;`, table, name, name, name), factor)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err = tx.Exec(`UPDATE field_precisions SET places = ? WHERE field = ?;`, places, string(field)); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	fieldPlaces[field] = places
+	return nil
+}
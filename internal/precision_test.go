@@ -0,0 +1,100 @@
+package internal_test
+
+import (
+	"accounting/internal"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ericlagergren/decimal"
+)
+
+func TestParseFieldAmount(t *testing.T) {
+	type TestCase struct {
+		amount string
+		locale internal.LocaleUnit
+		value  *decimal.Big
+		lost   bool
+		err    error
+	}
+	var cases = []TestCase{
+		{"12.5", internal.US, decimal.New(125, 1), false, nil},
+		{"1 234,5", internal.SE, decimal.New(12345, 1), false, nil},
+		{"0,123456789", internal.SE, decimal.New(1235, 4), true, nil},
+		{"0.00005", internal.US, decimal.New(0, 4), true, nil},
+		{"0.00015", internal.US, decimal.New(2, 4), true, nil},
+		{"-1.23455", internal.US, decimal.New(-12346, 4), true, nil},
+		{"", internal.US, decimal.New(0, 4), false, nil},
+		{"1.2.3", internal.US, internal.ERROR_VALUE, false, internal.ErrInvalidPrecisionValue},
+		{"1,2x", internal.SE, internal.ERROR_VALUE, false, internal.ErrInvalidPrecisionValue},
+	}
+	for i, c := range cases {
+		value, loss, err := internal.ParseFieldAmount(c.amount, c.locale, internal.QUANTITY_FIELD)
+		if !errors.Is(err, c.err) {
+			t.Errorf("Case %d: expected error %v, got %v", i, c.err, err)
+			continue
+		}
+		if value.Cmp(c.value) != 0 {
+			t.Errorf("Case %d: expected %s, got %s", i, c.value, value)
+		}
+		if (loss != nil) != c.lost {
+			t.Errorf("Case %d: expected loss %t, got %v", i, c.lost, loss)
+		}
+		if loss != nil && loss.Stored.Cmp(c.value) != 0 {
+			t.Errorf("Case %d: loss reports %s stored, expected %s", i, loss.Stored, c.value)
+		}
+	}
+}
+
+func TestSetFieldPlaces(t *testing.T) {
+	const securityID = "SEK:PRECISION"
+	date := time.Date(2024, 6, 28, 0, 0, 0, 0, time.UTC)
+	defer internal.GlobalDB.Exec(`DELETE FROM securities WHERE id = ?;`, securityID)
+	defer internal.GlobalDB.Exec(`DELETE FROM prices WHERE security_id = ?;`, securityID)
+	if _, err := internal.GlobalDB.Exec(`INSERT OR IGNORE INTO securities (id, currency) VALUES (?, 'SEK');`, securityID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := internal.SetFieldPlaces(internal.PRICE_FIELD, 9); !errors.Is(err, internal.ErrInvalidFieldPlaces) {
+		t.Fatalf("expected ErrInvalidFieldPlaces, got %v", err)
+	}
+	price := internal.Price{SecurityID: securityID, Date: date, Price: decimal.New(123400, 4), Currency: internal.SEK, Source: internal.MANUAL_PRICE_SOURCE}
+	if err := internal.UpsertPrice(price, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := internal.SetFieldPlaces(internal.PRICE_FIELD, 6); err != nil {
+		t.Fatal(err)
+	}
+	if places := internal.PRICE_FIELD.Places(); places != 6 {
+		t.Fatalf("expected 6 places, got %d", places)
+	}
+	stored, err := internal.GetStoredPrice(securityID, date, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Price.Cmp(decimal.New(123400, 4)) != 0 {
+		t.Errorf("rescaled price changed to %s", stored.Price)
+	}
+
+	price.Price = decimal.New(12345678, 6)
+	if err = internal.UpsertPrice(price, nil); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ = internal.GetStoredPrice(securityID, date, nil)
+	if stored.Price.Cmp(decimal.New(12345678, 6)) != 0 {
+		t.Errorf("expected 12.345678, got %s", stored.Price)
+	}
+	if err = internal.SetFieldPlaces(internal.PRICE_FIELD, 4); !errors.Is(err, internal.ErrFixedPrecision) {
+		t.Errorf("expected ErrFixedPrecision dropping places of 12.345678, got %v", err)
+	}
+	if places := internal.PRICE_FIELD.Places(); places != 6 {
+		t.Errorf("failed change left %d places", places)
+	}
+
+	if _, err = internal.GlobalDB.Exec(`DELETE FROM prices WHERE security_id = ?;`, securityID); err != nil {
+		t.Fatal(err)
+	}
+	if err = internal.SetFieldPlaces(internal.PRICE_FIELD, 4); err != nil {
+		t.Fatal(err)
+	}
+}
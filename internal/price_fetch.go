@@ -0,0 +1,272 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPriceWorkers        = 4
+	DefaultRequestsPerSecond   = 2.0
+	DefaultPriceRetries        = 3
+	DefaultPriceRetryBackoff   = 500 * time.Millisecond
+	DefaultPriceRequestTimeout = 20 * time.Second
+	DefaultPriceLookbackDays   = 10
+)
+
+/**
+RATE LIMITING
+*/
+
+// tokenBucket allows rate requests per second with bursts of up to burst requests
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Wait blocks until a request may be made or the context is done
+func (b *tokenBucket) Wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+/**
+RETRIES AND TIMEOUTS
+*/
+
+// retryTransport rate limits requests, gives every attempt its own timeout and retries
+// network errors, 429 and 5xx answers with exponential backoff.
+type retryTransport struct {
+	base    http.RoundTripper
+	limiter *tokenBucket
+	retries int
+	backoff time.Duration
+	timeout time.Duration
+}
+
+func newRetryTransport(base http.RoundTripper, cfg PriceProviderConfig) *retryTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	transport := &retryTransport{
+		base:    base,
+		retries: DefaultPriceRetries,
+		backoff: cfg.RetryBackoff,
+		timeout: cfg.RequestTimeout,
+	}
+	if cfg.Retries != nil && *cfg.Retries >= 0 {
+		transport.retries = *cfg.Retries
+	}
+	rate := cfg.RequestsPerSecond
+	if rate <= 0 {
+		rate = DefaultRequestsPerSecond
+	}
+	transport.limiter = newTokenBucket(rate, cfg.Workers)
+	if transport.backoff <= 0 {
+		transport.backoff = DefaultPriceRetryBackoff
+	}
+	if transport.timeout <= 0 {
+		transport.timeout = DefaultPriceRequestTimeout
+	}
+	return transport
+}
+
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	parent := req.Context()
+	backoff := t.backoff
+	for attempt := 0; ; attempt++ {
+		if err := t.limiter.Wait(parent); err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(parent, t.timeout)
+		resp, err := t.base.RoundTrip(req.Clone(ctx))
+		retry := attempt < t.retries && parent.Err() == nil &&
+			(err != nil || retryableStatus(resp.StatusCode))
+		if !retry {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			// The attempt's context has to live until the body is read.
+			resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			InfoLogger.Printf("retrying %s after %s\n", req.URL.Host, resp.Status)
+		} else {
+			InfoLogger.Printf("retrying %s after %v\n", req.URL.Host, err)
+		}
+		cancel()
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-parent.Done():
+			timer.Stop()
+			return nil, parent.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+/**
+DEDUPLICATION
+*/
+
+// priceCache shares fetches of the same provider symbol and date between securities,
+// including fetches still in flight.
+type priceCache struct {
+	mu      sync.Mutex
+	entries map[string]*priceCacheEntry
+}
+
+type priceCacheEntry struct {
+	done  chan struct{}
+	close dailyClose
+	err   error
+}
+
+func newPriceCache() *priceCache {
+	return &priceCache{entries: make(map[string]*priceCacheEntry)}
+}
+
+// do runs fetch once per key. A nil cache fetches every time.
+func (c *priceCache) do(key string, fetch func() (dailyClose, error)) (dailyClose, error) {
+	if c == nil {
+		return fetch()
+	}
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok {
+		c.mu.Unlock()
+		<-entry.done
+		return entry.close, entry.err
+	}
+	entry := &priceCacheEntry{done: make(chan struct{})}
+	c.entries[key] = entry
+	c.mu.Unlock()
+
+	entry.close, entry.err = fetch()
+	if errors.Is(entry.err, context.Canceled) || errors.Is(entry.err, context.DeadlineExceeded) {
+		// Don't keep a cancelled fetch around for later callers.
+		c.mu.Lock()
+		delete(c.entries, key)
+		c.mu.Unlock()
+	}
+	close(entry.done)
+	return entry.close, entry.err
+}
+
+/**
+WORKER POOL
+*/
+
+// FetchedPrice is the outcome of looking up the price of a security
+type FetchedPrice struct {
+	Price    Price
+	Provider string
+	Err      error
+}
+
+// FetchPrices looks up the prices of securities with a pool of workers, each asking the
+// providers in order. Results are keyed by security id.
+func FetchPrices(ctx context.Context, providers []PriceProvider, securities []Security, date time.Time, workers int) map[string]FetchedPrice {
+	if workers <= 0 {
+		workers = DefaultPriceWorkers
+	}
+	type result struct {
+		securityID string
+		fetched    FetchedPrice
+	}
+	jobs := make(chan Security)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for security := range jobs {
+				price, provider, err := FetchPrice(ctx, providers, security, date)
+				results <- result{security.ID, FetchedPrice{Price: price, Provider: provider, Err: err}}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, security := range securities {
+			select {
+			case jobs <- security:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	fetched := make(map[string]FetchedPrice, len(securities))
+	for r := range results {
+		fetched[r.securityID] = r.fetched
+	}
+	// Securities never handed to a worker because the run was cancelled.
+	for _, security := range securities {
+		if _, ok := fetched[security.ID]; !ok {
+			fetched[security.ID] = FetchedPrice{Err: ctx.Err()}
+		}
+	}
+	return fetched
+}
@@ -0,0 +1,550 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ericlagergren/decimal"
+)
+
+var (
+	ErrPriceNotFound        = errors.New("no price found")
+	ErrUnknownPriceProvider = errors.New("unknown price provider")
+	ErrMissingPriceDir      = errors.New("the csv price provider needs a price directory")
+)
+
+const (
+	STORE_PRICE_PROVIDER = "store"
+	YAHOO_PRICE_PROVIDER = "yahoo"
+	STOOQ_PRICE_PROVIDER = "stooq"
+	CSV_PRICE_PROVIDER   = "csv"
+	FILE_PRICE_PROVIDER  = "file"
+)
+
+const (
+	DefaultYahooBaseURL = "https://query2.finance.yahoo.com"
+	DefaultStooqBaseURL = "https://stooq.com"
+)
+
+// DefaultPriceProviders is the lookup order used when none is configured
+var DefaultPriceProviders = []string{STORE_PRICE_PROVIDER, YAHOO_PRICE_PROVIDER}
+
+// PriceProvider looks up the closing price of a security on a date, or the last close
+// before it within the lookback when the date wasn't a trading day. Providers return
+// ErrPriceNotFound or ErrNoSymbolFound when they have nothing for the security.
+type PriceProvider interface {
+	Name() string
+	GetPrice(ctx context.Context, security Security, date time.Time) (Price, error)
+}
+
+// PriceProviderConfig selects the providers to ask, in order, and where they fetch from
+type PriceProviderConfig struct {
+	Providers    []string
+	YahooBaseURL string
+	StooqBaseURL string
+	PriceDir     string
+	Client       *http.Client // its transport is wrapped with the rate limit and retries
+	LookbackDays int          // how many days before the date a close may be from, below zero only the date
+	PriceField   PriceField   // defaults to the close
+
+	// Zero values use the defaults. Retries is set apart since 0 disables retrying, nil or
+	// below zero uses DefaultPriceRetries.
+	Workers           int
+	RequestsPerSecond float64
+	Retries           *int
+	RetryBackoff      time.Duration
+	RequestTimeout    time.Duration
+}
+
+// NewPriceProviders builds the configured providers. The store provider reads through tx;
+// a nil tx reads outside any transaction.
+func NewPriceProviders(cfg PriceProviderConfig, tx *sql.Tx) ([]PriceProvider, error) {
+	names := cfg.Providers
+	if len(names) == 0 {
+		names = DefaultPriceProviders
+	}
+	base := http.DefaultClient
+	if cfg.Client != nil {
+		base = cfg.Client
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = DefaultPriceWorkers
+	}
+	client := &http.Client{
+		Transport:     newRetryTransport(base.Transport, cfg),
+		CheckRedirect: base.CheckRedirect,
+		Jar:           base.Jar,
+	}
+	field := cfg.PriceField
+	if field == "" {
+		field = CLOSE_PRICE_FIELD
+	}
+	lookback := cfg.Lookback()
+	providers := make([]PriceProvider, 0, len(names))
+	for _, name := range names {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case STORE_PRICE_PROVIDER:
+			providers = append(providers, StorePriceProvider{Tx: tx, Lookback: lookback})
+		case YAHOO_PRICE_PROVIDER:
+			baseURL := cfg.YahooBaseURL
+			if baseURL == "" {
+				baseURL = DefaultYahooBaseURL
+			}
+			providers = append(providers, YahooPriceProvider{
+				BaseURL:  baseURL,
+				Client:   client,
+				Lookback: lookback,
+				Field:    field,
+				cache:    newPriceCache(),
+			})
+		case STOOQ_PRICE_PROVIDER:
+			baseURL := cfg.StooqBaseURL
+			if baseURL == "" {
+				baseURL = DefaultStooqBaseURL
+			}
+			providers = append(providers, StooqPriceProvider{
+				BaseURL:  baseURL,
+				Client:   client,
+				Lookback: lookback,
+				Field:    field,
+				cache:    newPriceCache(),
+			})
+		case CSV_PRICE_PROVIDER:
+			if cfg.PriceDir == "" {
+				return nil, ErrMissingPriceDir
+			}
+			providers = append(providers, CSVDirectoryPriceProvider{Directory: cfg.PriceDir, Lookback: lookback, Field: field})
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrUnknownPriceProvider, name)
+		}
+	}
+	return providers, nil
+}
+
+// Lookback is the number of days before the date a close may be from
+func (cfg PriceProviderConfig) Lookback() int {
+	if cfg.LookbackDays < 0 {
+		return 0
+	}
+	if cfg.LookbackDays == 0 {
+		return DefaultPriceLookbackDays
+	}
+	return cfg.LookbackDays
+}
+
+// dailyClose is a close and the trading day it is from
+type dailyClose struct {
+	Date  time.Time
+	Price *decimal.Big
+}
+
+// FetchPrice asks the providers in order and returns the first price found with the
+// name of the provider it came from. Provider errors other than not found are logged
+// and the next provider is asked.
+func FetchPrice(ctx context.Context, providers []PriceProvider, security Security, date time.Time) (Price, string, error) {
+	err := fmt.Errorf("%w: %s", ErrPriceNotFound, security.ID)
+	for _, provider := range providers {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return Price{}, "", ctxErr
+		}
+		price, providerErr := provider.GetPrice(ctx, security, date)
+		if providerErr == nil {
+			return price, provider.Name(), nil
+		}
+		if !errors.Is(providerErr, ErrPriceNotFound) && !errors.Is(providerErr, ErrNoSymbolFound) {
+			ErrLogger.Printf("%s: %v\n", provider.Name(), providerErr)
+			err = providerErr
+		}
+	}
+	return Price{}, "", err
+}
+
+/**
+STORE
+*/
+
+// StorePriceProvider returns prices from the prices table
+type StorePriceProvider struct {
+	Tx       *sql.Tx
+	Lookback int
+}
+
+func (p StorePriceProvider) Name() string { return STORE_PRICE_PROVIDER }
+
+func (p StorePriceProvider) GetPrice(ctx context.Context, security Security, date time.Time) (Price, error) {
+	price, err := GetLatestStoredPrice(security.ID, date.AddDate(0, 0, -p.Lookback), date, p.Tx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return price, ErrPriceNotFound
+	}
+	return price, err
+}
+
+/**
+YAHOO
+*/
+
+type StockPriceResponse struct {
+	Chart struct {
+		Result []struct {
+			Meta struct {
+				ExchangeTimezoneName string
+				Gmtoffset            int
+			}
+			Timestamp  []int64
+			Indicators struct {
+				Quote []struct {
+					Close []*float64
+				}
+				Adjclose []struct {
+					AdjClose []*float64
+				}
+			}
+		}
+	}
+}
+
+type SymbolSearchResponse struct {
+	Quotes []struct {
+		Symbol string
+	}
+}
+
+// YahooPriceProvider fetches daily closes from the Yahoo Finance chart API
+type YahooPriceProvider struct {
+	BaseURL  string
+	Client   *http.Client
+	Lookback int
+	Field    PriceField
+	cache    *priceCache
+}
+
+func (p YahooPriceProvider) Name() string { return YAHOO_PRICE_PROVIDER }
+
+func (p YahooPriceProvider) getJSON(ctx context.Context, requestURL string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return err
+	}
+	// Yahoo refuses the default Go user agent.
+	req.Header.Add("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/133.0.0.0 Safari/537.36")
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNoSymbolFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("yahoo: %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ResolveSymbol returns the Yahoo symbol of a security. Securities outside the US are
+// searched by ISIN, US securities use their ticker.
+func (p YahooPriceProvider) ResolveSymbol(ctx context.Context, security Security) (string, error) {
+	if security.YahooSymbol != "" {
+		return security.YahooSymbol, nil
+	}
+	if security.Currency == USD {
+		if symbol := securityTicker(security); symbol != "" {
+			return symbol, nil
+		}
+		return "", ErrNoSymbolFound
+	}
+	if security.ISIN == "" {
+		return "", ErrNoSymbolFound
+	}
+	searchData := SymbolSearchResponse{}
+	searchURL := fmt.Sprintf("%s/v1/finance/search?q=%s&lang=en-US&region=US", p.BaseURL, url.QueryEscape(security.ISIN))
+	if err := p.getJSON(ctx, searchURL, &searchData); err != nil {
+		return "", err
+	}
+	if len(searchData.Quotes) == 0 || strings.TrimSpace(searchData.Quotes[0].Symbol) == "" {
+		return "", ErrNoSymbolFound
+	}
+	return searchData.Quotes[0].Symbol, nil
+}
+
+func (p YahooPriceProvider) GetPrice(ctx context.Context, security Security, date time.Time) (Price, error) {
+	price := Price{SecurityID: security.ID, Date: date, Currency: security.Currency, Source: YAHOO_PRICE_SOURCE}
+	symbol, err := p.ResolveSymbol(ctx, security)
+	if err != nil {
+		return price, err
+	}
+	price.Symbol = symbol
+	daily, err := p.cache.do(symbol+"|"+date.Format(time.DateOnly), func() (dailyClose, error) {
+		return p.fetchClose(ctx, symbol, date)
+	})
+	price.Date, price.Price = daily.Date, daily.Price
+	return price, err
+}
+
+// fetchClose asks for the days of the lookback and returns the last close on or before
+// the date, by the trading day at the exchange.
+func (p YahooPriceProvider) fetchClose(ctx context.Context, symbol string, date time.Time) (dailyClose, error) {
+	day := dateOnly(date)
+	from := day.AddDate(0, 0, -p.Lookback)
+	// Bars are stamped with the time the session opens, which is the day before in UTC
+	// for exchanges east of it, so the window goes past the date and is cut below.
+	chartURL := fmt.Sprintf("%s/v8/finance/chart/%s?period1=%d&period2=%d&interval=1d&lang=en-US&region=SE",
+		p.BaseURL, url.PathEscape(symbol), from.AddDate(0, 0, -1).Unix(), day.AddDate(0, 0, 2).Unix())
+	var stockPrice StockPriceResponse
+	if err := p.getJSON(ctx, chartURL, &stockPrice); err != nil {
+		return dailyClose{}, err
+	}
+
+	// Yahoo may return empty chart results for non-equities / unknown symbols.
+	if len(stockPrice.Chart.Result) == 0 {
+		return dailyClose{}, ErrNoSymbolFound
+	}
+	result := stockPrice.Chart.Result[0]
+	var values []*float64
+	if p.Field == ADJ_CLOSE_PRICE_FIELD {
+		if len(result.Indicators.Adjclose) > 0 {
+			values = result.Indicators.Adjclose[0].AdjClose
+		}
+	} else if len(result.Indicators.Quote) > 0 {
+		values = result.Indicators.Quote[0].Close
+	}
+	location, err := time.LoadLocation(result.Meta.ExchangeTimezoneName)
+	if err != nil || result.Meta.ExchangeTimezoneName == "" {
+		location = time.FixedZone("", result.Meta.Gmtoffset)
+	}
+
+	found := -1
+	var foundDay time.Time
+	for i, timestamp := range result.Timestamp {
+		if i >= len(values) || values[i] == nil {
+			// Yahoo leaves holes for days without trades.
+			continue
+		}
+		tradingDay := dateOnly(time.Unix(timestamp, 0).In(location))
+		if tradingDay.Before(from) || tradingDay.After(day) || (found >= 0 && tradingDay.Before(foundDay)) {
+			continue
+		}
+		found, foundDay = i, tradingDay
+	}
+	if found < 0 {
+		return dailyClose{}, ErrPriceNotFound
+	}
+	price, _, err := ParseFieldAmount(strconv.FormatFloat(*values[found], 'f', -1, 64), US, PRICE_FIELD)
+	return dailyClose{Date: foundDay, Price: price}, err
+}
+
+// securityTicker is the first ticker of a security, or the symbol of a CURRENCY:SYMBOL id
+func securityTicker(security Security) string {
+	if len(security.Tickers) > 0 {
+		return security.Tickers[0].Ticker
+	}
+	if _, symbol, ok := strings.Cut(security.ID, ":"); ok {
+		return symbol
+	}
+	return ""
+}
+
+/**
+PRICE FILE
+*/
+
+// FilePriceProvider returns the prices of a price file (see ReadPriceFile), taking the
+// latest one on or before the date within the lookback
+type FilePriceProvider struct {
+	Prices   map[string]Price
+	Lookback int
+}
+
+// NewFilePriceProvider reads a price file. Securities are looked up through tx.
+func NewFilePriceProvider(path string, tx *sql.Tx) (FilePriceProvider, error) {
+	provider := FilePriceProvider{Prices: make(map[string]Price)}
+	prices, err := ReadPriceFile(path, tx)
+	if err != nil {
+		return provider, err
+	}
+	for _, price := range prices {
+		provider.Prices[price.SecurityID+"|"+dateOnly(price.Date).Format(time.DateOnly)] = price
+	}
+	return provider, nil
+}
+
+func (p FilePriceProvider) Name() string { return FILE_PRICE_PROVIDER }
+
+func (p FilePriceProvider) GetPrice(ctx context.Context, security Security, date time.Time) (Price, error) {
+	day := dateOnly(date)
+	for i := 0; i <= p.Lookback; i++ {
+		if price, ok := p.Prices[security.ID+"|"+day.AddDate(0, 0, -i).Format(time.DateOnly)]; ok {
+			return price, nil
+		}
+	}
+	return Price{}, ErrPriceNotFound
+}
+
+/**
+STOOQ
+*/
+
+// StooqPriceProvider fetches daily closes from the Stooq CSV download. Securities need a
+// ticker on the "stooq" exchange (e.g. stooq=ERIC-B.SE), US securities default to TICKER.US.
+type StooqPriceProvider struct {
+	BaseURL  string
+	Client   *http.Client
+	Lookback int
+	Field    PriceField
+	cache    *priceCache
+}
+
+func (p StooqPriceProvider) Name() string { return STOOQ_PRICE_PROVIDER }
+
+func (p StooqPriceProvider) symbol(security Security) string {
+	for _, ticker := range security.Tickers {
+		if strings.EqualFold(ticker.Exchange, STOOQ_PRICE_PROVIDER) {
+			return strings.ToLower(ticker.Ticker)
+		}
+	}
+	if security.Currency == USD {
+		if ticker := securityTicker(security); ticker != "" {
+			return strings.ToLower(ticker) + ".us"
+		}
+	}
+	return ""
+}
+
+func (p StooqPriceProvider) GetPrice(ctx context.Context, security Security, date time.Time) (Price, error) {
+	price := Price{SecurityID: security.ID, Date: date, Currency: security.Currency, Source: STOOQ_PRICE_SOURCE}
+	symbol := p.symbol(security)
+	if symbol == "" {
+		return price, ErrNoSymbolFound
+	}
+	price.Symbol = symbol
+	daily, err := p.cache.do(symbol+"|"+date.Format(time.DateOnly), func() (dailyClose, error) {
+		return p.fetchClose(ctx, symbol, date)
+	})
+	price.Date, price.Price = daily.Date, daily.Price
+	return price, err
+}
+
+func (p StooqPriceProvider) fetchClose(ctx context.Context, symbol string, date time.Time) (dailyClose, error) {
+	from := dateOnly(date).AddDate(0, 0, -p.Lookback)
+	requestURL := fmt.Sprintf("%s/q/d/l/?s=%s&d1=%s&d2=%s&i=d",
+		p.BaseURL, url.QueryEscape(symbol), from.Format("20060102"), date.Format("20060102"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return dailyClose{}, err
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return dailyClose{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return dailyClose{}, fmt.Errorf("stooq: %s", resp.Status)
+	}
+	return readClosePrice(resp.Body, from, date, p.Field)
+}
+
+/**
+CSV DIRECTORY
+*/
+
+// CSVDirectoryPriceProvider reads <security id>.csv files from a directory, with a colon
+// in the id written as an underscore (USD_AAPL.csv). Files have a Date column and a
+// Close or Price column in US number format, and optionally an Adj Close column.
+type CSVDirectoryPriceProvider struct {
+	Directory string
+	Lookback  int
+	Field     PriceField
+}
+
+func (p CSVDirectoryPriceProvider) Name() string { return CSV_PRICE_PROVIDER }
+
+func (p CSVDirectoryPriceProvider) GetPrice(ctx context.Context, security Security, date time.Time) (Price, error) {
+	price := Price{SecurityID: security.ID, Date: date, Currency: security.Currency, Source: IMPORT_PRICE_SOURCE}
+	f, err := os.Open(filepath.Join(p.Directory, strings.ReplaceAll(security.ID, ":", "_")+".csv"))
+	if errors.Is(err, os.ErrNotExist) {
+		return price, ErrPriceNotFound
+	}
+	if err != nil {
+		return price, err
+	}
+	defer f.Close()
+	daily, err := readClosePrice(f, dateOnly(date).AddDate(0, 0, -p.Lookback), date, p.Field)
+	price.Date, price.Price = daily.Date, daily.Price
+	return price, err
+}
+
+/*
+readClosePrice finds the last close between two dates, inclusive, in a CSV with a Date
+column (YYYY-MM-DD) and a Close or Price column. The adjusted close is read from an
+Adj Close column; files without one, like Stooq's, only have the close.
+*/
+func readClosePrice(r io.Reader, from time.Time, to time.Time, field PriceField) (dailyClose, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return dailyClose{}, ErrPriceNotFound
+	}
+	if err != nil {
+		return dailyClose{}, err
+	}
+	dateColumn, closeColumn, adjCloseColumn := -1, -1, -1
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))) {
+		case "date":
+			dateColumn = i
+		case "close", "price":
+			closeColumn = i
+		case "adj close", "adjclose", "adj_close":
+			adjCloseColumn = i
+		}
+	}
+	if field == ADJ_CLOSE_PRICE_FIELD && adjCloseColumn >= 0 {
+		closeColumn = adjCloseColumn
+	}
+	if dateColumn < 0 || closeColumn < 0 {
+		// Stooq answers "No data" for unknown symbols and empty ranges.
+		return dailyClose{}, ErrPriceNotFound
+	}
+	from, to = dateOnly(from), dateOnly(to)
+	found := dailyClose{}
+	var value string
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return dailyClose{}, err
+		}
+		if len(rec) <= closeColumn || len(rec) <= dateColumn || strings.TrimSpace(rec[closeColumn]) == "" {
+			continue
+		}
+		day, err := time.Parse(time.DateOnly, strings.TrimSpace(rec[dateColumn]))
+		if err != nil || day.Before(from) || day.After(to) || day.Before(found.Date) {
+			continue
+		}
+		found.Date, value = day, strings.TrimSpace(rec[closeColumn])
+	}
+	if value == "" {
+		return dailyClose{}, ErrPriceNotFound
+	}
+	found.Price, _, err = ParseFieldAmount(value, US, PRICE_FIELD)
+	return found, err
+}
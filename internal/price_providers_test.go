@@ -0,0 +1,238 @@
+package internal_test
+
+import (
+	"accounting/internal"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ericlagergren/decimal"
+)
+
+func TestYahooPriceProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/finance/search":
+			if r.URL.Query().Get("q") != "SE0000108656" {
+				t.Errorf("expected ISIN search, got %s", r.URL.RawQuery)
+			}
+			fmt.Fprint(w, `{"quotes":[{"symbol":"ERIC-B.ST"}]}`)
+		case "/v8/finance/chart/ERIC-B.ST":
+			// Bars open at 08:00 UTC: Dec 23, 27 (without trades), 30 and Jan 2.
+			fmt.Fprint(w, `{"chart":{"result":[{
+				"meta":{"exchangeTimezoneName":"Europe/Stockholm","gmtoffset":3600},
+				"timestamp":[1734940800,1735286400,1735545600,1735804800],
+				"indicators":{
+					"quote":[{"close":[87.1,null,88.42,90]}],
+					"adjclose":[{"adjclose":[80.5,null,81.25,83]}]
+				}
+			}]}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	providers, err := internal.NewPriceProviders(internal.PriceProviderConfig{
+		Providers:    []string{"yahoo"},
+		YahooBaseURL: server.URL,
+		Client:       server.Client(),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := providers[0]
+	// New Year's Eve is a holiday in Stockholm, so the last close is Dec 30.
+	date := time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC)
+	security := internal.Security{ID: "SE0000108656", ISIN: "SE0000108656", Currency: internal.SEK}
+	price, err := provider.GetPrice(context.Background(), security, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if price.Price.Cmp(decimal.New(8842, 2)) != 0 || price.Symbol != "ERIC-B.ST" || price.Source != internal.YAHOO_PRICE_SOURCE {
+		t.Errorf("expected 88.42 from ERIC-B.ST, got %+v", price)
+	}
+	if !price.Date.Equal(time.Date(2024, 12, 30, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the close of Dec 30, got %s", price.Date)
+	}
+
+	// Days without trades are passed over, and nothing is found before the lookback.
+	security.YahooSymbol = "ERIC-B.ST"
+	if price, err = provider.GetPrice(context.Background(), security, date.AddDate(0, 0, -2)); err != nil || !price.Date.Equal(time.Date(2024, 12, 23, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the close of Dec 23 on Dec 29, got %+v (%v)", price, err)
+	}
+	if _, err = provider.GetPrice(context.Background(), security, date.AddDate(0, 0, -20)); !errors.Is(err, internal.ErrPriceNotFound) {
+		t.Errorf("expected no price before the first bar, got %v", err)
+	}
+
+	adjusted, err := internal.NewPriceProviders(internal.PriceProviderConfig{
+		Providers:    []string{"yahoo"},
+		YahooBaseURL: server.URL,
+		Client:       server.Client(),
+		PriceField:   internal.ADJ_CLOSE_PRICE_FIELD,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if price, err = adjusted[0].GetPrice(context.Background(), security, date); err != nil || price.Price.Cmp(decimal.New(8125, 2)) != 0 {
+		t.Errorf("expected the adjusted close 81.25, got %+v (%v)", price, err)
+	}
+
+	// US securities use their ticker and unknown symbols are not found.
+	security = internal.Security{ID: "USD:NOPE", Currency: internal.USD}
+	if _, err = provider.GetPrice(context.Background(), security, date); !errors.Is(err, internal.ErrNoSymbolFound) {
+		t.Errorf("expected no symbol found, got %v", err)
+	}
+}
+
+func TestStooqAndCSVPriceProviders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("s") != "aapl.us" {
+			fmt.Fprint(w, "No data")
+			return
+		}
+		if r.URL.Query().Get("d1") != "20241222" || r.URL.Query().Get("d2") != "20250101" {
+			t.Errorf("expected a 10 day window, got %s", r.URL.RawQuery)
+		}
+		fmt.Fprint(w, "Date,Open,High,Low,Close,Volume\n2024-12-30,252.23,253.50,250.75,252.20,35557542\n2024-12-31,252.44,253.28,249.43,250.42,39480718\n")
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "USD_MSFT.csv"), []byte("Date,Price\n2024-12-31,421.50\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	providers, err := internal.NewPriceProviders(internal.PriceProviderConfig{
+		Providers:    []string{"csv", "stooq"},
+		StooqBaseURL: server.URL,
+		PriceDir:     dir,
+		Client:       server.Client(),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC)
+
+	// Jan 1 is a holiday, so the close is the one of Dec 31.
+	apple := internal.Security{ID: "USD:AAPL", Currency: internal.USD}
+	price, provider, err := internal.FetchPrice(context.Background(), providers, apple, date.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider != "stooq" || price.Price.Cmp(decimal.New(25042, 2)) != 0 || !price.Date.Equal(date) {
+		t.Errorf("expected 250.42 of Dec 31 from stooq, got %s of %s from %s", price.Price, price.Date, provider)
+	}
+	microsoft := internal.Security{ID: "USD:MSFT", Currency: internal.USD}
+	if price, provider, err = internal.FetchPrice(context.Background(), providers, microsoft, date); err != nil || provider != "csv" {
+		t.Errorf("expected the csv price first, got %s (%v)", provider, err)
+	} else if price.Price.Cmp(decimal.New(42150, 2)) != 0 {
+		t.Errorf("expected 421.50, got %s", price.Price)
+	}
+	if _, _, err = internal.FetchPrice(context.Background(), providers, microsoft, date.AddDate(0, 0, -1)); !errors.Is(err, internal.ErrPriceNotFound) {
+		t.Errorf("expected no price the day before, got %v", err)
+	}
+	if price, _, err = internal.FetchPrice(context.Background(), providers, microsoft, date.AddDate(0, 0, 10)); err != nil || !price.Date.Equal(date) {
+		t.Errorf("expected the Dec 31 price within the lookback, got %+v (%v)", price, err)
+	}
+	if _, _, err = internal.FetchPrice(context.Background(), providers, microsoft, date.AddDate(0, 0, 11)); !errors.Is(err, internal.ErrPriceNotFound) {
+		t.Errorf("expected no price past the lookback, got %v", err)
+	}
+
+	if _, err = internal.NewPriceProviders(internal.PriceProviderConfig{Providers: []string{"bloomberg"}}, nil); !errors.Is(err, internal.ErrUnknownPriceProvider) {
+		t.Errorf("expected unknown provider to be refused, got %v", err)
+	}
+}
+
+func TestFetchPricesRetriesAndDeduplicates(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		count := requests[r.URL.Path]
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/v8/finance/chart/FLAKY":
+			// Fails twice before answering.
+			if count <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprint(w, `{"chart":{"result":[{"timestamp":[1735655400],"indicators":{"quote":[{"close":[10]}]}}]}}`)
+		case "/v8/finance/chart/SHARED":
+			fmt.Fprint(w, `{"chart":{"result":[{"timestamp":[1735655400],"indicators":{"quote":[{"close":[20]}]}}]}}`)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	retries := 2
+	config := internal.PriceProviderConfig{
+		Providers:         []string{"yahoo"},
+		YahooBaseURL:      server.URL,
+		Client:            server.Client(),
+		Workers:           3,
+		RequestsPerSecond: 1000,
+		Retries:           &retries,
+		RetryBackoff:      time.Millisecond,
+		RequestTimeout:    time.Second,
+	}
+	providers, err := internal.NewPriceProviders(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	securities := []internal.Security{
+		{ID: "USD:FLAKY", Currency: internal.USD, YahooSymbol: "FLAKY"},
+		{ID: "USD:SHARED", Currency: internal.USD, YahooSymbol: "SHARED"},
+		{ID: "SE0000000039", Currency: internal.USD, YahooSymbol: "SHARED"},
+		{ID: "USD:DOWN", Currency: internal.USD, YahooSymbol: "DOWN"},
+	}
+	date := time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC)
+	fetched := internal.FetchPrices(context.Background(), providers, securities, date, 3)
+
+	if f := fetched["USD:FLAKY"]; f.Err != nil || f.Price.Price.Cmp(decimal.New(10, 0)) != 0 {
+		t.Errorf("expected the flaky symbol to succeed on the third attempt, got %+v", f)
+	}
+	if f := fetched["SE0000000039"]; f.Err != nil || f.Price.SecurityID != "SE0000000039" || f.Price.Price.Cmp(decimal.New(20, 0)) != 0 {
+		t.Errorf("expected the shared symbol's price, got %+v", f)
+	}
+	if f := fetched["USD:DOWN"]; f.Err == nil {
+		t.Error("expected a failing symbol to return an error")
+	}
+	if requests["/v8/finance/chart/SHARED"] != 1 {
+		t.Errorf("expected one request for a symbol shared by two securities, got %d", requests["/v8/finance/chart/SHARED"])
+	}
+	if requests["/v8/finance/chart/DOWN"] != 3 {
+		t.Errorf("expected 1 attempt and 2 retries, got %d", requests["/v8/finance/chart/DOWN"])
+	}
+
+	// 0 disables retrying, nil and below zero retry the default number of times.
+	zero, negative := 0, -1
+	for _, test := range []struct {
+		symbol   string
+		retries  *int
+		attempts int
+	}{
+		{"DOWN0", &zero, 1},
+		{"DOWNNIL", nil, 1 + internal.DefaultPriceRetries},
+		{"DOWNNEG", &negative, 1 + internal.DefaultPriceRetries},
+	} {
+		config.Retries = test.retries
+		if providers, err = internal.NewPriceProviders(config, nil); err != nil {
+			t.Fatal(err)
+		}
+		security := internal.Security{ID: "USD:" + test.symbol, Currency: internal.USD, YahooSymbol: test.symbol}
+		internal.FetchPrices(context.Background(), providers, []internal.Security{security}, date, 1)
+		if attempts := requests["/v8/finance/chart/"+test.symbol]; attempts != test.attempts {
+			t.Errorf("%s: expected %d attempts, got %d", test.symbol, test.attempts, attempts)
+		}
+	}
+}
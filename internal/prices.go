@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ericlagergren/decimal"
+)
+
+var ErrInvalidPriceFile = errors.New("invalid price file")
+
+// SetManualPrice stores a manual price override. The currency defaults to the security's.
+func SetManualPrice(securityID string, date time.Time, price *decimal.Big, currency CurrencyUnit) error {
+	security, err := GetSecurity(securityID)
+	if err != nil {
+		return err
+	}
+	if currency == "" {
+		currency = security.Currency
+	}
+	return UpsertPrice(Price{
+		SecurityID: security.ID,
+		Date:       date,
+		Price:      price,
+		Currency:   currency,
+		Source:     MANUAL_PRICE_SOURCE,
+	}, nil)
+}
+
+/*
+ImportPriceFile stores the prices of a CSV file with the header
+Security,Date,Price[,Currency]. Security is a security id (see `securities list`),
+Date is YYYY-MM-DD and Currency defaults to the security's currency. Prices are
+parsed in the currency's number format, like the reporting exports.
+*/
+func ImportPriceFile(path string) (int, error) {
+	tx, err := GlobalDB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	prices, err := ReadPriceFile(path, tx)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	for _, price := range prices {
+		if err = UpsertPrice(price, tx); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	return len(prices), tx.Commit()
+}
+
+// ReadPriceFile reads a price file in the ImportPriceFile format without storing it.
+// Securities are looked up through tx; a nil tx reads outside any transaction.
+func ReadPriceFile(path string, tx *sql.Tx) ([]Price, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	if len(header) < 3 {
+		return nil, fmt.Errorf("%w: expected Security,Date,Price[,Currency] header", ErrInvalidPriceFile)
+	}
+
+	var db queryer = GlobalDB
+	if tx != nil {
+		db = tx
+	}
+	format, err := newAmountFormat("", tx)
+	if err != nil {
+		return nil, err
+	}
+	prices := make([]Price, 0)
+	for line := 2; ; line++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		price, err := priceFromRecord(rec, db, format)
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidPriceFile, line, err)
+		}
+		prices = append(prices, price)
+	}
+	return prices, nil
+}
+
+func priceFromRecord(rec []string, db queryer, format amountFormat) (Price, error) {
+	price := Price{Source: IMPORT_PRICE_SOURCE}
+	if len(rec) < 3 {
+		return price, errors.New("expected at least 3 columns")
+	}
+	price.SecurityID = strings.TrimSpace(rec[0])
+	var currency string
+	err := db.QueryRow(`SELECT currency FROM securities WHERE id = ?;`, price.SecurityID).Scan(&currency)
+	if errors.Is(err, sql.ErrNoRows) {
+		return price, fmt.Errorf("%w: %s", ErrSecurityNotFound, price.SecurityID)
+	}
+	if err != nil {
+		return price, err
+	}
+	price.Currency = CurrencyUnit(currency)
+	if len(rec) > 3 && strings.TrimSpace(rec[3]) != "" {
+		price.Currency = CurrencyUnit(strings.ToUpper(strings.TrimSpace(rec[3])))
+	}
+	price.Date, err = time.Parse(time.DateOnly, strings.TrimSpace(rec[1]))
+	if err != nil {
+		return price, err
+	}
+	price.Price, err = format.parse("Price", rec[2], price.Currency, PRICE_FIELD)
+	if err != nil {
+		return price, err
+	}
+	if price.Price == nil {
+		return price, errors.New("missing price")
+	}
+	return price, nil
+}
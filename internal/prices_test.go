@@ -0,0 +1,206 @@
+package internal_test
+
+import (
+	"accounting/internal"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ericlagergren/decimal"
+)
+
+func TestStoredPrices(t *testing.T) {
+	internal.InitializeDB()
+	tx, err := internal.GlobalDB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	securityID, err := internal.EnsureSecurity(internal.AssetLot{
+		ISIN:              "SE0000000035",
+		Symbol:            "Price AB",
+		CostBasisCurrency: internal.SEK,
+	}, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "prices.csv")
+	content := "Security,Date,Price,Currency\nSE0000000035,2024-12-31,\"101,5\",\n"
+	if err = os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if imported, err := internal.ImportPriceFile(file); err != nil || imported != 1 {
+		t.Fatalf("expected 1 imported price, got %d (%v)", imported, err)
+	}
+	date := time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC)
+	price, err := internal.GetStoredPrice(securityID, date, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if price.Price.Cmp(decimal.New(1015, 1)) != 0 || price.Currency != internal.SEK || price.Source != internal.IMPORT_PRICE_SOURCE {
+		t.Errorf("expected imported 101.5 SEK, got %+v", price)
+	}
+
+	// Manual prices win over imported ones.
+	if err = internal.SetManualPrice(securityID, date, decimal.New(102, 0), ""); err != nil {
+		t.Fatal(err)
+	}
+	if price, err = internal.GetStoredPrice(securityID, date, nil); err != nil || price.Source != internal.MANUAL_PRICE_SOURCE {
+		t.Errorf("expected the manual price, got %+v (%v)", price, err)
+	}
+}
+
+func TestMarkStocksMissingPricePolicy(t *testing.T) {
+	internal.InitializeDB()
+	// Lots from before the other tests' lots, so only this one is marked.
+	tx, err := internal.GlobalDB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lotID, err := internal.InsertAssetLot(internal.AssetLot{
+		AccountID:         "mark-test",
+		ISIN:              "SE0000000037",
+		Symbol:            "Mark AB",
+		Shares:            decimal.New(10, 0),
+		CostBasisPerShare: decimal.New(50, 0),
+		CostBasisCurrency: internal.SEK,
+		CreatedDate:       time.Date(1989, 6, 1, 0, 0, 0, 0, time.UTC),
+	}, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(1989, 12, 29, 0, 0, 0, 0, time.UTC)
+	opts := internal.MarkOptions{
+		Prices:    internal.PriceProviderConfig{Providers: []string{"store"}},
+		OnMissing: internal.FAIL_ON_MISSING,
+	}
+	if _, err = internal.MarkStocks(context.Background(), date, opts); !errors.Is(err, internal.ErrMissingPrice) {
+		t.Fatalf("expected the run to fail without a price, got %v", err)
+	}
+
+	// Older than the lookback, so only found as the last known price.
+	if err = internal.SetManualPrice("SE0000000037", date.AddDate(0, 0, -20), decimal.New(55, 0), ""); err != nil {
+		t.Fatal(err)
+	}
+	opts.OnMissing = internal.LAST_KNOWN_ON_MISSING
+	results, err := internal.MarkStocks(context.Background(), date, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].LotID != lotID || results[0].Price.Cmp(decimal.New(55, 0)) != 0 {
+		t.Fatalf("expected the lot marked at the last known 55, got %+v", results)
+	}
+	if results[0].Source != "last known 1989-12-09" || !results[0].PriceDate.Equal(date.AddDate(0, 0, -20)) {
+		t.Errorf("expected the last known price date as source, got %s", results[0].Source)
+	}
+
+	// Marked lots are only marked again on the date when replacing. The price of the
+	// last trading day before the date is used.
+	if err = internal.SetManualPrice("SE0000000037", date.AddDate(0, 0, -1), decimal.New(60, 0), ""); err != nil {
+		t.Fatal(err)
+	}
+	if results, err = internal.MarkStocks(context.Background(), date, opts); err != nil || len(results) != 0 {
+		t.Fatalf("expected no lots to mark again, got %d (%v)", len(results), err)
+	}
+	opts.Replace = true
+	if results, err = internal.MarkStocks(context.Background(), date, opts); err != nil || len(results) != 1 {
+		t.Fatalf("expected the lot to be re-marked, got %d (%v)", len(results), err)
+	}
+	if results[0].Price.Cmp(decimal.New(60, 0)) != 0 || results[0].Source != "store" {
+		t.Errorf("expected the stored price of the day before, got %+v", results[0])
+	}
+	var current, superseded int
+	err = internal.GlobalDB.QueryRow(`
+	SELECT SUM(superseded_date IS NULL), SUM(superseded_date IS NOT NULL) FROM market_marks WHERE asset_lot_id = ?;
+	`, lotID).Scan(&current, &superseded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != 1 || superseded != 1 {
+		t.Errorf("expected 1 current and 1 superseded mark, got %d and %d", current, superseded)
+	}
+	var priceDate time.Time
+	err = internal.GlobalDB.QueryRow(`
+	SELECT price_date FROM market_marks WHERE asset_lot_id = ? AND superseded_date IS NULL;
+	`, lotID).Scan(&priceDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !priceDate.Equal(date.AddDate(0, 0, -1)) {
+		t.Errorf("expected the mark to keep the price date, got %s", priceDate)
+	}
+}
+
+func TestMarkStocksAsOfLotHistory(t *testing.T) {
+	internal.InitializeDB()
+	// Split and renamed after the mark date and sold before the other tests' mark dates.
+	bought := time.Date(1988, 3, 1, 0, 0, 0, 0, time.UTC)
+	lot := internal.AssetLot{
+		AccountID:         "mark-history-test",
+		ISIN:              "SE0000000038",
+		Symbol:            "History AB",
+		Shares:            decimal.New(10, 0),
+		CostBasisPerShare: decimal.New(50, 0),
+		CostBasisCurrency: internal.SEK,
+		CreatedDate:       bought,
+	}
+	tx, err := internal.GlobalDB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lot.ID, err = internal.InsertAssetLot(lot, tx); err != nil {
+		t.Fatal(err)
+	}
+	if err = internal.InsertAssetLotHistory(lot, bought, tx); err != nil {
+		t.Fatal(err)
+	}
+	lot.Symbol, lot.Shares, lot.CostBasisPerShare = "History AB NEW", decimal.New(20, 0), decimal.New(25, 0)
+	if err = internal.InsertAssetLotHistory(lot, time.Date(1989, 2, 1, 0, 0, 0, 0, time.UTC), tx); err != nil {
+		t.Fatal(err)
+	}
+	lot.Shares = decimal.New(0, 0)
+	if err = internal.InsertAssetLotHistory(lot, time.Date(1989, 6, 1, 0, 0, 0, 0, time.UTC), tx); err != nil {
+		t.Fatal(err)
+	}
+	if err = internal.UpdateAssetLotDetails(lot, tx); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	date := time.Date(1988, 12, 30, 0, 0, 0, 0, time.UTC)
+	if err = internal.SetManualPrice("SE0000000038", date, decimal.New(55, 0), ""); err != nil {
+		t.Fatal(err)
+	}
+	results, err := internal.MarkStocks(context.Background(), date, internal.MarkOptions{
+		Prices:    internal.PriceProviderConfig{Providers: []string{"store"}},
+		OnMissing: internal.FAIL_ON_MISSING,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].LotID != lot.ID || results[0].Symbol != "History AB" {
+		t.Fatalf("expected the lot marked under its symbol on the date, got %+v", results)
+	}
+	var shares, gainLoss int64
+	err = internal.GlobalDB.QueryRow(`
+	SELECT marked_shares, gain_loss FROM market_marks WHERE asset_lot_id = ? AND superseded_date IS NULL;
+	`, lot.ID).Scan(&shares, &gainLoss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10 shares at 55 against the basis of 50 held on the date.
+	if shares != 100000 || gainLoss != 500000 {
+		t.Errorf("expected 10 shares marked with a gain of 50, got %d and %d", shares, gainLoss)
+	}
+}
@@ -0,0 +1,623 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ericlagergren/decimal"
+)
+
+var ErrInvalidRateFile = errors.New("invalid rate file")
+
+/*
+ImportRateFile stores the rates of a file downloaded from the source:
+
+  - riksbank: the daily rates CSV of riksbank.se, in SEK per unit of each series
+  - ecb: the eurofxref XML of the ECB (eurofxref-daily.xml or eurofxref-hist.xml), in units per EUR
+  - irs: the IRS yearly average currency exchange rates table saved as CSV, in units per USD
+  - treasury: the Treasury reporting rates of exchange CSV of Fiscal Data, in units per USD
+
+Rates are converted to units per USD and stored per currency, date and source, so importing a
+file again replaces its rates. Currencies that aren't in supported_currencies are skipped.
+*/
+func ImportRateFile(source RateSource, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var rates []CurrencyRate
+	switch source {
+	case RIKSBANK_RATE_SOURCE:
+		rates, err = ReadRiksbankRates(f)
+	case ECB_RATE_SOURCE:
+		rates, err = ReadECBRates(f)
+	case IRS_RATE_SOURCE:
+		rates, err = ReadIRSRates(f)
+	case TREASURY_RATE_SOURCE:
+		rates, err = ReadTreasuryRates(f)
+	default:
+		return 0, fmt.Errorf("%w: %s", ErrUnknownRateSource, source)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err = ensureSupportedCurrencies(); err != nil {
+		return 0, err
+	}
+	currencies, err := GetSupportedCurrencies()
+	if err != nil {
+		return 0, err
+	}
+	supported := make(map[CurrencyUnit]bool)
+	for _, currency := range currencies {
+		supported[currency] = true
+	}
+
+	tx, err := GlobalDB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	imported := 0
+	skipped := make(map[CurrencyUnit]bool)
+	for _, rate := range rates {
+		if !supported[rate.Currency] {
+			skipped[rate.Currency] = true
+			continue
+		}
+		if err = UpsertCurrencyRate(rate, tx); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		imported++
+	}
+	if len(skipped) > 0 {
+		InfoLogger.Printf("skipped the rates of unsupported currencies: %s\n", strings.Join(sortedCurrencies(skipped), ", "))
+	}
+	return imported, tx.Commit()
+}
+
+func sortedCurrencies(set map[CurrencyUnit]bool) []string {
+	currencies := make([]string, 0, len(set))
+	for currency := range set {
+		currencies = append(currencies, string(currency))
+	}
+	sort.Strings(currencies)
+	return currencies
+}
+
+// parseRateValue parses a rate with either decimal separator, keeping its full precision
+func parseRateValue(value string) (*decimal.Big, bool) {
+	value = strings.ReplaceAll(strings.ReplaceAll(strings.TrimSpace(value), "\u00a0", ""), " ", "")
+	if strings.Contains(value, ",") && !strings.Contains(value, ".") {
+		value = strings.Replace(value, ",", ".", 1)
+	}
+	rate, ok := new(decimal.Big).SetString(value)
+	if !ok || rate.Sign() <= 0 {
+		return nil, false
+	}
+	return rate, true
+}
+
+// perUSD converts rates of a date in units per base currency into units per USD.
+// The base currency itself is included, and the rates are dropped when there is no USD rate.
+func perUSD(date time.Time, base CurrencyUnit, perBase map[CurrencyUnit]*decimal.Big, source RateSource) []CurrencyRate {
+	usd, ok := perBase[USD]
+	if !ok {
+		return nil
+	}
+	rates := make([]CurrencyRate, 0, len(perBase))
+	if base != USD {
+		rates = append(rates, CurrencyRate{Currency: base, Date: date, Rate: RATE_FIELD.Round(decimal.New(0, 4).Quo(decimal.New(1, 0), usd)), Source: source})
+	}
+	for currency, rate := range perBase {
+		if currency == USD || currency == base {
+			continue
+		}
+		rates = append(rates, CurrencyRate{Currency: currency, Date: date, Rate: RATE_FIELD.Round(decimal.New(0, 4).Quo(rate, usd)), Source: source})
+	}
+	sort.Slice(rates, func(i, j int) bool { return rates[i].Currency < rates[j].Currency })
+	return rates
+}
+
+/**
+RIKSBANK
+*/
+
+// riksbankSeries matches the currency of a Riksbank series name: SEKUSDPMI, "1 USD",
+// "100 JPY", "USD/SEK" or plain USD. The optional leading number is the units quoted.
+var riksbankSeries = regexp.MustCompile(`^(?:(\d+)\s+)?(?:SEK)?([A-Z]{3})(?:PMI|/SEK)?$`)
+
+func riksbankCurrency(series string) (CurrencyUnit, *decimal.Big, bool) {
+	match := riksbankSeries.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(series)))
+	if match == nil || match[2] == string(SEK) {
+		return "", nil, false
+	}
+	units := decimal.New(1, 0)
+	if match[1] != "" {
+		n, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil || n <= 0 {
+			return "", nil, false
+		}
+		units = decimal.New(n, 0)
+	}
+	return CurrencyUnit(match[2]), units, true
+}
+
+/*
+ReadRiksbankRates reads a Riksbank exchange rate CSV, separated by semicolons or commas.
+The first column holding dates (Date, Datum, Period or Dag) gives the day. Rates are either
+in one column per series (Period;SEKEURPMI;SEKUSDPMI) or in a Series/Serie column with a
+Value/Värde column. Days without a USD rate are skipped, since rates are stored per USD.
+*/
+func ReadRiksbankRates(r io.Reader) ([]CurrencyRate, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	firstLine, _, _ := bufio.NewReader(bytes.NewReader(data)).ReadLine()
+	if strings.Contains(string(firstLine), ";") {
+		reader.Comma = ';'
+	}
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRateFile, err)
+	}
+
+	dateColumn, seriesColumn, valueColumn := -1, -1, -1
+	seriesColumns := make(map[int]CurrencyUnit)
+	units := make(map[CurrencyUnit]*decimal.Big)
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "date", "datum", "period", "dag":
+			if dateColumn < 0 {
+				dateColumn = i
+			}
+		case "series", "serie", "series name", "serienamn":
+			seriesColumn = i
+		case "value", "värde", "varde":
+			valueColumn = i
+		default:
+			if currency, n, ok := riksbankCurrency(name); ok {
+				seriesColumns[i] = currency
+				units[currency] = n
+			}
+		}
+	}
+	long := seriesColumn >= 0 && valueColumn >= 0
+	if dateColumn < 0 || (!long && len(seriesColumns) == 0) {
+		return nil, fmt.Errorf("%w: expected a date column and rate series", ErrInvalidRateFile)
+	}
+
+	days := make(map[string]map[CurrencyUnit]*decimal.Big)
+	order := make([]string, 0)
+	add := func(day string, currency CurrencyUnit, n *decimal.Big, value string) {
+		rate, ok := parseRateValue(value)
+		if !ok {
+			// Days without a rate are published as empty or n/a.
+			return
+		}
+		if days[day] == nil {
+			days[day] = make(map[CurrencyUnit]*decimal.Big)
+			order = append(order, day)
+		}
+		// SEK per unit of the currency
+		days[day][currency] = decimal.New(0, 8).Quo(rate, n)
+	}
+	for line := 2; ; line++ {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidRateFile, line, err)
+		}
+		if len(rec) <= dateColumn {
+			continue
+		}
+		date, err := time.Parse(time.DateOnly, strings.TrimSpace(rec[dateColumn]))
+		if err != nil {
+			// Footers and notes below the rates.
+			continue
+		}
+		day := date.Format(time.DateOnly)
+		if long {
+			if len(rec) <= seriesColumn || len(rec) <= valueColumn {
+				continue
+			}
+			if currency, n, ok := riksbankCurrency(rec[seriesColumn]); ok {
+				add(day, currency, n, rec[valueColumn])
+			}
+			continue
+		}
+		for column, currency := range seriesColumns {
+			if len(rec) > column {
+				add(day, currency, units[currency], rec[column])
+			}
+		}
+	}
+
+	sort.Strings(order)
+	rates := make([]CurrencyRate, 0)
+	for _, day := range order {
+		date, _ := time.Parse(time.DateOnly, day)
+		// Rates in SEK per unit become units per SEK before converting to USD.
+		perSEK := make(map[CurrencyUnit]*decimal.Big)
+		for currency, sekPerUnit := range days[day] {
+			perSEK[currency] = decimal.New(0, 8).Quo(decimal.New(1, 0), sekPerUnit)
+		}
+		rates = append(rates, perUSD(date, SEK, perSEK, RIKSBANK_RATE_SOURCE)...)
+	}
+	if len(rates) == 0 {
+		return nil, fmt.Errorf("%w: no USD rates found", ErrInvalidRateFile)
+	}
+	return rates, nil
+}
+
+/**
+ECB
+*/
+
+type ecbEnvelope struct {
+	Days []struct {
+		Time  string `xml:"time,attr"`
+		Rates []struct {
+			Currency string `xml:"currency,attr"`
+			Rate     string `xml:"rate,attr"`
+		} `xml:"Cube"`
+	} `xml:"Cube>Cube"`
+}
+
+// ReadECBRates reads the ECB euro foreign exchange reference rates XML, in units per EUR
+func ReadECBRates(r io.Reader) ([]CurrencyRate, error) {
+	var envelope ecbEnvelope
+	if err := xml.NewDecoder(r).Decode(&envelope); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRateFile, err)
+	}
+	rates := make([]CurrencyRate, 0)
+	for _, day := range envelope.Days {
+		date, err := time.Parse(time.DateOnly, day.Time)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidRateFile, err)
+		}
+		perEUR := make(map[CurrencyUnit]*decimal.Big)
+		for _, rate := range day.Rates {
+			if value, ok := parseRateValue(rate.Rate); ok {
+				perEUR[CurrencyUnit(strings.ToUpper(rate.Currency))] = value
+			}
+		}
+		rates = append(rates, perUSD(date, CurrencyUnit("EUR"), perEUR, ECB_RATE_SOURCE)...)
+	}
+	sort.SliceStable(rates, func(i, j int) bool { return rates[i].Date.Before(rates[j].Date) })
+	if len(rates) == 0 {
+		return nil, fmt.Errorf("%w: no USD rates found", ErrInvalidRateFile)
+	}
+	return rates, nil
+}
+
+/**
+IRS
+*/
+
+// countryCurrencies maps the countries of the IRS and Treasury tables to their currency
+var countryCurrencies = map[string]CurrencyUnit{
+	"australia":      "AUD",
+	"canada":         "CAD",
+	"china":          "CNY",
+	"denmark":        "DKK",
+	"euro zone":      "EUR",
+	"hong kong":      "HKD",
+	"india":          "INR",
+	"israel":         "ILS",
+	"japan":          "JPY",
+	"mexico":         "MXN",
+	"new zealand":    "NZD",
+	"norway":         "NOK",
+	"poland":         "PLN",
+	"singapore":      "SGD",
+	"south africa":   "ZAR",
+	"south korea":    "KRW",
+	"sweden":         SEK,
+	"switzerland":    "CHF",
+	"taiwan":         "TWD",
+	"united kingdom": "GBP",
+}
+
+var currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+/*
+ReadIRSRates reads the IRS yearly average currency exchange rates table saved as CSV: a
+Country column, a Currency column and one column per year, in units per USD. The currency
+is taken from a Currency (or Code) column holding a code like SEK, else from the country.
+Yearly averages are dated December 31 of their year.
+*/
+func ReadIRSRates(r io.Reader) ([]CurrencyRate, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRateFile, err)
+	}
+	countryColumn, currencyColumn := -1, -1
+	years := make(map[int]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		switch name {
+		case "country":
+			countryColumn = i
+		case "currency", "code", "currency code":
+			if currencyColumn < 0 || name != "currency" {
+				currencyColumn = i
+			}
+		default:
+			if year, err := strconv.Atoi(name); err == nil && year > 1900 {
+				years[i] = year
+			}
+		}
+	}
+	if countryColumn < 0 && currencyColumn < 0 || len(years) == 0 {
+		return nil, fmt.Errorf("%w: expected Country, Currency and year columns", ErrInvalidRateFile)
+	}
+
+	rates := make([]CurrencyRate, 0)
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidRateFile, err)
+		}
+		var currency CurrencyUnit
+		if currencyColumn >= 0 && currencyColumn < len(rec) && currencyCode.MatchString(strings.TrimSpace(rec[currencyColumn])) {
+			currency = CurrencyUnit(strings.TrimSpace(rec[currencyColumn]))
+		} else if countryColumn >= 0 && countryColumn < len(rec) {
+			currency = countryCurrencies[strings.ToLower(strings.TrimSpace(rec[countryColumn]))]
+		}
+		if currency == "" || currency == USD {
+			continue
+		}
+		for column, year := range years {
+			if column >= len(rec) {
+				continue
+			}
+			if rate, ok := parseRateValue(rec[column]); ok {
+				rates = append(rates, CurrencyRate{
+					Currency: currency,
+					Date:     time.Date(year, 12, 31, 0, 0, 0, 0, time.UTC),
+					Rate:     RATE_FIELD.Round(decimal.New(0, 4).Copy(rate)),
+					Source:   IRS_RATE_SOURCE,
+				})
+			}
+		}
+	}
+	sort.SliceStable(rates, func(i, j int) bool {
+		if rates[i].Currency != rates[j].Currency {
+			return rates[i].Currency < rates[j].Currency
+		}
+		return rates[i].Date.Before(rates[j].Date)
+	})
+	if len(rates) == 0 {
+		return nil, fmt.Errorf("%w: no rates found", ErrInvalidRateFile)
+	}
+	return rates, nil
+}
+
+/**
+TREASURY
+*/
+
+/*
+ReadTreasuryRates reads the Treasury reporting rates of exchange CSV of Fiscal Data: a Record
+Date column, a Country (or Country-Currency Description like Euro Zone-Euro) column and an
+Exchange Rate column in units per USD. Rates are published quarterly and dated their record date.
+*/
+func ReadTreasuryRates(r io.Reader) ([]CurrencyRate, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRateFile, err)
+	}
+	dateColumn, countryColumn, descriptionColumn, rateColumn := -1, -1, -1, -1
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))) {
+		case "record date", "record_date":
+			dateColumn = i
+		case "country":
+			countryColumn = i
+		case "country-currency description", "country_currency_desc":
+			descriptionColumn = i
+		case "exchange rate", "exchange_rate":
+			rateColumn = i
+		}
+	}
+	if dateColumn < 0 || rateColumn < 0 || countryColumn < 0 && descriptionColumn < 0 {
+		return nil, fmt.Errorf("%w: expected Record Date, Country and Exchange Rate columns", ErrInvalidRateFile)
+	}
+
+	rates := make([]CurrencyRate, 0)
+	for line := 2; ; line++ {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidRateFile, line, err)
+		}
+		if len(rec) <= dateColumn || len(rec) <= rateColumn {
+			continue
+		}
+		date, err := time.Parse(time.DateOnly, strings.TrimSpace(rec[dateColumn]))
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidRateFile, line, err)
+		}
+		var currency CurrencyUnit
+		if countryColumn >= 0 && countryColumn < len(rec) {
+			currency = countryCurrencies[strings.ToLower(strings.TrimSpace(rec[countryColumn]))]
+		}
+		if currency == "" && descriptionColumn >= 0 && descriptionColumn < len(rec) {
+			description := rec[descriptionColumn]
+			if i := strings.LastIndex(description, "-"); i > 0 {
+				description = description[:i]
+			}
+			currency = countryCurrencies[strings.ToLower(strings.TrimSpace(description))]
+		}
+		if currency == "" || currency == USD {
+			continue
+		}
+		if rate, ok := parseRateValue(rec[rateColumn]); ok {
+			rates = append(rates, CurrencyRate{
+				Currency: currency,
+				Date:     date,
+				Rate:     RATE_FIELD.Round(decimal.New(0, 4).Copy(rate)),
+				Source:   TREASURY_RATE_SOURCE,
+			})
+		}
+	}
+	sort.SliceStable(rates, func(i, j int) bool {
+		if rates[i].Currency != rates[j].Currency {
+			return rates[i].Currency < rates[j].Currency
+		}
+		return rates[i].Date.Before(rates[j].Date)
+	})
+	if len(rates) == 0 {
+		return nil, fmt.Errorf("%w: no rates found", ErrInvalidRateFile)
+	}
+	return rates, nil
+}
+
+/**
+COVERAGE
+*/
+
+// RateCoverage is how well the stored rates of a currency cover a year. Missing weekdays
+// are weekdays without a daily rate, including bank holidays, up to today.
+type RateCoverage struct {
+	Currency        CurrencyUnit
+	Year            int
+	Sources         []RateSource
+	DailyRates      int
+	FirstDaily      time.Time
+	LastDaily       time.Time
+	MissingWeekdays int
+	LongestGapStart time.Time // first weekday of the longest run without daily rates
+	LongestGapDays  int       // weekdays in that run
+	Yearly          bool      // an IRS or seeded yearly rate is stored
+}
+
+// GetRateCoverage returns the coverage of every supported currency but USD for every year
+// with rates, or only of the given currency and year when they aren't empty or zero.
+func GetRateCoverage(currency CurrencyUnit, year int) ([]RateCoverage, error) {
+	currencies := []CurrencyUnit{currency}
+	if currency == "" {
+		supported, err := GetSupportedCurrencies()
+		if err != nil {
+			return nil, err
+		}
+		currencies = make([]CurrencyUnit, 0, len(supported))
+		for _, c := range supported {
+			if c != USD {
+				currencies = append(currencies, c)
+			}
+		}
+	}
+	today := dateOnly(time.Now())
+	coverage := make([]RateCoverage, 0)
+	for _, c := range currencies {
+		rates, err := GetCurrencyRates(c)
+		if err != nil {
+			return nil, err
+		}
+		byYear := make(map[int][]CurrencyRate)
+		for _, rate := range rates {
+			// Rates against other currencies, like Nordnet's, don't cover conversions to USD.
+			if rate.Base != USD {
+				continue
+			}
+			byYear[rate.Date.Year()] = append(byYear[rate.Date.Year()], rate)
+		}
+		years := []int{year}
+		if year == 0 {
+			years = make([]int, 0, len(byYear))
+			for y := range byYear {
+				years = append(years, y)
+			}
+			sort.Ints(years)
+		}
+		for _, y := range years {
+			coverage = append(coverage, yearCoverage(c, y, byYear[y], today))
+		}
+	}
+	return coverage, nil
+}
+
+func yearCoverage(currency CurrencyUnit, year int, rates []CurrencyRate, today time.Time) RateCoverage {
+	coverage := RateCoverage{Currency: currency, Year: year}
+	sources := make(map[RateSource]bool)
+	daily := make(map[string]bool)
+	for _, rate := range rates {
+		if !sources[rate.Source] {
+			sources[rate.Source] = true
+			coverage.Sources = append(coverage.Sources, rate.Source)
+		}
+		if !rate.Source.Daily() {
+			coverage.Yearly = coverage.Yearly || rate.Source.Yearly()
+			continue
+		}
+		day := dateOnly(rate.Date)
+		if daily[day.Format(time.DateOnly)] {
+			continue
+		}
+		daily[day.Format(time.DateOnly)] = true
+		coverage.DailyRates++
+		if coverage.FirstDaily.IsZero() || day.Before(coverage.FirstDaily) {
+			coverage.FirstDaily = day
+		}
+		if day.After(coverage.LastDaily) {
+			coverage.LastDaily = day
+		}
+	}
+	sort.Slice(coverage.Sources, func(i, j int) bool { return coverage.Sources[i] < coverage.Sources[j] })
+
+	end := time.Date(year, 12, 31, 0, 0, 0, 0, time.UTC)
+	if today.Before(end) {
+		end = today
+	}
+	var gapStart time.Time
+	gapDays := 0
+	for day := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC); !day.After(end); day = day.AddDate(0, 0, 1) {
+		if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+			continue
+		}
+		if daily[day.Format(time.DateOnly)] {
+			gapDays = 0
+			continue
+		}
+		coverage.MissingWeekdays++
+		if gapDays == 0 {
+			gapStart = day
+		}
+		gapDays++
+		if gapDays > coverage.LongestGapDays {
+			coverage.LongestGapStart, coverage.LongestGapDays = gapStart, gapDays
+		}
+	}
+	return coverage
+}
@@ -0,0 +1,140 @@
+package internal_test
+
+import (
+	"accounting/internal"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ericlagergren/decimal"
+)
+
+const riksbankRates = "Period;SEKEURPMI;SEKUSDPMI\n" +
+	"2019-01-02;10,2335;8,9710\n" +
+	"2019-01-03;10,2050;\n" +
+	"2019-01-04;10,1990;8,9450\n" +
+	"Källa: Riksbanken;;\n"
+
+const ecbRates = `<?xml version="1.0" encoding="UTF-8"?>
+<gesmes:Envelope xmlns:gesmes="http://www.gesmes.org/xml/2002-08-01" xmlns="http://www.ecb.int/vocabulary/2002-08-01/eurofxref">
+	<gesmes:subject>Reference rates</gesmes:subject>
+	<Cube>
+		<Cube time="2019-01-07">
+			<Cube currency="USD" rate="1.1445"/>
+			<Cube currency="SEK" rate="10.2448"/>
+		</Cube>
+	</Cube>
+</gesmes:Envelope>`
+
+const irsRates = "Country,Currency,2019,2018\n" +
+	"Sweden,Krona,9.457,8.693\n" +
+	"Euro Zone,Euro,0.893,0.847\n"
+
+const treasuryRates = "Record Date,Country,Currency,Country-Currency Description,Exchange Rate,Effective Date\n" +
+	"2023-12-31,Sweden,Krona,Sweden-Krona,10.035,2023-12-31\n" +
+	"2023-12-31,Euro Zone,Euro,Euro Zone-Euro,0.904,2023-12-31\n" +
+	"2023-12-31,Atlantis,Shell,Atlantis-Shell,1.5,2023-12-31\n"
+
+func TestReadRateFiles(t *testing.T) {
+	rates, err := internal.ReadRiksbankRates(strings.NewReader(riksbankRates))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The day without a USD rate is skipped.
+	if len(rates) != 4 {
+		t.Fatalf("expected EUR and SEK rates of 2 days, got %+v", rates)
+	}
+	if rates[1].Currency != internal.SEK || rates[1].Rate.Cmp(decimal.New(89710, 4)) != 0 {
+		t.Errorf("expected 8.9710 SEK per USD, got %+v", rates[1])
+	}
+	if rates[0].Currency != "EUR" || rates[0].Rate.Cmp(decimal.New(87663067, 8)) != 0 {
+		t.Errorf("expected 0.87663067 EUR per USD, got %+v", rates[0])
+	}
+
+	rates, err = internal.ReadECBRates(strings.NewReader(ecbRates))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rates) != 2 || rates[1].Currency != internal.SEK || rates[1].Rate.Cmp(decimal.New(895133246, 8)) != 0 {
+		t.Errorf("expected 8.95133246 SEK per USD from the EUR cross rate, got %+v", rates)
+	}
+
+	rates, err = internal.ReadIRSRates(strings.NewReader(irsRates))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rates) != 4 || rates[3].Currency != internal.SEK || rates[3].Rate.Cmp(decimal.New(9457, 3)) != 0 {
+		t.Errorf("expected the 2019 yearly average of 9.457 SEK, got %+v", rates)
+	}
+	if !rates[3].Date.Equal(time.Date(2019, 12, 31, 0, 0, 0, 0, time.UTC)) || rates[3].Source != internal.IRS_RATE_SOURCE {
+		t.Errorf("expected the IRS rate dated December 31, got %+v", rates[3])
+	}
+
+	// Countries without a known currency are skipped.
+	rates, err = internal.ReadTreasuryRates(strings.NewReader(treasuryRates))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rates) != 2 || rates[1].Currency != internal.SEK || rates[1].Rate.Cmp(decimal.New(10035, 3)) != 0 || rates[1].Source != internal.TREASURY_RATE_SOURCE {
+		t.Errorf("expected the Treasury rates of SEK and EUR, got %+v", rates)
+	}
+}
+
+func TestImportRatesAndCoverage(t *testing.T) {
+	internal.InitializeDB()
+	dir := t.TempDir()
+	files := map[internal.RateSource]string{
+		internal.RIKSBANK_RATE_SOURCE: riksbankRates,
+		internal.ECB_RATE_SOURCE:      ecbRates,
+		internal.IRS_RATE_SOURCE:      irsRates,
+	}
+	// The files quote SEK and EUR, both supported.
+	expected := map[internal.RateSource]int{internal.RIKSBANK_RATE_SOURCE: 4, internal.ECB_RATE_SOURCE: 2, internal.IRS_RATE_SOURCE: 4}
+	for source, content := range files {
+		path := filepath.Join(dir, string(source))
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// Importing twice replaces the rates.
+		for i := 0; i < 2; i++ {
+			imported, err := internal.ImportRateFile(source, path)
+			if err != nil || imported != expected[source] {
+				t.Fatalf("expected %d %s rates, got %d (%v)", expected[source], source, imported, err)
+			}
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := internal.UpdateRates(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rates, err := internal.GetCurrencyRates(internal.SEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[internal.RateSource]int)
+	for _, rate := range rates {
+		counts[rate.Source]++
+	}
+	if counts[internal.RIKSBANK_RATE_SOURCE] != 2 || counts[internal.ECB_RATE_SOURCE] != 1 || counts[internal.IRS_RATE_SOURCE] != 2 || counts[internal.SEED_RATE_SOURCE] != 4 {
+		t.Errorf("expected no duplicate rates, got %v", counts)
+	}
+
+	coverage, err := internal.GetRateCoverage(internal.SEK, 2019)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(coverage) != 1 {
+		t.Fatalf("expected the coverage of one year, got %+v", coverage)
+	}
+	c := coverage[0]
+	if c.DailyRates != 3 || !c.Yearly || len(c.Sources) != 3 || !c.LastDaily.Equal(time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected 3 daily rates and a yearly one, got %+v", c)
+	}
+	// 2019 has 261 weekdays, the longest gap runs from January 8 to the end of the year.
+	if c.MissingWeekdays != 258 || c.LongestGapDays != 256 || !c.LongestGapStart.Equal(time.Date(2019, 1, 8, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected 258 missing weekdays and a gap of 256 from January 8, got %+v", c)
+	}
+}
@@ -44,31 +44,52 @@ type reportingAssetRow struct {
 	MarkedCapitalGainCurrency CurrencyUnit
 }
 
-func parseCurrencyUnit(s string) (CurrencyUnit, error) {
+// amountFormat writes and reads the amounts of a file in one number format, or in the format
+// of each amount's currency when no locale is given.
+type amountFormat struct {
+	locale  LocaleUnit
+	locales map[CurrencyUnit]LocaleUnit
+}
+
+func newAmountFormat(locale LocaleUnit, tx *sql.Tx) (amountFormat, error) {
+	format := amountFormat{locale: locale, locales: make(map[CurrencyUnit]LocaleUnit)}
+	currencies, err := GetCurrencies(tx)
+	if err != nil {
+		return format, err
+	}
+	for _, c := range currencies {
+		format.locales[c.Code] = c.Locale
+	}
+	return format, nil
+}
+
+// currency parses a currency code of supported_currencies
+func (f amountFormat) currency(s string) (CurrencyUnit, error) {
 	v := strings.TrimSpace(s)
 	if v == "" {
 		return "", errors.New("missing currency")
 	}
-	switch CurrencyUnit(strings.ToUpper(v)) {
-	case USD, SEK:
-		return CurrencyUnit(strings.ToUpper(v)), nil
-	default:
-		return "", fmt.Errorf("unsupported currency: %s", v)
+	currency := CurrencyUnit(strings.ToUpper(v))
+	if _, ok := f.locales[currency]; !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedCurrency, v)
 	}
+	return currency, nil
 }
 
-func currencyToLocale(c CurrencyUnit) (LocaleUnit, error) {
-	switch c {
-	case USD:
-		return US, nil
-	case SEK:
-		return SE, nil
-	default:
-		return "", fmt.Errorf("unsupported currency for locale: %s", c)
+func (f amountFormat) localeOf(currency CurrencyUnit) (LocaleUnit, error) {
+	if f.locale != "" {
+		return f.locale, nil
+	}
+	locale, ok := f.locales[currency]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedCurrency, currency)
 	}
+	return locale, nil
 }
 
-func parseReportDecimal(s string, currency CurrencyUnit) (*decimal.Big, error) {
+// parse reads an amount of field, rounding it half-even to the places the field is stored with.
+// Rounded amounts are logged with their column.
+func (f amountFormat) parse(column string, s string, currency CurrencyUnit, field PrecisionField) (*decimal.Big, error) {
 	trimmed := strings.TrimSpace(s)
 	if trimmed == "" {
 		return nil, nil
@@ -77,7 +98,7 @@ func parseReportDecimal(s string, currency CurrencyUnit) (*decimal.Big, error) {
 	trimmed = strings.ReplaceAll(trimmed, " ", "")
 
 	// Normalize thousands/decimal separators based on expected locale.
-	locale, err := currencyToLocale(currency)
+	locale, err := f.localeOf(currency)
 	if err != nil {
 		return nil, err
 	}
@@ -100,18 +121,23 @@ func parseReportDecimal(s string, currency CurrencyUnit) (*decimal.Big, error) {
 		}
 	}
 
-	val, err := ProcessStringAmount(trimmed, locale)
+	val, loss, err := ParseFieldAmount(trimmed, locale, field)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%s: %w", column, err)
+	}
+	if loss != nil {
+		loss.Column = column
+		loss.Input = strings.TrimSpace(s)
+		InfoLogger.Printf("rounded %s\n", loss)
 	}
 	return val, nil
 }
 
-func decimalToLocaleString(val *decimal.Big, currency CurrencyUnit) string {
+func (f amountFormat) format(val *decimal.Big, currency CurrencyUnit) string {
 	if val == nil {
 		return ""
 	}
-	locale, err := currencyToLocale(currency)
+	locale, err := f.localeOf(currency)
 	if err != nil {
 		// Fallback: output raw
 		return val.String()
@@ -178,6 +204,30 @@ func transactionTypeFromString(s string) (TransactionType, error) {
 		return DIVIDEND, nil
 	case "QUALIFIED_DIVIDEND":
 		return QUALIFIED_DIVIDEND, nil
+	case "RSU_VEST_TRANSACTION":
+		return RSU_VEST_TRANSACTION, nil
+	case "ESPP_PURCHASE_TRANSACTION":
+		return ESPP_PURCHASE_TRANSACTION, nil
+	case "SHARES_WITHHELD_TRANSACTION":
+		return SHARES_WITHHELD_TRANSACTION, nil
+	case "CASH_IN_LIEU_TRANSACTION":
+		return CASH_IN_LIEU_TRANSACTION, nil
+	case "MERGER_CASH_TRANSACTION":
+		return MERGER_CASH_TRANSACTION, nil
+	case "RETURN_OF_CAPITAL":
+		return RETURN_OF_CAPITAL, nil
+	case "CAPITAL_GAIN_DISTRIBUTION":
+		return CAPITAL_GAIN_DISTRIBUTION, nil
+	case "RETURN_OF_CAPITAL_GAIN":
+		return RETURN_OF_CAPITAL_GAIN, nil
+	case "WITHHOLDING_TAX":
+		return WITHHOLDING_TAX, nil
+	case "DEPOSIT_TRANSACTION":
+		return DEPOSIT_TRANSACTION, nil
+	case "WITHDRAWAL_TRANSACTION":
+		return WITHDRAWAL_TRANSACTION, nil
+	case "CORPORATE_ACTION_GAIN":
+		return CORPORATE_ACTION_GAIN, nil
 	default:
 		// Best-effort: if export used a friendly name, try substring match.
 		if strings.Contains(upper, "PURCHASE") {
@@ -198,6 +248,21 @@ func transactionTypeFromString(s string) (TransactionType, error) {
 		if strings.Contains(upper, "SPLITOUT") || strings.Contains(upper, "SPLIT OUT") {
 			return SPLITOUT_TRANSACTION, nil
 		}
+		if strings.Contains(upper, "RETURN OF CAPITAL") {
+			return RETURN_OF_CAPITAL, nil
+		}
+		if strings.Contains(upper, "CAP GAIN") || strings.Contains(upper, "CAPITAL GAIN") {
+			return CAPITAL_GAIN_DISTRIBUTION, nil
+		}
+		if strings.Contains(upper, "DEPOSIT") {
+			return DEPOSIT_TRANSACTION, nil
+		}
+		if strings.Contains(upper, "WITHDRAWAL") {
+			return WITHDRAWAL_TRANSACTION, nil
+		}
+		if strings.Contains(upper, "WITHHOLDING") {
+			return WITHHOLDING_TAX, nil
+		}
 		if strings.Contains(upper, "DIVIDEND") {
 			return DIVIDEND, nil
 		}
@@ -209,67 +274,31 @@ func transactionTypeToExportString(t TransactionType) string {
 	return t.String()
 }
 
-func getRateToOneUSD(currency CurrencyUnit, asOf time.Time) (*decimal.Big, error) {
-	if currency == USD {
-		return decimal.New(1, 0), nil
-	}
-
-	var rateInt int64
-	queryYear := `
-		SELECT rate
-		FROM currency_rates
-		-- We treat currency_rates as "per year" rates. The table is seeded with
-		-- e.g. 2024-12-31, but marks may happen earlier in 2024. Selecting by
-		-- calendar year avoids falling back to the previous year.
-		WHERE currency_code = ?
-			AND strftime('%Y', as_of_date) = strftime('%Y', ?)
-		ORDER BY as_of_date DESC
-		LIMIT 1;
-	`
-	// SQLite driver typically accepts time.Time; formatting is handled by database/sql.
-	row := GlobalDB.QueryRow(queryYear, string(currency), asOf)
-	err := row.Scan(&rateInt)
-	if err != nil {
-		// If the exact calendar year rate doesn't exist (e.g. exports into 2025
-		// but `rates` hasn't been extended beyond 2024), fall back to the latest
-		// available rate up to the requested date so exported USD fields aren't blank.
-		if errors.Is(err, sql.ErrNoRows) {
-			queryLatest := `
-				SELECT rate
-				FROM currency_rates
-				WHERE currency_code = ? AND as_of_date <= ?
-				ORDER BY as_of_date DESC
-				LIMIT 1;
-			`
-			row2 := GlobalDB.QueryRow(queryLatest, string(currency), asOf)
-			if err2 := row2.Scan(&rateInt); err2 != nil {
-				return nil, err2
-			}
-		} else {
-			return nil, err
-		}
-	}
-	// Rates are stored as BIGINT with 4-decimal fixed-point precision
-	// (e.g. SEK rate 101220 represents 10.1220 SEK per 1.0000 USD).
-	return decimal.New(rateInt, 4), nil
+// Columns converted to USD by the reporting exports, and the policies they default to.
+const (
+	TOTAL_AMOUNT_USD_COLUMN        = "Total Amount USD"
+	COST_BASIS_USD_COLUMN          = "Cost Basis USD"
+	MARKED_SHARE_VALUE_USD_COLUMN  = "Marked Share Value USD"
+	MARKED_CAPITAL_GAIN_USD_COLUMN = "Marked Capital Gain USD"
+)
+
+var reportingFXColumns = map[string]FXPolicy{
+	TOTAL_AMOUNT_USD_COLUMN:        CALENDAR_YEAR_FX_POLICY,
+	COST_BASIS_USD_COLUMN:          CALENDAR_YEAR_FX_POLICY,
+	MARKED_SHARE_VALUE_USD_COLUMN:  CALENDAR_YEAR_FX_POLICY,
+	MARKED_CAPITAL_GAIN_USD_COLUMN: CALENDAR_YEAR_FX_POLICY,
 }
 
-func convertFromCurrencyToUSD(amount *decimal.Big, amountCurrency CurrencyUnit, asOf time.Time) (*decimal.Big, error) {
-	if amount == nil {
-		return nil, nil
-	}
-	if amountCurrency == USD {
-		return amount, nil
-	}
-	rate, err := getRateToOneUSD(amountCurrency, asOf)
+// ExportReportingExports writes transactions.csv and assets.csv. Assets carry each lot's
+// latest mark, or its latest mark on or before markDate when one is given. USD columns are
+// converted with the given policies, calendar-year by default, and each file gets a
+// <file>.meta.json listing the policy and rate sources of its USD columns. Amounts are
+// written in the given locale, or in the one of their currency when it's empty.
+func ExportReportingExports(outDir string, accountNumber string, markDate *time.Time, policies FXPolicies, locale LocaleUnit) error {
+	converter, err := newFXConverter(policies, reportingFXColumns)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	usd := decimal.New(0, 4).Quo(amount, rate).Quantize(4)
-	return usd, nil
-}
-
-func ExportReportingExports(outDir string, accountNumber string) error {
 	if err := os.MkdirAll(outDir, 0o755); err != nil {
 		return err
 	}
@@ -282,16 +311,31 @@ func ExportReportingExports(outDir string, accountNumber string) error {
 	transactionsPath := filepath.Join(outDir, "transactions.csv")
 	assetsPath := filepath.Join(outDir, "assets.csv")
 
-	if err := exportTransactionsCSV(transactionsPath, accountNumber); err != nil {
+	format, err := newAmountFormat(locale, nil)
+	if err != nil {
 		return err
 	}
-	if err := exportAssetsCSV(assetsPath, accountNumber); err != nil {
+	if err := exportTransactionsCSV(transactionsPath, accountNumber, converter, format); err != nil {
 		return err
 	}
-	return nil
+	if err := writeExportMetadata(transactionsPath, converter.Columns(TOTAL_AMOUNT_USD_COLUMN)); err != nil {
+		return err
+	}
+	if err := exportAssetsCSV(assetsPath, accountNumber, markDate, converter, format); err != nil {
+		return err
+	}
+	return writeExportMetadata(assetsPath, converter.Columns(COST_BASIS_USD_COLUMN, MARKED_SHARE_VALUE_USD_COLUMN, MARKED_CAPITAL_GAIN_USD_COLUMN))
+}
+
+// scanExecutedFX returns the executed rate of a transaction row, nil when it has none
+func scanExecutedFX(currency sql.NullString, rate sql.NullInt64) *ExecutedFX {
+	if !currency.Valid || currency.String == "" || !rate.Valid || rate.Int64 <= 0 {
+		return nil
+	}
+	return &ExecutedFX{Currency: CurrencyUnit(currency.String), Rate: decimal.New(rate.Int64, RATE_FIELD.Places())}
 }
 
-func exportTransactionsCSV(path string, accountNumber string) error {
+func exportTransactionsCSV(path string, accountNumber string, converter *fxConverter, format amountFormat) error {
 	f, err := os.Create(path)
 	if err != nil {
 		return err
@@ -323,7 +367,8 @@ func exportTransactionsCSV(path string, accountNumber string) error {
 	}
 
 	query := fmt.Sprintf(`
-		SELECT account, settlement_date, symbol, share_lot, transaction_type, total_amount, currency
+		SELECT account, settlement_date, symbol, share_lot, transaction_type, total_amount, currency,
+			instrument_currency, executed_fx_rate
 		FROM transactions
 		%s
 		ORDER BY settlement_date ASC;
@@ -341,25 +386,19 @@ func exportTransactionsCSV(path string, accountNumber string) error {
 		var symbol string
 		var shareLot sql.NullString
 		var transactionTypeInt int64
-		var totalAmountInt int64
+		var totalAmount *decimal.Big
 		var currency string
+		var instrumentCurrency sql.NullString
+		var executedFXRate sql.NullInt64
 
-		if err := rows.Scan(&account, &settlementDate, &symbol, &shareLot, &transactionTypeInt, &totalAmountInt, &currency); err != nil {
+		if err := rows.Scan(&account, &settlementDate, &symbol, &shareLot, &transactionTypeInt, scanField(&totalAmount, AMOUNT_FIELD), &currency, &instrumentCurrency, &executedFXRate); err != nil {
 			return err
 		}
 
 		curr := CurrencyUnit(strings.ToUpper(strings.TrimSpace(currency)))
-		totalAmount := decimal.New(totalAmountInt, 4)
 
-		totalAmountUSD := (*decimal.Big)(nil)
-		if curr == USD {
-			totalAmountUSD = totalAmount
-		} else {
-			usd, err := convertFromCurrencyToUSD(totalAmount, curr, settlementDate)
-			if err == nil {
-				totalAmountUSD = usd
-			}
-		}
+		// Amounts without a rate are left empty, the metadata counts them.
+		totalAmountUSD, _ := converter.convertTrade(TOTAL_AMOUNT_USD_COLUMN, totalAmount, curr, USD, settlementDate, scanExecutedFX(instrumentCurrency, executedFXRate))
 
 		if err := w.Write([]string{
 			account,
@@ -367,9 +406,9 @@ func exportTransactionsCSV(path string, accountNumber string) error {
 			symbol,
 			shareLot.String,
 			transactionTypeToExportString(TransactionType(transactionTypeInt)),
-			decimalToLocaleString(totalAmount, curr),
+			format.format(totalAmount, curr),
 			string(curr),
-			decimalToLocaleString(totalAmountUSD, USD),
+			format.format(totalAmountUSD, USD),
 		}); err != nil {
 			return err
 		}
@@ -378,7 +417,7 @@ func exportTransactionsCSV(path string, accountNumber string) error {
 	return rows.Err()
 }
 
-func exportAssetsCSV(path string, accountNumber string) error {
+func exportAssetsCSV(path string, accountNumber string, markDate *time.Time, converter *fxConverter, format amountFormat) error {
 	f, err := os.Create(path)
 	if err != nil {
 		return err
@@ -419,6 +458,11 @@ func exportAssetsCSV(path string, accountNumber string) error {
 		args = append(args, accountNumber)
 	}
 
+	var markDateArg any
+	if markDate != nil {
+		markDateArg = *markDate
+	}
+
 	query := fmt.Sprintf(`
 		SELECT id, account, exchange, symbol, isin, shares, cost_basis_per_share, cost_basis_currency, created_date
 		FROM asset_lots
@@ -438,18 +482,16 @@ func exportAssetsCSV(path string, accountNumber string) error {
 		var exchangeRaw sql.NullString
 		var symbol string
 		var isin string
-		var sharesLeftInt int64
-		var costBasisPerShareInt int64
+		var sharesLeft *decimal.Big
+		var costBasis *decimal.Big
 		var costBasisCurrencyRaw string
 		var createdDate time.Time
 
-		if err := rows.Scan(&assetLotID, &account, &exchangeRaw, &symbol, &isin, &sharesLeftInt, &costBasisPerShareInt, &costBasisCurrencyRaw, &createdDate); err != nil {
+		if err := rows.Scan(&assetLotID, &account, &exchangeRaw, &symbol, &isin, scanField(&sharesLeft, QUANTITY_FIELD), scanField(&costBasis, PRICE_FIELD), &costBasisCurrencyRaw, &createdDate); err != nil {
 			return err
 		}
 
 		costBasisCurrency := CurrencyUnit(strings.ToUpper(strings.TrimSpace(costBasisCurrencyRaw)))
-		sharesLeft := decimal.New(sharesLeftInt, 4)
-		costBasis := decimal.New(costBasisPerShareInt, 4)
 
 		originatedShares, originatedCostCurrency := (*decimal.Big)(nil), CurrencyUnit("")
 		{
@@ -460,12 +502,10 @@ func exportAssetsCSV(path string, accountNumber string) error {
 				ORDER BY as_of_date ASC
 				LIMIT 1;
 			`, assetLotID)
-			var originSharesInt int64
-			var originCostBasisInt int64
+			var originCostBasis *decimal.Big
 			var originCostCurrencyRaw string
 			var originDate time.Time
-			if err := row.Scan(&originSharesInt, &originCostBasisInt, &originCostCurrencyRaw, &originDate); err == nil {
-				originatedShares = decimal.New(originSharesInt, 4)
+			if err := row.Scan(scanField(&originatedShares, QUANTITY_FIELD), scanField(&originCostBasis, PRICE_FIELD), &originCostCurrencyRaw, &originDate); err == nil {
 				originatedCostCurrency = CurrencyUnit(strings.ToUpper(strings.TrimSpace(originCostCurrencyRaw)))
 			}
 		}
@@ -476,7 +516,7 @@ func exportAssetsCSV(path string, accountNumber string) error {
 			originatedCostCurrency = costBasisCurrency
 		}
 
-		// Mark data (latest mark).
+		// Mark data (latest current mark, up to the requested mark date).
 		var markedDate *time.Time
 		var markedShares *decimal.Big
 		var markedValuePerShare *decimal.Big
@@ -486,25 +526,35 @@ func exportAssetsCSV(path string, accountNumber string) error {
 			row := GlobalDB.QueryRow(`
 				SELECT market_mark_date, marked_shares, marked_value_per_share, marked_value_currency, gain_loss
 				FROM market_marks
-				WHERE asset_lot_id = ?
+				WHERE asset_lot_id = ? AND superseded_date IS NULL AND (? IS NULL OR market_mark_date <= ?)
 				ORDER BY market_mark_date DESC
 				LIMIT 1;
-			`, assetLotID)
+			`, assetLotID, markDateArg, markDateArg)
 			var md time.Time
-			var msInt int64
-			var mvpInt int64
 			var mvcRaw string
-			var glInt int64
-			if err := row.Scan(&md, &msInt, &mvpInt, &mvcRaw, &glInt); err == nil {
+			if err := row.Scan(&md, scanField(&markedShares, QUANTITY_FIELD), scanField(&markedValuePerShare, PRICE_FIELD), &mvcRaw, scanField(&gainLoss, AMOUNT_FIELD)); err == nil {
 				markedDate = &md
-				markedShares = decimal.New(msInt, 4)
-				markedValuePerShare = decimal.New(mvpInt, 4)
 				markedValueCurrency = CurrencyUnit(strings.ToUpper(strings.TrimSpace(mvcRaw)))
-				gainLoss = decimal.New(glInt, 4)
 			}
 		}
 
-		costBasisUSD, _ := convertFromCurrencyToUSD(costBasis, costBasisCurrency, createdDate)
+		// The basis of a foreign trade is taken back at the rate the lot was bought at.
+		var executed *ExecutedFX
+		{
+			row := GlobalDB.QueryRow(`
+				SELECT instrument_currency, executed_fx_rate
+				FROM transactions
+				WHERE share_lot = ? AND executed_fx_rate IS NOT NULL
+				ORDER BY settlement_date ASC, id ASC
+				LIMIT 1;
+			`, assetLotID)
+			var instrumentCurrency sql.NullString
+			var executedFXRate sql.NullInt64
+			if err := row.Scan(&instrumentCurrency, &executedFXRate); err == nil {
+				executed = scanExecutedFX(instrumentCurrency, executedFXRate)
+			}
+		}
+		costBasisUSD, _ := converter.convertTrade(COST_BASIS_USD_COLUMN, costBasis, costBasisCurrency, USD, createdDate, executed)
 
 		var markedSharesStr, markedValueStr, markedDateStr string
 		var markedValueUSDStr, markedGainStr, markedGainCurrencyStr, markedGainUSDStr string
@@ -512,20 +562,20 @@ func exportAssetsCSV(path string, accountNumber string) error {
 
 		if markedDate != nil {
 			markedDateStr = markedDate.Format("2006-01-02")
-			markedSharesStr = decimalToLocaleString(markedShares, markedValueCurrency)
-			markedValueStr = decimalToLocaleString(markedValuePerShare, markedValueCurrency)
+			markedSharesStr = format.format(markedShares, markedValueCurrency)
+			markedValueStr = format.format(markedValuePerShare, markedValueCurrency)
 			markedValueCurrencyStr = string(markedValueCurrency)
 
-			markedValueUSD, err := convertFromCurrencyToUSD(markedValuePerShare, markedValueCurrency, *markedDate)
+			markedValueUSD, err := converter.toUSD(MARKED_SHARE_VALUE_USD_COLUMN, markedValuePerShare, markedValueCurrency, *markedDate)
 			if err == nil {
-				markedValueUSDStr = decimalToLocaleString(markedValueUSD, USD)
+				markedValueUSDStr = format.format(markedValueUSD, USD)
 			}
 
-			markedGainStr = decimalToLocaleString(gainLoss, markedValueCurrency)
+			markedGainStr = format.format(gainLoss, markedValueCurrency)
 			markedGainCurrencyStr = string(markedValueCurrency)
-			markedGainUSD, err := convertFromCurrencyToUSD(gainLoss, markedValueCurrency, *markedDate)
+			markedGainUSD, err := converter.toUSD(MARKED_CAPITAL_GAIN_USD_COLUMN, gainLoss, markedValueCurrency, *markedDate)
 			if err == nil {
-				markedGainUSDStr = decimalToLocaleString(markedGainUSD, USD)
+				markedGainUSDStr = format.format(markedGainUSD, USD)
 			}
 		}
 
@@ -538,11 +588,11 @@ func exportAssetsCSV(path string, accountNumber string) error {
 			isin,
 			assetLotID,
 			createdDate.Format("2006-01-02"),
-			decimalToLocaleString(originatedShares, originatedCostCurrency),
-			decimalToLocaleString(sharesLeft, costBasisCurrency),
-			decimalToLocaleString(costBasis, costBasisCurrency),
+			format.format(originatedShares, originatedCostCurrency),
+			format.format(sharesLeft, costBasisCurrency),
+			format.format(costBasis, costBasisCurrency),
 			string(costBasisCurrency),
-			decimalToLocaleString(costBasisUSD, USD),
+			format.format(costBasisUSD, USD),
 			markedDateStr,
 			markedSharesStr,
 			markedValueStr,
@@ -567,6 +617,11 @@ func ReadReportingTransactionsExport(filepath string) ([]reportingTransactionRow
 		return nil, err
 	}
 	defer f.Close()
+	// Amounts are read in the number format of their currency, either separator is accepted.
+	format, err := newAmountFormat("", nil)
+	if err != nil {
+		return nil, err
+	}
 
 	r := csv.NewReader(f)
 	// Default is ','.
@@ -602,11 +657,11 @@ func ReadReportingTransactionsExport(filepath string) ([]reportingTransactionRow
 		if err != nil {
 			return nil, err
 		}
-		totalCurrency, err := parseCurrencyUnit(rec[6])
+		totalCurrency, err := format.currency(rec[6])
 		if err != nil {
 			return nil, err
 		}
-		totalAmt, err := parseReportDecimal(rec[5], totalCurrency)
+		totalAmt, err := format.parse(header[5], rec[5], totalCurrency, AMOUNT_FIELD)
 		if err != nil {
 			return nil, err
 		}
@@ -631,6 +686,11 @@ func ReadReportingAssetsExport(filepath string) ([]reportingAssetRow, error) {
 		return nil, err
 	}
 	defer f.Close()
+	// Amounts are read in the number format of their currency, either separator is accepted.
+	format, err := newAmountFormat("", nil)
+	if err != nil {
+		return nil, err
+	}
 
 	r := csv.NewReader(f)
 	header, err := r.Read()
@@ -665,20 +725,20 @@ func ReadReportingAssetsExport(filepath string) ([]reportingAssetRow, error) {
 			return nil, err
 		}
 
-		costBasisCurrency, err := parseCurrencyUnit(rec[9])
+		costBasisCurrency, err := format.currency(rec[9])
 		if err != nil {
 			return nil, err
 		}
 
-		originatedShares, err := parseReportDecimal(rec[6], costBasisCurrency)
+		originatedShares, err := format.parse(header[6], rec[6], costBasisCurrency, QUANTITY_FIELD)
 		if err != nil {
 			return nil, err
 		}
-		sharesLeft, err := parseReportDecimal(rec[7], costBasisCurrency)
+		sharesLeft, err := format.parse(header[7], rec[7], costBasisCurrency, QUANTITY_FIELD)
 		if err != nil {
 			return nil, err
 		}
-		costBasis, err := parseReportDecimal(rec[8], costBasisCurrency)
+		costBasis, err := format.parse(header[8], rec[8], costBasisCurrency, PRICE_FIELD)
 		if err != nil {
 			return nil, err
 		}
@@ -695,8 +755,8 @@ func ReadReportingAssetsExport(filepath string) ([]reportingAssetRow, error) {
 		var markedGain *decimal.Big
 		var markedGainCurrency CurrencyUnit
 
-		markedValueCurrency, _ = parseCurrencyUnit(rec[14])
-		markedGainCurrency, _ = parseCurrencyUnit(rec[17])
+		markedValueCurrency, _ = format.currency(rec[14])
+		markedGainCurrency, _ = format.currency(rec[17])
 
 		if markedDate != nil {
 			// If currency cells are empty, fall back to cost basis currency.
@@ -712,16 +772,16 @@ func ReadReportingAssetsExport(filepath string) ([]reportingAssetRow, error) {
 			// From here on, marked numeric values are interpreted using the same currency.
 			markedGainCurrency = markedValueCurrency
 
-			markedShares, err = parseReportDecimal(rec[12], markedValueCurrency)
+			markedShares, err = format.parse(header[12], rec[12], markedValueCurrency, QUANTITY_FIELD)
 			if err != nil {
 				return nil, err
 			}
-			markedValuePerShare, err = parseReportDecimal(rec[13], markedValueCurrency)
+			markedValuePerShare, err = format.parse(header[13], rec[13], markedValueCurrency, PRICE_FIELD)
 			if err != nil {
 				return nil, err
 			}
 			// Marked capital gain uses the same currency as marked share value (or we error above).
-			markedGain, err = parseReportDecimal(rec[16], markedGainCurrency)
+			markedGain, err = format.parse(header[16], rec[16], markedGainCurrency, AMOUNT_FIELD)
 			if err != nil {
 				return nil, err
 			}
@@ -781,19 +841,41 @@ func ImportReportingExports(assetsFile string, transactionsFile string, replaceE
 		return errors.New("import: no accounts found in export files")
 	}
 
+	tx, err := GlobalDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Replaced lots are imported again with their ids, the stock plan lots referring to them
+	// only have to find them again when the import commits.
+	if _, err = tx.Exec(`PRAGMA defer_foreign_keys = ON;`); err != nil {
+		return err
+	}
+
 	if replaceExisting {
 		for account := range accounts {
 			// Delete in FK-safe order.
-			if _, err := GlobalDB.Exec(`DELETE FROM market_marks WHERE account = ?;`, account); err != nil {
+			if _, err := tx.Exec(`
+				DELETE FROM dividend_classifications WHERE transaction_id IN (SELECT id FROM transactions WHERE account = ?);
+			`, account); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`
+				DELETE FROM espp_dispositions WHERE transaction_id IN (SELECT id FROM transactions WHERE account = ?)
+					OR asset_lot_id IN (SELECT id FROM asset_lots WHERE account = ?);
+			`, account, account); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`DELETE FROM market_marks WHERE account = ?;`, account); err != nil {
 				return err
 			}
-			if _, err := GlobalDB.Exec(`DELETE FROM transactions WHERE account = ?;`, account); err != nil {
+			if _, err := tx.Exec(`DELETE FROM transactions WHERE account = ?;`, account); err != nil {
 				return err
 			}
-			if _, err := GlobalDB.Exec(`DELETE FROM asset_lots_history WHERE account = ?;`, account); err != nil {
+			if _, err := tx.Exec(`DELETE FROM asset_lots_history WHERE account = ?;`, account); err != nil {
 				return err
 			}
-			if _, err := GlobalDB.Exec(`DELETE FROM asset_lots WHERE account = ?;`, account); err != nil {
+			if _, err := tx.Exec(`DELETE FROM asset_lots WHERE account = ?;`, account); err != nil {
 				return err
 			}
 		}
@@ -803,21 +885,21 @@ func ImportReportingExports(assetsFile string, transactionsFile string, replaceE
 	for _, r := range assetRows {
 		// Upsert (keeps the CSV-provided Asset Lot ID).
 		costBasisCur := r.CostBasisCurrency
-		if _, err := GlobalDB.Exec(`
+		if _, err := tx.Exec(`
 			INSERT OR REPLACE INTO asset_lots (
 				id, account, exchange, symbol, isin, shares, cost_basis_per_share, cost_basis_currency, created_date
 			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
 		`, r.AssetLotID, r.Account, r.Exchange, r.Symbol, r.ISIN,
-			getDbDecimalValue(r.SharesLeft), getDbDecimalValue(r.CostBasis), string(costBasisCur), r.DateAttained); err != nil {
+			fieldFixed(r.SharesLeft, QUANTITY_FIELD), fieldFixed(r.CostBasis, PRICE_FIELD), string(costBasisCur), r.DateAttained); err != nil {
 			return err
 		}
 
-		if _, err := GlobalDB.Exec(`
+		if _, err := tx.Exec(`
 			INSERT INTO asset_lots_history (
 				id, account, symbol, isin, shares, cost_basis_per_share, cost_basis_currency, as_of_date
 			) VALUES (?, ?, ?, ?, ?, ?, ?, ?);
 		`, r.AssetLotID, r.Account, r.Symbol, r.ISIN,
-			getDbDecimalValue(r.OriginatedShares), getDbDecimalValue(r.CostBasis), string(costBasisCur), r.DateAttained); err != nil {
+			fieldFixed(r.OriginatedShares, QUANTITY_FIELD), fieldFixed(r.CostBasis, PRICE_FIELD), string(costBasisCur), r.DateAttained); err != nil {
 			return err
 		}
 
@@ -829,12 +911,12 @@ func ImportReportingExports(assetsFile string, transactionsFile string, replaceE
 			if r.MarkedCapitalGainCurrency != "" {
 				markedValueCurrency = r.MarkedCapitalGainCurrency
 			}
-			if _, err := GlobalDB.Exec(`
+			if _, err := tx.Exec(`
 				INSERT INTO market_marks (
 					account, asset_lot_id, market_mark_date, marked_shares, marked_value_per_share, marked_value_currency, gain_loss
 				) VALUES (?, ?, ?, ?, ?, ?, ?);
 			`, r.Account, r.AssetLotID, *r.MarkedDate,
-				getDbDecimalValue(r.MarkedShares), getDbDecimalValue(r.MarkedShareValue), string(markedValueCurrency), getDbDecimalValue(r.MarkedCapitalGain)); err != nil {
+				fieldFixed(r.MarkedShares, QUANTITY_FIELD), fieldFixed(r.MarkedShareValue, PRICE_FIELD), string(markedValueCurrency), fieldFixed(r.MarkedCapitalGain, AMOUNT_FIELD)); err != nil {
 				return err
 			}
 		}
@@ -843,52 +925,85 @@ func ImportReportingExports(assetsFile string, transactionsFile string, replaceE
 	// Now import transactions.
 	for _, r := range txRows {
 		totalCur := r.TotalCurrency
-		if _, err := GlobalDB.Exec(`
+		if _, err := tx.Exec(`
 			INSERT INTO transactions (
 				account, transaction_reference, transaction_type, settlement_date, symbol,
 				share_lot, shares, price_per_share, share_value, fees_amount,
 				total_amount, currency
 			) VALUES (?, ?, ?, ?, ?, ?, NULL, NULL, NULL, ?, ?, ?);
 		`, r.Account, "", int64(r.Transaction), r.DateSettled, r.Symbol,
-			r.ShareLotID, int64(0), getDbDecimalValue(r.TotalAmount), string(totalCur)); err != nil {
+			nullString(r.ShareLotID), int64(0), fieldFixed(r.TotalAmount, AMOUNT_FIELD), string(totalCur)); err != nil {
 			return err
 		}
 	}
 
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	// Link the imported lots to the security master.
+	if _, err := SyncSecurities(nil); err != nil {
+		return err
+	}
 	return nil
 }
 
-func ensureSupportedCurrencies() error {
-	// supported_currencies.id is the CHAR(3) currency code.
-	_, err := GlobalDB.Exec(`
-		INSERT OR IGNORE INTO supported_currencies (id, name)
-		SELECT 'USD', 'US Dollar'
+// supportedCurrenciesSeed adds the currencies the importers know about.
+// supported_currencies.id is the CHAR(3) currency code. Currencies already stored keep
+// their name and number format.
+const supportedCurrenciesSeed = `
+		INSERT OR IGNORE INTO supported_currencies (id, name, locale)
+		SELECT 'USD', 'US Dollar', 'US'
+		UNION ALL
+		SELECT 'SEK', 'Svensk krona', 'SE'
+		UNION ALL
+		SELECT 'EUR', 'Euro', 'SE'
+		UNION ALL
+		SELECT 'NOK', 'Norsk krone', 'SE'
 		UNION ALL
-		SELECT 'SEK', 'Svensk krona';
-	`)
+		SELECT 'DKK', 'Dansk krone', 'SE'
+		UNION ALL
+		SELECT 'GBP', 'Pound Sterling', 'US'
+		UNION ALL
+		SELECT 'CHF', 'Schweizer Franken', 'US';
+	`
+
+func ensureSupportedCurrencies() error {
+	_, err := GlobalDB.Exec(supportedCurrenciesSeed)
 	return err
 }
 
+// currencyRateSeeds are the yearly rates to one USD a ledger starts out with
+var currencyRateSeeds = []struct {
+	currency CurrencyUnit
+	rate     *decimal.Big
+	date     string
+}{
+	{USD, decimal.New(1, 0), "2022-12-31"},
+	{USD, decimal.New(1, 0), "2023-12-31"},
+	{USD, decimal.New(1, 0), "2024-12-31"},
+	{USD, decimal.New(1, 0), "2025-12-31"},
+	{SEK, decimal.New(101220, 4), "2022-12-31"},
+	{SEK, decimal.New(106130, 4), "2023-12-31"},
+	{SEK, decimal.New(105770, 4), "2024-12-31"},
+	{SEK, decimal.New(98130, 4), "2025-12-31"},
+}
+
 func ensureCurrencyRates() error {
 	if err := ensureSupportedCurrencies(); err != nil {
 		return err
 	}
 
-	// This table has no unique constraint, so inserts are safe (we always pick the latest as_of_date).
-	_, err := GlobalDB.Exec(`
-		INSERT INTO "currency_rates" (currency_code, rate, as_of_date)
-		SELECT 'USD', 10000, '2022-12-31'
-		UNION ALL
-		SELECT 'USD', 10000, '2023-12-31'
-		UNION ALL
-		SELECT 'USD', 10000, '2024-12-31'
-		UNION ALL
-		SELECT 'SEK', 101220, '2022-12-31'
-		UNION ALL
-		SELECT 'SEK', 106130, '2023-12-31'
-		UNION ALL
-		SELECT 'SEK', 105770, '2024-12-31';
-	`)
-	return err
+	// Rates are unique per currency, date and source, so seeding again changes nothing.
+	for _, seed := range currencyRateSeeds {
+		_, err := GlobalDB.Exec(`
+			INSERT OR IGNORE INTO "currency_rates" (currency_code, rate, as_of_date, source)
+			VALUES (?, ?, ?, 'seed');
+		`, seed.currency, fieldFixed(seed.rate, RATE_FIELD), seed.date)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrSecurityNotFound = errors.New("security not found")
+	ErrInvalidTicker    = errors.New("invalid ticker, expected EXCHANGE=TICKER")
+)
+
+// SecurityID is the ISIN of a lot, or CURRENCY:SYMBOL for lots without one (typically US tickers)
+func SecurityID(assetLot AssetLot) string {
+	if isin := strings.TrimSpace(assetLot.ISIN); isin != "" {
+		return strings.ToUpper(isin)
+	}
+	return fmt.Sprintf("%s:%s", assetLot.CostBasisCurrency, strings.ToUpper(strings.TrimSpace(assetLot.Symbol)))
+}
+
+// DefaultPFIC flags funds, ETFs and ETCs domiciled outside the US as PFICs
+func DefaultPFIC(isin string, assetClass AssetClass) bool {
+	switch assetClass {
+	case FUND_ASSET, ETF_ASSET, ETC_ASSET:
+		return isin != "" && !strings.HasPrefix(strings.ToUpper(isin), "US")
+	}
+	return false
+}
+
+// ParseSecurityTicker parses EXCHANGE=TICKER as given on the command line
+func ParseSecurityTicker(value string) (SecurityTicker, error) {
+	exchange, ticker, ok := strings.Cut(value, "=")
+	if !ok || strings.TrimSpace(ticker) == "" {
+		return SecurityTicker{}, fmt.Errorf("%w: %s", ErrInvalidTicker, value)
+	}
+	return SecurityTicker{Exchange: strings.TrimSpace(exchange), Ticker: strings.TrimSpace(ticker)}, nil
+}
+
+// EnsureSecurity adds the security of a lot when it isn't known yet and points the lot at it.
+// Securities already stored are left as they are so edits aren't overwritten by imports.
+func EnsureSecurity(assetLot AssetLot, tx *sql.Tx) (string, error) {
+	id := SecurityID(assetLot)
+	security := Security{
+		ID:         id,
+		ISIN:       strings.ToUpper(strings.TrimSpace(assetLot.ISIN)),
+		Name:       assetLot.Symbol,
+		Currency:   assetLot.CostBasisCurrency,
+		AssetClass: EQUITY_ASSET,
+	}
+	if assetLot.Symbol != "" {
+		security.Tickers = []SecurityTicker{{Exchange: assetLot.Exchange, Ticker: assetLot.Symbol}}
+	}
+	if err := InsertSecurityIfMissing(security, tx); err != nil {
+		return "", err
+	}
+	if assetLot.ID != "" {
+		if err := SetAssetLotSecurity(assetLot.ID, id, tx); err != nil {
+			return "", err
+		}
+	}
+	return id, nil
+}
+
+// SyncSecurities links every lot without a security, adding the securities it needs
+func SyncSecurities(tx *sql.Tx) (int, error) {
+	immediateCommit := false
+	var err error
+	if tx == nil {
+		immediateCommit = true
+		tx, err = GlobalDB.Begin()
+		if err != nil {
+			return 0, err
+		}
+	}
+	lots, err := GetAssetLotsWithoutSecurity(tx)
+	if err != nil {
+		if immediateCommit {
+			tx.Rollback()
+		}
+		return 0, err
+	}
+	for _, lot := range lots {
+		if _, err = EnsureSecurity(lot, tx); err != nil {
+			if immediateCommit {
+				tx.Rollback()
+			}
+			return 0, err
+		}
+	}
+	if immediateCommit {
+		if err = tx.Commit(); err != nil {
+			return 0, err
+		}
+	}
+	return len(lots), nil
+}
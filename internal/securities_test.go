@@ -0,0 +1,74 @@
+package internal_test
+
+import (
+	"accounting/internal"
+	"testing"
+	"time"
+
+	"github.com/ericlagergren/decimal"
+)
+
+func TestEnsureSecurity(t *testing.T) {
+	internal.InitializeDB()
+	lot := internal.AssetLot{
+		AccountID:         "securities-test",
+		Exchange:          "Nasdaq",
+		Symbol:            "SECCO",
+		Shares:            decimal.New(10, 0),
+		CostBasisPerShare: decimal.New(100, 0),
+		CostBasisCurrency: internal.USD,
+		CreatedDate:       time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+	}
+	tx, err := internal.GlobalDB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lotID, err := internal.InsertAssetLot(lot, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	security, err := internal.GetSecurityByAssetLot(lotID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if security.ID != "USD:SECCO" || security.AssetClass != internal.EQUITY_ASSET {
+		t.Errorf("expected equity USD:SECCO, got %s %s", security.AssetClass, security.ID)
+	}
+	if len(security.Tickers) != 1 || security.Tickers[0].Exchange != "Nasdaq" || security.Tickers[0].Ticker != "SECCO" {
+		t.Errorf("expected Nasdaq ticker, got %+v", security.Tickers)
+	}
+
+	// Edits are kept when later lots of the security are imported.
+	security.AssetClass = internal.ETF_ASSET
+	security.YahooSymbol = "SECCO"
+	if err = internal.UpdateSecurity(security); err != nil {
+		t.Fatal(err)
+	}
+	if tx, err = internal.GlobalDB.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = internal.InsertAssetLot(lot, tx); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if security, err = internal.GetSecurity("USD:SECCO"); err != nil || security.AssetClass != internal.ETF_ASSET {
+		t.Errorf("expected the edited asset class to be kept, got %s (%v)", security.AssetClass, err)
+	}
+}
+
+func TestDefaultPFIC(t *testing.T) {
+	if !internal.DefaultPFIC("IE00B4L5Y983", internal.ETF_ASSET) {
+		t.Error("expected an Irish ETF to be a PFIC")
+	}
+	if internal.DefaultPFIC("US9229083632", internal.ETF_ASSET) {
+		t.Error("expected a US ETF not to be a PFIC")
+	}
+	if internal.DefaultPFIC("SE0000108656", internal.EQUITY_ASSET) {
+		t.Error("expected a Swedish stock not to be a PFIC")
+	}
+}
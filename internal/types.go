@@ -2,7 +2,6 @@ package internal
 
 import (
 	"errors"
-	"strconv"
 	"strings"
 	"time"
 
@@ -11,6 +10,8 @@ import (
 
 var ZeroPrecisionValue = decimal.New(0, 4)
 
+// CurrencyUnit is an ISO 4217 code. The currencies the ledger accepts are the ones in
+// supported_currencies, SEK and USD are the ones the code itself relies on.
 type CurrencyUnit string
 
 var (
@@ -18,6 +19,9 @@ var (
 	USD = CurrencyUnit("USD")
 )
 
+var ErrUnsupportedCurrency = errors.New("unsupported currency, add it with rates currencies add")
+
+// LocaleUnit is a number format: SE writes 1234,56 and US writes 1234.56
 type LocaleUnit string
 
 var (
@@ -25,39 +29,42 @@ var (
 	US = LocaleUnit("US")
 )
 
+func ParseLocale(value string) (LocaleUnit, error) {
+	switch LocaleUnit(strings.ToUpper(strings.TrimSpace(value))) {
+	case SE:
+		return SE, nil
+	case US:
+		return US, nil
+	}
+	return "", ErrInvalidLocale
+}
+
+// Currency is a row of supported_currencies. Locale is the number format its amounts are
+// written in by exports that aren't given one.
+type Currency struct {
+	Code   CurrencyUnit
+	Name   string
+	Locale LocaleUnit
+}
+
 var ERROR_VALUE = decimal.New(-999999999999999999, 4)
 
 var (
-	ErrInvalidPrecisionValue = errors.New("value is invalid for precision value")
+	ErrInvalidPrecisionValue = errors.New("invalid amount")
 	ErrInvalidLocale         = errors.New("invalid locale")
 )
 
 // ProcessStringAmount returns a very clear error amount
 // This is necessary as we need to really make sure mistakes
-// are very transparent in any ledger we maintain
+// are very transparent in any ledger we maintain.
+// Values are rounded half-even to STORAGE_SCALE places, use ParseFieldAmount for
+// values of a configurable field.
 func ProcessStringAmount(amount string, locale LocaleUnit) (*decimal.Big, error) {
-	var parts []string
-	switch locale {
-	case SE:
-		parts = strings.Split(strings.Replace(amount, " ", "", -1), ",")
-	case US:
-		parts = strings.Split(strings.Replace(amount, " ", "", -1), ".")
-	default:
-		return ERROR_VALUE, ErrInvalidLocale
-	}
-
-	value := parts[0]
-	if len(parts) > 1 {
-		value += (parts[1] + "0000")[:4]
-	} else {
-		value += "0000"
-	}
-	val, err := strconv.Atoi(value)
+	value, err := parseAmount(amount, locale)
 	if err != nil {
-		return ERROR_VALUE, ErrInvalidPrecisionValue
+		return ERROR_VALUE, err
 	}
-	newValue := decimal.New(int64(val), 4)
-	return newValue, nil
+	return decimal.Context128.Quantize(value, STORAGE_SCALE), nil
 }
 
 type TransactionType int
@@ -71,6 +78,18 @@ const (
 	SPLITOUT_TRANSACTION
 	DIVIDEND
 	QUALIFIED_DIVIDEND
+	RSU_VEST_TRANSACTION
+	ESPP_PURCHASE_TRANSACTION
+	SHARES_WITHHELD_TRANSACTION
+	CASH_IN_LIEU_TRANSACTION
+	MERGER_CASH_TRANSACTION
+	RETURN_OF_CAPITAL
+	CAPITAL_GAIN_DISTRIBUTION
+	RETURN_OF_CAPITAL_GAIN
+	WITHHOLDING_TAX
+	DEPOSIT_TRANSACTION
+	WITHDRAWAL_TRANSACTION
+	CORPORATE_ACTION_GAIN // cash of a corporate action less the basis it takes, negative for a loss
 )
 
 func (t TransactionType) String() string {
@@ -91,6 +110,30 @@ func (t TransactionType) String() string {
 		return "TRANSFERIN_TRANSACTION"
 	case TRANSFEROUT_TRANSACTION:
 		return "TRANSFEROUT_TRANSACTION"
+	case RSU_VEST_TRANSACTION:
+		return "RSU_VEST_TRANSACTION"
+	case ESPP_PURCHASE_TRANSACTION:
+		return "ESPP_PURCHASE_TRANSACTION"
+	case SHARES_WITHHELD_TRANSACTION:
+		return "SHARES_WITHHELD_TRANSACTION"
+	case CASH_IN_LIEU_TRANSACTION:
+		return "CASH_IN_LIEU_TRANSACTION"
+	case MERGER_CASH_TRANSACTION:
+		return "MERGER_CASH_TRANSACTION"
+	case RETURN_OF_CAPITAL:
+		return "RETURN_OF_CAPITAL"
+	case CAPITAL_GAIN_DISTRIBUTION:
+		return "CAPITAL_GAIN_DISTRIBUTION"
+	case RETURN_OF_CAPITAL_GAIN:
+		return "RETURN_OF_CAPITAL_GAIN"
+	case WITHHOLDING_TAX:
+		return "WITHHOLDING_TAX"
+	case DEPOSIT_TRANSACTION:
+		return "DEPOSIT_TRANSACTION"
+	case WITHDRAWAL_TRANSACTION:
+		return "WITHDRAWAL_TRANSACTION"
+	case CORPORATE_ACTION_GAIN:
+		return "CORPORATE_ACTION_GAIN"
 	}
 	return "UNKNOWN"
 }
@@ -123,10 +166,17 @@ type Transaction struct {
 
 	TotalAmount *decimal.Big
 	Currency    CurrencyUnit
+
+	// Trades of instruments quoted in another currency than Currency keep what the broker
+	// executed: the instrument currency, the trade amount in it and the rate in Currency per
+	// unit of it. They are empty for trades in the booked currency.
+	InstrumentCurrency CurrencyUnit
+	InstrumentAmount   *decimal.Big
+	ExecutedFXRate     *decimal.Big
 }
 
 func (t Transaction) CopyFromShares(newShares *decimal.Big) Transaction {
-	return Transaction{
+	copied := Transaction{
 		t.ID,
 		t.AccountID,
 		t.TransactionReference,
@@ -136,11 +186,26 @@ func (t Transaction) CopyFromShares(newShares *decimal.Big) Transaction {
 		t.ShareLot,
 		newShares,
 		decimal.New(0, 4).Copy(t.PricePerShare),
-		decimal.New(0, 4).Mul(t.PricePerShare, newShares).Quantize(4),
+		AMOUNT_FIELD.Round(decimal.New(0, 4).Mul(t.PricePerShare, newShares)),
 		decimal.New(0, 4).Copy(ZeroPrecisionValue), // remove fee to prevent duplication
-		decimal.New(0, 4).Mul(t.PricePerShare, newShares).Quantize(4),
+		AMOUNT_FIELD.Round(decimal.New(0, 4).Mul(t.PricePerShare, newShares)),
 		t.Currency,
+		t.InstrumentCurrency,
+		nil,
+		t.ExecutedFXRate,
+	}
+	if t.ExecutedFXRate != nil && t.ExecutedFXRate.Sign() > 0 {
+		copied.InstrumentAmount = AMOUNT_FIELD.Round(decimal.New(0, 4).Quo(copied.ShareValue, t.ExecutedFXRate))
 	}
+	return copied
+}
+
+// ExecutedFX returns the rate the trade was executed at, nil when it was booked in its own currency
+func (t Transaction) ExecutedFX() *ExecutedFX {
+	if t.InstrumentCurrency == "" || t.InstrumentCurrency == t.Currency || t.ExecutedFXRate == nil || t.ExecutedFXRate.Sign() <= 0 {
+		return nil
+	}
+	return &ExecutedFX{Currency: t.InstrumentCurrency, Rate: t.ExecutedFXRate}
 }
 
 type AssetLot struct {
@@ -154,3 +219,362 @@ type AssetLot struct {
 	CostBasisCurrency CurrencyUnit
 	CreatedDate       time.Time
 }
+
+// AssetLotShares is the share count of a lot after a change recorded in its history
+type AssetLotShares struct {
+	AsOfDate time.Time
+	Shares   *decimal.Big
+}
+
+type AccountType string
+
+var (
+	DEPA_ACCOUNT       = AccountType("DEPA")       // regular Swedish custody account, taxed on gains
+	ISK_ACCOUNT        = AccountType("ISK")        // investeringssparkonto, taxed on a standardized yield
+	KF_ACCOUNT         = AccountType("KF")         // kapitalförsäkring, taxed like ISK
+	TAXABLE_US_ACCOUNT = AccountType("TAXABLE_US") // regular US brokerage account
+	IRA_ACCOUNT        = AccountType("IRA")
+)
+
+var ErrInvalidAccountType = errors.New("invalid account type")
+
+func ParseAccountType(value string) (AccountType, error) {
+	switch strings.ReplaceAll(strings.ToUpper(strings.TrimSpace(value)), "-", "_") {
+	case "DEPA", "DEPÅ":
+		return DEPA_ACCOUNT, nil
+	case "ISK":
+		return ISK_ACCOUNT, nil
+	case "KF":
+		return KF_ACCOUNT, nil
+	case "TAXABLE_US", "TAXABLE":
+		return TAXABLE_US_ACCOUNT, nil
+	case "IRA":
+		return IRA_ACCOUNT, nil
+	}
+	return "", ErrInvalidAccountType
+}
+
+/*
+Account describes a brokerage account. ID is the account id given to imports with
+--account. Owners is a comma separated list of names, and the institution name
+and address are what FBAR asks for.
+*/
+type Account struct {
+	ID                 string
+	Broker             string
+	AccountType        AccountType
+	BaseCurrency       CurrencyUnit
+	OpenedDate         *time.Time
+	Owners             string
+	Institution        string
+	InstitutionAddress string
+}
+
+type AssetClass string
+
+var (
+	EQUITY_ASSET = AssetClass("EQUITY")
+	FUND_ASSET   = AssetClass("FUND")
+	ETF_ASSET    = AssetClass("ETF")
+	BOND_ASSET   = AssetClass("BOND")
+	ETC_ASSET    = AssetClass("ETC") // exchange traded commodity
+)
+
+var ErrInvalidAssetClass = errors.New("invalid asset class")
+
+func ParseAssetClass(value string) (AssetClass, error) {
+	switch AssetClass(strings.ToUpper(strings.TrimSpace(value))) {
+	case EQUITY_ASSET:
+		return EQUITY_ASSET, nil
+	case FUND_ASSET:
+		return FUND_ASSET, nil
+	case ETF_ASSET:
+		return ETF_ASSET, nil
+	case BOND_ASSET:
+		return BOND_ASSET, nil
+	case ETC_ASSET:
+		return ETC_ASSET, nil
+	}
+	return "", ErrInvalidAssetClass
+}
+
+type SecurityTicker struct {
+	Exchange string
+	Ticker   string
+}
+
+/*
+Security is the master record lots point at. ID is the ISIN, or CURRENCY:SYMBOL
+for securities imported without one (E*TRADE rows). YahooSymbol caches the
+symbol prices are looked up with, and PFIC marks passive foreign investment
+companies (most non-US funds), whose dividends are never qualified.
+*/
+type Security struct {
+	ID          string
+	ISIN        string
+	Name        string
+	YahooSymbol string
+	Currency    CurrencyUnit
+	AssetClass  AssetClass
+	PFIC        bool
+	Tickers     []SecurityTicker
+}
+
+type PriceSource string
+
+var (
+	YAHOO_PRICE_SOURCE  = PriceSource("yahoo")
+	MANUAL_PRICE_SOURCE = PriceSource("manual")
+	IMPORT_PRICE_SOURCE = PriceSource("import")
+	STOOQ_PRICE_SOURCE  = PriceSource("stooq")
+)
+
+// MissingPricePolicy is what mark does when no provider has a price for a security
+type MissingPricePolicy string
+
+var (
+	PROMPT_ON_MISSING     = MissingPricePolicy("prompt")
+	SKIP_ON_MISSING       = MissingPricePolicy("skip")
+	FAIL_ON_MISSING       = MissingPricePolicy("fail")
+	LAST_KNOWN_ON_MISSING = MissingPricePolicy("last-known")
+)
+
+var ErrInvalidMissingPricePolicy = errors.New("invalid missing price policy, expected skip, fail or last-known")
+
+func ParseMissingPricePolicy(value string) (MissingPricePolicy, error) {
+	switch MissingPricePolicy(strings.ToLower(strings.TrimSpace(value))) {
+	case PROMPT_ON_MISSING:
+		return PROMPT_ON_MISSING, nil
+	case SKIP_ON_MISSING:
+		return SKIP_ON_MISSING, nil
+	case FAIL_ON_MISSING:
+		return FAIL_ON_MISSING, nil
+	case LAST_KNOWN_ON_MISSING:
+		return LAST_KNOWN_ON_MISSING, nil
+	}
+	return "", ErrInvalidMissingPricePolicy
+}
+
+// RateSource is where a currency rate comes from
+type RateSource string
+
+var (
+	SEED_RATE_SOURCE     = RateSource("seed") // the yearly rates `rates` seeds
+	RIKSBANK_RATE_SOURCE = RateSource("riksbank")
+	ECB_RATE_SOURCE      = RateSource("ecb")
+	IRS_RATE_SOURCE      = RateSource("irs")
+	TREASURY_RATE_SOURCE = RateSource("treasury") // quarterly Treasury reporting rates of exchange
+	NORDNET_RATE_SOURCE  = RateSource("nordnet")  // Växlingskurs of imported Nordnet rows, SEK per unit of the base currency
+)
+
+var ErrUnknownRateSource = errors.New("unknown rate source, expected riksbank, ecb, irs or treasury")
+
+// ParseRateSource parses the sources rates can be imported from
+func ParseRateSource(value string) (RateSource, error) {
+	switch RateSource(strings.ToLower(strings.TrimSpace(value))) {
+	case RIKSBANK_RATE_SOURCE:
+		return RIKSBANK_RATE_SOURCE, nil
+	case ECB_RATE_SOURCE:
+		return ECB_RATE_SOURCE, nil
+	case IRS_RATE_SOURCE:
+		return IRS_RATE_SOURCE, nil
+	case TREASURY_RATE_SOURCE:
+		return TREASURY_RATE_SOURCE, nil
+	}
+	return "", ErrUnknownRateSource
+}
+
+// Yearly reports whether the source has one rate per year rather than daily rates
+func (s RateSource) Yearly() bool {
+	return s == SEED_RATE_SOURCE || s == IRS_RATE_SOURCE
+}
+
+// Daily reports whether the source publishes a rate every banking day
+func (s RateSource) Daily() bool {
+	return s == RIKSBANK_RATE_SOURCE || s == ECB_RATE_SOURCE
+}
+
+// CurrencyRate is how much of a currency one unit of the base currency buys, USD unless
+// the source quotes another one. Yearly rates are dated December 31.
+type CurrencyRate struct {
+	Currency CurrencyUnit
+	Date     time.Time
+	Rate     *decimal.Big
+	Source   RateSource
+	Base     CurrencyUnit
+}
+
+// PriceField is the daily value of a security used as its price. Adjusted closes are
+// corrected for later dividends and splits, so they don't match the market value on the date.
+type PriceField string
+
+var (
+	CLOSE_PRICE_FIELD     = PriceField("close")
+	ADJ_CLOSE_PRICE_FIELD = PriceField("adjclose")
+)
+
+var ErrInvalidPriceField = errors.New("invalid price field, expected close or adjclose")
+
+func ParsePriceField(value string) (PriceField, error) {
+	switch PriceField(strings.ToLower(strings.TrimSpace(value))) {
+	case CLOSE_PRICE_FIELD:
+		return CLOSE_PRICE_FIELD, nil
+	case ADJ_CLOSE_PRICE_FIELD:
+		return ADJ_CLOSE_PRICE_FIELD, nil
+	}
+	return "", ErrInvalidPriceField
+}
+
+// FXPolicy is the convention used to pick the currency rate of a converted amount
+type FXPolicy string
+
+var (
+	SPOT_FX_POLICY              = FXPolicy("spot")              // daily rate of the transaction date
+	YEARLY_AVERAGE_FX_POLICY    = FXPolicy("yearly-average")    // IRS yearly average, else the average of the daily rates
+	TREASURY_YEAR_END_FX_POLICY = FXPolicy("treasury-year-end") // Treasury reporting rate of December 31
+	RIKSBANK_DAILY_FX_POLICY    = FXPolicy("riksbank-daily")    // Riksbank rate of the date, for SEK reporting
+	CALENDAR_YEAR_FX_POLICY     = FXPolicy("calendar-year")     // rate of the calendar year, else the latest before it
+	EXECUTED_FX_POLICY          = FXPolicy("executed")          // rate the broker executed the trade at, else spot
+)
+
+var ErrInvalidFXPolicy = errors.New("invalid fx policy, expected spot, yearly-average, treasury-year-end, riksbank-daily or calendar-year")
+
+func ParseFXPolicy(value string) (FXPolicy, error) {
+	switch FXPolicy(strings.ToLower(strings.TrimSpace(value))) {
+	case SPOT_FX_POLICY:
+		return SPOT_FX_POLICY, nil
+	case YEARLY_AVERAGE_FX_POLICY:
+		return YEARLY_AVERAGE_FX_POLICY, nil
+	case TREASURY_YEAR_END_FX_POLICY:
+		return TREASURY_YEAR_END_FX_POLICY, nil
+	case RIKSBANK_DAILY_FX_POLICY:
+		return RIKSBANK_DAILY_FX_POLICY, nil
+	case CALENDAR_YEAR_FX_POLICY:
+		return CALENDAR_YEAR_FX_POLICY, nil
+	case EXECUTED_FX_POLICY:
+		return EXECUTED_FX_POLICY, nil
+	}
+	return "", ErrInvalidFXPolicy
+}
+
+// Price is the closing price per share of a security on a date. Providers looking back
+// over non-trading days return the date of the close they found.
+type Price struct {
+	SecurityID string
+	Date       time.Time
+	Price      *decimal.Big
+	Currency   CurrencyUnit
+	Source     PriceSource
+	Symbol     string // provider symbol the price was fetched with, not stored
+}
+
+// ISKRate is the yearly input to the ISK/KF standardized income. The rates are percentages.
+type ISKRate struct {
+	Year               int
+	GovernmentBondRate *decimal.Big // statslåneränta on November 30 of the year before
+	TaxFreeAmount      *decimal.Big // skattefri nivå in SEK
+}
+
+type StockPlanType string
+
+var (
+	RSU  = StockPlanType("RSU")
+	ESPP = StockPlanType("ESPP")
+)
+
+// StockPlanLot holds the employer stock plan details behind an asset lot.
+// FairMarketValue is the FMV per share at vest (RSU) or purchase (ESPP) and
+// is what the lot's cost basis is derived from.
+type StockPlanLot struct {
+	AssetLotID      string
+	PlanType        StockPlanType
+	GrantDate       time.Time
+	EventDate       time.Time
+	FairMarketValue *decimal.Big
+	PurchasePrice   *decimal.Big
+	GrantDateFMV    *decimal.Big
+	DiscountIncome  *decimal.Big
+	SharesWithheld  *decimal.Big
+}
+
+// ESPPDisposition is the sale of shares of an ESPP lot. OrdinaryIncome is only
+// known for disqualifying dispositions and nil otherwise.
+type ESPPDisposition struct {
+	TransactionID   int
+	AssetLotID      string
+	DispositionDate time.Time
+	Shares          *decimal.Big
+	Qualifying      bool
+	OrdinaryIncome  *decimal.Big
+}
+
+// IsQualifyingESPPDisposition reports whether selling ESPP shares on saleDate
+// is a qualifying disposition: more than two years after the offering (grant)
+// date and more than one year after the purchase date.
+func IsQualifyingESPPDisposition(lot StockPlanLot, saleDate time.Time) bool {
+	// Without a grant date the holding period can't be shown to have passed.
+	if lot.PlanType != ESPP || lot.GrantDate.IsZero() {
+		return false
+	}
+	return saleDate.After(lot.GrantDate.AddDate(2, 0, 0)) && saleDate.After(lot.EventDate.AddDate(1, 0, 0))
+}
+
+// DividendClassification records how much of a dividend is qualified and why
+type DividendClassification struct {
+	TransactionID   int
+	Qualified       bool
+	QualifiedAmount *decimal.Big
+	PayerCountry    string
+	Reason          string
+}
+
+// ExDividendDate is the ex-dividend date of a payment of a security
+type ExDividendDate struct {
+	Symbol      string
+	PaymentDate time.Time
+	ExDate      time.Time
+	Source      string
+}
+
+type CorporateActionType string
+
+var (
+	SPLIT_ACTION         = CorporateActionType("SPLIT")
+	REVERSE_SPLIT_ACTION = CorporateActionType("REVERSE_SPLIT")
+	MERGER_ACTION        = CorporateActionType("MERGER")
+	RENAME_ACTION        = CorporateActionType("RENAME")
+	SPINOFF_ACTION       = CorporateActionType("SPINOFF")
+)
+
+/*
+CorporateAction transforms every open lot of a security in place.
+RatioTo new shares are received for every RatioFrom old shares, so a 4:1
+split is RatioTo=4, RatioFrom=1 and a 1:10 reverse split is RatioTo=1,
+RatioFrom=10. NewSymbol/NewISIN are applied to the lots when set.
+CashPerShare is merger cash paid per old share; CashInLieuPrice, when set,
+pays out each account's fractional new shares instead of keeping them.
+For a spin-off the parent lots keep their shares, RatioTo:RatioFrom is the
+number of spun-off shares per parent share and BasisAllocation is the
+published percentage of parent basis that moves to the spun-off shares.
+For a merger paying both shares and cash BasisAllocation is the percentage
+of the old basis that goes to the cash.
+*/
+type CorporateAction struct {
+	ID              int
+	ActionType      CorporateActionType
+	AccountID       string
+	Symbol          string
+	ISIN            string
+	EffectiveDate   time.Time
+	RatioFrom       *decimal.Big
+	RatioTo         *decimal.Big
+	NewSymbol       string
+	NewISIN         string
+	CashPerShare    *decimal.Big
+	CashInLieuPrice *decimal.Big
+	BasisAllocation *decimal.Big
+	Currency        CurrencyUnit
+	Source          string
+	Note            string
+	AppliedDate     *time.Time
+}
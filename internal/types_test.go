@@ -2,7 +2,10 @@ package internal_test
 
 import (
 	"accounting/internal"
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/ericlagergren/decimal"
 )
@@ -23,6 +26,24 @@ func TestProcessStringAmount(t *testing.T) {
 		{"0.0001", internal.US},
 		{"1010.0001", internal.SE},
 		{"1010.0001", "DK"},
+		{"-0,5", internal.SE},
+		{"-1,5", internal.SE},
+		{"1.234.567,89", internal.SE},
+		{"1\u00a0234,50 kr", internal.SE},
+		{"1\u202f234,5", internal.SE},
+		{"(1 234,50)", internal.SE},
+		{"($1,234.50)", internal.US},
+		{"SEK -12,5", internal.SE},
+		{"\u221212.5 USD", internal.US},
+		{"1,5e3", internal.SE},
+		{"2.5E-4", internal.US},
+		{"1,23456", internal.SE},
+		{"1.5", internal.SE},
+		{"12,34,567", internal.US},
+		{"1,2x", internal.SE},
+		{"-(5)", internal.US},
+		{"kr", internal.SE},
+		{"1e99", internal.US},
 	}
 	var results []TestResult = []TestResult{
 		{decimal.New(1001000, 4), nil},
@@ -31,12 +52,63 @@ func TestProcessStringAmount(t *testing.T) {
 		{decimal.New(1, 4), nil},
 		{internal.ERROR_VALUE, internal.ErrInvalidPrecisionValue},
 		{internal.ERROR_VALUE, internal.ErrInvalidLocale},
+		{decimal.New(-5000, 4), nil},
+		{decimal.New(-15000, 4), nil},
+		{decimal.New(12345678900, 4), nil},
+		{decimal.New(12345000, 4), nil},
+		{decimal.New(12345000, 4), nil},
+		{decimal.New(-12345000, 4), nil},
+		{decimal.New(-12345000, 4), nil},
+		{decimal.New(-125000, 4), nil},
+		{decimal.New(-125000, 4), nil},
+		{decimal.New(15000000, 4), nil},
+		{decimal.New(2, 4), nil},
+		{decimal.New(12346, 4), nil},
+		{internal.ERROR_VALUE, internal.ErrInvalidPrecisionValue},
+		{internal.ERROR_VALUE, internal.ErrInvalidPrecisionValue},
+		{internal.ERROR_VALUE, internal.ErrInvalidPrecisionValue},
+		{internal.ERROR_VALUE, internal.ErrInvalidPrecisionValue},
+		{internal.ERROR_VALUE, internal.ErrInvalidPrecisionValue},
+		{internal.ERROR_VALUE, internal.ErrInvalidPrecisionValue},
 	}
 	for i, v := range args {
 		r, e := internal.ProcessStringAmount(v.amount, v.currency)
 		var result = TestResult{r, e}
-		if result.amount.Cmp(results[i].amount) != 0 || result.err != results[i].err {
+		if result.amount.Cmp(results[i].amount) != 0 || !errors.Is(result.err, results[i].err) {
+			t.Errorf("Failed test %d: %s %v", i, result.amount, result.err)
+		}
+		// Errors quote the amount they failed on.
+		if e != nil && e != internal.ErrInvalidLocale && !strings.Contains(e.Error(), v.amount) {
+			t.Errorf("Failed test %d: error %q doesn't include %q", i, e, v.amount)
+		}
+	}
+}
+
+func TestIsQualifyingESPPDisposition(t *testing.T) {
+	lot := internal.StockPlanLot{
+		PlanType:  internal.ESPP,
+		GrantDate: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		EventDate: time.Date(2022, 6, 30, 0, 0, 0, 0, time.UTC),
+	}
+	var cases = []struct {
+		saleDate   time.Time
+		qualifying bool
+	}{
+		{time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC), false}, // under two years from grant
+		{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), false}, // exactly two years from grant
+		{time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), true},
+	}
+	for i, c := range cases {
+		if internal.IsQualifyingESPPDisposition(lot, c.saleDate) != c.qualifying {
 			t.Errorf("Failed test %d", i)
 		}
 	}
+	lot.GrantDate = time.Time{}
+	if internal.IsQualifyingESPPDisposition(lot, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("ESPP lots without a grant date are never qualifying")
+	}
+	lot.PlanType = internal.RSU
+	if internal.IsQualifyingESPPDisposition(lot, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("RSU lots are never qualifying ESPP dispositions")
+	}
 }
@@ -3,11 +3,15 @@ package main
 import (
 	"accounting/internal"
 	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
 	"strings"
 	"time"
 
+	"github.com/ericlagergren/decimal"
 	flag "github.com/spf13/pflag"
 )
 
@@ -21,19 +25,129 @@ type ImportConfig struct {
 }
 
 type MarkConfig struct {
-	markDate string
+	markDate       string
+	priceProviders []string
+	yahooURL       string
+	stooqURL       string
+	priceDir       string
+	priceFile      string
+	nonInteractive bool
+	onMissing      string
+	replace        bool
+	workers        int
+	rate           float64
+	retries        int
+	timeout        time.Duration
+	lookback       int
+	priceField     string
+}
+
+type CorporateActionConfig struct {
+	id              int
+	actionType      string
+	accountNumber   string
+	symbol          string
+	isin            string
+	effectiveDate   string
+	ratio           string
+	newSymbol       string
+	newISIN         string
+	cashPerShare    string
+	cashInLieuPrice string
+	basisAllocation string
+	currency        string
+	note            string
+	apply           bool
+}
+
+type DividendsConfig struct {
+	year          int
+	accountNumber string
+	format        string
+	outDir        string
+	fxPolicy      string
+	fxColumns     []string
+	locale        string
+	symbol        string
+	paidDate      string
+	exDate        string
+	save          bool
+}
+
+type AccountsConfig struct {
+	accountNumber      string
+	broker             string
+	accountType        string
+	currency           string
+	openedDate         string
+	owners             string
+	institution        string
+	institutionAddress string
+}
+
+type SecuritiesConfig struct {
+	id          string
+	name        string
+	yahooSymbol string
+	currency    string
+	assetClass  string
+	pfic        bool
+	tickers     []string
+}
+
+type PricesConfig struct {
+	file       string
+	securityID string
+	date       string
+	price      string
+	currency   string
+}
+
+type RatesConfig struct {
+	source   string
+	file     string
+	currency string
+	year     int
+	name     string
+	locale   string
+}
+
+type LedgerConfig struct {
+	ledger     string
+	profile    string
+	setDefault bool
+}
+
+type PrecisionConfig struct {
+	field  string
+	places int
+}
+
+type ISKConfig struct {
+	year          int
+	accountNumber string
+	quarters      [4]string
+	bondRate      string
+	taxFree       string
+	fxPolicy      string
+	fxColumns     []string
 }
 
 type ExportConfig struct {
 	outDir        string
 	accountNumber string
+	markDate      string
+	fxPolicy      string
+	fxColumns     []string
+	locale        string
 }
 
 func importUsage() {
 	fmt.Println(`
-	Usage: go run main.go import --file ./file.csv --source nordnet
+	Usage: go run main.go import --file ./file.csv --source nordnet --account 123456
 	--file: import file location (broker exports)
-	--source: import record source. Supports: [ nordnet | etrade | reporting ]
+	--account: registered account id the records belong to (see accounts add)
+	--source: import record source. Supports: [ nordnet | etrade | etrade-benefits | reporting ]
 
 	Reporting exports:
 	go run main.go import --source reporting --transactions ./transactions.csv --assets ./assets.csv [--replace=false]
@@ -49,25 +163,230 @@ func markUsage() {
 	Usage: go run main.go mark --date 2024-12-31
 
 	--date: date of market-mark
+	--price-providers: providers asked for prices, in order [ store | yahoo | stooq | csv ] (default: store,yahoo)
+	--price-dir: directory with <security id>.csv price files for the csv provider
+	--yahoo-url / --stooq-url: base URLs of the Yahoo and Stooq providers
+	--prices: price file (Security,Date,Price[,Currency]) used for securities the providers have no price for
+	--non-interactive: never prompt, missing prices are handled by --on-missing
+	--on-missing: [ skip | fail | last-known ] when no price is found (default: prompt, or skip with --non-interactive)
+	--replace: re-mark lots already marked on the date, the earlier marks are kept as superseded
+	--workers: concurrent price lookups (default: 4)
+	--rate: price requests per second across all workers (default: 2)
+	--retries: retries of failed price requests, with exponential backoff, 0 disables them (default: 3)
+	--timeout: timeout of each price request (default: 20s)
+	--lookback: days before the date the last close may be from when the date isn't a trading day (default: 10)
+	--price-field: [ close | adjclose ] daily value used as price (default: close, adjusted closes don't match the market value)
+	`)
+}
+
+func corporateActionsUsage() {
+	fmt.Println(`
+	Usage: go run main.go corporate-actions [ add | list | apply ]
+
+	add: records a corporate action and applies it to open lots
+	go run main.go corporate-actions add --type split --symbol ACME --date 2024-06-10 --ratio 4:1
+	go run main.go corporate-actions add --type merger --symbol ACME --date 2024-06-10 --ratio 0:1 --cash-per-share 42.50
+	go run main.go corporate-actions add --type merger --symbol ACME --new-symbol NEWCO --date 2024-06-10 --ratio 1:2 --cash-per-share 3.00 --allocation 5
+	go run main.go corporate-actions add --type spinoff --symbol ACME --new-symbol SPUN --date 2024-06-10 --ratio 1:3 --allocation 12.5
+
+	--type: [ split | reverse-split | merger | rename | spinoff ]
+	--symbol / --isin: security the action applies to (ISIN wins when given)
+	--date: effective date in YYYY-MM-DD format, lots acquired before it are transformed
+	--ratio: new:old shares, e.g. 4:1 for a split or 1:10 for a reverse split (default 1:1), 0:1 for an all-cash merger
+	--new-symbol / --new-isin: security after the action (mergers and renames) or the spun-off security
+	--cash-per-share: merger cash consideration per old share (US format)
+	--cash-in-lieu: price per share paid for fractional shares (US format)
+	--allocation: spin-off, percent of the parent's basis allocated to the new shares; merger paying shares and cash, percent of the basis allocated to the cash (US format)
+	--currency: currency of cash amounts (default: lot cost basis currency)
+	--account: only apply to this account
+	--note: free text
+	--apply: apply right away (default: true)
+
+	list: lists recorded corporate actions
+	apply: applies a recorded corporate action
+	go run main.go corporate-actions apply --id 3
+	`)
+}
+
+func dividendsUsage() {
+	fmt.Println(`
+	Usage: go run main.go dividends [ ex-date ] --year 2024 [--account 123456] [--format csv|json] [--out ./reporting] [--save]
+
+	--year: calendar year of the payments
+	--account: only report this account
+	--format: [ csv | json ] (default: csv)
+	--out: output directory (default: ./reporting)
+	--fx-policy: [ spot | yearly-average | treasury-year-end | riksbank-daily | calendar-year | executed ] policy of all USD columns
+	--fx-column: "COLUMN=POLICY" policy of one column, can be repeated. Columns: USD (default: spot), USD Yearly Average (default: yearly-average)
+	--locale: [ SE | US ] number format of all amounts in csv (default: the format of each amount's currency, see rates currencies)
+	--save: record the qualified/ordinary classification of every dividend in the ledger, the report alone doesn't change it
+
+	Every file gets a <file>.meta.json, or a "fx" field in json, with the policy and rate sources of its USD columns.
+
+	ex-date: records and lists the ex-dividend dates the qualified holding period is counted from,
+	dividends without one are reported as ordinary
+	go run main.go dividends ex-date set --symbol ACME --paid 2024-06-14 --ex-date 2024-05-31
+	go run main.go dividends ex-date list --year 2024
+
+	--symbol: symbol of the dividend payment
+	--paid: settlement date of the payment in YYYY-MM-DD format
+	--ex-date: ex-dividend date in YYYY-MM-DD format, replaces the one recorded before
+	`)
+}
+
+func accountsUsage() {
+	fmt.Println(`
+	Usage: go run main.go accounts [ add | list | edit ]
+
+	add: registers an account, imports only accept registered accounts
+	go run main.go accounts add --account 123456 --broker nordnet --type isk --owners "Jane Doe" --opened 2019-05-02
+
+	--account: account id used on imports
+	--broker: [ nordnet | etrade ] imports from another broker are refused
+	--type: [ depa | isk | kf | taxable-us | ira ] (default: depa)
+	--currency: base currency (default: the broker's, SEK for nordnet and USD for etrade)
+	--opened: opening date in YYYY-MM-DD format
+	--owners: comma separated owner names
+	--institution / --address: financial institution name and address (for FBAR)
+
+	list: lists registered accounts
+
+	edit: changes the given attributes of an account
+	go run main.go accounts edit --account 123456 --type kf
+	`)
+}
+
+func iskUsage() {
+	fmt.Println(`
+	Usage: go run main.go isk --year 2024 [--account 123456] [--q1 100000 --q2 ... --q4 ...]
+
+	--year: tax year
+	--account: only this ISK/KF account (default: all ISK and KF accounts)
+	--q1..--q4: value in SEK at the start of each quarter (US format), overrides the marks and is required for quarters without marks
+	--fx-policy: [ spot | yearly-average | treasury-year-end | riksbank-daily | calendar-year ] policy converting marks to SEK (default: calendar-year)
+
+	go run main.go isk rates list
+	go run main.go isk rates set --year 2026 --bond-rate 2.55 --tax-free 300000
+
+	--bond-rate: statslåneränta on November 30 of the year before, percent (US format)
+	--tax-free: skattefri nivå in SEK (US format)
 	`)
 }
 
 func defaultUsage() {
 	fmt.Println(`
-	Usage: go run main.go [ import | rates | mark | export ]
+	Usage: go run main.go [ init | import | rates | mark | export | dividends | isk | accounts | corporate-actions | precision | db ] [ --ledger PATH | --profile NAME ]
 
+	init: creates the ledger, and the profile pointing at it with --profile
 	import: imports records from transaction exports
 	mark: marks to market transactions
-	rates: seeds currency_rates
+	rates: seeds, imports and lists the currency rates
 	export: exports your ledger into csv exports for reporting
+	dividends: dividend income report for a year
+	isk: ISK/KF schablonintäkt and tax for a year
+	accounts: registers the accounts imports go into
+	securities: lists and edits the securities lots refer to
+	prices: imports and overrides the prices used when marking
+	corporate-actions: records and applies splits, mergers, renames and spin-offs
+	precision: lists and changes the decimal places quantities, prices and amounts are stored with
+	db: shows and applies the schema migrations of the ledger and checks its integrity
+
+	--ledger: the ledger to work on
+	--profile: the profile of the config file whose ledger to work on, see init
+	Without them the default profile or ledger of the config file is used, else ledger.db in the
+	working directory. The config file is $XDG_CONFIG_HOME/accounting/config.json, or
+	~/.config/accounting/config.json. Commands other than init fail when the ledger doesn't exist.
+	`)
+}
+
+func initUsage() {
+	fmt.Println(`
+	Usage: go run main.go init [ --ledger PATH ] [ --profile NAME [ --default ] ]
+
+	init: creates the ledger and applies its migrations, opening it when it already exists
+	go run main.go init --ledger ~/ledgers/household.db
+
+	--profile with --ledger adds or changes the profile in the config file, other commands then
+	open its ledger with --profile
+	go run main.go init --profile sandbox-2025 --ledger sandbox-2025.db
+	go run main.go import --profile sandbox-2025 --source nordnet --file ./nordnet-export.csv --account 123456
+
+	--default: makes the profile the one used without --ledger or --profile
+	go run main.go init --profile household --ledger ~/ledgers/household.db --default
 	`)
 }
 
+/*
+setLedgerFlags parses --ledger and --profile ahead of the flags of the command, which the ledger
+has to be opened for, and adds them to the flags of every command.
+*/
+func setLedgerFlags() LedgerConfig {
+	var cfg = LedgerConfig{}
+	fs := flag.NewFlagSet("ledger", flag.ContinueOnError)
+	fs.ParseErrorsWhitelist.UnknownFlags = true
+	fs.Usage = func() {}
+	fs.SetOutput(io.Discard)
+	var l = fs.String("ledger", "", "Ledger to work on")
+	var p = fs.String("profile", "", "Profile of the config file whose ledger to work on")
+	// Help and the flags of the command are left to the command.
+	fs.Parse(os.Args[1:])
+	flag.CommandLine.AddFlagSet(fs)
+	cfg.ledger = *l
+	cfg.profile = *p
+	return cfg
+}
+
+func setInitFlags(cfg LedgerConfig) LedgerConfig {
+	var d = flag.Bool("default", false, "Make --profile the default profile")
+	flag.Parse()
+	cfg.setDefault = *d
+	return cfg
+}
+
+func doInit(cfg LedgerConfig) {
+	cfg = setInitFlags(cfg)
+	if cfg.setDefault && cfg.profile == "" {
+		initUsage()
+		return
+	}
+	if cfg.profile != "" && cfg.ledger != "" {
+		if err := internal.SaveProfile(cfg.profile, cfg.ledger, cfg.setDefault); err != nil {
+			internal.ErrLogger.Fatal(err)
+		}
+		path, _ := internal.ConfigPath()
+		internal.InfoLogger.Printf("saved profile %s in %s\n", cfg.profile, path)
+		cfg.ledger = ""
+	} else if cfg.setDefault {
+		config, err := internal.LoadConfig()
+		if err != nil {
+			internal.ErrLogger.Fatal(err)
+		}
+		if _, ok := config.Profiles[cfg.profile]; ok {
+			config.DefaultProfile = cfg.profile
+			if err = internal.SaveConfig(config); err != nil {
+				internal.ErrLogger.Fatal(err)
+			}
+		}
+	}
+	ledger, err := internal.ResolveLedger(cfg.ledger, cfg.profile)
+	if err != nil {
+		internal.ErrLogger.Fatal(err)
+	}
+	internal.LedgerPath = ledger
+	if _, err = os.Stat(ledger); err == nil {
+		internal.InfoLogger.Printf("%s already exists, applying its pending migrations\n", ledger)
+	}
+	if err = internal.CreateDB(); err != nil {
+		internal.ErrLogger.Fatal(err)
+	}
+	internal.InfoLogger.Printf("ledger %s is ready\n", ledger)
+}
+
 func setImportFlags() ImportConfig {
 	var impCfg = ImportConfig{}
 	var a = flag.String("account", "", "When importing, your account id associated with the import record")
 	var f = flag.String("file", "", "When importing, the location of the file you containing records")
-	var s = flag.String("source", "", "When importing, the source. supports: [ nordnet | etrade | reporting ]")
+	var s = flag.String("source", "", "When importing, the source. supports: [ nordnet | etrade | etrade-benefits | reporting ]")
 	var tf = flag.String("transactions", "", "When importing reporting exports: reporting transactions csv file")
 	var af = flag.String("assets", "", "When importing reporting exports: reporting assets csv file")
 	var r = flag.Bool("replace", true, "When importing reporting exports: replace existing rows for accounts found in the import")
@@ -84,8 +403,36 @@ func setImportFlags() ImportConfig {
 func setMarkFlags() MarkConfig {
 	var cfg = MarkConfig{}
 	var d = flag.String("date", "", "When marking, date in YYYY-MM-DD format")
+	var p = flag.StringSlice("price-providers", internal.DefaultPriceProviders, "Price providers in lookup order: [ store | yahoo | stooq | csv ]")
+	var y = flag.String("yahoo-url", internal.DefaultYahooBaseURL, "Yahoo Finance base URL")
+	var s = flag.String("stooq-url", internal.DefaultStooqBaseURL, "Stooq base URL")
+	var pd = flag.String("price-dir", "", "Directory with <security id>.csv price files")
+	var pf = flag.String("prices", "", "Price file used for missing prices")
+	var ni = flag.Bool("non-interactive", false, "Never prompt")
+	var om = flag.String("on-missing", "", "When no price is found: [ skip | fail | last-known ]")
+	var r = flag.Bool("replace", false, "Re-mark lots already marked on the date")
+	var w = flag.Int("workers", internal.DefaultPriceWorkers, "Concurrent price lookups")
+	var rt = flag.Float64("rate", internal.DefaultRequestsPerSecond, "Price requests per second")
+	var rr = flag.Int("retries", internal.DefaultPriceRetries, "Retries of failed price requests")
+	var to = flag.Duration("timeout", internal.DefaultPriceRequestTimeout, "Timeout of each price request")
+	var lb = flag.Int("lookback", internal.DefaultPriceLookbackDays, "Days before the date the last close may be from")
+	var pfl = flag.String("price-field", string(internal.CLOSE_PRICE_FIELD), "Daily value used as price: [ close | adjclose ]")
 	flag.Parse()
 	cfg.markDate = *d
+	cfg.priceProviders = *p
+	cfg.yahooURL = *y
+	cfg.stooqURL = *s
+	cfg.priceDir = *pd
+	cfg.priceFile = *pf
+	cfg.nonInteractive = *ni
+	cfg.onMissing = *om
+	cfg.replace = *r
+	cfg.workers = *w
+	cfg.rate = *rt
+	cfg.retries = *rr
+	cfg.timeout = *to
+	cfg.lookback = *lb
+	cfg.priceField = *pfl
 	return cfg
 }
 
@@ -102,6 +449,12 @@ func doImport() {
 		return
 	}
 	var err error
+	if broker := internal.ImportSourceBroker(impCfg.importSource); broker != "" {
+		if err = internal.ValidateImportAccount(impCfg.accountNumber, broker); err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+	}
 	var importRecords []internal.ImportRecord
 	if impCfg.importSource == "nordnet" {
 		importRecords, err = internal.ReadNordnetExport(impCfg.importLocation, impCfg.accountNumber)
@@ -115,6 +468,12 @@ func doImport() {
 			internal.ErrLogger.Println(err)
 			return
 		}
+	} else if impCfg.importSource == "etrade-benefits" {
+		importRecords, err = internal.ReadETradeBenefitHistory(impCfg.importLocation, impCfg.accountNumber)
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
 	} else if impCfg.importSource == "reporting" {
 		if impCfg.assetsFile == "" {
 			fmt.Println("Missing --assets flag")
@@ -145,29 +504,57 @@ func doImport() {
 
 func doMark() {
 	cfg := setMarkFlags()
-	if cfg.markDate == "" {
-		// Prompt user if not provided. This avoids panics due to missing flags.
-		reader := bufio.NewReader(os.Stdin)
-		for {
-			fmt.Print("Enter mark date (YYYY-MM-DD): ")
-			text, _ := reader.ReadString('\n')
-			text = strings.TrimSpace(text)
-			d, err := time.Parse(time.DateOnly, text)
-			if err != nil {
-				fmt.Printf("Invalid date. Expected format: YYYY-MM-DD\n")
-				continue
-			}
-			internal.MarkStocks(d)
+	opts := internal.MarkOptions{
+		Prices: internal.PriceProviderConfig{
+			Providers:    cfg.priceProviders,
+			YahooBaseURL: cfg.yahooURL,
+			StooqBaseURL: cfg.stooqURL,
+			PriceDir:     cfg.priceDir,
+
+			Workers:           cfg.workers,
+			RequestsPerSecond: cfg.rate,
+			Retries:           &cfg.retries,
+			RequestTimeout:    cfg.timeout,
+			LookbackDays:      cfg.lookback,
+		},
+		PriceFile: cfg.priceFile,
+		OnMissing: internal.PROMPT_ON_MISSING,
+		Replace:   cfg.replace,
+	}
+	if cfg.lookback == 0 {
+		opts.Prices.LookbackDays = -1
+	}
+	field, err := internal.ParsePriceField(cfg.priceField)
+	if err != nil {
+		internal.ErrLogger.Println(err)
+		return
+	}
+	opts.Prices.PriceField = field
+	if cfg.nonInteractive {
+		opts.OnMissing = internal.SKIP_ON_MISSING
+	}
+	if cfg.onMissing != "" {
+		policy, err := internal.ParseMissingPricePolicy(cfg.onMissing)
+		if err != nil || (cfg.nonInteractive && policy == internal.PROMPT_ON_MISSING) {
+			internal.ErrLogger.Println(internal.ErrInvalidMissingPricePolicy)
 			return
 		}
+		opts.OnMissing = policy
 	}
 
 	// Validate input date strictly.
 	d, err := time.Parse(time.DateOnly, cfg.markDate)
 	if err != nil {
+		if cfg.nonInteractive {
+			internal.ErrLogger.Printf("Invalid --date (%s). Expected YYYY-MM-DD.\n", cfg.markDate)
+			return
+		}
+		// Prompt user if not provided. This avoids panics due to missing flags.
 		reader := bufio.NewReader(os.Stdin)
 		for {
-			fmt.Printf("Invalid --date (%s). Expected YYYY-MM-DD.\n", cfg.markDate)
+			if cfg.markDate != "" {
+				fmt.Printf("Invalid --date (%s). Expected YYYY-MM-DD.\n", cfg.markDate)
+			}
 			fmt.Print("Enter mark date (YYYY-MM-DD): ")
 			text, _ := reader.ReadString('\n')
 			text = strings.TrimSpace(text)
@@ -179,16 +566,44 @@ func doMark() {
 			break
 		}
 	}
-	internal.MarkStocks(d)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	results, err := internal.MarkStocks(ctx, d, opts)
+	if err != nil {
+		internal.ErrLogger.Println(err)
+		return
+	}
+	marked := 0
+	for _, r := range results {
+		price := "-"
+		if r.Price != nil {
+			price = r.Price.String()
+			marked++
+		}
+		priceDate := "-"
+		if r.Price != nil {
+			priceDate = r.PriceDate.Format(time.DateOnly)
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s %s\t%s\t%s\n", r.AccountID, r.LotID, r.Symbol, r.SecurityID, price, r.Currency, priceDate, r.Source)
+	}
+	fmt.Printf("marked %d of %d lots as of %s\n", marked, len(results), d.Format(time.DateOnly))
 }
 
 func setExportFlags() ExportConfig {
 	var cfg = ExportConfig{}
 	var out = flag.String("out", "./reporting", "Output directory for reporting csv exports")
 	var account = flag.String("account", "", "Optional: only export rows for this account")
+	var md = flag.String("mark-date", "", "Optional: export the marks of this date (latest on or before it) in YYYY-MM-DD format")
+	var fp = flag.String("fx-policy", "", "Policy of the USD columns: [ spot | yearly-average | treasury-year-end | riksbank-daily | calendar-year | executed ] (default: calendar-year)")
+	var fc = flag.StringArray("fx-column", nil, "COLUMN=POLICY, policy of one USD column, can be repeated")
+	var l = flag.String("locale", "", "Optional: number format of all amounts: [ SE | US ] (default: the format of each amount's currency)")
 	flag.Parse()
 	cfg.outDir = *out
 	cfg.accountNumber = *account
+	cfg.markDate = *md
+	cfg.fxPolicy = *fp
+	cfg.fxColumns = *fc
+	cfg.locale = *l
 	return cfg
 }
 
@@ -198,28 +613,1032 @@ func doExport() {
 		fmt.Println("Missing --out flag")
 		return
 	}
-	err := internal.ExportReportingExports(cfg.outDir, cfg.accountNumber)
+	var markDate *time.Time
+	if cfg.markDate != "" {
+		d, err := time.Parse(time.DateOnly, cfg.markDate)
+		if err != nil {
+			fmt.Printf("Invalid --mark-date (%s). Expected YYYY-MM-DD.\n", cfg.markDate)
+			return
+		}
+		markDate = &d
+	}
+	policies, err := internal.ParseFXPolicies(cfg.fxPolicy, cfg.fxColumns)
+	if err != nil {
+		internal.ErrLogger.Println(err)
+		return
+	}
+	locale, err := parseLocaleFlag(cfg.locale)
+	if err != nil {
+		internal.ErrLogger.Println(err)
+		return
+	}
+	err = internal.ExportReportingExports(cfg.outDir, cfg.accountNumber, markDate, policies, locale)
 	if err != nil {
 		internal.ErrLogger.Println(err)
 	}
 }
 
-func main() {
-	flag.Usage = defaultUsage
-	if len(os.Args) < 2 {
-		flag.Usage()
-		os.Exit(1)
+// parseLocaleFlag parses an optional --locale, empty keeps the format of each currency
+func parseLocaleFlag(value string) (internal.LocaleUnit, error) {
+	if strings.TrimSpace(value) == "" {
+		return "", nil
+	}
+	return internal.ParseLocale(value)
+}
+
+func setDividendsFlags() DividendsConfig {
+	var cfg = DividendsConfig{}
+	var y = flag.Int("year", 0, "Calendar year of the dividend payments")
+	var a = flag.String("account", "", "Optional: only report this account")
+	var f = flag.String("format", "csv", "Report format: [ csv | json ]")
+	var out = flag.String("out", "./reporting", "Output directory for the report")
+	var fp = flag.String("fx-policy", "", "Policy of the USD columns: [ spot | yearly-average | treasury-year-end | riksbank-daily | calendar-year | executed ]")
+	var fc = flag.StringArray("fx-column", nil, "COLUMN=POLICY, policy of one USD column, can be repeated")
+	var l = flag.String("locale", "", "Optional: number format of all amounts in csv: [ SE | US ] (default: the format of each amount's currency)")
+	var s = flag.String("symbol", "", "Symbol of the dividend payment")
+	var p = flag.String("paid", "", "Settlement date of the payment in YYYY-MM-DD format")
+	var e = flag.String("ex-date", "", "Ex-dividend date in YYYY-MM-DD format")
+	var sv = flag.Bool("save", false, "Record the classification of every dividend in the ledger")
+	flag.Parse()
+	cfg.save = *sv
+	cfg.symbol = *s
+	cfg.paidDate = *p
+	cfg.exDate = *e
+	cfg.year = *y
+	cfg.accountNumber = *a
+	cfg.format = *f
+	cfg.outDir = *out
+	cfg.fxPolicy = *fp
+	cfg.fxColumns = *fc
+	cfg.locale = *l
+	return cfg
+}
+
+func doExDividendDates(cfg DividendsConfig) {
+	if len(os.Args) < 4 {
+		dividendsUsage()
+		return
+	}
+	switch os.Args[3] {
+	case "set":
+		paidDate, err := time.Parse(time.DateOnly, cfg.paidDate)
+		if err != nil {
+			fmt.Println("Invalid --paid. Expected YYYY-MM-DD")
+			return
+		}
+		exDate, err := time.Parse(time.DateOnly, cfg.exDate)
+		if err != nil {
+			fmt.Println("Invalid --ex-date. Expected YYYY-MM-DD")
+			return
+		}
+		err = internal.UpsertExDividendDate(internal.ExDividendDate{Symbol: cfg.symbol, PaymentDate: paidDate, ExDate: exDate})
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		internal.InfoLogger.Printf("%s paid on %s went ex-dividend on %s\n", cfg.symbol, cfg.paidDate, cfg.exDate)
+	case "list":
+		if cfg.year == 0 {
+			fmt.Println("Missing --year flag")
+			return
+		}
+		exDates, err := internal.GetExDividendDates(cfg.year)
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		fmt.Println("Symbol\tPaid\tEx-date\tSource")
+		for _, e := range exDates {
+			fmt.Printf("%s\t%s\t%s\t%s\n", e.Symbol, e.PaymentDate.Format(time.DateOnly), e.ExDate.Format(time.DateOnly), e.Source)
+		}
+	default:
+		dividendsUsage()
+	}
+}
+
+func doDividends() {
+	cfg := setDividendsFlags()
+	if len(os.Args) > 2 && os.Args[2] == "ex-date" {
+		doExDividendDates(cfg)
+		return
+	}
+	if cfg.year == 0 {
+		fmt.Println("Missing --year flag")
+		dividendsUsage()
+		return
+	}
+	policies, err := internal.ParseFXPolicies(cfg.fxPolicy, cfg.fxColumns)
+	if err != nil {
+		internal.ErrLogger.Println(err)
+		return
+	}
+	locale, err := parseLocaleFlag(cfg.locale)
+	if err != nil {
+		internal.ErrLogger.Println(err)
+		return
+	}
+	paths, err := internal.ExportDividendReport(cfg.outDir, cfg.year, cfg.accountNumber, cfg.format, policies, locale)
+	if err != nil {
+		internal.ErrLogger.Println(err)
+		return
+	}
+	for _, path := range paths {
+		fmt.Printf("Wrote %s\n", path)
+	}
+	if cfg.save {
+		saved, err := internal.SaveDividendClassifications(cfg.year, cfg.accountNumber)
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		fmt.Printf("Saved the classification of %d dividends\n", saved)
+	}
+}
+
+func setAccountsFlags() AccountsConfig {
+	var cfg = AccountsConfig{}
+	var a = flag.String("account", "", "Account id")
+	var b = flag.String("broker", "", "Broker: [ nordnet | etrade ]")
+	var t = flag.String("type", "", "Account type: [ depa | isk | kf | taxable-us | ira ]")
+	var c = flag.String("currency", "", "Base currency")
+	var o = flag.String("opened", "", "Opening date in YYYY-MM-DD format")
+	var ow = flag.String("owners", "", "Comma separated owner names")
+	var i = flag.String("institution", "", "Financial institution name")
+	var ad = flag.String("address", "", "Financial institution address")
+	flag.Parse()
+	cfg.accountNumber = *a
+	cfg.broker = *b
+	cfg.accountType = *t
+	cfg.currency = *c
+	cfg.openedDate = *o
+	cfg.owners = *ow
+	cfg.institution = *i
+	cfg.institutionAddress = *ad
+	return cfg
+}
+
+// applyAccountFlags copies the flags given on the command line onto account
+func applyAccountFlags(cfg AccountsConfig, account *internal.Account) error {
+	if flag.CommandLine.Changed("broker") {
+		account.Broker = strings.ToLower(cfg.broker)
+	}
+	if flag.CommandLine.Changed("type") {
+		accountType, err := internal.ParseAccountType(cfg.accountType)
+		if err != nil {
+			return err
+		}
+		account.AccountType = accountType
+	}
+	if flag.CommandLine.Changed("currency") {
+		account.BaseCurrency = internal.CurrencyUnit(strings.ToUpper(cfg.currency))
+	}
+	if flag.CommandLine.Changed("opened") {
+		account.OpenedDate = nil
+		if cfg.openedDate != "" {
+			d, err := time.Parse(time.DateOnly, cfg.openedDate)
+			if err != nil {
+				return fmt.Errorf("invalid --opened (%s), expected YYYY-MM-DD", cfg.openedDate)
+			}
+			account.OpenedDate = &d
+		}
+	}
+	if flag.CommandLine.Changed("owners") {
+		account.Owners = cfg.owners
+	}
+	if flag.CommandLine.Changed("institution") {
+		account.Institution = cfg.institution
+	}
+	if flag.CommandLine.Changed("address") {
+		account.InstitutionAddress = cfg.institutionAddress
+	}
+	return nil
+}
+
+func doAccounts() {
+	cfg := setAccountsFlags()
+	if len(os.Args) < 3 {
+		accountsUsage()
+		return
+	}
+	switch os.Args[2] {
+	case "add":
+		if cfg.accountNumber == "" {
+			fmt.Println("Missing --account flag")
+			accountsUsage()
+			return
+		}
+		account := internal.Account{ID: cfg.accountNumber}
+		if err := applyAccountFlags(cfg, &account); err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		if err := internal.AddAccount(account); err != nil {
+			internal.ErrLogger.Println(err)
+		}
+	case "edit":
+		if cfg.accountNumber == "" {
+			fmt.Println("Missing --account flag")
+			accountsUsage()
+			return
+		}
+		account, err := internal.GetAccount(cfg.accountNumber)
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		if err := applyAccountFlags(cfg, &account); err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		if err := internal.UpdateAccount(account); err != nil {
+			internal.ErrLogger.Println(err)
+		}
+	case "list":
+		accounts, err := internal.GetAccounts()
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		for _, a := range accounts {
+			opened := ""
+			if a.OpenedDate != nil {
+				opened = a.OpenedDate.Format(time.DateOnly)
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				a.ID, a.Broker, a.AccountType, a.BaseCurrency, opened, a.Owners, a.Institution, a.InstitutionAddress)
+		}
+	default:
+		accountsUsage()
+	}
+}
+
+func securitiesUsage() {
+	fmt.Println(`
+	Usage: go run main.go securities [ list | edit | sync ]
+
+	list: lists securities with their tickers per exchange
+
+	edit: changes the given attributes of a security
+	go run main.go securities edit --id SE0000000001 --asset-class fund --ticker "Nasdaq OMX Stockholm AB=ABC"
+
+	--id: security id, the ISIN or CURRENCY:SYMBOL for securities without one (e.g. USD:AAPL)
+	--name: security name
+	--yahoo: Yahoo symbol used when marking
+	--currency: trading currency
+	--asset-class: [ equity | fund | etf | bond | etc ]
+	--pfic: PFIC flag (default when --asset-class is given: true for non-US funds, ETFs and ETCs)
+	--ticker: EXCHANGE=TICKER, can be repeated
+
+	sync: adds securities for lots that don't reference one yet
+	`)
+}
+
+func setSecuritiesFlags() SecuritiesConfig {
+	var cfg = SecuritiesConfig{}
+	var i = flag.String("id", "", "Security id")
+	var n = flag.String("name", "", "Security name")
+	var y = flag.String("yahoo", "", "Yahoo symbol")
+	var c = flag.String("currency", "", "Trading currency")
+	var a = flag.String("asset-class", "", "Asset class: [ equity | fund | etf | bond | etc ]")
+	var p = flag.Bool("pfic", false, "PFIC flag")
+	var t = flag.StringArray("ticker", nil, "EXCHANGE=TICKER, can be repeated")
+	flag.Parse()
+	cfg.id = *i
+	cfg.name = *n
+	cfg.yahooSymbol = *y
+	cfg.currency = *c
+	cfg.assetClass = *a
+	cfg.pfic = *p
+	cfg.tickers = *t
+	return cfg
+}
+
+func applySecurityFlags(cfg SecuritiesConfig, security *internal.Security) error {
+	if flag.CommandLine.Changed("name") {
+		security.Name = cfg.name
+	}
+	if flag.CommandLine.Changed("yahoo") {
+		security.YahooSymbol = cfg.yahooSymbol
+	}
+	if flag.CommandLine.Changed("currency") {
+		security.Currency = internal.CurrencyUnit(strings.ToUpper(cfg.currency))
+	}
+	if flag.CommandLine.Changed("asset-class") {
+		assetClass, err := internal.ParseAssetClass(cfg.assetClass)
+		if err != nil {
+			return err
+		}
+		security.AssetClass = assetClass
+		security.PFIC = internal.DefaultPFIC(security.ISIN, assetClass)
+	}
+	if flag.CommandLine.Changed("pfic") {
+		security.PFIC = cfg.pfic
+	}
+	for _, value := range cfg.tickers {
+		ticker, err := internal.ParseSecurityTicker(value)
+		if err != nil {
+			return err
+		}
+		security.Tickers = append(security.Tickers, ticker)
+	}
+	return nil
+}
+
+func doSecurities() {
+	cfg := setSecuritiesFlags()
+	if len(os.Args) < 3 {
+		securitiesUsage()
+		return
+	}
+	switch os.Args[2] {
+	case "list":
+		securities, err := internal.GetSecurities()
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		for _, s := range securities {
+			tickers := make([]string, 0, len(s.Tickers))
+			for _, t := range s.Tickers {
+				tickers = append(tickers, t.Exchange+"="+t.Ticker)
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\tpfic=%t\t%s\n",
+				s.ID, s.Name, s.YahooSymbol, s.Currency, s.AssetClass, s.PFIC, strings.Join(tickers, ","))
+		}
+	case "edit":
+		if cfg.id == "" {
+			fmt.Println("Missing --id flag")
+			securitiesUsage()
+			return
+		}
+		security, err := internal.GetSecurity(cfg.id)
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		if err := applySecurityFlags(cfg, &security); err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		if err := internal.UpdateSecurity(security); err != nil {
+			internal.ErrLogger.Println(err)
+		}
+	case "sync":
+		linked, err := internal.SyncSecurities(nil)
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		internal.InfoLogger.Printf("linked %d lots to securities\n", linked)
+	default:
+		securitiesUsage()
+	}
+}
+
+func pricesUsage() {
+	fmt.Println(`
+	Usage: go run main.go prices [ import | set ]
+
+	import: stores the prices of a CSV file with the header Security,Date,Price[,Currency]
+	go run main.go prices import --file ./prices.csv
+
+	set: stores a manual price, used by mark before any other price of that day
+	go run main.go prices set --id SE0000000001 --date 2025-12-31 --price 242.65
+
+	--file: price CSV file, Security is the security id (see securities list) and Date is YYYY-MM-DD
+	--id: security id
+	--date: price date in YYYY-MM-DD format
+	--price: price per share (US format)
+	--currency: price currency (default: the security's currency)
+	`)
+}
+
+func setPricesFlags() PricesConfig {
+	var cfg = PricesConfig{}
+	var f = flag.String("file", "", "Price CSV file")
+	var i = flag.String("id", "", "Security id")
+	var d = flag.String("date", "", "Price date in YYYY-MM-DD format")
+	var p = flag.String("price", "", "Price per share")
+	var c = flag.String("currency", "", "Price currency")
+	flag.Parse()
+	cfg.file = *f
+	cfg.securityID = *i
+	cfg.date = *d
+	cfg.price = *p
+	cfg.currency = *c
+	return cfg
+}
+
+func doPrices() {
+	cfg := setPricesFlags()
+	if len(os.Args) < 3 {
+		pricesUsage()
+		return
+	}
+	switch os.Args[2] {
+	case "import":
+		if cfg.file == "" {
+			fmt.Println("Missing --file flag")
+			pricesUsage()
+			return
+		}
+		imported, err := internal.ImportPriceFile(cfg.file)
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		internal.InfoLogger.Printf("imported %d prices\n", imported)
+	case "set":
+		if cfg.securityID == "" || cfg.date == "" || cfg.price == "" {
+			fmt.Println("Missing --id, --date or --price flag")
+			pricesUsage()
+			return
+		}
+		date, err := time.Parse(time.DateOnly, cfg.date)
+		if err != nil {
+			internal.ErrLogger.Printf("invalid --date (%s), expected YYYY-MM-DD\n", cfg.date)
+			return
+		}
+		price, err := internal.ProcessStringAmount(cfg.price, internal.US)
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		currency := internal.CurrencyUnit(strings.ToUpper(cfg.currency))
+		if err = internal.SetManualPrice(cfg.securityID, date, price, currency); err != nil {
+			internal.ErrLogger.Println(err)
+		}
+	default:
+		pricesUsage()
+	}
+}
+
+func ratesUsage() {
+	fmt.Println(`
+	Usage: go run main.go rates [ seed | import | list | currencies ]
+
+	seed: stores the built-in yearly USD rates, the default without a subcommand
+
+	import: stores the rates of a file downloaded from the source, again replaces them
+	go run main.go rates import --source riksbank --file ./valutakurser.csv
+	go run main.go rates import --source ecb --file ./eurofxref-hist.xml
+	go run main.go rates import --source irs --file ./yearly-average-rates.csv
+	go run main.go rates import --source treasury --file ./RprtRateXchg.csv
+
+	list: shows per currency and year the sources, daily rates and weekdays without one
+	go run main.go rates list --currency SEK --year 2024
+
+	currencies: lists the supported currencies, add one or change its name and number format with add
+	go run main.go rates currencies add --currency PLN --name "Polski złoty" --locale SE
+
+	--source: [ riksbank | ecb | irs | treasury ]
+	--file: Riksbank daily rates CSV, ECB eurofxref XML, the IRS yearly average table saved as CSV or the Treasury rates of exchange CSV
+	--currency: only list this currency, or the currency to add
+	--year: only list this year
+	--name: name of the currency to add
+	--locale: [ SE | US ] number format of the currency's amounts in exports (default: US)
+	`)
+}
+
+func setRatesFlags() RatesConfig {
+	var cfg = RatesConfig{}
+	var s = flag.String("source", "", "Rate source: [ riksbank | ecb | irs | treasury ]")
+	var f = flag.String("file", "", "Rate file")
+	var c = flag.String("currency", "", "Optional: only list this currency")
+	var y = flag.Int("year", 0, "Optional: only list this year")
+	var n = flag.String("name", "", "Name of the currency to add")
+	var l = flag.String("locale", "US", "Number format of the currency to add: [ SE | US ]")
+	flag.Parse()
+	cfg.source = *s
+	cfg.file = *f
+	cfg.currency = *c
+	cfg.year = *y
+	cfg.name = *n
+	cfg.locale = *l
+	return cfg
+}
+
+func doRates() {
+	cfg := setRatesFlags()
+	command := "seed"
+	if len(os.Args) > 2 && !strings.HasPrefix(os.Args[2], "-") {
+		command = os.Args[2]
+	}
+	switch command {
+	case "seed":
+		if err := internal.UpdateRates(); err != nil {
+			internal.ErrLogger.Println(err)
+		}
+	case "import":
+		if cfg.source == "" || cfg.file == "" {
+			fmt.Println("Missing --source or --file flag")
+			ratesUsage()
+			return
+		}
+		source, err := internal.ParseRateSource(cfg.source)
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		imported, err := internal.ImportRateFile(source, cfg.file)
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		internal.InfoLogger.Printf("imported %d rates\n", imported)
+	case "list":
+		coverage, err := internal.GetRateCoverage(internal.CurrencyUnit(strings.ToUpper(cfg.currency)), cfg.year)
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		fmt.Println("Currency\tYear\tSources\tYearly\tDaily Rates\tFirst\tLast\tMissing Weekdays\tLongest Gap")
+		for _, c := range coverage {
+			sources := make([]string, 0, len(c.Sources))
+			for _, source := range c.Sources {
+				sources = append(sources, string(source))
+			}
+			first, last, gap := "-", "-", "-"
+			if c.DailyRates > 0 {
+				first, last = c.FirstDaily.Format(time.DateOnly), c.LastDaily.Format(time.DateOnly)
+			}
+			if c.LongestGapDays > 0 {
+				gap = fmt.Sprintf("%d from %s", c.LongestGapDays, c.LongestGapStart.Format(time.DateOnly))
+			}
+			yearly := "no"
+			if c.Yearly {
+				yearly = "yes"
+			}
+			fmt.Printf("%s\t%d\t%s\t%s\t%d\t%s\t%s\t%d\t%s\n",
+				c.Currency, c.Year, strings.Join(sources, ","), yearly, c.DailyRates, first, last, c.MissingWeekdays, gap)
+		}
+	case "currencies":
+		doCurrencies(cfg)
+	default:
+		ratesUsage()
+	}
+}
+
+func doCurrencies(cfg RatesConfig) {
+	if len(os.Args) > 3 && os.Args[3] == "add" {
+		if len(strings.TrimSpace(cfg.currency)) != 3 || strings.TrimSpace(cfg.name) == "" {
+			fmt.Println("Missing --currency (3 letter code) or --name flag")
+			ratesUsage()
+			return
+		}
+		locale, err := internal.ParseLocale(cfg.locale)
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		currency := internal.Currency{Code: internal.CurrencyUnit(strings.ToUpper(strings.TrimSpace(cfg.currency))), Name: strings.TrimSpace(cfg.name), Locale: locale}
+		if err = internal.UpsertCurrency(currency); err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		internal.InfoLogger.Printf("added %s\n", currency.Code)
+		return
+	}
+	currencies, err := internal.GetCurrencies(nil)
+	if err != nil {
+		internal.ErrLogger.Println(err)
+		return
+	}
+	fmt.Println("Currency\tName\tLocale")
+	for _, c := range currencies {
+		fmt.Printf("%s\t%s\t%s\n", c.Code, c.Name, c.Locale)
+	}
+}
+
+func precisionUsage() {
+	fmt.Println(`
+	Usage: go run main.go precision [ list | set ]
+
+	list: shows the decimal places each field is stored with
+	go run main.go precision list
+
+	set: changes the places of a field and rescales its stored values
+	go run main.go precision set --field quantity --places 8
+
+	--field: [ quantity | price | amount ]
+	--places: 0 to 8, fewer places fail when a stored value has digits in the places dropped
+	`)
+}
+
+func setPrecisionFlags() PrecisionConfig {
+	var cfg = PrecisionConfig{}
+	var f = flag.String("field", "", "Field: [ quantity | price | amount ]")
+	var p = flag.Int("places", -1, "Decimal places to store the field with")
+	flag.Parse()
+	cfg.field = *f
+	cfg.places = *p
+	return cfg
+}
+
+func doPrecision() {
+	cfg := setPrecisionFlags()
+	if len(os.Args) < 3 {
+		precisionUsage()
+		return
+	}
+	switch os.Args[2] {
+	case "list":
+		fmt.Println("Field\tPlaces")
+		for _, field := range internal.PrecisionFields {
+			fmt.Printf("%s\t%d\n", field, field.Places())
+		}
+	case "set":
+		if cfg.field == "" || cfg.places < 0 {
+			fmt.Println("Missing --field or --places flag")
+			precisionUsage()
+			return
+		}
+		field, err := internal.ParsePrecisionField(cfg.field)
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		if err = internal.SetFieldPlaces(field, cfg.places); err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		internal.InfoLogger.Printf("%s is stored with %d places\n", field, cfg.places)
+	default:
+		precisionUsage()
+	}
+}
+
+func dbUsage() {
+	fmt.Println(`
+	Usage: go run main.go db [ status | migrate | check ]
+
+	status: lists the schema migrations and when they were applied to the ledger
+	go run main.go db status
+
+	check: lists the rows referring to rows that don't exist and the rows breaking a constraint,
+	which have to be fixed or deleted before foreign keys and constraints can be enforced
+	go run main.go db check
+
+	migrate: backs up the ledger and applies its pending migrations, other commands do so on start
+	go run main.go db migrate
+	`)
+}
+
+func doDB() {
+	if len(os.Args) < 3 {
+		dbUsage()
+		return
+	}
+	if err := internal.OpenDB(); err != nil {
+		internal.ErrLogger.Fatal(err)
+	}
+	switch os.Args[2] {
+	case "status":
+		status, err := internal.GetMigrationStatus()
+		if err != nil {
+			internal.ErrLogger.Println(err)
+		}
+		fmt.Println("Version\tName\tApplied")
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedDate != nil {
+				applied = s.AppliedDate.Format(time.DateTime)
+			}
+			fmt.Printf("%d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+	case "migrate":
+		applied, backup, err := internal.MigrateDB()
+		if backup != "" {
+			internal.InfoLogger.Printf("backed up the ledger to %s\n", backup)
+		}
+		for _, migration := range applied {
+			internal.InfoLogger.Printf("applied migration %d %s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		if len(applied) == 0 {
+			internal.InfoLogger.Println("the ledger is up to date")
+		}
+	case "check":
+		violations, err := internal.CheckIntegrity(internal.GlobalDB)
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		for _, v := range violations {
+			fmt.Println(v)
+		}
+		if len(violations) == 0 {
+			internal.InfoLogger.Println("no integrity violations found")
+		} else {
+			internal.InfoLogger.Printf("%d integrity violations found\n", len(violations))
+		}
+	default:
+		dbUsage()
+	}
+}
+
+func setISKFlags() ISKConfig {
+	var cfg = ISKConfig{}
+	var y = flag.Int("year", 0, "Tax year")
+	var a = flag.String("account", "", "Optional: only this ISK/KF account")
+	var q1 = flag.String("q1", "", "Value in SEK on January 1")
+	var q2 = flag.String("q2", "", "Value in SEK on April 1")
+	var q3 = flag.String("q3", "", "Value in SEK on July 1")
+	var q4 = flag.String("q4", "", "Value in SEK on October 1")
+	var br = flag.String("bond-rate", "", "Statslåneränta on November 30 of the year before, percent")
+	var tf = flag.String("tax-free", "0", "Skattefri nivå in SEK")
+	var fp = flag.String("fx-policy", "", "Policy converting marks to SEK: [ spot | yearly-average | treasury-year-end | riksbank-daily | calendar-year ] (default: calendar-year)")
+	var fc = flag.StringArray("fx-column", nil, "COLUMN=POLICY, policy of one converted column, can be repeated")
+	flag.Parse()
+	cfg.year = *y
+	cfg.accountNumber = *a
+	cfg.quarters = [4]string{*q1, *q2, *q3, *q4}
+	cfg.bondRate = *br
+	cfg.taxFree = *tf
+	cfg.fxPolicy = *fp
+	cfg.fxColumns = *fc
+	return cfg
+}
+
+func doISKRates(cfg ISKConfig) {
+	if len(os.Args) < 4 {
+		iskUsage()
+		return
+	}
+	switch os.Args[3] {
+	case "list":
+		rates, err := internal.GetISKRates()
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		for _, r := range rates {
+			fmt.Printf("%d\tstatslåneränta %s%%\tschablonränta %s%%\tskattefri nivå %s SEK\n",
+				r.Year, r.GovernmentBondRate, internal.ISKStandardRate(r.GovernmentBondRate), r.TaxFreeAmount)
+		}
+	case "set":
+		if cfg.year == 0 || cfg.bondRate == "" {
+			fmt.Println("Missing --year or --bond-rate flag")
+			iskUsage()
+			return
+		}
+		bondRate, err := internal.ProcessStringAmount(cfg.bondRate, internal.US)
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		taxFree, err := internal.ProcessStringAmount(cfg.taxFree, internal.US)
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		err = internal.SetISKRate(internal.ISKRate{Year: cfg.year, GovernmentBondRate: bondRate, TaxFreeAmount: taxFree})
+		if err != nil {
+			internal.ErrLogger.Println(err)
+		}
+	default:
+		iskUsage()
+	}
+}
+
+func doISK() {
+	cfg := setISKFlags()
+	if len(os.Args) > 2 && os.Args[2] == "rates" {
+		doISKRates(cfg)
+		return
+	}
+	if cfg.year == 0 {
+		fmt.Println("Missing --year flag")
+		iskUsage()
+		return
+	}
+	var overrides [4]*decimal.Big
+	for i, q := range cfg.quarters {
+		if q == "" {
+			continue
+		}
+		value, err := internal.ProcessStringAmount(q, internal.US)
+		if err != nil {
+			internal.ErrLogger.Printf("invalid --q%d: %v\n", i+1, err)
+			return
+		}
+		overrides[i] = value
+	}
+	policies, err := internal.ParseFXPolicies(cfg.fxPolicy, cfg.fxColumns)
+	if err != nil {
+		internal.ErrLogger.Println(err)
+		return
+	}
+	report, err := internal.ComputeISKReport(cfg.year, cfg.accountNumber, overrides, policies)
+	if err != nil {
+		internal.ErrLogger.Println(err)
+		return
+	}
+	for _, a := range report.Accounts {
+		fmt.Printf("%s (%s)\n", a.Account, a.AccountType)
+		for i, q := range a.Quarters {
+			fmt.Printf("\tQ%d %s\t%s SEK\t(%s)\n", i+1, q.Date.Format(time.DateOnly), q.Value, q.Source)
+		}
+		fmt.Printf("\tDeposits\t%s SEK\n", a.Deposits)
+		fmt.Printf("\tKapitalunderlag\t%s SEK\n", a.CapitalBase)
+	}
+	fmt.Printf("Kapitalunderlag\t%s SEK\n", report.CapitalBase)
+	fmt.Printf("Skattefri nivå\t%s SEK\n", report.TaxFreeAmount)
+	fmt.Printf("Schablonränta\t%s%% (statslåneränta %s%%)\n", report.StandardRate, report.Rate.GovernmentBondRate)
+	fmt.Printf("Schablonintäkt\t%s SEK\n", report.StandardIncome)
+	fmt.Printf("Skatt (30%%)\t%s SEK\n", report.Tax)
+	for _, fx := range report.FX {
+		sources := "none used"
+		if len(fx.Sources) > 0 {
+			sources = strings.Join(fx.Sources, ", ")
+		}
+		fmt.Printf("FX %s\t%s (rates: %s, %d converted, %d at the calendar-year rate, %d missing)\n", fx.Column, fx.Policy, sources, fx.Converted, fx.Fallbacks, fx.Missing)
+	}
+}
+
+func setCorporateActionFlags() CorporateActionConfig {
+	var cfg = CorporateActionConfig{}
+	var id = flag.Int("id", 0, "Corporate action id")
+	var t = flag.String("type", "", "Corporate action type: [ split | reverse-split | merger | rename | spinoff ]")
+	var a = flag.String("account", "", "Optional: only apply to this account")
+	var sym = flag.String("symbol", "", "Symbol of the affected security")
+	var isin = flag.String("isin", "", "ISIN of the affected security")
+	var d = flag.String("date", "", "Effective date in YYYY-MM-DD format")
+	var r = flag.String("ratio", "1:1", "New:old share ratio, e.g. 4:1")
+	var ns = flag.String("new-symbol", "", "Symbol after the action")
+	var ni = flag.String("new-isin", "", "ISIN after the action")
+	var cps = flag.String("cash-per-share", "", "Merger cash consideration per old share")
+	var cil = flag.String("cash-in-lieu", "", "Price per share paid for fractional shares")
+	var al = flag.String("allocation", "", "Spin-off: percent of parent basis allocated to the new shares, merger paying shares and cash: percent of basis allocated to the cash")
+	var c = flag.String("currency", "", "Currency of cash amounts")
+	var n = flag.String("note", "", "Free text note")
+	var ap = flag.Bool("apply", true, "Apply the action to open lots right away")
+	flag.Parse()
+	cfg.id = *id
+	cfg.actionType = *t
+	cfg.accountNumber = *a
+	cfg.symbol = *sym
+	cfg.isin = *isin
+	cfg.effectiveDate = *d
+	cfg.ratio = *r
+	cfg.newSymbol = *ns
+	cfg.newISIN = *ni
+	cfg.cashPerShare = *cps
+	cfg.cashInLieuPrice = *cil
+	cfg.basisAllocation = *al
+	cfg.currency = *c
+	cfg.note = *n
+	cfg.apply = *ap
+	return cfg
+}
+
+func doCorporateActions() {
+	cfg := setCorporateActionFlags()
+	if len(os.Args) < 3 {
+		corporateActionsUsage()
+		return
+	}
+	switch os.Args[2] {
+	case "add":
+		actionTypes := map[string]internal.CorporateActionType{
+			"split":         internal.SPLIT_ACTION,
+			"reverse-split": internal.REVERSE_SPLIT_ACTION,
+			"merger":        internal.MERGER_ACTION,
+			"rename":        internal.RENAME_ACTION,
+			"spinoff":       internal.SPINOFF_ACTION,
+		}
+		actionType, ok := actionTypes[cfg.actionType]
+		if !ok {
+			fmt.Println("Missing or unsupported --type flag")
+			corporateActionsUsage()
+			return
+		}
+		effectiveDate, err := time.Parse(time.DateOnly, cfg.effectiveDate)
+		if err != nil {
+			fmt.Println("Invalid --date. Expected YYYY-MM-DD")
+			return
+		}
+		ratioTo, ratioFrom, err := internal.ParseCorporateActionRatio(cfg.ratio)
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		action := internal.CorporateAction{
+			ActionType:    actionType,
+			AccountID:     cfg.accountNumber,
+			Symbol:        cfg.symbol,
+			ISIN:          cfg.isin,
+			EffectiveDate: effectiveDate,
+			RatioFrom:     ratioFrom,
+			RatioTo:       ratioTo,
+			NewSymbol:     cfg.newSymbol,
+			NewISIN:       cfg.newISIN,
+			Currency:      internal.CurrencyUnit(strings.ToUpper(cfg.currency)),
+			Note:          cfg.note,
+		}
+		if cfg.cashPerShare != "" {
+			action.CashPerShare, err = internal.ProcessStringAmount(cfg.cashPerShare, internal.US)
+			if err != nil {
+				internal.ErrLogger.Println(err)
+				return
+			}
+		}
+		if cfg.cashInLieuPrice != "" {
+			action.CashInLieuPrice, err = internal.ProcessStringAmount(cfg.cashInLieuPrice, internal.US)
+			if err != nil {
+				internal.ErrLogger.Println(err)
+				return
+			}
+		}
+		if cfg.basisAllocation != "" {
+			action.BasisAllocation, err = internal.ProcessStringAmount(cfg.basisAllocation, internal.US)
+			if err != nil {
+				internal.ErrLogger.Println(err)
+				return
+			}
+		}
+		id, err := internal.AddCorporateAction(action, cfg.apply)
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		fmt.Printf("Recorded corporate action %d\n", id)
+	case "apply":
+		if cfg.id == 0 {
+			fmt.Println("Missing --id flag")
+			return
+		}
+		if err := internal.ApplyCorporateActionById(cfg.id); err != nil {
+			internal.ErrLogger.Println(err)
+		}
+	case "list":
+		actions, err := internal.GetCorporateActions(0)
+		if err != nil {
+			internal.ErrLogger.Println(err)
+			return
+		}
+		for _, a := range actions {
+			applied := "pending"
+			if a.AppliedDate != nil {
+				applied = "applied " + a.AppliedDate.Format(time.DateOnly)
+			}
+			fmt.Printf("%d\t%s\t%s\t%s %s\t%s:%s\t%s %s\t%s\t%s\n",
+				a.ID, a.EffectiveDate.Format(time.DateOnly), a.ActionType, a.Symbol, a.ISIN,
+				a.RatioTo, a.RatioFrom, a.NewSymbol, a.NewISIN, a.Source, applied)
+		}
+	default:
+		corporateActionsUsage()
+	}
+}
+
+func main() {
+	flag.Usage = defaultUsage
+	if len(os.Args) < 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	ledgerCfg := setLedgerFlags()
+	if os.Args[1] == "init" {
+		doInit(ledgerCfg)
+		return
+	}
+	ledger, err := internal.ResolveLedger(ledgerCfg.ledger, ledgerCfg.profile)
+	if err != nil {
+		internal.ErrLogger.Fatal(err)
+	}
+	internal.LedgerPath = ledger
+	// db shows and applies migrations itself, every other command works on a migrated ledger.
+	if os.Args[1] == "db" {
+		doDB()
+		return
 	}
 	internal.InitializeDB()
 	switch os.Args[1] {
 	case "import":
 		doImport()
 	case "rates":
-		internal.UpdateRates()
+		doRates()
 	case "mark":
 		doMark()
 	case "export":
 		doExport()
+	case "dividends":
+		doDividends()
+	case "isk":
+		doISK()
+	case "accounts":
+		doAccounts()
+	case "securities":
+		doSecurities()
+	case "prices":
+		doPrices()
+	case "corporate-actions":
+		doCorporateActions()
+	case "precision":
+		doPrecision()
 	default:
 		flag.Usage()
 		os.Exit(1)
@@ -0,0 +1,119 @@
+-- A ledger written by the first release, before migrations existed: its tables as createTables
+-- made them, the rates UpdateRates seeded and a lot that was bought, re-marked and partly sold.
+
+CREATE TABLE IF NOT EXISTS "supported_currencies" (
+	 id                   	CHAR(3) PRIMARY KEY
+	,name      				TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS "asset_lots" (
+	 id                   	TEXT PRIMARY KEY
+	,account				TEXT NOT NULL
+	,exchange				TEXT NOT NULL DEFAULT ''
+	,symbol				 	TEXT NOT NULL
+	,isin      				TEXT NOT NULL
+	,shares       			BIGINT NOT NULL
+
+	,cost_basis_per_share   TEXT
+	,cost_basis_currency   	BIGINT
+	,created_date   		TIMESTAMP NOT NULL
+	,FOREIGN KEY (cost_basis_currency) REFERENCES supported_currencies(id)
+);
+
+CREATE TABLE IF NOT EXISTS "asset_lots_history" (
+	 int_id                 INTEGER PRIMARY KEY AUTOINCREMENT
+	,id                   	TEXT
+	,account               	TEXT
+	,symbol				 	TEXT NOT NULL
+	,isin      				TEXT NOT NULL
+	,shares       			BIGINT NOT NULL
+
+	,cost_basis_per_share   TEXT
+	,cost_basis_currency   	BIGINT
+	,as_of_date   			TIMESTAMP NOT NULL
+	,FOREIGN KEY (cost_basis_currency) REFERENCES supported_currencies(id)
+);
+
+CREATE TABLE IF NOT EXISTS "transactions" (
+	 id                   	INTEGER PRIMARY KEY AUTOINCREMENT
+	,account			 	TEXT
+	,transaction_reference 	TEXT
+	,transaction_type      	SMALLINT NOT NULL
+	,settlement_date       	TIMESTAMP NOT NULL
+
+	,symbol					TEXT
+	,share_lot      		TEXT
+	,shares        			BIGINT
+	,price_per_share 		BIGINT
+	,share_value    		BIGINT
+
+	,fees_amount 			BIGINT NOT NULL DEFAULT 0
+
+	,total_amount 			BIGINT NOT NULL
+	,currency    			CHAR(3) NOT NULL
+	,FOREIGN KEY (share_lot) REFERENCES asset_lots(id)
+	,FOREIGN KEY (currency) REFERENCES supported_currencies(id)
+	);
+
+CREATE TABLE IF NOT EXISTS "currency_rates" (
+	id                   	INTEGER PRIMARY KEY AUTOINCREMENT
+	,currency_code 			CHAR(3)
+	,rate 		     		BIGINT -- how much to one USD
+	,as_of_date    			TIMESTAMP
+	,FOREIGN KEY (currency_code) REFERENCES supported_currencies(id)
+);
+
+CREATE TABLE IF NOT EXISTS "market_marks" (
+	id                   		INTEGER PRIMARY KEY AUTOINCREMENT
+	,account	 				TEXT
+	,asset_lot_id 				TEXT
+	,market_mark_date			TIMESTAMP
+	,marked_shares				BIGINT
+	,marked_value_per_share 	BIGINT
+	,marked_value_currency		CHAR(3)
+	,gain_loss				 	BIGINT
+	,FOREIGN KEY (asset_lot_id) REFERENCES asset_lots(id)
+	,FOREIGN KEY (marked_value_currency) REFERENCES supported_currencies(id)
+);
+
+INSERT INTO "supported_currencies" (id, name)
+	SELECT "USD", "US Dollar"
+	UNION ALL
+	SELECT "SEK", "Svensk krona";
+
+INSERT INTO "currency_rates" (currency_code, rate, as_of_date)
+	SELECT 'USD', 10000, '2022-12-31'
+	UNION ALL
+	SELECT 'USD', 10000, '2023-12-31'
+	UNION ALL
+	SELECT 'USD', 10000, '2024-12-31'
+	UNION ALL
+	SELECT 'USD', 10000, '2025-12-31'
+	UNION ALL
+	SELECT 'SEK', 101220, '2022-12-31'
+	UNION ALL
+	SELECT 'SEK', 106130, '2023-12-31'
+	UNION ALL
+	SELECT 'SEK', 105770, '2024-12-31'
+	UNION ALL
+	SELECT 'SEK', 98130, '2025-12-31';
+
+INSERT INTO "asset_lots" (id, account, exchange, symbol, isin, shares, cost_basis_per_share, cost_basis_currency, created_date)
+VALUES ('SE0000108656-20230302-000001', '1234', 'Stockholm', 'ERIC B', 'SE0000108656', 60000, '900000', 'SEK', '2023-03-02 00:00:00+00:00');
+
+INSERT INTO "asset_lots_history" (id, account, symbol, isin, shares, cost_basis_per_share, cost_basis_currency, as_of_date)
+VALUES
+	('SE0000108656-20230302-000001', '1234', 'ERIC B', 'SE0000108656', 100000, '900000', 'SEK', '2023-03-02 00:00:00+00:00'),
+	('SE0000108656-20230302-000001', '1234', 'ERIC B', 'SE0000108656', 60000, '900000', 'SEK', '2023-09-14 00:00:00+00:00');
+
+INSERT INTO "transactions" (account, transaction_reference, transaction_type, settlement_date, symbol, share_lot, shares, price_per_share, share_value, fees_amount, total_amount, currency)
+VALUES
+	('1234', '', 0, '2023-03-02 00:00:00+00:00', 'ERIC B', 'SE0000108656-20230302-000001', 100000, 900000, 9000000, 0, -9000000, 'SEK'),
+	('1234', '', 1, '2023-09-14 00:00:00+00:00', 'ERIC B', 'SE0000108656-20230302-000001', 40000, 1000000, 4000000, 0, 4000000, 'SEK');
+
+-- Marking a date again added another mark.
+INSERT INTO "market_marks" (account, asset_lot_id, market_mark_date, marked_shares, marked_value_per_share, marked_value_currency, gain_loss)
+VALUES
+	('1234', 'SE0000108656-20230302-000001', '2023-12-29 00:00:00+00:00', 60000, 600000, 'SEK', -1800000),
+	('1234', 'SE0000108656-20230302-000001', '2023-12-29 00:00:00+00:00', 60000, 620000, 'SEK', -1680000),
+	('1234', 'SE0000108656-20230302-000001', '2024-06-28 00:00:00+00:00', 60000, 650000, 'SEK', -1500000);